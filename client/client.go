@@ -1,371 +1,390 @@
-package main
+// Package client is a client of file-relay server, speaking the memcached text protocol over pooled connections.
+package client
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
-	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"crypto/md5"
-	"hash/fnv"
-
 	"github.com/nickeljew/file-relay/filerelay"
 )
 
 
 var (
-	ErrNoServer = errors.New("no server")
-
 	// ErrCacheMiss means that a Get failed because the data-key wasn't present.
 	ErrCacheMiss = errors.New("cache miss")
 
 	// ErrCASConflict means that a CompareAndSwap call failed due to the
 	// cached value being modified between the Get and the CompareAndSwap.
 	// If the cached value was simply evicted rather than replaced,
-	// ErrNotStored will be returned instead.
+	// ErrCacheMiss will be returned instead.
 	ErrCASConflict = errors.New("compare-and-swap conflict")
 
 	// ErrNotStored means that a conditional write operation (i.e. Add or
-	// CompareAndSwap) failed because the condition was not satisfied.
+	// Replace) failed because the condition was not satisfied.
 	ErrNotStored = errors.New("data not stored")
 
-	// ErrServer means that a server error occurred.
-	ErrServerError = errors.New("server error")
-
 	// ErrMalformedKey is returned when an invalid key is used.
 	// Keys must be at maximum 250 bytes long and not
 	// contain whitespace or control characters.
 	ErrMalformedKey = errors.New("malformed: key is too long or contains invalid characters")
+
+	// ErrAuthFailed means that the server rejected User and Token of client.
+	ErrAuthFailed = errors.New("authentication failed")
 )
 
 const (
-	MaxFileSize = 1024 * 1024 * 10 //10MB
+	DefaultTimeout = 5 * time.Second
+	DefaultMaxIdleConns = 2
 )
 
 
-
-type TrialKeyMap struct {
-	keys map[string]bool
-	sync.Mutex
+// ServerError is a SERVER_ERROR or CLIENT_ERROR responded by server, with its message
+type ServerError struct {
+	Line string
 }
-var trialKeyMap = TrialKeyMap{
-	keys: make(map[string]bool),
+
+func (e *ServerError) Error() string {
+	return "file-relay: " + e.Line
 }
 
 
-//
-func main() {
-	fmt.Println("File-Relay client *", time.Now())
+// Item is an item to be stored or retrieved
+type Item struct {
+	Key string
+	Value []byte
+	Flags uint32
+	Expiration int32 //in seconds from now, or Unix time when over 30 days; 0 for default expiration of server
+	CasId uint64 //set by Gets, and used by CompareAndSwap
+}
 
-	//doConcurrentSet(101, "set", "")
-	//doConcurrentSet(101, "add", "./files")
 
-	//doAddAndReplace()
+// Client keeps connections to a server, and is safe for use by multiple goroutines.
+// Every call is bounded by deadline of its context, or by Timeout when the context has none.
+type Client struct {
+	addr string
 
-	//doSetNGet("test-abc-set-and-get", false)
+	Timeout time.Duration
+	MaxIdleConns int
+	User string //authenticated on every new connection when set
+	Token string
 
-	data := []byte("These pretzels are making me thirsty.")
-	hash := md5.Sum(data)
-	fmt.Printf("Hash %T:\n%x\n%v\n\n", hash, hash, hash)
+	idle []*conn
+	sync.Mutex
+}
 
-	var hSum uint64
-	for _, h := range hash {
-		m := hSum << 2
-		hSum = m + uint64(h)
-		fmt.Printf("----\nSum: %v %v - mod 1024: %v\n", m, hSum, hSum % 1024)
+// New returns client of server at the address
+func New(addr string) *Client {
+	return &Client{
+		addr: addr,
+		Timeout: DefaultTimeout,
+		MaxIdleConns: DefaultMaxIdleConns,
 	}
+}
 
-	hashing2 := fnv.New32a()
-	hash2 := hashing2.Sum(data)
-	fmt.Printf("Hash2 %T:\n%x\n%v\n\n", hash2, hash2, hash2)
-	
-	os.Exit(0)
+// NewFromConfig returns client of server at address in config
+func NewFromConfig(cfg *filerelay.Config) *Client {
+	return New(cfg.Addr())
 }
 
+// Close closes all idle connections
+func (c *Client) Close() {
+	c.Lock()
+	defer c.Unlock()
+	for _, cn := range c.idle {
+		_ = cn.nc.Close()
+	}
+	c.idle = nil
+}
 
-//
-type Client struct {
+
+type conn struct {
 	nc net.Conn
 	rw *bufio.ReadWriter
 }
 
-func setupClient() (*Client, error) {
-	cfg, _ := filerelay.InitClientConfig("localhost")
-	nc, err := net.Dial("tcp", cfg.Addr())
-	if err != nil {
-		fmt.Println("Failed connection to: ", cfg.Addr())
-		return nil, ErrNoServer
+// getConn takes an idle connection, or dials a new one
+func (c *Client) getConn(ctx context.Context) (*conn, error) {
+	c.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n - 1]
+		c.idle = c.idle[:n - 1]
+		c.Unlock()
+		return cn, nil
 	}
+	c.Unlock()
 
-	return &Client{
+	d := net.Dialer{Timeout: c.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{
 		nc: nc,
 		rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
-	}, nil
-}
-
-
-func doConcurrentSet(cnt int, cmd, dirPath string) {
-	fin := make(chan int)
-
-	count := 0
-	if dirPath == "" {
-		for i := 0; i < cnt; i++ {
-			count++
-			go doStorageInIndex(i, fin, cmd, "", "")
-		}
-	} else {
-		handleFile := func(i int, filepath string) bool {
-			fmt.Println("--> File path: ", filepath)
-			count++
-			go doStorageInIndex(i, fin, cmd, filepath, filepath)
-			return true
-		}
-		readFilesFromDir(dirPath, cnt, handleFile)
 	}
-	
-	for {
-		select {
-		case <- fin:
-			count--
-			fmt.Println("- left count: ", count)
-			if count == 0 {
-				return
-			}
+	if c.User != "" {
+		if e := c.auth(ctx, cn); e != nil {
+			_ = nc.Close()
+			return nil, e
 		}
 	}
+	return cn, nil
 }
 
-
-func doStorageInIndex(idx int, fin chan int, cmd, key, filepath string) {
-	fmt.Println("Doing at index: ", idx)
-	if err := tryStorage(idx, cmd, key, filepath); err != nil {
-		fmt.Printf("Error in %d: %s\n", idx, err.Error())
-	} else {
-		fmt.Printf("Finish %d\n", idx)
-	}
-	fin <- idx
-}
-
-
-
-
-func doAddAndReplace() {
-	key := "add-replace-key"
-	filepath1 := "./files/m_1390221121382.jpg"
-	filepath2 := "./files/m_1390221149351.jpg"
-
-	if err := tryStorage(0, "add", key, filepath1); err != nil {
-		fmt.Printf("Error in adding: %s\n", err.Error())
-	} else {
-		fmt.Println("Finish adding")
-	}
-
-	if e := tryGet(key); e != nil {
-		fmt.Printf("Error: %s\n", e.Error())
-	}
-
-	if err := tryStorage(0, "replace", key, filepath2); err != nil {
-		fmt.Printf("Error in adding: %s\n", err.Error())
-	} else {
-		fmt.Println("Finish adding")
+func (c *Client) auth(ctx context.Context, cn *conn) error {
+	c.setDeadline(ctx, cn)
+	line, err := cn.roundTrip(fmt.Sprintf("auth %s %s\r\n", c.User, c.Token), nil)
+	if err != nil {
+		return err
 	}
-
-	if e := tryGet(key); e != nil {
-		fmt.Printf("Error: %s\n", e.Error())
+	if !bytes.Equal(line, filerelay.ResultOK) {
+		return ErrAuthFailed
 	}
+	return nil
 }
 
-
-
-
-
-func doSetNGet(key string, onlyGet bool) {
-	if !onlyGet {
-		fmt.Println("# Doing set with key: ", key)
-		if e := tryStorage(0, "set", key, ""); e != nil {
-			fmt.Printf("Error: %s\n", e.Error())
-		} else {
-			fmt.Println("Finish")
-		}
-	}
-
-	fmt.Println("# Doing get with key: ", key)
-	if e := tryGet(key); e != nil {
-		fmt.Printf("Error: %s\n", e.Error())
+// putConn keeps connection for later calls, or closes it when there are enough idle ones
+func (c *Client) putConn(cn *conn) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.idle) >= c.MaxIdleConns {
+		_ = cn.nc.Close()
+		return
 	}
+	c.idle = append(c.idle, cn)
 }
 
-func createKey() string {
-	var key string
-	for {
-		key = "test123" + filerelay.RandomStr(1000, 9999)
-		fmt.Println("Trying created key: ", key)
-		trialKeyMap.Lock()
-		if !trialKeyMap.keys[key] {
-			trialKeyMap.keys[key] = true
-			trialKeyMap.Unlock()
-			break
-		}
-		trialKeyMap.Unlock()
+func (c *Client) setDeadline(ctx context.Context, cn *conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.Timeout)
 	}
-	return key
+	_ = cn.nc.SetDeadline(deadline)
 }
 
-//
-func tryStorage(tryIndex int, cmd, key, filepath string) error {
-	client, err := setupClient()
-	if err != nil {
-		fmt.Printf("Error in setup client for key[%s]: %v", key, err.Error())
-		return nil
+// do runs fn on a connection within deadline of context, and interrupts it when context is canceled;
+// The connection is kept only after responses which leave it open, as server closes it on failures of storage.
+func (c *Client) do(ctx context.Context, key string, fn func(cn *conn) error) error {
+	if !filerelay.ValidKey(key) {
+		return ErrMalformedKey
 	}
-	defer client.nc.Close()
-
-	if filepath == "" {
-		filepath = "./test.txt"
+	if e := ctx.Err(); e != nil {
+		return e
 	}
-	reqValue, err := ioutil.ReadFile(filepath)
-	key = strings.Trim(key, " \f\n\r\t\v")
-	if key == "" {
-		key = createKey()
+	cn, err := c.getConn(ctx)
+	if err != nil {
+		return err
 	}
+	c.setDeadline(ctx, cn)
 
-	msgline := &filerelay.MsgLine{
-		Cmd: cmd,
-		Key: key,
-		ValueLen: uint64( len(reqValue) ),
-		Flags: 1,
-		Expiration: 120,
+	stop := make(chan bool)
+	interrupted := make(chan bool)
+	go func() {
+		defer close(interrupted)
+		select {
+		case <-ctx.Done():
+			_ = cn.nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err = fn(cn)
+	close(stop)
+	<-interrupted
+
+	if err == nil || err == ErrCacheMiss {
+		if ctx.Err() == nil {
+			c.putConn(cn)
+			return err
+		}
 	}
-
-	toSend := fmt.Sprintf("%s %s %d %d %d\r\n",
-		msgline.Cmd, msgline.Key, msgline.Flags, msgline.Expiration, msgline.ValueLen)
-	fmt.Printf("Sending[%d]:\n>%s", tryIndex, toSend)
-	//if _, err := fmt.Fprintf(client.rw, toSend); err != nil {
-	//	return err
-	//}
-	if _, err := client.rw.Write([]byte(toSend)); err != nil {
-		fmt.Printf("Error in writing storage cmd-line for key[%s]: %v\n", msgline.Key, err)
-		return err
+	_ = cn.nc.Close()
+	if e := ctx.Err(); e != nil {
+		return e
 	}
+	return err
+}
 
-	if _, err := client.rw.Write(reqValue); err != nil {
-		fmt.Printf("Error in writing value for key[%s]: %v\n", msgline.Key, err)
-		return err
+// roundTrip sends command line with value block if it's not nil, and reads the first line of response
+func (cn *conn) roundTrip(line string, value []byte) ([]byte, error) {
+	if _, e := cn.rw.WriteString(line); e != nil {
+		return nil, e
 	}
-	if _, err := client.rw.Write(filerelay.Crlf); err != nil {
-		fmt.Printf("Error in writing END for key[%s]: %v\n", msgline.Key, err)
-		return err
+	if value != nil {
+		if _, e := cn.rw.Write(value); e != nil {
+			return nil, e
+		}
+		if _, e := cn.rw.Write(filerelay.Crlf); e != nil {
+			return nil, e
+		}
 	}
-	if err := client.rw.Flush(); err != nil {
-		fmt.Printf("Error in flushing for key[%s]: %v\n", msgline.Key, err)
-		return err
+	if e := cn.rw.Flush(); e != nil {
+		return nil, e
 	}
-
-	line, err := client.rw.ReadSlice('\n')
+	resp, err := cn.rw.ReadSlice('\n')
 	if err != nil {
-		fmt.Printf("Error in read for server for key[%s]: %v\n", msgline.Key, err)
-		return err
+		return nil, err
 	}
-	fmt.Printf("Response from server[%d] for key[%s]: %s\n", tryIndex, key, strings.Trim(string(line)," \r\n"))
-
-	switch {
-	case bytes.Equal(line, filerelay.ResultStored):
-		return nil
-	case bytes.Equal(line, filerelay.ResultNotStored):
-		return ErrNotStored
-	case bytes.Equal(line, filerelay.ResultExists):
-		return ErrCASConflict
-	case bytes.Equal(line, filerelay.ResultNotFound):
-		return ErrCacheMiss
+	if bytes.HasPrefix(resp, filerelay.ResultServerErrorPrefix) || bytes.HasPrefix(resp, filerelay.ResultClientErrorPrefix) {
+		return nil, &ServerError{Line: strings.TrimSpace(string(resp))}
 	}
-
-	return fmt.Errorf("unexpected response line from %q: %q", msgline.Cmd, string(line))
+	return resp, nil
 }
 
 
 
 
-//
-func tryGet(key string) error {
-	client, err := setupClient()
-	if err != nil {
-		fmt.Println(err.Error())
-		return nil
-	}
-	defer client.nc.Close()
+// Get returns item of key, or ErrCacheMiss
+func (c *Client) Get(ctx context.Context, key string) (*Item, error) {
+	return c.retrieve(ctx, "get", key)
+}
 
-	toSend := fmt.Sprintf("get %s\r\n", key)
-	fmt.Printf("Sending:\n>%s", toSend)
-	if _, err := client.rw.Write([]byte(toSend)); err != nil {
-		fmt.Printf("Error in writing retrieval cmd-line for key[%s]: %v\n", key, err)
-		return err
-	}
-	if err := client.rw.Flush(); err != nil {
-		fmt.Printf("Error in flushing for key[%s]: %v\n", key, err)
-		return err
-	}
+// Gets returns item of key with its cas unique, for CompareAndSwap
+func (c *Client) Gets(ctx context.Context, key string) (*Item, error) {
+	return c.retrieve(ctx, "gets", key)
+}
 
-	line, err := client.rw.ReadSlice('\n')
-	if err != nil {
+func (c *Client) retrieve(ctx context.Context, cmd, key string) (*Item, error) {
+	var item *Item
+	err := c.do(ctx, key, func(cn *conn) error {
+		line, err := cn.roundTrip(cmd + " " + key + "\r\n", nil)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(line, filerelay.ResultEnd) {
+			return ErrCacheMiss
+		}
+		item, err = cn.readValue(line)
 		return err
-	}
-	fmt.Println("Response from server:", strings.Trim(string(line)," \r\n"))
-	//fmt.Println("Response from server:", strings.ReplaceAll(string(line), "\\", "\\\\"))
+	})
+	return item, err
+}
 
-	ml := &filerelay.MsgLine{}
+// readValue reads value block of the VALUE line, and END of response
+func (cn *conn) readValue(line []byte) (*Item, error) {
+	item := &Item{}
+	var size int
 	pattern := "VALUE %s %d %d %d\r\n"
-	dest := []interface{}{&ml.Key, &ml.Flags, &ml.ValueLen, &ml.CasId}
+	dest := []interface{}{&item.Key, &item.Flags, &size, &item.CasId}
 	if bytes.Count(line, filerelay.Space) == 3 {
 		pattern = "VALUE %s %d %d\r\n"
 		dest = dest[:3]
 	}
 	if n, e := fmt.Sscanf(string(line), pattern, dest...); e != nil || n != len(dest) {
-		return fmt.Errorf("unexpected line in get response: %q", line)
+		return nil, fmt.Errorf("unexpected line in get response: %q", line)
 	}
 
-	if ml.ValueLen == 0 {
-		return nil
+	// empty value is responded without value block, and a miss as empty value without cas unique
+	if size > 0 {
+		value := make([]byte, size + len(filerelay.Crlf))
+		if _, e := io.ReadFull(cn.rw, value); e != nil {
+			return nil, e
+		}
+		if !bytes.HasSuffix(value, filerelay.Crlf) {
+			return nil, errors.New("corrupt get result read")
+		}
+		item.Value = value[:size]
+	} else {
+		item.Value = []byte{}
 	}
 
-	itemValue := make([]byte, ml.ValueLen + 2)
-	if _, e := io.ReadFull(client.rw, itemValue); e != nil {
-		client.rw = nil
-		return e
+	end, err := cn.rw.ReadSlice('\n')
+	if err != nil {
+		return nil, err
 	}
-	if !bytes.HasSuffix(itemValue, filerelay.Crlf) {
-		itemValue = nil
-		return fmt.Errorf("corrupt get result read")
+	if !bytes.Equal(end, filerelay.ResultEnd) {
+		return nil, fmt.Errorf("unexpected end of get response: %q", end)
 	}
-	itemValue = itemValue[:ml.ValueLen]
-	fmt.Printf("Value:\n%d\n-- END --\n", len(itemValue))
-	return nil
+	if size == 0 && item.CasId == 0 {
+		return nil, ErrCacheMiss
+	}
+	return item, nil
 }
 
 
 
-func readFilesFromDir(dirPath string, count int, handleFile func(idx int, filepath string) bool) {
-	dir, err := ioutil.ReadDir(dirPath)
-	if err != nil {
-		fmt.Println("Error in reading directory")
-		return
-	}
 
-	sep := string(os.PathSeparator)
-	for i, file := range dir {
-		if count > 0 && i >= count {
-			break
+// Set stores item unconditionally
+func (c *Client) Set(ctx context.Context, item *Item) error {
+	return c.store(ctx, "set", item)
+}
+
+// Add stores item only if key isn't stored yet, or returns ErrNotStored
+func (c *Client) Add(ctx context.Context, item *Item) error {
+	return c.store(ctx, "add", item)
+}
+
+// Replace stores item only if key is stored already, or returns ErrNotStored
+func (c *Client) Replace(ctx context.Context, item *Item) error {
+	return c.store(ctx, "replace", item)
+}
+
+// CompareAndSwap stores item only if it's not changed since CasId of item is taken by Gets;
+// ErrCASConflict is returned if it's changed, and ErrCacheMiss if it's gone.
+func (c *Client) CompareAndSwap(ctx context.Context, item *Item) error {
+	return c.store(ctx, "cas", item)
+}
+
+func (c *Client) store(ctx context.Context, cmd string, item *Item) error {
+	return c.do(ctx, item.Key, func(cn *conn) error {
+		line := fmt.Sprintf("%s %s %d %d %d", cmd, item.Key, item.Flags, item.Expiration, len(item.Value))
+		if cmd == "cas" {
+			line += fmt.Sprintf(" %d", item.CasId)
+		}
+		value := item.Value
+		if value == nil {
+			value = []byte{}
+		}
+		resp, err := cn.roundTrip(line + "\r\n", value)
+		if err != nil {
+			return err
 		}
-		if !file.IsDir() && file.Size() <= MaxFileSize {
-			if !handleFile(i, dirPath + sep + file.Name()) {
-				break
-			}
+		switch {
+		case bytes.Equal(resp, filerelay.ResultStored):
+			return nil
+		case bytes.Equal(resp, filerelay.ResultNotStored):
+			return ErrNotStored
+		case bytes.Equal(resp, filerelay.ResultExists):
+			return ErrCASConflict
+		case bytes.Equal(resp, filerelay.ResultNotFound):
+			return ErrCacheMiss
 		}
+		return fmt.Errorf("unexpected response line from %q: %q", cmd, resp)
+	})
+}
+
+// Delete removes item of key, or returns ErrCacheMiss
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, key, func(cn *conn) error {
+		return cn.expect("delete " + key + "\r\n", filerelay.ResultDeleted)
+	})
+}
+
+// Touch sets expiration of item in seconds, or returns ErrCacheMiss
+func (c *Client) Touch(ctx context.Context, key string, seconds int32) error {
+	return c.do(ctx, key, func(cn *conn) error {
+		return cn.expect(fmt.Sprintf("touch %s %d\r\n", key, seconds), filerelay.ResultTouched)
+	})
+}
+
+// expect sends command responded with the result on success, or NOT_FOUND
+func (cn *conn) expect(line string, result []byte) error {
+	resp, err := cn.roundTrip(line, nil)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(resp, result):
+		return nil
+	case bytes.Equal(resp, filerelay.ResultNotFound):
+		return ErrCacheMiss
 	}
+	return fmt.Errorf("unexpected response line from %q: %q", strings.Fields(line)[0], resp)
 }
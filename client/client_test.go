@@ -0,0 +1,149 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nickeljew/file-relay/filerelay"
+)
+
+
+func startServer(t *testing.T) string {
+	c := filerelay.NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	server, err := filerelay.NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	go func() {
+		var idx uint64
+		for {
+			conn, e := lis.Accept()
+			if e != nil {
+				return
+			}
+			idx++
+			server.Handle(filerelay.MakeServConn(conn, idx))
+		}
+	}()
+	t.Cleanup(func() {
+		lis.Close()
+		server.Stop()
+	})
+	return lis.Addr().String()
+}
+
+func TestClient_Commands(t *testing.T) {
+	c := New(startServer(t))
+	defer c.Close()
+	ctx := context.Background()
+
+	value := bytes.Repeat([]byte("file-relay "), 20000)
+	if e := c.Set(ctx, &Item{Key: "k", Value: value, Flags: 7, Expiration: 300}); e != nil {
+		t.Fatal(e)
+	}
+	item, err := c.Get(ctx, "k")
+	if err != nil || !bytes.Equal(item.Value, value) || item.Flags != 7 {
+		t.Fatalf("get: %v", err)
+	}
+	if _, e := c.Get(ctx, "missing"); e != ErrCacheMiss {
+		t.Errorf("get of missing key: %v", e)
+	}
+
+	if e := c.Add(ctx, &Item{Key: "k", Value: []byte("x")}); e != ErrNotStored {
+		t.Errorf("add of existing key: %v", e)
+	}
+	if e := c.Replace(ctx, &Item{Key: "missing", Value: []byte("x")}); e != ErrNotStored {
+		t.Errorf("replace of missing key: %v", e)
+	}
+	if e := c.Add(ctx, &Item{Key: "empty"}); e != nil {
+		t.Errorf("add of empty value: %v", e)
+	}
+	if item, e := c.Get(ctx, "empty"); e != nil || len(item.Value) != 0 {
+		t.Errorf("get of empty value: %+v, %v", item, e)
+	}
+
+	item, err = c.Gets(ctx, "k")
+	if err != nil || item.CasId == 0 {
+		t.Fatalf("gets: %v", err)
+	}
+	item.Value = []byte("swapped")
+	if e := c.CompareAndSwap(ctx, item); e != nil {
+		t.Errorf("cas: %v", e)
+	}
+	if e := c.CompareAndSwap(ctx, item); e != ErrCASConflict {
+		t.Errorf("cas with old unique: %v", e)
+	}
+	if e := c.CompareAndSwap(ctx, &Item{Key: "missing", CasId: 1}); e != ErrCacheMiss {
+		t.Errorf("cas of missing key: %v", e)
+	}
+
+	if e := c.Touch(ctx, "k", 100); e != nil {
+		t.Errorf("touch: %v", e)
+	}
+	if e := c.Touch(ctx, "missing", 100); e != ErrCacheMiss {
+		t.Errorf("touch of missing key: %v", e)
+	}
+	if e := c.Delete(ctx, "k"); e != nil {
+		t.Errorf("delete: %v", e)
+	}
+	if e := c.Delete(ctx, "k"); e != ErrCacheMiss {
+		t.Errorf("delete of missing key: %v", e)
+	}
+
+	for _, key := range []string{"", "with space", strings.Repeat("k", filerelay.KeyMax + 1)} {
+		if e := c.Set(ctx, &Item{Key: key}); e != ErrMalformedKey {
+			t.Errorf("set of malformed key %q: %v", key, e)
+		}
+	}
+}
+
+func TestClient_Deadline(t *testing.T) {
+	// server accepting connections without responding
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, e := lis.Accept()
+			if e != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c := New(lis.Addr().String())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 100)
+	defer cancel()
+	start := time.Now()
+	if _, e := c.Get(ctx, "k"); e != context.DeadlineExceeded {
+		t.Errorf("get beyond deadline: %v", e)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("get returned after %v", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	if e := c.Delete(ctx, "k"); e != context.Canceled {
+		t.Errorf("delete canceled: %v", e)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"crypto/md5"
+	"hash/fnv"
+
+	"github.com/nickeljew/file-relay/client"
+	"github.com/nickeljew/file-relay/filerelay"
+)
+
+
+const (
+	MaxFileSize = 1024 * 1024 * 10 //10MB
+)
+
+
+
+type TrialKeyMap struct {
+	keys map[string]bool
+	sync.Mutex
+}
+var trialKeyMap = TrialKeyMap{
+	keys: make(map[string]bool),
+}
+
+
+//
+func main() {
+	fmt.Println("File-Relay client *", time.Now())
+
+	//doConcurrentSet(101, "set", "")
+	//doConcurrentSet(101, "add", "./files")
+
+	//doAddAndReplace()
+
+	//doSetNGet("test-abc-set-and-get", false)
+
+	data := []byte("These pretzels are making me thirsty.")
+	hash := md5.Sum(data)
+	fmt.Printf("Hash %T:\n%x\n%v\n\n", hash, hash, hash)
+
+	var hSum uint64
+	for _, h := range hash {
+		m := hSum << 2
+		hSum = m + uint64(h)
+		fmt.Printf("----\nSum: %v %v - mod 1024: %v\n", m, hSum, hSum % 1024)
+	}
+
+	hashing2 := fnv.New32a()
+	hash2 := hashing2.Sum(data)
+	fmt.Printf("Hash2 %T:\n%x\n%v\n\n", hash2, hash2, hash2)
+	
+	os.Exit(0)
+}
+
+
+//
+func setupClient() *client.Client {
+	cfg, _ := filerelay.InitClientConfig("localhost")
+	return client.NewFromConfig(cfg)
+}
+
+
+func doConcurrentSet(cnt int, cmd, dirPath string) {
+	fin := make(chan int)
+
+	count := 0
+	if dirPath == "" {
+		for i := 0; i < cnt; i++ {
+			count++
+			go doStorageInIndex(i, fin, cmd, "", "")
+		}
+	} else {
+		handleFile := func(i int, filepath string) bool {
+			fmt.Println("--> File path: ", filepath)
+			count++
+			go doStorageInIndex(i, fin, cmd, filepath, filepath)
+			return true
+		}
+		readFilesFromDir(dirPath, cnt, handleFile)
+	}
+	
+	for {
+		select {
+		case <- fin:
+			count--
+			fmt.Println("- left count: ", count)
+			if count == 0 {
+				return
+			}
+		}
+	}
+}
+
+
+func doStorageInIndex(idx int, fin chan int, cmd, key, filepath string) {
+	fmt.Println("Doing at index: ", idx)
+	if err := tryStorage(idx, cmd, key, filepath); err != nil {
+		fmt.Printf("Error in %d: %s\n", idx, err.Error())
+	} else {
+		fmt.Printf("Finish %d\n", idx)
+	}
+	fin <- idx
+}
+
+
+
+
+func doAddAndReplace() {
+	key := "add-replace-key"
+	filepath1 := "./files/m_1390221121382.jpg"
+	filepath2 := "./files/m_1390221149351.jpg"
+
+	if err := tryStorage(0, "add", key, filepath1); err != nil {
+		fmt.Printf("Error in adding: %s\n", err.Error())
+	} else {
+		fmt.Println("Finish adding")
+	}
+
+	if e := tryGet(key); e != nil {
+		fmt.Printf("Error: %s\n", e.Error())
+	}
+
+	if err := tryStorage(0, "replace", key, filepath2); err != nil {
+		fmt.Printf("Error in adding: %s\n", err.Error())
+	} else {
+		fmt.Println("Finish adding")
+	}
+
+	if e := tryGet(key); e != nil {
+		fmt.Printf("Error: %s\n", e.Error())
+	}
+}
+
+
+
+
+
+func doSetNGet(key string, onlyGet bool) {
+	if !onlyGet {
+		fmt.Println("# Doing set with key: ", key)
+		if e := tryStorage(0, "set", key, ""); e != nil {
+			fmt.Printf("Error: %s\n", e.Error())
+		} else {
+			fmt.Println("Finish")
+		}
+	}
+
+	fmt.Println("# Doing get with key: ", key)
+	if e := tryGet(key); e != nil {
+		fmt.Printf("Error: %s\n", e.Error())
+	}
+}
+
+func createKey() string {
+	var key string
+	for {
+		key = "test123" + filerelay.RandomStr(1000, 9999)
+		fmt.Println("Trying created key: ", key)
+		trialKeyMap.Lock()
+		if !trialKeyMap.keys[key] {
+			trialKeyMap.keys[key] = true
+			trialKeyMap.Unlock()
+			break
+		}
+		trialKeyMap.Unlock()
+	}
+	return key
+}
+
+//
+func tryStorage(tryIndex int, cmd, key, filepath string) error {
+	c := setupClient()
+	defer c.Close()
+
+	if filepath == "" {
+		filepath = "./test.txt"
+	}
+	reqValue, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	key = strings.Trim(key, " \f\n\r\t\v")
+	if key == "" {
+		key = createKey()
+	}
+
+	item := &client.Item{
+		Key: key,
+		Value: reqValue,
+		Flags: 1,
+		Expiration: 120,
+	}
+	fmt.Printf("Sending[%d]:\n>%s %s %d %d %d\n", tryIndex, cmd, item.Key, item.Flags, item.Expiration, len(item.Value))
+
+	ctx := context.Background()
+	switch cmd {
+	case "add":
+		err = c.Add(ctx, item)
+	case "replace":
+		err = c.Replace(ctx, item)
+	default:
+		err = c.Set(ctx, item)
+	}
+	fmt.Printf("Response from server[%d] for key[%s]: %v\n", tryIndex, key, err)
+	return err
+}
+
+
+
+
+//
+func tryGet(key string) error {
+	c := setupClient()
+	defer c.Close()
+
+	fmt.Printf("Sending:\n>get %s\n", key)
+	item, err := c.Get(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Value:\n%d\n-- END --\n", len(item.Value))
+	return nil
+}
+
+
+
+func readFilesFromDir(dirPath string, count int, handleFile func(idx int, filepath string) bool) {
+	dir, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		fmt.Println("Error in reading directory")
+		return
+	}
+
+	sep := string(os.PathSeparator)
+	for i, file := range dir {
+		if count > 0 && i >= count {
+			break
+		}
+		if !file.IsDir() && file.Size() <= MaxFileSize {
+			if !handleFile(i, dirPath + sep + file.Name()) {
+				break
+			}
+		}
+	}
+}
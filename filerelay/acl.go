@@ -0,0 +1,124 @@
+package filerelay
+
+import (
+	"errors"
+	"strings"
+)
+
+
+var (
+	ErrAccessDenied = errors.New("access denied")
+)
+
+
+type Permission byte
+const (
+	PermRead Permission = 1 << iota
+	PermWrite
+	PermDelete
+	PermAdmin
+)
+
+var _PermNames = map[string]Permission{
+	"read": PermRead,
+	"write": PermWrite,
+	"delete": PermDelete,
+	"admin": PermAdmin,
+}
+
+// permissions required by commands; commands not listed here need admin permission
+var _CmdPerms = map[string]Permission{
+	"get": PermRead,
+	"gets": PermRead,
+	"mg": PermRead,
+	"set": PermWrite,
+	"add": PermWrite,
+	"replace": PermWrite,
+	"cas": PermWrite,
+	"touch": PermWrite,
+	"delete": PermDelete,
+	"persist": PermWrite,
+}
+
+func CmdPermission(cmd string) Permission {
+	if p, ok := _CmdPerms[cmd]; ok {
+		return p
+	}
+	return PermAdmin
+}
+
+
+// ACLRule grants permissions on keys with the prefix to the identity;
+// Identity "*" matches all connections including unauthenticated ones,
+// and admin permission only takes effect in rules with empty prefix, which matches all keys.
+type ACLRule struct {
+	Identity string `yaml:"identity"`
+	Prefix string `yaml:"prefix"`
+	Allow []string `yaml:"allow"`
+}
+
+type aclRule struct {
+	identity string
+	prefix string
+	perms Permission
+}
+
+
+// ACL checks commands of identities on keys against rules, allowing everything when there's no rule
+type ACL struct {
+	rules []aclRule
+}
+
+func NewACL(rules []ACLRule) (*ACL, error) {
+	acl := &ACL{
+		rules: make([]aclRule, 0, len(rules)),
+	}
+	for _, r := range rules {
+		if r.Identity == "" {
+			return nil, errors.New("acl rule without identity")
+		}
+		rule := aclRule{
+			identity: r.Identity,
+			prefix: r.Prefix,
+		}
+		for _, name := range r.Allow {
+			p, ok := _PermNames[strings.ToLower(name)]
+			if !ok {
+				return nil, errors.New("unknown permission in acl: " + name)
+			}
+			rule.perms |= p
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+// Enabled tells whether there are rules to enforce; everything is allowed without rules
+func (a *ACL) Enabled() bool {
+	return a != nil && len(a.rules) > 0
+}
+
+// Check tells whether the identity is allowed to issue the command on key,
+// by the union of permissions from all matched rules
+func (a *ACL) Check(identity, cmd, key string) bool {
+	if !a.Enabled() {
+		return true
+	}
+
+	need := CmdPermission(cmd)
+	for _, r := range a.rules {
+		if r.identity != "*" && r.identity != identity {
+			continue
+		}
+		if need == PermAdmin {
+			if r.prefix == "" && r.perms & PermAdmin != 0 {
+				return true
+			}
+			continue
+		}
+		if r.perms & need != 0 && strings.HasPrefix(key, r.prefix) {
+			return true
+		}
+	}
+	return false
+}
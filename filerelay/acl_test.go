@@ -0,0 +1,89 @@
+package filerelay
+
+import (
+	"testing"
+)
+
+
+func TestACL_Check(t *testing.T) {
+	acl, err := NewACL([]ACLRule{
+		{Identity: "image-team", Prefix: "img:", Allow: []string{"read", "write"}},
+		{Identity: "image-team", Prefix: "img:tmp:", Allow: []string{"delete"}},
+		{Identity: "ops", Prefix: "", Allow: []string{"admin", "read"}},
+		{Identity: "ops", Prefix: "img:", Allow: []string{"ADMIN"}},
+		{Identity: "report", Prefix: "img:", Allow: []string{"admin"}},
+		{Identity: "*", Prefix: "pub:", Allow: []string{"read"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		identity, cmd, key string
+		allowed bool
+	}{
+		{"image-team", "get", "img:1", true},
+		{"image-team", "set", "img:1", true},
+		{"image-team", "get", "doc:1", false}, //prefix not matched
+		{"image-team", "delete", "img:1", false},
+		{"image-team", "delete", "img:tmp:1", true}, //union of rules
+		{"image-team", "mg", "img:tmp:1", true},
+		{"image-team", "get", "pub:1", true}, //rule of "*"
+		{"", "get", "pub:1", true},
+		{"", "set", "pub:1", false},
+		{"other", "get", "img:1", false},
+		{"ops", "flush_all", "", true}, //admin with empty prefix
+		{"ops", "get", "doc:1", true},
+		{"ops", "delete", "doc:1", false},
+		{"report", "stats", "", false}, //admin with prefix takes no effect
+		{"image-team", "stats", "", false},
+	}
+	for _, cs := range cases {
+		if ok := acl.Check(cs.identity, cs.cmd, cs.key); ok != cs.allowed {
+			t.Errorf("%s of %q by %q: expect allowed %v", cs.cmd, cs.key, cs.identity, cs.allowed)
+		}
+	}
+
+	if _, e := NewACL([]ACLRule{{Prefix: "img:", Allow: []string{"read"}}}); e == nil {
+		t.Error("rule without identity accepted")
+	}
+	if _, e := NewACL([]ACLRule{{Identity: "*", Allow: []string{"list"}}}); e == nil {
+		t.Error("rule with unknown permission accepted")
+	}
+	if acl, _ := NewACL(nil); !acl.Check("", "flush_all", "") {
+		t.Error("command denied without rules")
+	}
+}
+
+func TestACL_Denied(t *testing.T) {
+	defer quietLogs()()
+	c := authConfig(t)
+	c.ACL = []ACLRule{
+		{Identity: "alice", Prefix: "img:", Allow: []string{"read", "write"}},
+		{Identity: "*", Prefix: "pub:", Allow: []string{"read"}},
+	}
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+
+	if resp := command(t, rw, "auth alice secret", nil); resp != string(ResultOK) {
+		t.Fatalf("auth: %q", resp)
+	}
+	if resp := command(t, rw, "set img:1 0 0 5", []byte("hello")); resp != string(ResultStored) {
+		t.Errorf("set allowed: %q", resp)
+	}
+	// value block of storage denied is skipped, and the connection goes on
+	if resp := command(t, rw, "set doc:1 0 0 5", []byte("hello")); resp != "CLIENT_ERROR access denied\r\n" {
+		t.Errorf("set denied: %q", resp)
+	}
+	if resp := command(t, rw, "delete img:1", nil); resp != "CLIENT_ERROR access denied\r\n" {
+		t.Errorf("delete denied: %q", resp)
+	}
+	if resp := command(t, rw, "flush_all", nil); resp != "CLIENT_ERROR access denied\r\n" {
+		t.Errorf("flush_all denied: %q", resp)
+	}
+	if resp := command(t, rw, "mg img:1 s", nil); resp != "HD s5\r\n" {
+		t.Errorf("mg allowed: %q", resp)
+	}
+}
@@ -0,0 +1,90 @@
+package filerelay
+
+import (
+	"sync"
+	"time"
+)
+
+
+const (
+	SlabBackendHeap = "heap"
+	SlabBackendMmap = "mmap"
+
+	// delay for unmapping released arenas, since slots may still be touched by in-flight commands;
+	// Arenas with slots still pinned are kept for another delay.
+	_ArenaFreeDelay = time.Minute
+)
+
+
+// slabArena is the memory carved into slots of a slab
+type slabArena interface {
+	Slice(offset, size uint64) []byte
+	Free()
+}
+
+
+// heapArena leaves each slot in its own allocation in Go heap
+type heapArena struct{}
+
+func (a heapArena) Slice(offset, size uint64) []byte {
+	return make([]byte, size, size)
+}
+
+func (a heapArena) Free() {}
+
+
+// newSlabArena allocates memory for a slab in the backend,
+// and falls back to Go heap if the backend is not available.
+func newSlabArena(backend string, size uint64) slabArena {
+	if backend == SlabBackendMmap {
+		a, err := newMmapArena(size)
+		if err == nil {
+			return a
+		}
+		logger.Errorf("Failed to mmap arena of %d bytes, fall back to heap: %v", size, err.Error())
+	}
+	return heapArena{}
+}
+
+
+
+
+// arenaGraveyard keeps arenas of released slabs until it's safe to free them
+type arenaGraveyard struct {
+	slabs []*Slab
+	freeAt []time.Time
+	sync.Mutex
+}
+
+var graveyard = &arenaGraveyard{}
+
+func (gy *arenaGraveyard) bury(s *Slab) {
+	if _, ok := s.arena.(heapArena); ok {
+		return
+	}
+
+	gy.Lock()
+	gy.slabs = append(gy.slabs, s)
+	gy.freeAt = append(gy.freeAt, time.Now().Add(_ArenaFreeDelay))
+	gy.Unlock()
+
+	time.AfterFunc(_ArenaFreeDelay, gy.sweep)
+}
+
+// sweep frees arenas out of delay, and delays the ones with slots still pinned
+func (gy *arenaGraveyard) sweep() {
+	now := time.Now()
+	gy.Lock()
+	defer gy.Unlock()
+
+	i := 0
+	for ; i < len(gy.slabs) && !now.Before(gy.freeAt[i]); i++ {
+		if s := gy.slabs[i]; !s.freeArena() {
+			gy.slabs = append(gy.slabs, s)
+			gy.freeAt = append(gy.freeAt, now.Add(_ArenaFreeDelay))
+			time.AfterFunc(_ArenaFreeDelay, gy.sweep)
+		}
+	}
+	gy.slabs = gy.slabs[i:]
+	gy.freeAt = gy.freeAt[i:]
+}
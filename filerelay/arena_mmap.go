@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+//+build linux darwin freebsd netbsd openbsd
+
+package filerelay
+
+import (
+	"syscall"
+)
+
+
+// mmapArena is an anonymous memory mapping out of Go heap, which is not scanned or accounted by GC
+type mmapArena struct {
+	mem []byte
+}
+
+func newMmapArena(size uint64) (*mmapArena, error) {
+	mem, err := syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapArena{mem: mem}, nil
+}
+
+func (a *mmapArena) Slice(offset, size uint64) []byte {
+	return a.mem[offset : offset+size : offset+size]
+}
+
+func (a *mmapArena) Free() {
+	if a.mem == nil {
+		return
+	}
+	if e := syscall.Munmap(a.mem); e != nil {
+		logger.Errorf("Failed to unmap arena: %v", e.Error())
+	}
+	a.mem = nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+//+build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package filerelay
+
+import (
+	"errors"
+)
+
+
+func newMmapArena(size uint64) (slabArena, error) {
+	return nil, errors.New("mmap not supported")
+}
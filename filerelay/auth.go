@@ -0,0 +1,205 @@
+package filerelay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	_AuthPayloadMax = 1024
+)
+
+
+var (
+	ErrAuthFailed = errors.New("authentication failed")
+	ErrUnauthenticated = errors.New("unauthenticated")
+)
+
+// commands always accepted before authentication
+var _AuthCmds = map[string]bool{
+	"auth": true,
+	"quit": true,
+}
+
+
+type AuthConfig struct {
+	AuthFile string `yaml:"auth-file"` //file of credentials in lines of "user:token"
+	AuthReloadIntv int `yaml:"auth-reload-interval"` //in seconds; 0 to reload only on SIGHUP
+	AuthOpenCmds []string `yaml:"auth-open-cmds"` //commands allowed for unauthenticated connections
+}
+
+
+
+
+//
+type Authenticator struct {
+	path string
+	openCmds map[string]bool
+
+	creds map[string]string
+	modAt time.Time
+	quit chan bool
+	sync.RWMutex
+}
+
+func NewAuthenticator(c *AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		path: c.AuthFile,
+		openCmds: make(map[string]bool),
+		creds: make(map[string]string),
+		quit: make(chan bool, 1),
+	}
+	for _, cmd := range c.AuthOpenCmds {
+		a.openCmds[cmd] = true
+	}
+
+	if a.path != "" {
+		if e := a.Reload(); e != nil {
+			return nil, e
+		}
+	}
+	return a, nil
+}
+
+// Enabled tells whether connections should authenticate before issuing commands
+func (a *Authenticator) Enabled() bool {
+	return a != nil && a.path != ""
+}
+
+// Reload reads the credential file again and replaces all credentials in memory
+func (a *Authenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	creds := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.Trim(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 || i == len(line)-1 {
+			logger.Warnf("Skip malformed line in auth file: %s", a.path)
+			continue
+		}
+		creds[line[:i]] = line[i+1:]
+	}
+	if e := scanner.Err(); e != nil {
+		return e
+	}
+
+	a.Lock()
+	a.creds = creds
+	a.modAt = fi.ModTime()
+	a.Unlock()
+
+	logger.Infof("Loaded %d credentials from auth file: %s", len(creds), a.path)
+	return nil
+}
+
+func (a *Authenticator) changed() bool {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return false
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return !fi.ModTime().Equal(a.modAt)
+}
+
+// StartWatch reloads the credential file on SIGHUP,
+// or when it's found modified in checking at every interval if interval is set
+func (a *Authenticator) StartWatch(intv int) {
+	if !a.Enabled() {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var t *time.Ticker
+	if intv > 0 {
+		t = time.NewTicker(time.Second * time.Duration(intv))
+		tick = t.C
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+			case <-tick:
+				if !a.changed() {
+					continue
+				}
+			case <- a.quit:
+				signal.Stop(hup)
+				if t != nil {
+					t.Stop()
+				}
+				return
+			}
+
+			if e := a.Reload(); e != nil {
+				logger.Errorf("Error reloading auth file: %v", e.Error())
+			}
+		}
+	}()
+}
+
+func (a *Authenticator) StopWatch() {
+	if a.Enabled() {
+		a.quit <- true
+	}
+}
+
+func (a *Authenticator) Verify(user, token string) bool {
+	a.RLock()
+	expected, ok := a.creds[user]
+	a.RUnlock()
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// VerifyPayload checks the payload of a memcached-style authentication by a fake "set",
+// which is either "user token" or a SASL PLAIN message "[authzid]\x00user\x00token"
+func (a *Authenticator) VerifyPayload(payload []byte) (string, bool) {
+	var parts [][]byte
+	if bytes.IndexByte(payload, 0) >= 0 {
+		if parts = bytes.Split(payload, []byte{0}); len(parts) != 3 {
+			return "", false
+		}
+		parts = parts[1:]
+	} else {
+		if parts = bytes.Fields(payload); len(parts) != 2 {
+			return "", false
+		}
+	}
+
+	user := string(parts[0])
+	return user, a.Verify(user, string(parts[1]))
+}
+
+// Allowed tells whether the command can be issued by an unauthenticated connection
+func (a *Authenticator) Allowed(cmd string) bool {
+	return !a.Enabled() || _AuthCmds[cmd] || a.openCmds[cmd]
+}
@@ -0,0 +1,129 @@
+package filerelay
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+
+func authConfig(t *testing.T) *MemConfig {
+	file := filepath.Join(t.TempDir(), "filerelay.auth")
+	if e := ioutil.WriteFile(file, []byte("# users\nalice:secret\nbob:token-2\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.AuthFile = file
+	c.AuthOpenCmds = []string{"stats"}
+	return c
+}
+
+// expectClosed checks that server has closed the connection after the last response
+func expectClosed(t *testing.T, rw io.Reader, what string) {
+	if _, e := rw.Read(make([]byte, 1)); e != io.EOF {
+		t.Errorf("connection not closed after %s: %v", what, e)
+	}
+}
+
+func TestAuth_Command(t *testing.T) {
+	defer quietLogs()()
+	addr, stop := startTestServer(t, authConfig(t), 0)
+	defer stop()
+
+	conn, rw := dialTest(t, addr)
+	if resp := command(t, rw, "get k", nil); resp != "CLIENT_ERROR unauthenticated\r\n" {
+		t.Errorf("get before auth: %q", resp)
+	}
+	expectClosed(t, rw, "unauthenticated command")
+	conn.Close()
+
+	conn, rw = dialTest(t, addr)
+	if resp := command(t, rw, "auth alice wrong", nil); resp != "CLIENT_ERROR authentication failed\r\n" {
+		t.Errorf("auth with wrong token: %q", resp)
+	}
+	expectClosed(t, rw, "failed auth")
+	conn.Close()
+
+	conn, rw = dialTest(t, addr)
+	defer conn.Close()
+	if resp := command(t, rw, "auth alice secret", nil); resp != string(ResultOK) {
+		t.Fatalf("auth: %q", resp)
+	}
+	if resp := command(t, rw, "set k 0 0 5", []byte("hello")); resp != string(ResultStored) {
+		t.Errorf("set after auth: %q", resp)
+	}
+	if resp := command(t, rw, "mg k s", nil); resp != "HD s5\r\n" {
+		t.Errorf("mg after auth: %q", resp)
+	}
+}
+
+func TestAuth_Payload(t *testing.T) {
+	defer quietLogs()()
+	addr, stop := startTestServer(t, authConfig(t), 0)
+	defer stop()
+
+	for _, payload := range []string{"bob token-2", "\x00bob\x00token-2", "bob\x00bob\x00token-2"} {
+		conn, rw := dialTest(t, addr)
+		if resp := command(t, rw, "set auth 0 0 " + strconv.Itoa(len(payload)), []byte(payload)); resp != string(ResultStored) {
+			t.Errorf("auth by payload %q: %q", payload, resp)
+		}
+		if resp := command(t, rw, "mg auth", nil); resp != string(ResultMetaMiss) {
+			t.Errorf("payload of auth stored as value: %q", resp)
+		}
+		conn.Close()
+	}
+
+	for _, payload := range []string{"bob token-1", "\x00bob\x00token-1", "\x00bob", "bob"} {
+		conn, rw := dialTest(t, addr)
+		if resp := command(t, rw, "set auth 0 0 " + strconv.Itoa(len(payload)), []byte(payload)); resp != "CLIENT_ERROR authentication failed\r\n" {
+			t.Errorf("auth by wrong payload %q: %q", payload, resp)
+		}
+		expectClosed(t, rw, "failed auth")
+		conn.Close()
+	}
+}
+
+func TestAuth_Allowed(t *testing.T) {
+	defer quietLogs()()
+	addr, stop := startTestServer(t, authConfig(t), 0)
+	defer stop()
+
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+	// commands in auth-open-cmds are served before authentication
+	if stats := statsOf(t, rw); stats["pid"] == "" {
+		t.Errorf("stats before auth: %v", stats)
+	}
+	if resp := command(t, rw, "delete k", nil); resp != "CLIENT_ERROR unauthenticated\r\n" {
+		t.Errorf("delete before auth: %q", resp)
+	}
+}
+
+func TestAuthenticator_Reload(t *testing.T) {
+	c := authConfig(t)
+	a, err := NewAuthenticator(&c.AuthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Verify("alice", "secret") || a.Verify("alice", "token-2") || a.Verify("carol", "") {
+		t.Error("credentials verified wrong")
+	}
+	if !a.Allowed("auth") || !a.Allowed("stats") || a.Allowed("get") {
+		t.Error("commands allowed wrong")
+	}
+
+	if e := ioutil.WriteFile(c.AuthFile, []byte("alice:changed\nmalformed\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := a.Reload(); e != nil {
+		t.Fatal(e)
+	}
+	if a.Verify("alice", "secret") || !a.Verify("alice", "changed") || a.Verify("bob", "token-2") {
+		t.Error("credentials not replaced by reload")
+	}
+}
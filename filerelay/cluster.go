@@ -0,0 +1,701 @@
+package filerelay
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nickeljew/file-relay/hashring"
+)
+
+
+const (
+	PeerPoolSize = 8
+	PeerTimeout = 10 //in seconds
+	_PeerIdleMax = time.Second * 10 //pooled connections idle longer may have been closed by peer
+	_PeerAnonymous = "-" //identity declared for unauthenticated clients of commands sent to peer
+)
+
+var (
+	ErrPeerUnavailable = errors.New("peer unavailable")
+)
+
+// commands on keys which are forwarded to the owner node
+var _ForwardCmds = map[string]bool{
+	"set": true,
+	"add": true,
+	"replace": true,
+	"cas": true,
+	"get": true,
+	"gets": true,
+	"mg": true,
+	"touch": true,
+	"delete": true,
+	"persist": true,
+}
+
+
+// ClusterConfig lists nodes sharing keys by consistent hashing; Cluster mode is off without peers.
+type ClusterConfig struct {
+	Node string `yaml:"node"` //address of this node as peers reach it, in host:port
+	Peers []PeerConfig `yaml:"peers"`
+	Hash string `yaml:"hash"` //md5 or fnv; default as md5
+	VNodes int `yaml:"vnodes"` //virtual nodes per weight in hash ring
+	PoolSize int `yaml:"pool-size"` //idle connections kept for every peer
+	Timeout int `yaml:"timeout"` //in seconds; for dialing, and every read or write on peer connections
+	NodeId int `yaml:"node-id"` //0..1023 unique in cluster, in low bits of cas unique; derived from node by default
+
+	Membership string `yaml:"membership"` //static by peers, or gossip joining by seeds; default as static
+	Seeds []string `yaml:"seeds"` //addresses of nodes to join by gossip
+	GossipKey string `yaml:"gossip-key"` //shared by members for signing gossip packets; others are ignored
+	Weight int `yaml:"weight"` //weight of this node in gossip membership; default as 1
+	ProbeInterval int `yaml:"probe-interval"` //in milliseconds; a member is probed in every interval
+	ProbeTimeout int `yaml:"probe-timeout"` //in milliseconds; for ack of direct probe, before probing through others
+	IndirectProbes int `yaml:"indirect-probes"` //members asked to probe a member not responding
+	SuspectTimeout int `yaml:"suspect-timeout"` //in milliseconds; suspected members not refuting it are dead after it
+
+	Replicas int `yaml:"replicas"` //copies of every item on ring owners, including the primary; default as 1
+	Replication string `yaml:"replication"` //sync or async; default as async
+	ReplicationQueue int `yaml:"replication-queue"` //changes waiting for async replication; more are dropped
+	HandoffRate int64 `yaml:"handoff-rate"` //bytes per second of items moved to new owners after ring changes
+
+	// credentials for peers with authentication enabled
+	AuthUser string `yaml:"auth-user"`
+	AuthToken string `yaml:"auth-token"`
+}
+
+type PeerConfig struct {
+	Addr string `yaml:"addr"` //host:port
+	Weight int `yaml:"weight"` //default as 1
+}
+
+
+
+
+// Cluster finds owner of keys in hash ring of nodes, and keeps pooled connections to peers;
+// Nodes in ring are updated by gossip in gossip membership.
+type Cluster struct {
+	cfg *ClusterConfig //only reference
+	self string
+	ring *hashring.Ring
+	gossip *Gossip
+	version uint64 //increased on every change of ring
+	changed chan bool //notified on changes of ring, for handoff
+	handoff *Handoff
+	pools map[string]*peerPool
+	replicaPools map[string]*peerPool //connections for replication, on which nothing is replicated again
+	replicas int
+	replication string
+	queues []chan *replicaTask //async replication, by hash of key for order of changes on key
+	quit chan bool
+	workers sync.WaitGroup
+
+	forwarded uint64
+	forwardFails uint64
+	replicated uint64
+	replicateFails uint64
+	replicateDrops uint64
+
+	sync.RWMutex
+}
+
+// NewCluster returns nil for config without peers in static membership, which means cluster mode is off
+func NewCluster(c *ClusterConfig) (*Cluster, error) {
+	if !validMembership(c.Membership) {
+		return nil, errors.New("unknown membership: " + c.Membership)
+	}
+	gossip := c.Membership == MembershipGossip
+	if len(c.Peers) == 0 && !gossip {
+		return nil, nil
+	}
+	if c.Node == "" {
+		return nil, errors.New("cluster without address of this node")
+	}
+	hash, err := hashring.NewHashFunc(c.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if c.PoolSize <= 0 {
+		c.PoolSize = PeerPoolSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = PeerTimeout
+	}
+	if c.Replicas <= 0 {
+		c.Replicas = 1
+	}
+	if !validReplication(c.Replication) {
+		return nil, errors.New("unknown replication: " + c.Replication)
+	}
+	if c.ReplicationQueue <= 0 {
+		c.ReplicationQueue = ReplicationQueue
+	}
+	if c.HandoffRate <= 0 {
+		c.HandoffRate = HandoffRate
+	}
+	if c.Weight <= 0 {
+		c.Weight = 1
+	}
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = GossipProbeInterval
+	}
+	if c.ProbeTimeout <= 0 || c.ProbeTimeout >= c.ProbeInterval {
+		c.ProbeTimeout = c.ProbeInterval / 2
+	}
+	if c.IndirectProbes <= 0 {
+		c.IndirectProbes = GossipIndirectProbes
+	}
+	if c.SuspectTimeout <= 0 {
+		c.SuspectTimeout = GossipSuspectTimeout
+	}
+	if c.NodeId < 0 || c.NodeId > CASNodeMax {
+		return nil, errors.New("node-id out of range")
+	} else if c.NodeId > 0 {
+		setCASNode(uint64(c.NodeId))
+	} else {
+		setCASNode(uint64(keyHash(c.Node)))
+	}
+
+	cl := &Cluster{
+		cfg: c,
+		self: c.Node,
+		ring: hashring.NewRing(hash, c.VNodes),
+		pools: make(map[string]*peerPool),
+		replicaPools: make(map[string]*peerPool),
+		replicas: c.Replicas,
+		replication: c.Replication,
+		queues: make([]chan *replicaTask, ReplicationWorkers),
+		quit: make(chan bool),
+		changed: make(chan bool, 1),
+	}
+	for i := range cl.queues {
+		cl.queues[i] = make(chan *replicaTask, c.ReplicationQueue / ReplicationWorkers + 1)
+	}
+	if gossip {
+		if cl.gossip, err = NewGossip(cl, c); err != nil {
+			return nil, err
+		}
+		_ = cl.ring.AddNode(c.Node, c.Weight)
+		return cl, nil
+	}
+
+	selfListed := false
+	for _, p := range c.Peers {
+		weight := p.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if e := cl.ring.AddNode(p.Addr, weight); e != nil {
+			return nil, errors.New("peer " + p.Addr + ": " + e.Error())
+		}
+		if p.Addr == c.Node {
+			selfListed = true
+			continue
+		}
+		cl.pools[p.Addr] = newPeerPool(p.Addr, c, false)
+		cl.replicaPools[p.Addr] = newPeerPool(p.Addr, c, true)
+	}
+	if !selfListed {
+		_ = cl.ring.AddNode(c.Node, 1)
+	}
+	return cl, nil
+}
+
+// Enabled tells whether keys are shared with peers
+func (c *Cluster) Enabled() bool {
+	return c != nil
+}
+
+// Owner returns address of the node owning key, and whether it's a peer other than this node
+func (c *Cluster) Owner(key string) (string, bool) {
+	node, ok := c.ring.GetNode(key)
+	if !ok || node == c.self {
+		return c.self, false
+	}
+	return node, true
+}
+
+// Owners returns addresses of the primary and replica nodes of key, in order of ring
+func (c *Cluster) Owners(key string) []string {
+	return c.ring.GetNodes(key, c.replicas)
+}
+
+// Holds tells whether this node is the primary or a replica node of key
+func (c *Cluster) Holds(key string) bool {
+	for _, node := range c.Owners(key) {
+		if node == c.self {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cluster) RingVersion() uint64 {
+	return atomic.LoadUint64(&c.version)
+}
+
+// ringChanged is called with lock held after nodes added into or removed from ring
+func (c *Cluster) ringChanged() {
+	atomic.AddUint64(&c.version, 1)
+	select {
+	case c.changed <- true:
+	default:
+	}
+}
+
+func (c *Cluster) pool(addr string) *peerPool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.pools[addr]
+}
+
+func (c *Cluster) replicaPool(addr string) *peerPool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.replicaPools[addr]
+}
+
+func (c *Cluster) membership() string {
+	if c.gossip != nil {
+		return MembershipGossip
+	}
+	return MembershipStatic
+}
+
+// addMember puts node joined by gossip into ring, with pools of connections to it
+func (c *Cluster) addMember(node string, weight int) {
+	c.Lock()
+	defer c.Unlock()
+	if e := c.ring.AddNode(node, weight); e != nil {
+		return
+	}
+	c.pools[node] = newPeerPool(node, c.cfg, false)
+	c.replicaPools[node] = newPeerPool(node, c.cfg, true)
+	c.ringChanged()
+}
+
+// removeMember takes node failed or left out of ring, and closes idle connections to it
+func (c *Cluster) removeMember(node string) {
+	c.Lock()
+	defer c.Unlock()
+	if e := c.ring.RemoveNode(node); e != nil {
+		return
+	}
+	for _, pools := range []map[string]*peerPool{c.pools, c.replicaPools} {
+		if p := pools[node]; p != nil {
+			p.Close()
+			delete(pools, node)
+		}
+	}
+	c.ringChanged()
+}
+
+// Start runs workers of async replication, handoff of items in tenants, and gossip in gossip membership
+func (c *Cluster) Start(tenants *TenantSet) {
+	if c == nil {
+		return
+	}
+	for _, q := range c.queues {
+		c.workers.Add(1)
+		go c.replicateQueued(q)
+	}
+	c.handoff = NewHandoff(c, tenants, c.cfg.HandoffRate)
+	c.handoff.Start()
+	if c.gossip != nil {
+		c.gossip.Start()
+	}
+}
+
+// Close leaves gossip, stops workers of async replication, and closes idle connections to peers
+func (c *Cluster) Close() {
+	if c == nil {
+		return
+	}
+	if c.gossip != nil {
+		c.gossip.Stop(true)
+	}
+	if c.handoff != nil {
+		c.handoff.Stop()
+	}
+	close(c.quit)
+	c.workers.Wait()
+
+	c.Lock()
+	defer c.Unlock()
+	for _, p := range c.pools {
+		p.Close()
+	}
+	for _, p := range c.replicaPools {
+		p.Close()
+	}
+}
+
+
+
+
+// peerConn is connection to peer, on which every read or write must finish in timeout
+type peerConn struct {
+	net.Conn
+	rw *bufio.ReadWriter
+	timeout time.Duration
+	usedAt time.Time
+	broken bool //not to be reused for a failure in the middle of a command
+}
+
+func (pc *peerConn) Read(b []byte) (int, error) {
+	_ = pc.Conn.SetReadDeadline(time.Now().Add(pc.timeout))
+	return pc.Conn.Read(b)
+}
+
+func (pc *peerConn) Write(b []byte) (int, error) {
+	_ = pc.Conn.SetWriteDeadline(time.Now().Add(pc.timeout))
+	return pc.Conn.Write(b)
+}
+
+
+// peerPool keeps idle connections to a peer for reuse
+type peerPool struct {
+	addr string
+	cfg *ClusterConfig //only reference
+	replica bool //connections for replication
+	idle chan *peerConn
+	closed int32 //peer taken out of ring
+}
+
+func newPeerPool(addr string, c *ClusterConfig, replica bool) *peerPool {
+	return &peerPool{
+		addr: addr,
+		cfg: c,
+		replica: replica,
+		idle: make(chan *peerConn, c.PoolSize),
+	}
+}
+
+// Get takes an idle connection, or dials a new one when there's none
+func (p *peerPool) Get() (*peerConn, error) {
+	for {
+		select {
+		case pc := <-p.idle:
+			if time.Since(pc.usedAt) < _PeerIdleMax {
+				return pc, nil
+			}
+			_ = pc.Close()
+			continue
+		default:
+		}
+		return p.dial()
+	}
+}
+
+// Put gives back connection for reuse, or closes it if it's broken or the pool is full
+func (p *peerPool) Put(pc *peerConn) {
+	if pc.broken || atomic.LoadInt32(&p.closed) == 1 {
+		_ = pc.Close()
+		return
+	}
+	pc.usedAt = time.Now()
+	select {
+	case p.idle <- pc:
+	default:
+		_ = pc.Close()
+	}
+}
+
+func (p *peerPool) Close() {
+	atomic.StoreInt32(&p.closed, 1)
+	for {
+		select {
+		case pc := <-p.idle:
+			_ = pc.Close()
+		default:
+			return
+		}
+	}
+}
+
+// dial connects to peer, authenticates if credentials are set, and declares itself as peer,
+// so that commands on the connection are served by the peer, never forwarded again;
+// Connections for replication are declared as replica, on which changes are not replicated again.
+// Peers are configured, or members joined by gossip signed with key of cluster, so credentials never go to others.
+func (p *peerPool) dial() (*peerConn, error) {
+	timeout := time.Second * time.Duration(p.cfg.Timeout)
+	nc, err := net.DialTimeout("tcp", p.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	pc := &peerConn{
+		Conn: nc,
+		timeout: timeout,
+	}
+	pc.rw = bufio.NewReadWriter(bufio.NewReader(pc), bufio.NewWriter(pc))
+
+	if p.cfg.AuthUser != "" {
+		if e := pc.handshake("auth " + p.cfg.AuthUser + " " + p.cfg.AuthToken); e != nil {
+			_ = nc.Close()
+			return nil, e
+		}
+	}
+	declare := "peer " + p.cfg.Node
+	if p.replica {
+		declare += " " + PeerReplica
+	}
+	if e := pc.handshake(declare); e != nil {
+		_ = nc.Close()
+		return nil, e
+	}
+	return pc, nil
+}
+
+// peerClient is the client of a command from peer, by its tenant, and its identity if declared
+type peerClient struct {
+	tenant string
+	identity string
+	withIdentity bool
+}
+
+// parsePeerClient takes arguments of "as <tenant> [<identity>]", in which "-" is for unauthenticated client
+func parsePeerClient(args []string) *peerClient {
+	c := &peerClient{tenant: args[0]}
+	if len(args) > 1 {
+		c.withIdentity = true
+		if args[1] != _PeerAnonymous {
+			c.identity = args[1]
+		}
+	}
+	return c
+}
+
+// asLine declares the client of the next command sent to peer, so that the command is served
+// in tenant of the client and checked against ACL for its identity
+func asLine(tenant, identity string) string {
+	if identity == "" {
+		identity = _PeerAnonymous
+	}
+	return "as " + tenant + " " + identity + "\r\n"
+}
+
+func (pc *peerConn) handshake(line string) error {
+	if _, e := pc.rw.WriteString(line + "\r\n"); e != nil {
+		return e
+	}
+	if e := pc.rw.Flush(); e != nil {
+		return e
+	}
+	resp, e := pc.rw.ReadString('\n')
+	if e != nil {
+		return e
+	}
+	if resp != string(ResultOK) {
+		return errors.New("peer handshake failed: " + strings.TrimSpace(resp))
+	}
+	return nil
+}
+
+
+
+
+// forward proxies the command to the primary node of its key, streaming value blocks in both directions
+// without buffering them; The raw line is the command line as received.
+// Retrievals go on with replica nodes when the primary is unreachable, and false is returned
+// if this node is the next one to serve it.
+// Failures before anything of reply is written are responded with SERVER_ERROR, and the connection goes on;
+// Error is returned for failures in the middle of a reply, so that the connection is closed.
+func (h *handler) forward(msgline *MsgLine, raw []byte, sc *ServConn, sub *limitSubject) (bool, error) {
+	primary, remote := h.cluster.Owner(msgline.Key)
+	if !remote {
+		return false, nil
+	}
+	owners := []string{primary}
+	if msgline.Cmd == "get" || msgline.Cmd == "gets" || msgline.Cmd == "mg" {
+		owners = h.cluster.Owners(msgline.Key)
+	}
+
+	var valueLen uint64 //bytes of value block to stream to peer
+	if _StoreCmds[msgline.Cmd] {
+		valueLen = msgline.ValueLen + uint64(len(Crlf))
+		if e := h.limiter.Admit(sub, limitUpload, msgline.ValueLen); e != nil {
+			logger.Warnf("Upload of key [%s] rejected by rate limit", msgline.Key)
+			if _, e := sc.rw.Discard(int(valueLen)); e != nil {
+				return true, e
+			}
+			h.writeServerError(sc.rw, e.Error())
+			return true, nil
+		}
+	}
+
+	for _, owner := range owners {
+		if owner == h.cluster.self {
+			return false, nil
+		}
+		if sent, e := h.forwardTo(msgline, raw, sc, owner, valueLen, sub); sent || e != nil {
+			return true, e
+		}
+	}
+	return true, h.forwardFailed(sc, valueLen, ErrPeerUnavailable)
+}
+
+// forwardTo proxies the command to the node; It returns false if the node is unreachable,
+// with nothing taken from or written to client.
+func (h *handler) forwardTo(msgline *MsgLine, raw []byte, sc *ServConn, owner string, valueLen uint64, sub *limitSubject) (bool, error) {
+	log := logger.WithFields(logrus.Fields{
+		"cmd": msgline.Cmd,
+		"itemKey": msgline.Key,
+		"owner": owner,
+		"handler": h.index,
+		"conn": sc.index,
+	})
+
+	pool := h.cluster.pool(owner)
+	if pool == nil {
+		return false, nil
+	}
+	for retry := valueLen == 0; ; retry = false {
+		pc, err := pool.Get()
+		if err != nil {
+			log.Warnf("Connect to peer failed: %v", err.Error())
+			return false, nil
+		}
+
+		replied, err := h.relay(msgline, raw, sc, pc, valueLen, sub)
+		if err != nil {
+			pc.broken = true
+		}
+		pool.Put(pc)
+		if err == nil {
+			atomic.AddUint64(&h.cluster.forwarded, 1)
+			log.Info("Command forwarded")
+			return true, nil
+		}
+		if replied {
+			atomic.AddUint64(&h.cluster.forwardFails, 1)
+			log.Errorf("Relay reply failed: %v", err.Error())
+			return true, err
+		}
+		log.Warnf("Forward failed: %v", err.Error())
+		if valueLen > 0 {
+			// value block has been taken from client
+			return true, h.forwardFailed(sc, 0, ErrPeerUnavailable)
+		}
+		if !retry {
+			return false, nil
+		}
+		// pooled connection may have been closed by peer, and the command without value can be sent again
+	}
+}
+
+// forwardFailed skips value block left from client and responds with server error
+func (h *handler) forwardFailed(sc *ServConn, bytesLeft uint64, reason error) error {
+	atomic.AddUint64(&h.cluster.forwardFails, 1)
+	if bytesLeft > 0 {
+		if _, e := sc.rw.Discard(int(bytesLeft)); e != nil {
+			return e
+		}
+	}
+	h.writeServerError(sc.rw, reason.Error())
+	return nil
+}
+
+// relay sends command with its value block to peer, and writes reply of peer back to client;
+// It tells whether anything has been written to client, after which the reply can't be taken back.
+func (h *handler) relay(msgline *MsgLine, raw []byte, sc *ServConn, pc *peerConn, valueLen uint64, sub *limitSubject) (bool, error) {
+	if _, e := pc.rw.WriteString(asLine(sub.tenant, sub.identity)); e != nil {
+		return false, h.skipValue(sc, valueLen, e)
+	}
+	if _, e := pc.rw.Write(raw); e != nil {
+		return false, h.skipValue(sc, valueLen, e)
+	}
+	if valueLen > 0 {
+		h.limiter.Throttle(sub, limitUpload, msgline.ValueLen)
+		src := &countReader{r: io.LimitReader(sc.rw, int64(valueLen))}
+		if _, e := io.CopyN(pc.rw, src, int64(valueLen)); e != nil {
+			return false, h.skipValue(sc, valueLen - src.n, e)
+		}
+	}
+	if e := pc.rw.Flush(); e != nil {
+		return false, e
+	}
+
+	line, e := pc.rw.ReadSlice('\n')
+	if e != nil {
+		return false, e
+	}
+	return true, h.relayReply(msgline.Cmd, line, sc, pc, sub)
+}
+
+// relayReply writes reply of peer to client from the first line read, with reply lines following it,
+// each of which may be followed by a value block
+func (h *handler) relayReply(cmd string, line []byte, sc *ServConn, pc *peerConn, sub *limitSubject) error {
+	for {
+		block, more := replyBlock(cmd, line)
+		if _, e := sc.rw.Write(line); e != nil {
+			return e
+		}
+		if block > 0 {
+			h.limiter.Throttle(sub, limitDownload, block)
+			if _, e := io.CopyN(sc.rw, pc.rw, int64(block)); e != nil {
+				return e
+			}
+		}
+		if !more {
+			return sc.rw.Flush()
+		}
+
+		var e error
+		if line, e = pc.rw.ReadSlice('\n'); e != nil {
+			return e
+		}
+	}
+}
+
+// skipValue discards the rest of value block from client when peer fails in taking it, keeping the error
+func (h *handler) skipValue(sc *ServConn, bytesLeft uint64, err error) error {
+	if bytesLeft > 0 {
+		if _, e := sc.rw.Discard(int(bytesLeft)); e != nil {
+			return e
+		}
+	}
+	return err
+}
+
+// replyBlock tells bytes of value block with \r\n following the reply line of command,
+// and whether more lines are coming
+func replyBlock(cmd string, line []byte) (uint64, bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	switch {
+	case (cmd == "get" || cmd == "gets") && fields[0] == "VALUE" && len(fields) >= 4:
+		n, _ := strconv.ParseUint(fields[3], 10, 64)
+		if n == 0 {
+			return 0, true //no value block for miss or empty value
+		}
+		return n + uint64(len(Crlf)), true
+	case cmd == "mg" && fields[0] == "VA" && len(fields) >= 2:
+		// value block of empty value is still ended with \r\n
+		n, _ := strconv.ParseUint(fields[1], 10, 64)
+		return n + uint64(len(Crlf)), false
+	}
+	return 0, false
+}
+
+
+// countReader counts bytes read, for the rest to be skipped on failure
+type countReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, e := c.r.Read(b)
+	c.n += uint64(n)
+	return n, e
+}
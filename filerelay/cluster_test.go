@@ -0,0 +1,298 @@
+package filerelay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+
+// startTestCluster runs nodes on local ports, with every node listing all as peers;
+// Config of every node is adjusted by fn if it's not nil.
+func startTestCluster(t *testing.T, nodes int, fn func(c *MemConfig)) ([]string, []*Server, func()) {
+	listeners := make([]net.Listener, nodes)
+	peers := make([]PeerConfig, nodes)
+	for i := range listeners {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = lis
+		peers[i] = PeerConfig{Addr: lis.Addr().String()}
+	}
+
+	addrs := make([]string, nodes)
+	servers := make([]*Server, nodes)
+	stops := make([]func(), nodes)
+	for i, lis := range listeners {
+		c := NewMemConfig()
+		c.MaxRoutines = 32
+		c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+		c.SlotsInSlab, c.SlabsInGroup = 16, 2
+		c.MaxStorage = "8MB"
+		c.Cluster = ClusterConfig{
+			Node: peers[i].Addr,
+			Peers: peers,
+		}
+		if fn != nil {
+			fn(c)
+		}
+		addrs[i] = peers[i].Addr
+		servers[i], stops[i] = serveTestListener(t, lis, c, 0)
+	}
+	return addrs, servers, func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+func dialTest(t *testing.T, addr string) (net.Conn, *bufio.ReadWriter) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+}
+
+// command sends line with value block if value is not nil, and returns the first line of reply
+func command(t *testing.T, rw *bufio.ReadWriter, line string, value []byte) string {
+	fmt.Fprintf(rw, "%s\r\n", line)
+	if value != nil {
+		rw.Write(value)
+		rw.Write(Crlf)
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rw.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func quietLogs() func() {
+	level := rootLogger.GetLevel()
+	rootLogger.SetLevel(logrus.ErrorLevel)
+	return func() {
+		rootLogger.SetLevel(level)
+	}
+}
+
+
+func TestCluster_Forward(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startTestCluster(t, 3, nil)
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	const keys = 30
+	for i := 0; i < keys; i++ {
+		key := "fwd-" + strconv.Itoa(i)
+		v := stressValue(key, 100 + i * 10 * 1024) //up to 300KB streamed through peers
+		if resp := command(t, rw, fmt.Sprintf("set %s 0 0 %d", key, len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+	}
+
+	// every key is stored only on its owner, and readable from any node
+	stored := 0
+	for i, s := range servers {
+		n := s.tenants.Select("", "").entry.Len()
+		if n == 0 {
+			t.Errorf("no key stored on node %d", i)
+		}
+		stored += n
+	}
+	if stored != keys {
+		t.Errorf("%d items stored in cluster, expect %d", stored, keys)
+	}
+	for _, addr := range addrs {
+		c, r := dialTest(t, addr)
+		for i := 0; i < keys; i++ {
+			key := "fwd-" + strconv.Itoa(i)
+			fmt.Fprintf(r, "get %s\r\n", key)
+			r.Flush()
+			v, err := readStressValue(r)
+			if err != nil {
+				t.Fatalf("get %s from %s: %v", key, addr, err)
+			}
+			if !bytes.Equal(v, stressValue(key, 100 + i * 10 * 1024)) {
+				t.Fatalf("get %s from %s: broken value of %d bytes", key, addr, len(v))
+			}
+		}
+		c.Close()
+	}
+
+	// other commands on keys are forwarded as well
+	conn2, rw2 := dialTest(t, addrs[1])
+	defer conn2.Close()
+	for i := 0; i < keys; i++ {
+		key := "fwd-" + strconv.Itoa(i)
+		if resp := command(t, rw2, "mg " + key + " s v", nil); !strings.HasPrefix(resp, "VA ") {
+			t.Fatalf("mg %s: %q", key, resp)
+		}
+		if _, err := rw2.Discard(100 + i * 10 * 1024 + len(Crlf)); err != nil {
+			t.Fatal(err)
+		}
+		if resp := command(t, rw2, "touch " + key + " 300", nil); resp != string(ResultTouched) {
+			t.Fatalf("touch %s: %q", key, resp)
+		}
+		if resp := command(t, rw2, "delete " + key, nil); resp != string(ResultDeleted) {
+			t.Fatalf("delete %s: %q", key, resp)
+		}
+		if resp := command(t, rw, "mg " + key, nil); resp != string(ResultMetaMiss) {
+			t.Fatalf("mg %s after deleted: %q", key, resp)
+		}
+	}
+}
+
+func TestCluster_PeerDown(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startTestCluster(t, 2, nil)
+	defer stop()
+
+	remoteKey, localKey := "", ""
+	for i := 0; remoteKey == "" || localKey == ""; i++ {
+		key := "down-" + strconv.Itoa(i)
+		if _, remote := servers[0].cluster.Owner(key); remote {
+			remoteKey = key
+		} else {
+			localKey = key
+		}
+	}
+	// the second node is in ring, but not reachable
+	servers[0].cluster.pools[addrs[1]].addr = "127.0.0.1:1"
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	v := []byte("value of key owned by peer down")
+	if resp := command(t, rw, fmt.Sprintf("set %s 0 0 %d", remoteKey, len(v)), v); !strings.HasPrefix(resp, "SERVER_ERROR") {
+		t.Errorf("set on peer down: %q", resp)
+	}
+	// connection goes on with keys of this node
+	if resp := command(t, rw, fmt.Sprintf("set %s 0 0 %d", localKey, len(v)), v); resp != string(ResultStored) {
+		t.Errorf("set after peer down: %q", resp)
+	}
+}
+
+// clusterAuth sets authentication with credentials of cluster on nodes, and tenant "team" for identity alice
+func clusterAuth(t *testing.T) func(c *MemConfig) {
+	file := filepath.Join(t.TempDir(), "filerelay.auth")
+	if e := ioutil.WriteFile(file, []byte("alice:secret\nnode:cluster-secret\n"), 0600); e != nil {
+		t.Fatal(e)
+	}
+	return func(c *MemConfig) {
+		c.AuthFile = file
+		c.Cluster.AuthUser, c.Cluster.AuthToken = "node", "cluster-secret"
+		c.Tenants = []TenantConfig{{Name: "team", Identities: []string{"alice"}}}
+	}
+}
+
+func TestCluster_PeerAuth(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startTestCluster(t, 2, clusterAuth(t))
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	if resp := command(t, rw, "auth alice secret", nil); resp != string(ResultOK) {
+		t.Fatalf("auth: %q", resp)
+	}
+	// only connections with credentials of cluster declare themselves as peers
+	if resp := command(t, rw, "peer " + addrs[0], nil); resp != "CLIENT_ERROR access denied\r\n" {
+		t.Errorf("peer declared by client: %q", resp)
+	}
+	if resp := command(t, rw, "as team alice", nil); resp != "CLIENT_ERROR access denied\r\n" {
+		t.Errorf("client declared by client: %q", resp)
+	}
+
+	// forwarded commands are served in tenant of the client on owner
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, remote := servers[0].cluster.Owner("team-" + strconv.Itoa(i)); remote {
+			key = "team-" + strconv.Itoa(i)
+		}
+	}
+	v := []byte("value in tenant of identity")
+	if resp := command(t, rw, fmt.Sprintf("set %s 0 0 %d", key, len(v)), v); resp != string(ResultStored) {
+		t.Fatalf("set %s: %q", key, resp)
+	}
+	if servers[1].tenants.Get("team").entry.Get(key) == nil {
+		t.Error("forwarded item not stored in tenant of client")
+	}
+	if resp := command(t, rw, "mg " + key + " s", nil); resp != fmt.Sprintf("HD s%d\r\n", len(v)) {
+		t.Errorf("mg %s: %q", key, resp)
+	}
+}
+
+// TestCluster_PeerHandlers takes all handlers of both nodes by clients storing keys of each other,
+// which are served as peer connections are served by handlers of their own
+func TestCluster_PeerHandlers(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startTestCluster(t, 2, func(c *MemConfig) {
+		c.MaxRoutines = 2
+		c.Cluster.Timeout = 2
+	})
+	defer stop()
+
+	// keys of every node owned by the other one
+	keys := make([][]string, 2)
+	for i := 0; len(keys[0]) < 4 || len(keys[1]) < 4; i++ {
+		key := "peer-" + strconv.Itoa(i)
+		owner, _ := servers[0].cluster.Owner(key)
+		from := 1 - nodeIndex(addrs, owner)
+		keys[from] = append(keys[from], key)
+	}
+	v := stressValue("peer", 1000)
+	store := func(node int, key string, pause time.Duration) string {
+		conn, rw := dialTest(t, addrs[node])
+		defer conn.Close()
+		fmt.Fprintf(rw, "set %s 0 0 %d\r\n", key, len(v))
+		rw.Write(v[:500])
+		rw.Flush()
+		time.Sleep(pause)
+		rw.Write(v[500:])
+		rw.Write([]byte("\r\n"))
+		rw.Flush()
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return err.Error()
+		}
+		return line
+	}
+
+	// pooled connections are set up first, then clients on every node hold all its handlers at once
+	for _, pause := range []time.Duration{0, time.Millisecond * 300} {
+		var wg sync.WaitGroup
+		resps := make(chan string, 4)
+		for node := 0; node < 2; node++ {
+			for j := 0; j < 2; j++ {
+				wg.Add(1)
+				go func(node int, key string) {
+					defer wg.Done()
+					resps <- key + ": " + store(node, key, pause)
+				}(node, keys[node][j + int(pause / time.Millisecond / 150)])
+			}
+		}
+		wg.Wait()
+		close(resps)
+		for resp := range resps {
+			if !strings.HasSuffix(resp, string(ResultStored)) {
+				t.Errorf("pause %v: %q", pause, resp)
+			}
+		}
+	}
+}
@@ -11,6 +11,8 @@ const (
 	NetType = "tcp"
 
 	KeyMax = 250
+
+	ConnIdleTimeout = 30
 )
 
 
@@ -25,6 +27,7 @@ type Config struct {
 	NetworkType string `yaml:"network-type"`
 
 	MaxRoutines int `yaml:"max-routines"`
+	IdleTimeout int `yaml:"idle-timeout"` //in seconds; for closing connections without incoming commands
 }
 
 
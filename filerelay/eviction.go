@@ -0,0 +1,77 @@
+package filerelay
+
+import (
+	linkedlist "container/list"
+	"errors"
+)
+
+
+const (
+	EvictionLRU = "lru"
+	EvictionSLRU = "slru"
+	EvictionTinyLFU = "tinylfu"
+
+	StorageFullFail = "fail"
+	StorageFullEvict = "evict"
+
+	_EvictSearchDepth = 100 //max items to look through for a victim holding slots of a capacity class
+)
+
+
+// EvictionPolicy keeps items of ItemsEntry within its size, and decides which one to evict for room;
+// Slots of items removed or evicted by policy are cleared.
+type EvictionPolicy interface {
+	// Add puts item into policy, or replaces the existing one with the same key unless noReplace;
+	// The item evicted for room is returned, which may be the added one if the policy rejects it.
+	Add(t *MetaItem, noReplace bool) (evicted *MetaItem, err error)
+	Replace(t *MetaItem) bool
+	Get(key string) *MetaItem
+	// Peek returns the item without updating its recency or frequency
+	Peek(key string) *MetaItem
+	Remove(key string) *MetaItem
+	Contains(key string) bool
+	Len() int
+	Purge()
+
+	removeOldest(clear bool) *MetaItem
+	// victims walks items in order of eviction, until fn returns false
+	victims(fn func(t *MetaItem) bool)
+}
+
+
+func NewEvictionPolicy(name string, size int) (EvictionPolicy, error) {
+	switch name {
+	case EvictionLRU, "":
+		return NewLRU(size), nil
+	case EvictionSLRU:
+		return NewSLRU(size), nil
+	case EvictionTinyLFU:
+		return NewTinyLFU(size), nil
+	}
+	return nil, errors.New("unknown eviction policy: " + name)
+}
+
+
+// holdsSlotIn tells whether item holds any slot of the capacity class
+func holdsSlotIn(t *MetaItem, slotCap uint64) bool {
+	slots, _, _ := t.held()
+	for _, s := range slots {
+		if s.capacity == slotCap {
+			return true
+		}
+	}
+	return false
+}
+
+
+func errKeyExists(key string) error {
+	return errors.New("key already exists: " + key)
+}
+
+// replaceValue puts new item into element, and clears slots held by the replaced one
+func replaceValue(elem *linkedlist.Element, t *MetaItem) {
+	if old := elem.Value.(*MetaItem); old != nil && old != t {
+		old.ClearSlots()
+	}
+	elem.Value = t
+}
@@ -0,0 +1,261 @@
+package filerelay
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	traceSeed = 20190601
+	traceLen = 200000
+	traceCacheSize = 1000
+)
+
+var evictionPolicies = []string{EvictionLRU, EvictionSLRU, EvictionTinyLFU}
+
+
+// loadTrace reads keys of requests, one per line, from file in env FILERELAY_TRACE;
+// Without the file, a trace is generated with fixed seed so that it's replayable:
+// hot files follow zipf distribution, mixed with files written once and read a few times shortly after.
+func loadTrace(tb testing.TB) []string {
+	if path := os.Getenv("FILERELAY_TRACE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		defer f.Close()
+
+		keys := make([]string, 0, traceLen)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				keys = append(keys, line)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			tb.Fatal(err)
+		}
+		return keys
+	}
+
+	r := rand.New(rand.NewSource(traceSeed))
+	zipf := rand.NewZipf(r, 1.1, 1, traceCacheSize * 20)
+	keys := make([]string, 0, traceLen)
+	oneshot := 0
+	for len(keys) < traceLen {
+		if r.Intn(100) < 60 {
+			keys = append(keys, "hot-" + strconv.FormatUint(zipf.Uint64(), 10))
+			continue
+		}
+		// write once, then a few reads spread in the following requests
+		oneshot++
+		key := "once-" + strconv.Itoa(oneshot)
+		keys = append(keys, key)
+		for n := r.Intn(3); n > 0 && len(keys) < traceLen; n-- {
+			keys = append(keys, "hot-" + strconv.FormatUint(zipf.Uint64(), 10), key)
+		}
+	}
+	return keys
+}
+
+// replayTrace requests keys in policy, and adds the missed ones as clients do; It returns the hit ratio.
+func replayTrace(p EvictionPolicy, keys []string) float64 {
+	hits := 0
+	for _, k := range keys {
+		if p.Get(k) != nil {
+			hits++
+			continue
+		}
+		_, _ = p.Add(voidMetaItem(k), false)
+	}
+	return float64(hits) / float64(len(keys))
+}
+
+
+func TestEvictionPolicy_Size(t *testing.T) {
+	for _, name := range evictionPolicies {
+		p, err := NewEvictionPolicy(name, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			if _, err = p.Add(voidMetaItem(key), false); err != nil {
+				t.Fatalf("%s: add %s: %v", name, key, err)
+			}
+			if i % 3 == 0 {
+				_ = p.Get(key)
+			}
+		}
+		if p.Len() > 100 {
+			t.Errorf("%s: %d items over size 100", name, p.Len())
+		}
+
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			if p.Contains(key) {
+				if p.Remove(key) == nil {
+					t.Errorf("%s: failed to remove contained key %s", name, key)
+				}
+			}
+		}
+		if p.Len() != 0 {
+			t.Errorf("%s: %d items left after removing all", name, p.Len())
+		}
+	}
+
+	if _, err := NewEvictionPolicy("fifo", 100); err == nil {
+		t.Error("unknown policy should fail")
+	}
+}
+
+func TestEvictionPolicy_NoReplace(t *testing.T) {
+	for _, name := range evictionPolicies {
+		p, _ := NewEvictionPolicy(name, 10)
+		_, _ = p.Add(voidMetaItem("a"), false)
+		if _, err := p.Add(voidMetaItem("a"), true); err == nil {
+			t.Errorf("%s: add of existing key should fail", name)
+		}
+		if !p.Replace(voidMetaItem("a")) {
+			t.Errorf("%s: replace of existing key should succeed", name)
+		}
+		if p.Replace(voidMetaItem("b")) {
+			t.Errorf("%s: replace of missing key should fail", name)
+		}
+	}
+}
+
+func TestTinyLFU_ScanResistant(t *testing.T) {
+	lru, _ := NewEvictionPolicy(EvictionLRU, traceCacheSize)
+	lfu, _ := NewEvictionPolicy(EvictionTinyLFU, traceCacheSize)
+	keys := loadTrace(t)
+
+	lruRatio := replayTrace(lru, keys)
+	lfuRatio := replayTrace(lfu, keys)
+	t.Logf("hit ratio - lru: %.4f, tinylfu: %.4f", lruRatio, lfuRatio)
+	if os.Getenv("FILERELAY_TRACE") == "" && lfuRatio <= lruRatio {
+		t.Errorf("tinylfu hit ratio %.4f not better than lru %.4f on generated trace", lfuRatio, lruRatio)
+	}
+}
+
+
+func benchmarkHitRatio(b *testing.B, name string) {
+	keys := loadTrace(b)
+	b.ResetTimer()
+
+	var ratio float64
+	for i := 0; i < b.N; i++ {
+		p, _ := NewEvictionPolicy(name, traceCacheSize)
+		ratio = replayTrace(p, keys)
+	}
+	b.ReportMetric(ratio * 100, "hit%")
+}
+
+func BenchmarkHitRatio_LRU(b *testing.B) {
+	benchmarkHitRatio(b, EvictionLRU)
+}
+
+func BenchmarkHitRatio_SLRU(b *testing.B) {
+	benchmarkHitRatio(b, EvictionSLRU)
+}
+
+func BenchmarkHitRatio_TinyLFU(b *testing.B) {
+	benchmarkHitRatio(b, EvictionTinyLFU)
+}
+
+
+func TestHandler_AllocSlotsEvict(t *testing.T) {
+	for _, mode := range []string{StorageFullFail, StorageFullEvict} {
+		c := NewMemConfig()
+		c.SlotCapMin, c.SlotCapMax = 64, 64
+		c.StorageFull = mode
+		c.ItemShards = 1 //for order of eviction across items
+		c.maxStorageSize = 4 * 64 //storage full with the initial slab
+		tenants, err := NewTenantSet(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := make(slabGroupMap)
+		groups[64] = NewSlabGroup(64, 1, 4, SlabCheckInterval, c.maxStorageSize, SlabBackendHeap)
+		c.AddCapToTotal(groups[64].Capacity())
+		h := &handler{cfg: c, groups: groups, tenants: tenants}
+
+		tenant := tenants.Select("", "")
+		store := func(key string) error {
+			item := NewMetaItem(key, 0, 600, 64)
+			item.tenant = tenant
+			_ = tenant.entry.Set(item)
+			if e := h.allocSlots(item); e != nil {
+				_ = tenant.entry.Remove(key)
+				return e
+			}
+			for _, s := range item.slots {
+				s.SetInfoWithItem(item)
+				s.key, s.used, s.filling = key, 64, false
+			}
+			return nil
+		}
+
+		for i := 0; i < 4; i++ {
+			if e := store("fill-" + strconv.Itoa(i)); e != nil {
+				t.Fatalf("%s: fill slots: %v", mode, e)
+			}
+		}
+		_ = tenant.entry.Get("fill-0") //recently used, so fill-1 is the victim
+
+		err = store("extra")
+		if mode == StorageFullFail {
+			if err == nil {
+				t.Errorf("%s: expect storage full", mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: expect slots freed by eviction, got: %v", mode, err)
+		}
+		if tenant.entry.Get("fill-1") != nil || tenant.entry.Get("fill-0") == nil {
+			t.Errorf("%s: expect the least recently used item evicted", mode)
+		}
+		if n := atomic.LoadUint64(&groups[64].evictions); n != 1 {
+			t.Errorf("%s: expect 1 eviction in group, got: %d", mode, n)
+		}
+	}
+}
+
+// TestHandler_StorageFullFail fails storage commands when storage is full, keeping the connection for next commands
+func TestHandler_StorageFullFail(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.MaxStorage = "2MB"
+	c.StorageFull = StorageFullFail
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+
+	full := false
+	for i := 0; i < 100 && !full; i++ {
+		key := "full-" + strconv.Itoa(i)
+		v := stressValue(key, 60000)
+		switch resp := command(t, rw, "set " + key + " 0 0 " + strconv.Itoa(len(v)), v); resp {
+		case string(ResultStored):
+		case string(ResultNotStored):
+			full = true
+		default:
+			t.Fatalf("set %s: %q", key, resp)
+		}
+	}
+	if !full {
+		t.Fatal("storage never full")
+	}
+	if resp := command(t, rw, "mg full-0 s", nil); resp != "HD s60000\r\n" {
+		t.Errorf("mg after storage full: %q", resp)
+	}
+}
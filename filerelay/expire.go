@@ -0,0 +1,68 @@
+package filerelay
+
+import (
+	"container/heap"
+	"time"
+)
+
+
+const (
+	ExpireBatch = 1000
+)
+
+
+// expiryQueue is a min-heap of items by time of expiration, for items to be removed soon after expired
+type expiryQueue []*MetaItem
+
+func (q expiryQueue) Len() int {
+	return len(q)
+}
+
+func (q expiryQueue) Less(i, j int) bool {
+	return q[i].expireAt.Before(q[j].expireAt)
+}
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	t := x.(*MetaItem)
+	t.queueIndex = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.queueIndex = -1
+	*q = old[:n-1]
+	return t
+}
+
+func (q *expiryQueue) schedule(t *MetaItem) {
+	t.expireAt = t.Deadline()
+	if t.queueIndex >= 0 {
+		heap.Fix(q, t.queueIndex)
+		return
+	}
+	heap.Push(q, t)
+}
+
+func (q *expiryQueue) unschedule(t *MetaItem) {
+	if t != nil && t.queueIndex >= 0 {
+		heap.Remove(q, t.queueIndex)
+	}
+}
+
+// popExpired takes the earliest item out of queue if it's expired at the time
+func (q *expiryQueue) popExpired(now time.Time) *MetaItem {
+	if len(*q) == 0 || (*q)[0].expireAt.After(now) {
+		return nil
+	}
+	return heap.Pop(q).(*MetaItem)
+}
@@ -4,6 +4,9 @@ import (
 	"math"
 	"net"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
@@ -68,6 +71,12 @@ func Start(rawCfg string) int {
 	}
 	dtrace.Logf("## Init with config: %+v", cfg)
 
+	server, err := NewServer(cfg)
+	if err != nil {
+		logger.Errorf("Error creating server: %v", err.Error())
+		return 1
+	}
+
 	lis, err2 := net.Listen(cfg.NetworkType, cfg.Addr())
 	if err2 != nil {
 		logger.Errorf("Error listening: %v", err2.Error())
@@ -76,17 +85,29 @@ func Start(rawCfg string) int {
 	logger.Infof("Server is listening at: %v", cfg.Addr())
 	defer lis.Close()
 
-	server := NewServer(cfg)
-	
 	server.Start()
 	defer server.Stop()
 
+	// server stops on SIGINT or SIGTERM, saving snapshot if it's enabled
+	var stopping int32
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		logger.Infof("Server stopping on signal: %v", s)
+		atomic.StoreInt32(&stopping, 1)
+		_ = lis.Close()
+	}()
+
 	var cIndex uint64 = 0
 
 	for {
         // Listen for an incoming connection.
         conn, err := lis.Accept()
         if err != nil {
+			if atomic.LoadInt32(&stopping) == 1 {
+				return 0
+			}
 			logger.Errorf("Error accepting: %v", err.Error())
             return 1
         }
@@ -0,0 +1,633 @@
+package filerelay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+
+const (
+	MembershipStatic = "static"
+	MembershipGossip = "gossip"
+
+	GossipProbeInterval = 1000 //in milliseconds
+	GossipProbeTimeout = 500 //in milliseconds
+	GossipIndirectProbes = 3
+	GossipSuspectTimeout = 5000 //in milliseconds
+
+	_GossipRetransmit = 4 //times of every update piggybacked, multiplied by log of member count
+	_GossipMaxUpdates = 16 //updates piggybacked in a message
+	_GossipPacketMax = 65507 //max payload of udp
+	_MemberForget = time.Minute * 10 //dead or left members are forgotten after it
+)
+
+var (
+	ErrGossipConfig = errors.New("gossip membership takes seeds, not peers")
+	ErrGossipKey = errors.New("gossip membership takes gossip-key")
+)
+
+
+func validMembership(m string) bool {
+	return m == "" || m == MembershipStatic || m == MembershipGossip
+}
+
+
+type memberState byte
+const (
+	memberAlive memberState = iota
+	memberSuspect
+	memberDead
+	memberLeft
+)
+
+func (s memberState) String() string {
+	switch s {
+	case memberAlive:
+		return "alive"
+	case memberSuspect:
+		return "suspect"
+	case memberDead:
+		return "dead"
+	}
+	return "left"
+}
+
+// inRing tells whether keys are still assigned to member in the state
+func (s memberState) inRing() bool {
+	return s == memberAlive || s == memberSuspect
+}
+
+
+//
+type member struct {
+	node string
+	weight int
+	state memberState
+	incarnation uint64 //only increased by the member itself, to refute suspicion on it
+	changedAt time.Time
+}
+
+// gossipUpdate is state of a member spread by piggybacking on messages
+type gossipUpdate struct {
+	Node string `json:"node"`
+	Weight int `json:"weight,omitempty"`
+	State memberState `json:"state"`
+	Incarnation uint64 `json:"inc"`
+}
+
+const (
+	msgPing = "ping"
+	msgAck = "ack"
+	msgPingReq = "ping-req" //asking to probe the target for sender
+	msgJoin = "join" //with all members known by sender, replied with state
+	msgState = "state"
+	msgLeave = "leave"
+)
+
+// gossipMsg is sent in a udp packet to the same address as the node serving commands
+type gossipMsg struct {
+	Kind string `json:"kind"`
+	Seq uint64 `json:"seq,omitempty"`
+	From string `json:"from"`
+	Target string `json:"target,omitempty"`
+	Updates []gossipUpdate `json:"updates,omitempty"`
+}
+
+// gossipBroadcast is update waiting to be piggybacked
+type gossipBroadcast struct {
+	update gossipUpdate
+	transmits int
+}
+
+
+
+
+// Gossip keeps members of cluster by SWIM: every member is probed in turn, through other members
+// when it's not responding directly, and marked as suspect and then dead if still not responding;
+// Changes of members are piggybacked on probes, and the ring of cluster is updated on them.
+type Gossip struct {
+	cl *Cluster //only reference
+	self string
+	weight int
+	seeds []string
+	key []byte //shared by members for signing packets
+	conn *net.UDPConn
+
+	interval time.Duration
+	timeout time.Duration
+	suspectTimeout time.Duration
+	indirect int
+
+	incarnation uint64
+	members map[string]*member
+	order []string //probing order of members, shuffled in every round
+	next int
+	queue []*gossipBroadcast
+	acks map[uint64]chan bool //probes waiting for ack by seq
+	seq uint64
+
+	drop func(node string) bool //for tests; packets to node dropped when it returns true
+	quit chan bool
+	done sync.WaitGroup
+	closing sync.Once
+
+	sync.Mutex
+}
+
+func NewGossip(cl *Cluster, c *ClusterConfig) (*Gossip, error) {
+	if len(c.Peers) > 0 {
+		return nil, ErrGossipConfig
+	}
+	if c.GossipKey == "" {
+		return nil, ErrGossipKey
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.Node)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gossip{
+		cl: cl,
+		self: c.Node,
+		weight: c.Weight,
+		seeds: c.Seeds,
+		key: []byte(c.GossipKey),
+		conn: conn,
+		interval: time.Millisecond * time.Duration(c.ProbeInterval),
+		timeout: time.Millisecond * time.Duration(c.ProbeTimeout),
+		suspectTimeout: time.Millisecond * time.Duration(c.SuspectTimeout),
+		indirect: c.IndirectProbes,
+		members: make(map[string]*member),
+		acks: make(map[uint64]chan bool),
+		quit: make(chan bool),
+	}
+	g.members[g.self] = &member{
+		node: g.self,
+		weight: g.weight,
+		state: memberAlive,
+		changedAt: time.Now(),
+	}
+	return g, nil
+}
+
+// Start joins cluster by seeds, and runs probing of members
+func (g *Gossip) Start() {
+	g.done.Add(2)
+	go g.receive()
+	go g.run()
+}
+
+// Stop leaves cluster, telling all members at once if leave is true, and stops probing
+func (g *Gossip) Stop(leave bool) {
+	g.closing.Do(func() {
+		if leave {
+			g.leave()
+		}
+		close(g.quit)
+		_ = g.conn.Close()
+		g.done.Wait()
+	})
+}
+
+func (g *Gossip) leave() {
+	g.Lock()
+	g.incarnation++
+	self := g.members[g.self]
+	self.state, self.incarnation = memberLeft, g.incarnation
+	u := gossipUpdate{Node: g.self, State: memberLeft, Incarnation: g.incarnation}
+	nodes := g.probeable("")
+	g.Unlock()
+
+	for _, node := range nodes {
+		g.send(node, &gossipMsg{Kind: msgLeave, Updates: []gossipUpdate{u}})
+	}
+	logger.Infof("Left cluster, told %d members", len(nodes))
+}
+
+
+func (g *Gossip) run() {
+	defer g.done.Done()
+	g.join()
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.quit:
+			return
+		case <-ticker.C:
+			g.probe()
+			g.reap()
+		}
+	}
+}
+
+// join sends all members known to seeds, when there's no other member to probe;
+// It's tried again in every round until any seed is reached.
+func (g *Gossip) join() {
+	g.Lock()
+	if len(g.probeable("")) > 0 {
+		g.Unlock()
+		return
+	}
+	msg := &gossipMsg{Kind: msgJoin, Updates: g.allUpdates()}
+	g.Unlock()
+
+	for _, seed := range g.seeds {
+		if seed != g.self {
+			g.send(seed, msg)
+		}
+	}
+}
+
+// probe pings the next member, and asks other members to ping it if there's no ack in timeout;
+// The member is suspected without any ack in the round.
+func (g *Gossip) probe() {
+	target := g.nextTarget()
+	if target == "" {
+		g.join()
+		return
+	}
+	seq, ack := g.expect()
+	defer g.forget(seq)
+
+	g.send(target, &gossipMsg{Kind: msgPing, Seq: seq, Target: target})
+	select {
+	case <-ack:
+		return
+	case <-g.quit:
+		return
+	case <-time.After(g.timeout):
+	}
+
+	g.Lock()
+	helpers := g.probeable(target)
+	g.Unlock()
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	if len(helpers) > g.indirect {
+		helpers = helpers[:g.indirect]
+	}
+	for _, node := range helpers {
+		g.send(node, &gossipMsg{Kind: msgPingReq, Seq: seq, Target: target})
+	}
+	select {
+	case <-ack:
+		return
+	case <-g.quit:
+		return
+	case <-time.After(g.interval - g.timeout):
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if m := g.members[target]; m != nil && m.state == memberAlive {
+		logger.Warnf("Member %s not responding, suspected", target)
+		g.apply(gossipUpdate{Node: target, Weight: m.weight, State: memberSuspect, Incarnation: m.incarnation})
+	}
+}
+
+// reap marks members suspected for long as dead, and forgets members dead for long
+func (g *Gossip) reap() {
+	g.Lock()
+	defer g.Unlock()
+	now := time.Now()
+	for node, m := range g.members {
+		switch {
+		case m.state == memberSuspect && now.Sub(m.changedAt) > g.suspectTimeout:
+			logger.Warnf("Member %s suspected for %v, marked as dead", node, now.Sub(m.changedAt))
+			g.apply(gossipUpdate{Node: node, Weight: m.weight, State: memberDead, Incarnation: m.incarnation})
+		case !m.state.inRing() && now.Sub(m.changedAt) > _MemberForget:
+			delete(g.members, node)
+		}
+	}
+}
+
+func (g *Gossip) nextTarget() string {
+	g.Lock()
+	defer g.Unlock()
+	for ; g.next < len(g.order); g.next++ {
+		if m := g.members[g.order[g.next]]; m != nil && m.state.inRing() {
+			g.next++
+			return m.node
+		}
+	}
+	g.order = g.probeable("")
+	rand.Shuffle(len(g.order), func(i, j int) {
+		g.order[i], g.order[j] = g.order[j], g.order[i]
+	})
+	g.next = 0
+	if len(g.order) == 0 {
+		return ""
+	}
+	g.next = 1
+	return g.order[0]
+}
+
+// probeable lists members alive or suspected other than this node and the one excluded; Lock must be held.
+func (g *Gossip) probeable(exclude string) []string {
+	nodes := make([]string, 0, len(g.members))
+	for node, m := range g.members {
+		if node != g.self && node != exclude && m.state.inRing() {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (g *Gossip) expect() (uint64, chan bool) {
+	seq := atomic.AddUint64(&g.seq, 1)
+	ack := make(chan bool, 1)
+	g.Lock()
+	g.acks[seq] = ack
+	g.Unlock()
+	return seq, ack
+}
+
+func (g *Gossip) forget(seq uint64) {
+	g.Lock()
+	delete(g.acks, seq)
+	g.Unlock()
+}
+
+func (g *Gossip) acked(seq uint64) {
+	g.Lock()
+	ack := g.acks[seq]
+	g.Unlock()
+	if ack != nil {
+		select {
+		case ack <- true:
+		default:
+		}
+	}
+}
+
+
+
+
+func (g *Gossip) receive() {
+	defer g.done.Done()
+	buf := make([]byte, _GossipPacketMax)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-g.quit:
+				return
+			default:
+			}
+			logger.Warnf("Read gossip failed: %v", err.Error())
+			continue
+		}
+		payload, ok := g.open(buf[:n])
+		if !ok {
+			logger.Warnf("Gossip from %s not signed by cluster key", from.String())
+			continue
+		}
+		var msg gossipMsg
+		if e := json.Unmarshal(payload, &msg); e != nil {
+			logger.Warnf("Bad gossip message from %s: %v", from.String(), e.Error())
+			continue
+		}
+		g.handle(&msg, from)
+	}
+}
+
+func (g *Gossip) handle(msg *gossipMsg, from *net.UDPAddr) {
+	g.Lock()
+	for _, u := range msg.Updates {
+		g.apply(u)
+	}
+	g.Unlock()
+
+	switch msg.Kind {
+	case msgPing:
+		g.sendTo(from, msg.From, &gossipMsg{Kind: msgAck, Seq: msg.Seq})
+	case msgAck:
+		g.acked(msg.Seq)
+	case msgPingReq:
+		go g.probeFor(msg, from)
+	case msgJoin:
+		logger.WithFields(logrus.Fields{
+			"member": msg.From,
+		}).Info("Member joining")
+		g.Lock()
+		reply := &gossipMsg{Kind: msgState, Updates: g.allUpdates()}
+		g.Unlock()
+		g.sendTo(from, msg.From, reply)
+	}
+}
+
+// probeFor pings target of ping-req, and acks the sender if target acks in timeout
+func (g *Gossip) probeFor(req *gossipMsg, from *net.UDPAddr) {
+	seq, ack := g.expect()
+	defer g.forget(seq)
+	g.send(req.Target, &gossipMsg{Kind: msgPing, Seq: seq, Target: req.Target})
+	select {
+	case <-ack:
+		g.sendTo(from, req.From, &gossipMsg{Kind: msgAck, Seq: req.Seq})
+	case <-g.quit:
+	case <-time.After(g.timeout):
+	}
+}
+
+
+// apply takes update of member if it's newer than the one known, and spreads it;
+// Suspicion on this node is refuted by a greater incarnation. Lock must be held.
+func (g *Gossip) apply(u gossipUpdate) {
+	if u.Node == g.self {
+		self := g.members[g.self]
+		if self.state == memberLeft {
+			return
+		}
+		if u.Incarnation > g.incarnation || u.State != memberAlive && u.Incarnation == g.incarnation {
+			g.incarnation = u.Incarnation + 1
+			logger.Warnf("Refuting %v of this node with incarnation %d", u.State, g.incarnation)
+			self.incarnation = g.incarnation
+			g.enqueue(gossipUpdate{Node: g.self, Weight: g.weight, State: memberAlive, Incarnation: g.incarnation})
+		}
+		return
+	}
+
+	m := g.members[u.Node]
+	if m == nil {
+		if u.State.inRing() {
+			weight := u.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			g.cl.addMember(u.Node, weight)
+			logger.Infof("Member %s joined with weight %d", u.Node, weight)
+			u.Weight = weight
+		}
+		g.members[u.Node] = &member{
+			node: u.Node,
+			weight: u.Weight,
+			state: u.State,
+			incarnation: u.Incarnation,
+			changedAt: time.Now(),
+		}
+		g.enqueue(u)
+		return
+	}
+
+	newer := false
+	switch u.State {
+	case memberAlive:
+		newer = u.Incarnation > m.incarnation
+	case memberSuspect:
+		newer = u.Incarnation > m.incarnation || u.Incarnation == m.incarnation && m.state == memberAlive
+	default:
+		newer = u.Incarnation >= m.incarnation && m.state.inRing() || u.Incarnation > m.incarnation
+	}
+	if !newer {
+		return
+	}
+
+	switch {
+	case !m.state.inRing() && u.State.inRing():
+		if u.Weight > 0 {
+			m.weight = u.Weight
+		}
+		g.cl.addMember(u.Node, m.weight)
+		logger.Infof("Member %s joined again", u.Node)
+	case m.state.inRing() && !u.State.inRing():
+		g.cl.removeMember(u.Node)
+		logger.Infof("Member %s removed as %v", u.Node, u.State)
+	}
+	m.state = u.State
+	m.incarnation = u.Incarnation
+	m.changedAt = time.Now()
+	u.Weight = m.weight
+	g.enqueue(u)
+}
+
+// enqueue puts update to be piggybacked, replacing the older one of the same member; Lock must be held.
+func (g *Gossip) enqueue(u gossipUpdate) {
+	for _, b := range g.queue {
+		if b.update.Node == u.Node {
+			b.update = u
+			b.transmits = 0
+			return
+		}
+	}
+	g.queue = append(g.queue, &gossipBroadcast{update: u})
+}
+
+// piggyback takes updates transmitted the least, and drops those transmitted enough; Lock must be held.
+func (g *Gossip) piggyback() []gossipUpdate {
+	if len(g.queue) == 0 {
+		return nil
+	}
+	limit := _GossipRetransmit * int(math.Ceil(math.Log10(float64(len(g.members) + 1))))
+	sort.SliceStable(g.queue, func(i, j int) bool {
+		return g.queue[i].transmits < g.queue[j].transmits
+	})
+	n := len(g.queue)
+	if n > _GossipMaxUpdates {
+		n = _GossipMaxUpdates
+	}
+	updates := make([]gossipUpdate, n)
+	for i := 0; i < n; i++ {
+		updates[i] = g.queue[i].update
+		g.queue[i].transmits++
+	}
+	kept := g.queue[:0]
+	for _, b := range g.queue {
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	g.queue = kept
+	return updates
+}
+
+// allUpdates is state of all members known, for joining; Lock must be held.
+func (g *Gossip) allUpdates() []gossipUpdate {
+	updates := make([]gossipUpdate, 0, len(g.members))
+	for _, m := range g.members {
+		updates = append(updates, gossipUpdate{Node: m.node, Weight: m.weight, State: m.state, Incarnation: m.incarnation})
+	}
+	return updates
+}
+
+
+func (g *Gossip) send(node string, msg *gossipMsg) {
+	addr, err := net.ResolveUDPAddr("udp", node)
+	if err != nil {
+		logger.Warnf("Resolve member %s failed: %v", node, err.Error())
+		return
+	}
+	g.sendTo(addr, node, msg)
+}
+
+// sendTo sends message with updates piggybacked, unless it's carrying updates already
+func (g *Gossip) sendTo(addr *net.UDPAddr, node string, msg *gossipMsg) {
+	g.Lock()
+	drop := g.drop != nil && g.drop(node)
+	msg.From = g.self
+	if msg.Updates == nil {
+		msg.Updates = g.piggyback()
+	}
+	g.Unlock()
+	if drop {
+		return
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logger.Errorf("Encode gossip message failed: %v", err.Error())
+		return
+	}
+	if _, e := g.conn.WriteToUDP(g.seal(b), addr); e != nil {
+		logger.Warnf("Send gossip to %s failed: %v", node, e.Error())
+	}
+}
+
+// seal prefixes payload with its HMAC by key of cluster
+func (g *Gossip) seal(payload []byte) []byte {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(payload)
+	return append(mac.Sum(make([]byte, 0, sha256.Size + len(payload))), payload...)
+}
+
+// open returns payload of packet, and false if it's not signed by key of cluster
+func (g *Gossip) open(packet []byte) ([]byte, bool) {
+	if len(packet) < sha256.Size {
+		return nil, false
+	}
+	payload := packet[sha256.Size:]
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(payload)
+	return payload, hmac.Equal(mac.Sum(nil), packet[:sha256.Size])
+}
+
+
+// Members returns members known, sorted by node
+func (g *Gossip) Members() []member {
+	g.Lock()
+	defer g.Unlock()
+	members := make([]member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].node < members[j].node
+	})
+	return members
+}
@@ -0,0 +1,195 @@
+package filerelay
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+// startGossipCluster runs nodes joining by gossip with the first node as seed
+func startGossipCluster(t *testing.T, nodes int) ([]string, []*Server, func()) {
+	seed := ""
+	return startTestCluster(t, nodes, func(c *MemConfig) {
+		if seed == "" {
+			seed = c.Cluster.Node
+		}
+		c.Cluster.Peers = nil
+		c.Cluster.Membership = MembershipGossip
+		c.Cluster.Seeds = []string{seed}
+		c.Cluster.GossipKey = "gossip-secret"
+		c.Cluster.ProbeInterval = 100
+		c.Cluster.ProbeTimeout = 40
+		c.Cluster.SuspectTimeout = 500
+	})
+}
+
+func stateOf(s *Server, node string) (memberState, bool) {
+	for _, m := range s.cluster.gossip.Members() {
+		if m.node == node {
+			return m.state, true
+		}
+	}
+	return 0, false
+}
+
+func waitJoined(t *testing.T, servers []*Server) {
+	waitFor(t, "all nodes joined", func() bool {
+		for _, s := range servers {
+			if s.cluster.ring.Len() != len(servers) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+
+func TestGossip_Join(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startGossipCluster(t, 4)
+	defer stop()
+	waitJoined(t, servers)
+
+	conn, rw := dialTest(t, addrs[3])
+	defer conn.Close()
+	stats := make(map[string]string)
+	for line := command(t, rw, "stats cluster", nil); line != string(ResultEnd); {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("stats cluster: %q", line)
+		}
+		stats[fields[1]] = fields[2]
+		var err error
+		if line, err = rw.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, addr := range addrs {
+		if state := stats[addr + ":state"]; state != "alive" {
+			t.Errorf("member %s in stats as %q", addr, state)
+		}
+	}
+
+	// keys are forwarded to owners joined by gossip
+	v := []byte("joined")
+	for _, key := range []string{"g-1", "g-2", "g-3", "g-4", "g-5", "g-6"} {
+		if resp := command(t, rw, "set " + key + " 0 0 6", v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+		owner, _ := servers[0].cluster.Owner(key)
+		if servers[nodeIndex(addrs, owner)].tenants.Select(key, "").entry.Get(key) == nil {
+			t.Errorf("%s not stored on owner %s", key, owner)
+		}
+	}
+}
+
+func TestGossip_Failure(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startGossipCluster(t, 3)
+	defer stop()
+	waitJoined(t, servers)
+
+	// gossip of the last node stops without leaving
+	servers[2].cluster.gossip.Stop(false)
+	waitFor(t, "failed node removed from ring", func() bool {
+		return servers[0].cluster.ring.Len() == 2 && servers[1].cluster.ring.Len() == 2
+	})
+	for _, s := range servers[:2] {
+		if state, _ := stateOf(s, addrs[2]); state != memberDead {
+			t.Errorf("failed node in state %v", state)
+		}
+		if s.cluster.pool(addrs[2]) != nil {
+			t.Error("pool of failed node kept")
+		}
+	}
+}
+
+func TestGossip_Leave(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startGossipCluster(t, 3)
+	defer stop()
+	waitJoined(t, servers)
+
+	servers[1].cluster.gossip.Stop(true)
+	for _, i := range []int{0, 2} {
+		waitFor(t, "left node removed", func() bool {
+			state, _ := stateOf(servers[i], addrs[1])
+			return state == memberLeft && servers[i].cluster.ring.Len() == 2
+		})
+	}
+}
+
+// TestGossip_IndirectProbe keeps a node unreachable from another one directly, but reachable through the third
+func TestGossip_IndirectProbe(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startGossipCluster(t, 3)
+	defer stop()
+	waitJoined(t, servers)
+
+	cut := func(node string) func(string) bool {
+		return func(to string) bool {
+			return to == node
+		}
+	}
+	for i, j := range []int{2, 0} {
+		g := servers[i * 2].cluster.gossip
+		g.Lock()
+		g.drop = cut(addrs[j])
+		g.Unlock()
+	}
+
+	time.Sleep(time.Millisecond * 1500) //3 times of suspect timeout
+	for _, i := range []int{0, 2} {
+		for _, addr := range addrs {
+			if state, _ := stateOf(servers[i], addr); !state.inRing() {
+				t.Errorf("node %d takes %s as %v", i, addr, state)
+			}
+		}
+		if n := servers[i].cluster.ring.Len(); n != 3 {
+			t.Errorf("%d nodes in ring of node %d", n, i)
+		}
+	}
+}
+
+// TestGossip_Unsigned sends leave of a member forged without key of cluster, or signed by another key
+func TestGossip_Unsigned(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startGossipCluster(t, 3)
+	defer stop()
+	waitJoined(t, servers)
+
+	if _, err := NewCluster(&ClusterConfig{Node: "127.0.0.1:0", Membership: MembershipGossip}); err != ErrGossipKey {
+		t.Errorf("gossip without key: %v", err)
+	}
+
+	payload, err := json.Marshal(&gossipMsg{
+		Kind: msgLeave,
+		From: addrs[1],
+		Updates: []gossipUpdate{{Node: addrs[1], State: memberLeft, Incarnation: 1000}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &Gossip{key: []byte("other-secret")}
+	conn, err := net.Dial("udp", addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, packet := range [][]byte{payload, other.seal(payload)} {
+		if _, e := conn.Write(packet); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 300)
+	if state, _ := stateOf(servers[0], addrs[1]); state != memberAlive {
+		t.Errorf("member taken as %v by unsigned gossip", state)
+	}
+	if n := servers[0].cluster.ring.Len(); n != 3 {
+		t.Errorf("%d nodes in ring", n)
+	}
+}
@@ -0,0 +1,156 @@
+package filerelay
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+const (
+	HandoffRate = 10 * 1024 * 1024 //bytes per second of items handed off
+
+	_HandoffRetry = time.Second * 5 //pass stopped by failure is resumed after it
+)
+
+var (
+	ErrHandoffStopped = errors.New("handoff stopped")
+)
+
+
+// handoffKey is an item to move in a pass of handoff
+type handoffKey struct {
+	tenant *Tenant
+	key string
+}
+
+// Handoff moves items no longer owned by this node to their owners after ring changes, throttled by rate;
+// A pass lists keys not owned at the ring version, and goes through them by cursor, so that it's resumed
+// from where it stopped on failures of owners. A new pass is planned on every ring change, in which items moved
+// are not listed again for they are removed here; Items are stored by add, so that moving an item again
+// after restart of either node never replaces the one stored on owner.
+type Handoff struct {
+	cluster *Cluster //only reference
+	tenants *TenantSet //only reference
+	bucket *tokenBucket
+
+	version uint64 //ring version of the pass
+	keys []handoffKey
+	cursor int
+
+	moved uint64
+	moveFails uint64
+	pending int64
+
+	quit chan bool
+	done sync.WaitGroup
+}
+
+func NewHandoff(cluster *Cluster, tenants *TenantSet, rate int64) *Handoff {
+	return &Handoff{
+		cluster: cluster,
+		tenants: tenants,
+		bucket: newTokenBucket(float64(rate), float64(rate)),
+		quit: make(chan bool),
+	}
+}
+
+func (h *Handoff) Start() {
+	h.done.Add(1)
+	go h.run()
+}
+
+func (h *Handoff) Stop() {
+	close(h.quit)
+	h.done.Wait()
+}
+
+// run plans a pass at start for items left from before, like the ones loaded from disk,
+// and on every ring change
+func (h *Handoff) run() {
+	defer h.done.Done()
+	retry := time.NewTicker(_HandoffRetry)
+	defer retry.Stop()
+
+	h.plan()
+	for {
+		if h.cursor < len(h.keys) {
+			if e := h.pass(); e != nil {
+				logger.Warnf("Handoff stopped at %d of %d items: %v", h.cursor, len(h.keys), e.Error())
+			}
+		}
+		select {
+		case <-h.quit:
+			return
+		case <-h.cluster.changed:
+			h.plan()
+		case <-retry.C:
+		}
+	}
+}
+
+// plan lists keys in all tenants not owned by this node at current ring version
+func (h *Handoff) plan() {
+	h.version = h.cluster.RingVersion()
+	h.keys = h.keys[:0]
+	h.cursor = 0
+	h.tenants.Each(func(t *Tenant) {
+		for _, key := range t.entry.Keys() {
+			if !h.cluster.Holds(key) {
+				h.keys = append(h.keys, handoffKey{tenant: t, key: key})
+			}
+		}
+	})
+	atomic.StoreInt64(&h.pending, int64(len(h.keys)))
+	if len(h.keys) > 0 {
+		logger.Infof("Handoff of %d items planned at ring version %d", len(h.keys), h.version)
+	}
+}
+
+// pass moves items from cursor, and stops on failure or ring change
+func (h *Handoff) pass() error {
+	for ; h.cursor < len(h.keys); h.cursor++ {
+		if h.cluster.RingVersion() != h.version {
+			return nil //planned again
+		}
+		k := h.keys[h.cursor]
+		if e := h.move(k.tenant, k.key); e != nil {
+			atomic.AddUint64(&h.moveFails, 1)
+			return e
+		}
+		atomic.AddInt64(&h.pending, -1)
+	}
+	logger.Infof("Handoff at ring version %d done", h.version)
+	return nil
+}
+
+// move sends the item to all its owners, and removes it here after stored by them
+func (h *Handoff) move(tenant *Tenant, key string) error {
+	t := tenant.entry.Get(key)
+	if t == nil || h.cluster.Holds(key) {
+		return nil
+	}
+	if wait := h.bucket.reserve(float64(t.byteLen)); wait > 0 {
+		select {
+		case <-h.quit:
+			return ErrHandoffStopped
+		case <-time.After(wait):
+		}
+	}
+
+	task := &replicaTask{op: replicaMove, key: key, item: t, exp: absoluteExpiration(t.TTL(time.Now())), tenant: tenant.name}
+	for _, node := range h.cluster.Owners(key) {
+		if e := h.cluster.sendTask(node, task); e != nil {
+			return e
+		}
+	}
+	tenant.entry.RemoveItem(t)
+	atomic.AddUint64(&h.moved, 1)
+	return nil
+}
+
+// Pending is count of items left in current pass
+func (h *Handoff) Pending() int64 {
+	return atomic.LoadInt64(&h.pending)
+}
@@ -0,0 +1,194 @@
+package filerelay
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+// startHandoffCluster runs 3 nodes with the last one out of ring of the others, and stores keys by the first node
+func startHandoffCluster(t *testing.T, keys, size int, fn func(c *MemConfig)) ([]string, []*Server, func()) {
+	addrs, servers, stop := startTestCluster(t, 3, fn)
+	for _, s := range servers[:2] {
+		s.cluster.removeMember(addrs[2])
+	}
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	for i := 0; i < keys; i++ {
+		key := "handoff-" + strconv.Itoa(i)
+		v := stressValue(key, size)
+		if resp := command(t, rw, fmt.Sprintf("set %s %d 300 %d", key, i, len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+	}
+	return addrs, servers, stop
+}
+
+// joinLast puts the last node into ring of the others
+func joinLast(addrs []string, servers []*Server) {
+	for _, s := range servers[:2] {
+		s.cluster.addMember(addrs[2], 1)
+	}
+}
+
+// redirect makes connections of server for replication to the node go to the address
+func redirect(s *Server, node, addr string) {
+	s.cluster.Lock()
+	s.cluster.replicaPools[node] = newPeerPool(addr, s.cluster.cfg, true)
+	s.cluster.Unlock()
+}
+
+func checkHandoff(t *testing.T, addrs []string, servers []*Server, keys, size int) {
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := "handoff-" + strconv.Itoa(i)
+		owner, _ := servers[0].cluster.Owner(key)
+		nodes := holders(servers, key)
+		if len(nodes) != 1 || addrs[nodes[0]] != owner {
+			t.Fatalf("%s on nodes %v, expect owner %s", key, nodes, owner)
+		}
+		if owner != addrs[2] {
+			continue
+		}
+		moved++
+		item := servers[2].tenants.Select(key, "").entry.Get(key)
+		if item.flags != uint32(i) {
+			t.Errorf("flags of %s: %d", key, item.flags)
+		}
+		if ttl := item.TTL(time.Now()); ttl < 200 || ttl > 300 {
+			t.Errorf("ttl of %s: %d", key, ttl)
+		}
+		v, ok := item.Pin()
+		if !ok || !bytes.Equal(bytes.Join(v.data, nil), stressValue(key, size)) {
+			t.Errorf("value of %s broken", key)
+		}
+		v.Unpin()
+	}
+	if moved == 0 {
+		t.Error("no key moved to the node joined")
+	}
+}
+
+
+func TestHandoff_Join(t *testing.T) {
+	defer quietLogs()()
+	const keys, size = 40, 5000
+	addrs, servers, stop := startHandoffCluster(t, keys, size, nil)
+	defer stop()
+
+	joinLast(addrs, servers)
+	waitFor(t, "handoff", func() bool {
+		return servers[0].cluster.handoff.Pending() == 0 && servers[1].cluster.handoff.Pending() == 0 &&
+			servers[2].tenants.Select("", "").entry.Len() > 0
+	})
+	checkHandoff(t, addrs, servers, keys, size)
+}
+
+func TestHandoff_Resume(t *testing.T) {
+	defer quietLogs()()
+	const keys, size = 40, 5000
+	addrs, servers, stop := startHandoffCluster(t, keys, size, func(c *MemConfig) {
+		c.Cluster.Timeout = 1
+	})
+	defer stop()
+
+	// the new node is not reachable at first
+	joinLast(addrs, servers)
+	for _, s := range servers[:2] {
+		redirect(s, addrs[2], "127.0.0.1:1")
+	}
+	waitFor(t, "handoff failure", func() bool {
+		return atomic.LoadUint64(&servers[0].cluster.handoff.moveFails) > 0
+	})
+	if n := servers[2].tenants.Select("", "").entry.Len(); n != 0 {
+		t.Fatalf("%d items moved to node unreachable", n)
+	}
+
+	for _, s := range servers[:2] {
+		redirect(s, addrs[2], addrs[2])
+	}
+	deadline := time.Now().Add(_HandoffRetry * 2)
+	for servers[0].cluster.handoff.Pending() != 0 || servers[1].cluster.handoff.Pending() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handoff not resumed")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	checkHandoff(t, addrs, servers, keys, size)
+}
+
+func TestHandoff_Throttle(t *testing.T) {
+	defer quietLogs()()
+	const keys, size, rate = 40, 20000, 40000
+	addrs, servers, stop := startHandoffCluster(t, keys, size, func(c *MemConfig) {
+		c.Cluster.HandoffRate = rate
+	})
+	defer stop()
+
+	start := time.Now()
+	joinLast(addrs, servers)
+	deadline := start.Add(time.Second * 10)
+	for servers[0].cluster.handoff.Pending() != 0 || servers[1].cluster.handoff.Pending() != 0 ||
+		servers[2].tenants.Select("", "").entry.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handoff not done")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	// every node moves its items by its own rate, with the first second of rate taken at once
+	elapsed := time.Since(start)
+	for _, s := range servers[:2] {
+		moved := s.cluster.handoff.moved
+		if min := time.Duration(float64(moved * size - rate) / rate * float64(time.Second)); elapsed < min {
+			t.Errorf("%d items of %d bytes moved in %v, faster than rate", moved, size, elapsed)
+		}
+	}
+	if elapsed < time.Second {
+		t.Errorf("handoff done in %v, faster than rate", elapsed)
+	}
+	checkHandoff(t, addrs, servers, keys, size)
+}
+
+func TestHandoff_Tenant(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startTestCluster(t, 3, clusterAuth(t))
+	defer stop()
+	for _, s := range servers[:2] {
+		s.cluster.removeMember(addrs[2])
+	}
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	if resp := command(t, rw, "auth alice secret", nil); resp != string(ResultOK) {
+		t.Fatalf("auth: %q", resp)
+	}
+	const keys = 20
+	for i := 0; i < keys; i++ {
+		key := "team-" + strconv.Itoa(i)
+		if resp := command(t, rw, "set " + key + " 0 300 4", []byte("team")); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+	}
+
+	// items are moved into tenant they are in
+	joinLast(addrs, servers)
+	moved := servers[2].tenants.Get("team").entry
+	waitFor(t, "handoff", func() bool {
+		return servers[0].cluster.handoff.Pending() == 0 && servers[1].cluster.handoff.Pending() == 0 &&
+			moved.Len() > 0
+	})
+	for i := 0; i < keys; i++ {
+		key := "team-" + strconv.Itoa(i)
+		if owner, _ := servers[0].cluster.Owner(key); owner == addrs[2] && moved.Get(key) == nil {
+			t.Errorf("%s not moved into tenant", key)
+		}
+	}
+	if n := servers[2].tenants.Select("", "").entry.Len(); n != 0 {
+		t.Errorf("%d items moved out of tenant", n)
+	}
+}
@@ -0,0 +1,197 @@
+package filerelay
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+
+const (
+	ItemShards = 16
+)
+
+
+// ItemsEntry keeps items of a tenant in shards by hash of keys, to lower contention on lock;
+// Each shard evicts and expires its own items.
+type ItemsEntry struct {
+	shards []*itemsShard
+	cursor uint32 //shard to start with in evicting for room
+	quit chan bool
+}
+
+// NewItemsEntry creates entry with a shard for each of the policies
+func NewItemsEntry(policies []EvictionPolicy, expireBatch int) *ItemsEntry {
+	if expireBatch <= 0 {
+		expireBatch = ExpireBatch
+	}
+	e := &ItemsEntry{
+		shards: make([]*itemsShard, len(policies)),
+		quit: make(chan bool, 1),
+	}
+	for i, p := range policies {
+		e.shards[i] = newItemsShard(p, expireBatch)
+	}
+	return e
+}
+
+func (e *ItemsEntry) shard(key string) *itemsShard {
+	if len(e.shards) == 1 {
+		return e.shards[0]
+	}
+	return e.shards[keyHash(key) % uint32(len(e.shards))]
+}
+
+// keyHash is fnv-1a of key
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// eachShard walks shards in turn from the cursor, until fn returns true
+func (e *ItemsEntry) eachShard(fn func(s *itemsShard) bool) bool {
+	n := uint32(len(e.shards))
+	start := atomic.AddUint32(&e.cursor, 1)
+	for i := uint32(0); i < n; i++ {
+		if fn(e.shards[(start + i) % n]) {
+			return true
+		}
+	}
+	return false
+}
+
+
+func (e *ItemsEntry) StartCheck() {
+	go func() {
+		t := time.NewTicker(time.Second)
+		for {
+			select {
+			case now := <-t.C:
+				e.Expire(now)
+			case <- e.quit:
+				t.Stop()
+				logger.Info("Quit ItemsEntry")
+				return
+			}
+		}
+	}()
+}
+
+func (e *ItemsEntry) StopCheck() {
+	e.quit <- true
+}
+
+// Expire removes items expired at the time in every shard, and returns the count
+func (e *ItemsEntry) Expire(now time.Time) (n int) {
+	for _, s := range e.shards {
+		n += s.Expire(now)
+	}
+	return
+}
+
+
+func (e *ItemsEntry) Get(key string) *MetaItem {
+	return e.shard(key).Get(key)
+}
+
+func (e *ItemsEntry) Touch(key string, exp int64) *MetaItem {
+	return e.shard(key).Touch(key, exp)
+}
+
+func (e *ItemsEntry) Remove(key string) *MetaItem {
+	return e.shard(key).Remove(key)
+}
+
+// RemoveItem removes the item only if it's still the one of its key
+func (e *ItemsEntry) RemoveItem(t *MetaItem) bool {
+	return e.shard(t.key).RemoveItem(t)
+}
+
+// spillItem moves item stored without slots to disk at the location
+func (e *ItemsEntry) spillItem(t *MetaItem, ref *spillRef) bool {
+	return e.shard(t.key).spillItem(t, ref)
+}
+
+// Keys lists keys of all items, shard by shard
+func (e *ItemsEntry) Keys() []string {
+	keys := make([]string, 0, e.Len())
+	for _, s := range e.shards {
+		keys = s.appendKeys(keys)
+	}
+	return keys
+}
+
+func (e *ItemsEntry) Set(t *MetaItem) error {
+	return e.shard(t.key).Set(t)
+}
+
+func (e *ItemsEntry) Add(t *MetaItem) error {
+	return e.shard(t.key).Add(t)
+}
+
+func (e *ItemsEntry) Replace(t *MetaItem) error {
+	return e.shard(t.key).Replace(t)
+}
+
+func (e *ItemsEntry) CompareAndSwap(t *MetaItem, casId uint64) error {
+	return e.shard(t.key).CompareAndSwap(t, casId)
+}
+
+// Flush removes all items in every shard, and returns the count
+func (e *ItemsEntry) Flush() (n int) {
+	for _, s := range e.shards {
+		n += s.Flush()
+	}
+	return
+}
+
+// EvictOldest removes an item chosen by eviction policy of a shard and clears its slots, except the skipped key;
+// Shards are taken in turn, so that evictions spread over them.
+func (e *ItemsEntry) EvictOldest(skip string) (t *MetaItem) {
+	e.eachShard(func(s *itemsShard) bool {
+		t = s.EvictOldest(skip)
+		return t != nil
+	})
+	return
+}
+
+// EvictInClass evicts an item holding slots of the capacity class, for item of skipped key
+func (e *ItemsEntry) EvictInClass(slotCap uint64, skip string) (t *MetaItem) {
+	e.eachShard(func(s *itemsShard) bool {
+		t = s.EvictInClass(slotCap, skip)
+		return t != nil
+	})
+	return
+}
+
+func (e *ItemsEntry) Len() (n int) {
+	for _, s := range e.shards {
+		n += s.Len()
+	}
+	return
+}
+
+// Spilled is the count of items on disk
+func (e *ItemsEntry) Spilled() (n int) {
+	for _, s := range e.shards {
+		n += s.Spilled()
+	}
+	return
+}
+
+// Expirations is the count of items removed by expiration checks
+func (e *ItemsEntry) Expirations() (n uint64) {
+	for _, s := range e.shards {
+		n += atomic.LoadUint64(&s.expirations)
+	}
+	return
+}
+
+// Evictions is the count of items evicted for exceeding size of entry
+func (e *ItemsEntry) Evictions() (n uint64) {
+	for _, s := range e.shards {
+		n += atomic.LoadUint64(&s.evictions)
+	}
+	return
+}
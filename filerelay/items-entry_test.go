@@ -0,0 +1,135 @@
+package filerelay
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests here are meant to run with -race:
+//   go test -race ./filerelay -run ItemsEntry
+
+
+func newShardedEntry(policy string, size, shards int) *ItemsEntry {
+	policies := make([]EvictionPolicy, shards)
+	for i := range policies {
+		policies[i], _ = NewEvictionPolicy(policy, size / shards)
+	}
+	return NewItemsEntry(policies, ExpireBatch)
+}
+
+
+func TestItemsEntry_Shards(t *testing.T) {
+	entry := newShardedEntry(EvictionLRU, 1600, 16)
+	for i := 0; i < 1600; i++ {
+		_ = entry.Set(voidMetaItem("shard-" + strconv.Itoa(i)))
+	}
+	for i, s := range entry.shards {
+		if n := s.Len(); n == 0 || n > 100 {
+			t.Errorf("unexpected count of items in shard %d: %d", i, n)
+		}
+	}
+	if entry.Len() + int(entry.Evictions()) != 1600 {
+		t.Errorf("items lost: %d in entry, %d evicted", entry.Len(), entry.Evictions())
+	}
+	for i := 0; i < 1600; i++ {
+		key := "shard-" + strconv.Itoa(i)
+		if got := entry.Get(key); got != nil && got.key != key {
+			t.Errorf("got item %s for key %s", got.key, key)
+		}
+	}
+}
+
+func TestItemsEntry_Concurrent(t *testing.T) {
+	for _, policy := range evictionPolicies {
+		entry := newShardedEntry(policy, 512, 8)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < 5000; i++ {
+					key := "race-" + strconv.Itoa(r.Intn(1000))
+					switch r.Intn(10) {
+					case 0:
+						_ = entry.Remove(key)
+					case 1:
+						_ = entry.Add(NewMetaItem(key, 0, 1, 0))
+					case 2:
+						_ = entry.Replace(NewMetaItem(key, 0, 600, 0))
+					case 3:
+						_ = entry.EvictOldest("")
+					case 4, 5:
+						_ = entry.Set(NewMetaItem(key, 0, int64(r.Intn(3)), 0))
+					default:
+						_ = entry.Get(key)
+					}
+				}
+			}(int64(g))
+		}
+
+		// expiration checks and stats run along with commands
+		done, stopped := make(chan bool), make(chan bool)
+		go func() {
+			defer close(stopped)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					entry.Expire(time.Now().Add(time.Second))
+					_ = entry.Len()
+					_ = entry.Evictions()
+				}
+			}
+		}()
+		wg.Wait()
+		close(done)
+		<-stopped
+
+		if n := entry.Len(); n > 512 {
+			t.Errorf("%s: %d items over size of entry", policy, n)
+		}
+		for i, s := range entry.shards {
+			if s.Len() != len(s.expiry) {
+				t.Errorf("%s: shard %d has %d items but %d queued for expiration", policy, i, s.Len(), len(s.expiry))
+			}
+		}
+	}
+}
+
+
+func benchmarkItemsEntry(b *testing.B, shards int) {
+	entry := newShardedEntry(EvictionLRU, 100000, shards)
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "bench-" + strconv.Itoa(i)
+		_ = entry.Set(NewMetaItem(keys[i], 0, 600, 0))
+	}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			key := keys[r.Intn(len(keys))]
+			if r.Intn(10) == 0 {
+				_ = entry.Set(NewMetaItem(key, 0, 600, 0))
+			} else {
+				_ = entry.Get(key)
+			}
+		}
+	})
+}
+
+// Compare scaling with GOMAXPROCS by:
+//   go test ./filerelay -run none -bench ItemsEntry_Parallel -cpu 1,2,4,8
+func BenchmarkItemsEntry_Parallel(b *testing.B) {
+	for _, shards := range []int{1, ItemShards} {
+		b.Run("shards-" + strconv.Itoa(shards), func(b *testing.B) {
+			benchmarkItemsEntry(b, shards)
+		})
+	}
+}
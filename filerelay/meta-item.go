@@ -4,26 +4,43 @@ import (
 	linkedlist "container/list"
 	"errors"
 	"fmt"
-	"math"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
+)
+
 
-	//"github.com/sirupsen/logrus"
-	"github.com/huandu/skiplist"
+const (
+	CASNodeBits = 10 //low bits of cas unique for id of node, so that ids never collide across nodes
+	CASNodeMax = 1 << CASNodeBits - 1
 )
 
+var (
+	ErrItemNotFound = errors.New("key not exists")
+	ErrCASConflict = errors.New("cas unique changed")
+)
 
 var (
-	_GlobalCASUnique uint64
+	// seeded by time in microseconds, so that ids keep growing over restarts of node
+	_GlobalCASUnique = uint64(time.Now().UnixNano() / 1000)
+	_CASNodeId uint64
 )
 
 
+// incCASUnique returns the next cas unique, which is made of a counter and id of node
 func incCASUnique() uint64 {
-	if _GlobalCASUnique == math.MaxUint64 {
-		_GlobalCASUnique = 0
+	for {
+		id := atomic.AddUint64(&_GlobalCASUnique, 1) << CASNodeBits | atomic.LoadUint64(&_CASNodeId)
+		if id != 0 { //wrapped around
+			return id
+		}
 	}
-	_GlobalCASUnique++
-	return _GlobalCASUnique
+}
+
+// setCASNode sets id of node in cas unique, in 0 .. CASNodeMax
+func setCASNode(id uint64) {
+	atomic.StoreUint64(&_CASNodeId, id & CASNodeMax)
 }
 
 
@@ -36,6 +53,16 @@ type MetaItem struct {
 	duration time.Duration
 	byteLen uint64
 	slots []*Slot
+	gens []uint64 //generations of slots when taken for item
+	disk *spillRef //location of value on disk when item is spilled, instead of slots; changed also with lock of shard
+	spilling *pinnedValue //value pinned at eviction, to be spilled after lock of shard released; only by the evicting routine
+
+	tenant *Tenant //to give back storage share when slots cleared
+	expireAt time.Time
+	queueIndex int //index in expiry queue; -1 when not queued
+
+	// guards setAt, duration, slots, gens and disk, which are changed while item is found by others
+	sync.Mutex
 }
 
 func NewMetaItem(key string, flags uint32, expiration int64, byteLen uint64) (t *MetaItem) {
@@ -45,6 +72,7 @@ func NewMetaItem(key string, flags uint32, expiration int64, byteLen uint64) (t
 		setAt: time.Now(),
 		byteLen: byteLen,
 		//slots: make([]*Slot),
+		queueIndex: -1,
 	}
 	secs := fmt.Sprintf("%ds", expiration)
 	t.duration, _ = time.ParseDuration(secs)
@@ -55,21 +83,249 @@ func voidMetaItem(key string) *MetaItem {
 	return &MetaItem{
 		key: key,
 		setAt: time.Now(),
+		queueIndex: -1,
 	}
 }
 
+// held returns slots of item with their generations, and location of value on disk
+func (t *MetaItem) held() ([]*Slot, []uint64, *spillRef) {
+	t.Lock()
+	defer t.Unlock()
+	return t.slots, t.gens, t.disk
+}
+
+func (t *MetaItem) setDisk(ref *spillRef) {
+	t.Lock()
+	t.disk = ref
+	t.Unlock()
+}
+
 func (t *MetaItem) ClearSlots() {
-	for _, s := range t.slots {
-		s.Clear()
-	}
+	t.Lock()
+	slots, gens := t.slots, t.gens
 	t.slots = make([]*Slot, 0, 0)
+	t.gens = nil
+	t.Unlock()
+
+	if t.tenant != nil && len(slots) > 0 {
+		t.tenant.release(slotsCap(slots))
+	}
+	for i, s := range slots {
+		// slot taken for others since then is left alone
+		s.Release(gens[i])
+	}
+}
+
+// assignCAS gives item a new cas unique, unless it's stored with the one of its primary node in cluster
+func (t *MetaItem) assignCAS() {
+	if t.casId == 0 {
+		t.casId = incCASUnique()
+	}
+}
+
+// takeSlots adds slots taken for item, with their generations
+func (t *MetaItem) takeSlots(slots []*Slot) {
+	t.Lock()
+	defer t.Unlock()
+	for _, s := range slots {
+		t.slots = append(t.slots, s)
+		t.gens = append(t.gens, s.Gen())
+	}
+}
+
+// evict clears slots of item evicted for room, and records the eviction in groups of slots;
+// The value is pinned first if disk tier is enabled, and spilled by shard after its lock released.
+func (t *MetaItem) evict() {
+	t.pinForSpill()
+	slots, _, _ := t.held()
+	for _, s := range slots {
+		s.Evicted()
+	}
+	t.ClearSlots()
+}
+
+// SlotsCap is the sum of capacity of slots held by item
+func (t *MetaItem) SlotsCap() uint64 {
+	slots, _, _ := t.held()
+	return slotsCap(slots)
+}
+
+func slotsCap(slots []*Slot) (cap uint64) {
+	for _, s := range slots {
+		cap += s.Cap()
+	}
+	return
+}
+
+// Pin pins slots of item for reading, and returns the value in them if data of item is intact;
+// Slots are unpinned at once if any of them has been taken for others, or not filled up.
+// For item spilled, segment of its value on disk is pinned instead.
+func (t *MetaItem) Pin() (*pinnedValue, bool) {
+	slots, gens, disk := t.held()
+	if disk != nil {
+		return disk.pin()
+	}
+	p := &pinnedValue{
+		slots: slots,
+		gens: gens,
+		data: make([][]byte, 0, len(slots)),
+	}
+	var size uint64
+	for i, s := range p.slots {
+		data, ok := s.Pin(p.gens[i])
+		if !ok {
+			p.slots = p.slots[:i]
+			p.Unpin()
+			return nil, false
+		}
+		p.data = append(p.data, data)
+		size += uint64(len(data))
+	}
+	if size != t.byteLen {
+		p.Unpin()
+		return nil, false
+	}
+	return p, true
+}
+
+
+// pinnedValue is value of item in pinned slots, captured with generations of slots, or on disk
+type pinnedValue struct {
+	slots []*Slot
+	gens []uint64
+	data [][]byte
+	disk *spillRef
+}
+
+func (p *pinnedValue) Unpin() {
+	if p == nil {
+		return
+	}
+	if p.disk != nil {
+		p.disk.unpin()
+		p.disk = nil
+	}
+	for _, s := range p.slots {
+		s.Unpin()
+	}
+	p.slots = nil
+}
+
+// Changed tells whether any slot has been taken for another generation since pinned
+func (p *pinnedValue) Changed() bool {
+	for i, s := range p.slots {
+		if s.Gen() != p.gens[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader reads value through data of slots without copying it, or from disk
+func (p *pinnedValue) Reader() *valueReader {
+	if p.disk != nil {
+		return &valueReader{at: p.disk.reader(), size: p.disk.size}
+	}
+	r := &valueReader{data: p.data}
+	for _, data := range p.data {
+		r.size += int64(len(data))
+	}
+	return r
+}
+
+
+// valueReader reads data of slots as one value; It's also io.ReaderAt and io.Seeker,
+// for value to be read again or in parts.
+type valueReader struct {
+	data [][]byte
+	at io.ReaderAt //value on disk
+	size int64
+	off int64
+}
+
+func (r *valueReader) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if r.at != nil {
+		return r.at.ReadAt(b, off)
+	}
+	n := 0
+	for _, data := range r.data {
+		if off >= int64(len(data)) {
+			off -= int64(len(data))
+			continue
+		}
+		c := copy(b[n:], data[off:])
+		n += c
+		off = 0
+		if n == len(b) {
+			return n, nil
+		}
+	}
+	return n, io.EOF
+}
+
+func (r *valueReader) Read(b []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	n, _ := r.ReadAt(b, r.off)
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *valueReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// lifetime is the time item is set at and its duration
+func (t *MetaItem) lifetime() (time.Time, time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	return t.setAt, t.duration
+}
+
+// Deadline is the time item expires at
+func (t *MetaItem) Deadline() time.Time {
+	setAt, duration := t.lifetime()
+	return setAt.Add(duration)
+}
+
+// touch sets expiration of item as seconds from now, and returns the time it expires at
+func (t *MetaItem) touch(exp int64) time.Time {
+	t.Lock()
+	defer t.Unlock()
+	t.setAt = time.Now()
+	t.duration = time.Duration(exp) * time.Second
+	return t.setAt.Add(t.duration)
+}
+
+// TTL is the remaining seconds before expiration
+func (t *MetaItem) TTL(now time.Time) int64 {
+	left := t.Deadline().Sub(now)
+	if left <= 0 {
+		return 0
+	}
+	return int64((left + time.Second - 1) / time.Second)
 }
 
 func (t *MetaItem) Expired() bool {
 	now := time.Now()
-	diff := now.Sub(t.setAt)
-	metaTrace.Logf(" - check item expiration -> setAt: %v | now: %v | diff: %v", t.setAt, now, diff)
-	return diff > t.duration
+	setAt, duration := t.lifetime()
+	diff := now.Sub(setAt)
+	metaTrace.Logf(" - check item expiration -> setAt: %v | now: %v | diff: %v", setAt, now, diff)
+	return diff > duration
 }
 
 
@@ -78,14 +334,14 @@ func (t *MetaItem) Expired() bool {
 type LRU struct {
 	size int
 	queue *linkedlist.List
-	lookup *skiplist.SkipList
+	lookup map[string]*linkedlist.Element
 }
 
 func NewLRU(size int) *LRU {
 	return &LRU{
 		size: size,
 		queue: linkedlist.New(),
-		lookup: skiplist.New(skiplist.String),
+		lookup: make(map[string]*linkedlist.Element),
 	}
 }
 
@@ -93,9 +349,10 @@ func (c *LRU) removeOldest(clear bool) (t *MetaItem) {
 	if e := c.queue.Back(); e != nil {
 		t = e.Value.(*MetaItem)
 		c.queue.Remove(e)
+		delete(c.lookup, t.key)
 
 		if clear == true {
-			t.ClearSlots()
+			t.evict()
 		}
 	}
 	return
@@ -112,8 +369,8 @@ func (c *LRU) removeElement(elem *linkedlist.Element, clear bool) *MetaItem {
 }
 
 func (c *LRU) Remove(key string) *MetaItem {
-	if el := c.lookup.Remove(key); el != nil {
-		elem := el.Value.(*linkedlist.Element)
+	if elem, ok := c.lookup[key]; ok {
+		delete(c.lookup, key)
 		return c.removeElement(elem, true)
 	}
 	return nil
@@ -121,59 +378,46 @@ func (c *LRU) Remove(key string) *MetaItem {
 
 func (c *LRU) Purge() {
 	c.queue.Init()
-	c.lookup.Init()
+	c.lookup = make(map[string]*linkedlist.Element)
 }
 
 func (c *LRU) Len() int {
-	return c.lookup.Len()
+	return len(c.lookup)
 }
 
-func (c *LRU) Add(t *MetaItem, noReplace bool) (elem *linkedlist.Element, exceed bool, err error) {
+func (c *LRU) Add(t *MetaItem, noReplace bool) (evicted *MetaItem, err error) {
 	// Check for existing item
 	//metaTrace.Logf("*** -==- **** Going check key for adding into LRU: %s, noReplace: %v", t.key, noReplace)
-	if el := c.lookup.Get(t.key); el != nil {
+	if elem, ok := c.lookup[t.key]; ok {
 		metaTrace.Logf(" *** Found key %s, noReplace: %v", t.key, noReplace)
 		if noReplace {
-			err = errors.New("key already exists: " + t.key)
+			err = errKeyExists(t.key)
 			return
 		}
-		elem = el.Value.(*linkedlist.Element)
 		c.queue.MoveToFront(elem)
-		t.casId = incCASUnique()
-		elem.Value = t
+		replaceValue(elem, t)
 		return
 	}
 
-	t.casId = incCASUnique()
-	elem = c.queue.PushFront(t)
-	if el := c.lookup.Set(t.key, elem); el == nil {
-		err = errors.New("failed to add item into skip-list")
-		return
-	}
+	c.lookup[t.key] = c.queue.PushFront(t)
 
-	if exceed = c.queue.Len() > c.size; exceed {
-		t2 := c.removeOldest(true)
-		if t2 != nil {
-			c.lookup.Remove(t2.key)
-		}
+	if c.queue.Len() > c.size {
+		evicted = c.removeOldest(true)
 	}
 	return
 }
 
-func (c *LRU) Replace(t *MetaItem) *linkedlist.Element {
-	if el := c.lookup.Get(t.key); el != nil {
-		elem := el.Value.(*linkedlist.Element)
+func (c *LRU) Replace(t *MetaItem) bool {
+	if elem, ok := c.lookup[t.key]; ok {
 		c.queue.MoveToFront(elem)
-		t.casId = incCASUnique()
-		elem.Value = t
-		return elem
+		replaceValue(elem, t)
+		return true
 	}
-	return nil
+	return false
 }
 
 func (c *LRU) Get(key string) *MetaItem {
-	if el := c.lookup.Get(key); el != nil {
-		elem := el.Value.(*linkedlist.Element)
+	if elem, ok := c.lookup[key]; ok {
 		c.queue.MoveToFront(elem)
 		return elem.Value.(*MetaItem)
 	}
@@ -187,180 +431,489 @@ func (c *LRU) GetOldest() *MetaItem {
 	return nil
 }
 
+func (c *LRU) victims(fn func(t *MetaItem) bool) {
+	for elem := c.queue.Back(); elem != nil; elem = elem.Prev() {
+		if !fn(elem.Value.(*MetaItem)) {
+			return
+		}
+	}
+}
+
 // Peek returns the key value without updating recently-used-ness
 func (c *LRU) Peek(key string) *MetaItem {
-	if el := c.lookup.Get(key); el != nil {
-		elem := el.Value.(*linkedlist.Element)
+	if elem, ok := c.lookup[key]; ok {
 		return elem.Value.(*MetaItem)
 	}
 	return nil
 }
 
 func (c *LRU) Contains(key string) bool {
-	if el := c.lookup.Get(key); el != nil {
-		return true
-	}
-	return false
+	_, ok := c.lookup[key]
+	return ok
 }
 
 
 
 
-//
-type ItemsEntry struct {
-	lru *LRU
-	checkpoint *skiplist.Element
-	checkAt time.Time
-	checkSteps int
-	quit chan bool
+// itemsShard is a partition of items in ItemsEntry, with its own lock, eviction policy and expiry queue
+type itemsShard struct {
+	policy EvictionPolicy
+	expiry expiryQueue //items in order of expiration
+	expireBatch int //max items to expire in every check
+	evictions uint64
+	expirations uint64
+	spilled map[string]*MetaItem //items on disk, out of eviction policy
+	evicting map[string]*MetaItem //items evicted with value being spilled, dropped once the key is stored or removed
 	sync.Mutex
 }
 
-func NewItemsEntry(lruSize, checkSteps int) *ItemsEntry {
-	return &ItemsEntry{
-		lru: NewLRU(lruSize),
-		checkSteps: checkSteps,
-		quit: make(chan bool, 1),
+func newItemsShard(policy EvictionPolicy, expireBatch int) *itemsShard {
+	return &itemsShard{
+		policy: policy,
+		spilled: make(map[string]*MetaItem),
+		evicting: make(map[string]*MetaItem),
+		expiry: make(expiryQueue, 0),
+		expireBatch: expireBatch,
 	}
 }
 
+// Expire removes items expired at the time, and frees their slots;
+// At most expireBatch items are removed in one check, and the rest are left to next check.
+func (e *itemsShard) Expire(now time.Time) (n int) {
+	e.Lock()
+	defer e.Unlock()
 
-func (e *ItemsEntry) StartCheck() {
-	go func() {
-		t := time.NewTicker(time.Second * 60)
-		for {
-			select {
-			case <-t.C:
-				e.ScheduledCheck()
-			case <- e.quit:
-				t.Stop()
-				logger.Info("Quit ItemsEntry")
-				return
-			}
+	for n < e.expireBatch {
+		t := e.expiry.popExpired(now)
+		if t == nil {
+			break
+		}
+		metaTrace.Logf("ItemsEntry expire key: %s; expired at: %v", t.key, t.expireAt)
+		if e.policy.Peek(t.key) == t {
+			_ = e.policy.Remove(t.key)
+		} else if e.spilled[t.key] == t {
+			delete(e.spilled, t.key)
+			t.disk.release()
 		}
-	}()
+		n++
+	}
+	if n > 0 {
+		atomic.AddUint64(&e.expirations, uint64(n))
+	}
+	return
+}
+
+
+// remove takes item out of policy or disk, and out of expiry queue; it must be called with lock
+func (e *itemsShard) remove(key string) *MetaItem {
+	t := e.policy.Remove(key)
+	if d := e.removeSpilled(key); t == nil {
+		t = d
+	}
+	delete(e.evicting, key)
+	e.expiry.unschedule(t)
+	return t
+}
+
+// removeSpilled takes item on disk out of shard, and frees its space; it must be called with lock
+func (e *itemsShard) removeSpilled(key string) *MetaItem {
+	t := e.spilled[key]
+	if t == nil {
+		return nil
+	}
+	delete(e.spilled, key)
+	e.expiry.unschedule(t)
+	t.disk.release()
+	return t
+}
+
+// getSpilled returns item on disk, removing it if it's expired; it must be called with lock
+func (e *itemsShard) getSpilled(key string) *MetaItem {
+	t := e.spilled[key]
+	if t != nil && t.Expired() {
+		_ = e.removeSpilled(key)
+		return nil
+	}
+	return t
 }
 
-func (e *ItemsEntry) StopCheck() {
-	e.quit <- true
+// keepSpilled keeps item out of policy on disk until it expires; it must be called with lock
+func (e *itemsShard) keepSpilled(t *MetaItem) {
+	if old := e.spilled[t.key]; old != nil && old != t {
+		_ = e.removeSpilled(t.key)
+	}
+	delete(e.evicting, t.key)
+	e.spilled[t.key] = t
+	e.expiry.schedule(t)
+}
+
+// detached takes item evicted out of expiry queue, and holds it while its value pinned is spilled;
+// it must be called with lock
+func (e *itemsShard) detached(t *MetaItem) {
+	e.expiry.unschedule(t)
+	if t.spilling != nil {
+		e.evicting[t.key] = t
+	}
 }
 
-func (e *ItemsEntry) ScheduledCheck() {
-	listLen := e.lru.Len()
-	if listLen == 0 {
+// evicted detaches item evicted by policy, and counts the eviction; it must be called with lock
+func (e *itemsShard) evicted(t *MetaItem) {
+	if t == nil {
 		return
 	}
+	e.detached(t)
+	atomic.AddUint64(&e.evictions, 1)
+}
 
-	if e.checkpoint == nil {
-		e.checkpoint = e.lru.lookup.Front()
+// spillEvicted writes value of item evicted to disk after lock released, and keeps the item on disk
+// unless its key has been stored or removed since then
+func (e *itemsShard) spillEvicted(t *MetaItem) {
+	if t == nil || t.spilling == nil {
+		return
 	}
+	ref := t.spill()
 
 	e.Lock()
 	defer e.Unlock()
+	current := e.evicting[t.key] == t
+	if current {
+		delete(e.evicting, t.key)
+	}
+	if ref == nil {
+		return
+	}
+	if !current {
+		ref.release()
+		return
+	}
+	t.setDisk(ref)
+	e.keepSpilled(t)
+}
 
-	steps := e.checkSteps
-	if listLen < steps {
-		metaTrace.Log("ItemsEntry len: ", listLen)
-		steps = listLen
+// stored queues item added into policy, in place of the replaced one; it must be called with lock
+func (e *itemsShard) stored(t, old *MetaItem, evicted *MetaItem) {
+	if old != t {
+		e.expiry.unschedule(old)
 	}
+	delete(e.evicting, t.key)
+	e.evicted(evicted)
+	if evicted != t {
+		e.expiry.schedule(t)
+	}
+}
 
-	for {
-		next := e.checkpoint.Next()
-		if next == nil {
-			next = e.lru.lookup.Front()
-		}
 
-		elem := e.checkpoint.Value.(*linkedlist.Element)
-		if elem != nil {
-			item := elem.Value.(*MetaItem)
-			metaTrace.Logf("ItemsEntry check steps: %d; key: %s", steps, item.key)
+func (e *itemsShard) Get(key string) *MetaItem {
+	e.Lock()
+	defer e.Unlock()
 
-			if item != nil && item.Expired() {
-				_ = e.lru.Remove(item.key)
-			}
-		}
+	t := e.policy.Get(key)
+	if t == nil {
+		return e.getSpilled(key)
+	}
+	if t.Expired() {
+		_ = e.remove(key)
+		return nil
+	}
+	return t
+}
 
-		e.checkpoint = next
-		steps--
-		if steps == 0 {
-			e.checkAt = time.Now()
-			return
-		}
+
+// Touch sets expiration of item as seconds from now
+func (e *itemsShard) Touch(key string, exp int64) *MetaItem {
+	e.Lock()
+	defer e.Unlock()
+
+	t := e.policy.Get(key)
+	if t == nil {
+		t = e.getSpilled(key)
+	} else if t.Expired() {
+		_ = e.remove(key)
+		return nil
+	}
+	if t == nil {
+		return nil
+	}
+	expireAt := t.touch(exp)
+	slots, gens, _ := t.held()
+	for i, s := range slots {
+		s.extend(gens[i], t)
+	}
+	if t.disk != nil {
+		t.disk.extend(expireAt)
 	}
+	e.expiry.schedule(t)
+	return t
+}
 
+func (e *itemsShard) Remove(key string) *MetaItem {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.remove(key)
 }
 
+func (e *itemsShard) RemoveItem(t *MetaItem) bool {
+	e.Lock()
+	defer e.Unlock()
 
-func (e *ItemsEntry) movePoint(key string) {
-	if e.checkpoint == nil {
-		return
+	if e.policy.Peek(t.key) != t && e.spilled[t.key] != t {
+		return false
 	}
+	return e.remove(t.key) != nil
+}
 
-	k := e.checkpoint.Key().(string)
-	metaTrace.Log("Current checkpoint key: ", k)
-	if k == key {
-		e.checkpoint = e.checkpoint.Next()
-		if e.checkpoint == nil {
-			metaTrace.Log("After removed, checkpoint is nil")
-		} else {
-			metaTrace.Log("After removed, checkpoint key: ", e.checkpoint.Key().(string))
-		}
+// spillItem moves item stored without slots to disk at the location; It fails if the item has been replaced.
+func (e *itemsShard) spillItem(t *MetaItem, ref *spillRef) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.policy.Peek(t.key) != t {
+		return false
 	}
+	_ = e.policy.Remove(t.key)
+	t.setDisk(ref)
+	e.keepSpilled(t)
+	return true
 }
 
+func (e *itemsShard) appendKeys(keys []string) []string {
+	e.Lock()
+	defer e.Unlock()
 
-func (e *ItemsEntry) Get(key string) *MetaItem {
-	t := e.lru.Get(key)
-	if t != nil && t.Expired() {
-		e.Lock()
-		defer e.Unlock()
+	e.policy.victims(func(t *MetaItem) bool {
+		keys = append(keys, t.key)
+		return true
+	})
+	for key := range e.spilled {
+		keys = append(keys, key)
+	}
+	return keys
+}
 
-		_ = e.lru.Remove(key)
-		e.movePoint(key)
-		return nil
+
+// Set stores item in place of the one of the same key; Item evicted for room is spilled after lock released,
+// also in Add, Replace and CompareAndSwap.
+func (e *itemsShard) Set(t *MetaItem) error {
+	evicted, err := e.set(t)
+	e.spillEvicted(evicted)
+	return err
+}
+
+func (e *itemsShard) set(t *MetaItem) (*MetaItem, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	t.assignCAS()
+	old := e.policy.Peek(t.key)
+	evicted, err := e.policy.Add(t, false)
+	if err != nil {
+		return nil, err
 	}
-	return t
+	_ = e.removeSpilled(t.key)
+	e.stored(t, old, evicted)
+	return evicted, nil
 }
 
 
-func (e *ItemsEntry) Remove(key string) *MetaItem {
+func (e *itemsShard) Add(t *MetaItem) error {
+	evicted, err := e.add(t)
+	e.spillEvicted(evicted)
+	return err
+}
+
+func (e *itemsShard) add(t *MetaItem) (*MetaItem, error) {
 	e.Lock()
 	defer e.Unlock()
 
-	t := e.lru.Remove(key)
-	e.movePoint(key)
-	return t
+	if e.getSpilled(t.key) != nil {
+		return nil, errKeyExists(t.key)
+	}
+	t.assignCAS()
+	evicted, err := e.policy.Add(t, true)
+	if err != nil {
+		return nil, err
+	}
+	e.stored(t, nil, evicted)
+	return evicted, nil
 }
 
 
-func (e *ItemsEntry) Set(t *MetaItem) error {
+func (e *itemsShard) Replace(t *MetaItem) error {
+	evicted, err := e.replace(t)
+	e.spillEvicted(evicted)
+	return err
+}
+
+func (e *itemsShard) replace(t *MetaItem) (*MetaItem, error) {
 	e.Lock()
 	defer e.Unlock()
 
-	if _, _, err := e.lru.Add(t, false); err != nil {
-		return err
+	t.assignCAS()
+	old := e.policy.Peek(t.key)
+	if e.policy.Replace(t) {
+		e.stored(t, old, nil)
+		return nil, nil
 	}
-	return nil
+	return e.replaceSpilled(t)
 }
 
+// replaceSpilled puts item into policy in place of the one on disk, and returns the one evicted for room;
+// it must be called with lock
+func (e *itemsShard) replaceSpilled(t *MetaItem) (*MetaItem, error) {
+	if e.getSpilled(t.key) == nil {
+		return nil, ErrItemNotFound
+	}
+	_ = e.removeSpilled(t.key)
+	evicted, err := e.policy.Add(t, true)
+	if err != nil {
+		return nil, err
+	}
+	e.stored(t, nil, evicted)
+	return evicted, nil
+}
 
-func (e *ItemsEntry) Add(t *MetaItem) error {
+
+// CompareAndSwap replaces item of the key only if its cas unique is still the one given
+func (e *itemsShard) CompareAndSwap(t *MetaItem, casId uint64) error {
+	evicted, err := e.compareAndSwap(t, casId)
+	e.spillEvicted(evicted)
+	return err
+}
+
+func (e *itemsShard) compareAndSwap(t *MetaItem, casId uint64) (*MetaItem, error) {
 	e.Lock()
 	defer e.Unlock()
 
-	if _, _, err := e.lru.Add(t, true); err != nil {
-		return err
+	old := e.policy.Peek(t.key)
+	if old == nil {
+		old = e.getSpilled(t.key)
 	}
-	return nil
+	if old == nil || old.Expired() {
+		return nil, ErrItemNotFound
+	}
+	if old.casId != casId {
+		return nil, ErrCASConflict
+	}
+	t.assignCAS()
+	if old.disk != nil {
+		return e.replaceSpilled(t)
+	}
+	if !e.policy.Replace(t) {
+		return nil, ErrItemNotFound
+	}
+	e.stored(t, old, nil)
+	return nil, nil
 }
 
 
-func (e *ItemsEntry) Replace(t *MetaItem) error {
+// Flush removes all items and clears their slots, and returns the count
+func (e *itemsShard) Flush() (n int) {
 	e.Lock()
 	defer e.Unlock()
 
-	if elem := e.lru.Replace(t); elem != nil {
+	keys := make([]string, 0, e.policy.Len())
+	e.policy.victims(func(t *MetaItem) bool {
+		keys = append(keys, t.key)
+		return true
+	})
+	for key := range e.spilled {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		if e.remove(key) != nil {
+			n++
+		}
+	}
+	e.evicting = make(map[string]*MetaItem)
+	return
+}
+
+
+// EvictOldest removes the item first in order of eviction policy and clears its slots;
+// The item of skipped key is left alone, as it's the one being stored for which room is made.
+// Its value is spilled after lock released, by then its slots are kept pinned.
+func (e *itemsShard) EvictOldest(skip string) *MetaItem {
+	victim := e.evictOldest(skip)
+	e.spillEvicted(victim)
+	return victim
+}
+
+func (e *itemsShard) evictOldest(skip string) *MetaItem {
+	e.Lock()
+	defer e.Unlock()
+
+	var victim *MetaItem
+	e.policy.victims(func(t *MetaItem) bool {
+		if t.key == skip {
+			return true
+		}
+		victim = t
+		return false
+	})
+	if victim == nil {
+		return nil
+	}
+
+	victim.pinForSpill()
+	slots, _, _ := victim.held()
+	for _, s := range slots {
+		s.Evicted()
+	}
+	_ = e.policy.Remove(victim.key)
+	e.detached(victim)
+	return victim
+}
+// EvictInClass evicts the item first in order of eviction policy which holds slots of the capacity class,
+// to free slots for item of skipped key; It returns nil if no such item found.
+// Its value is spilled after lock released, and slots freed are found once unpinned after it.
+func (e *itemsShard) EvictInClass(slotCap uint64, skip string) *MetaItem {
+	victim := e.evictInClass(slotCap, skip)
+	e.spillEvicted(victim)
+	return victim
+}
+
+func (e *itemsShard) evictInClass(slotCap uint64, skip string) *MetaItem {
+	e.Lock()
+	defer e.Unlock()
+
+	var victim *MetaItem
+	depth := _EvictSearchDepth
+	e.policy.victims(func(t *MetaItem) bool {
+		if t.key != skip && holdsSlotIn(t, slotCap) {
+			victim = t
+			return false
+		}
+		depth--
+		return depth > 0
+	})
+	if victim == nil {
 		return nil
 	}
-	return errors.New("key not exists")
+
+	victim.pinForSpill()
+	slots, _, _ := victim.held()
+	for _, s := range slots {
+		s.Evicted()
+	}
+	_ = e.policy.Remove(victim.key)
+	for _, s := range slots {
+		s.Recycle()
+	}
+	e.evicted(victim)
+	return victim
 }
+
+func (e *itemsShard) Len() int {
+	e.Lock()
+	defer e.Unlock()
+	return e.policy.Len() + len(e.spilled)
+}
+
+// Spilled is count of items on disk
+func (e *itemsShard) Spilled() int {
+	e.Lock()
+	defer e.Unlock()
+	return len(e.spilled)
+}
+
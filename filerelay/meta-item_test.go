@@ -1,8 +1,11 @@
 package filerelay
 
 import (
+	"io"
+	"io/ioutil"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const (
@@ -12,7 +15,7 @@ const (
 var itemsEntry *ItemsEntry
 
 func init() {
-	itemsEntry = NewItemsEntry(2)
+	itemsEntry = NewItemsEntry([]EvictionPolicy{NewLRU(2)}, 20)
 }
 
 
@@ -31,22 +34,97 @@ func TestItemsEntry_Add(t *testing.T) {
 }
 
 func TestItemsEntry_Remove(t *testing.T) {
-	front := itemsEntry.list.Front()
-	frontKey := front.Key().(string)
-	t.Log("Front element key: ", frontKey)
+	first := itemsEntry.shards[0].expiry[0]
+	t.Log("First item to expire: ", first.key)
 
-	itemsEntry.checkpoint = front
-	item := itemsEntry.checkpoint.Value.(*MetaItem)
+	item := itemsEntry.Remove(first.key)
+	if item != first || first.queueIndex != -1 {
+		t.Errorf("expect item %s removed from expiry queue", first.key)
+	}
+	for i, it := range itemsEntry.shards[0].expiry {
+		if it.queueIndex != i {
+			t.Errorf("item %s at %d in expiry queue has index %d", it.key, i, it.queueIndex)
+		}
+	}
+}
 
-	item2 := itemsEntry.Remove(item.key)
-	t.Log("Current checkpoint key: ", itemsEntry.checkpoint.Key().(string), "; item: ", item2)
+// to ensure expired items are removed in order of expiration, with bounded count in each check
+func TestItemsEntry_Expire(t *testing.T) {
+	entry := NewItemsEntry([]EvictionPolicy{NewLRU(100)}, 3)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		item := NewMetaItem("ExpireTest-" + strconv.Itoa(i), 0, int64(10 - i), 0)
+		item.setAt = now
+		_ = entry.Set(item)
+	}
+	// replaced item is taken out of queue
+	item := NewMetaItem("ExpireTest-9", 0, 600, 0)
+	item.setAt = now
+	_ = entry.Set(item)
+
+	at := now.Add(time.Second * 5)
+	if n := entry.Expire(at); n != 3 {
+		t.Errorf("expect 3 items expired in a check, got: %d", n)
+	}
+	if n := entry.Expire(at); n != 1 {
+		t.Errorf("expect 1 more item expired, got: %d", n)
+	}
+	if entry.Len() != 6 || entry.Get("ExpireTest-9") == nil || entry.Get("ExpireTest-5") != nil {
+		t.Errorf("unexpected items left after expiration: %d", entry.Len())
+	}
+	if n := entry.Expire(now.Add(time.Hour)); n != 3 {
+		t.Errorf("expect 3 items expired in a check, got: %d", n)
+	}
+	if entry.Expirations() != 7 {
+		t.Errorf("expect 7 expirations, got: %d", entry.Expirations())
+	}
 }
 
-// to ensure the checking will go through all items in skip-list
-func TestItemsEntry_ScheduledCheck(t *testing.T) {
-	itemsEntry.ScheduledCheck()
-	itemsEntry.ScheduledCheck()
-	itemsEntry.ScheduledCheck()
-	itemsEntry.ScheduledCheck()
-	itemsEntry.ScheduledCheck()
+// TTL of item is read out of lock of entry while it's touched
+func TestItemsEntry_Touch(t *testing.T) {
+	entry := NewItemsEntry([]EvictionPolicy{NewLRU(100)}, 3)
+	item := NewMetaItem("TouchTest", 0, 10, 0)
+	_ = entry.Set(item)
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = item.TTL(time.Now())
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		if entry.Touch(item.key, 600) != item {
+			t.Fatal("item not touched")
+		}
+	}
+	<-done
+	if ttl := item.TTL(time.Now()); ttl != 600 {
+		t.Errorf("expect ttl of touched item 600, got: %d", ttl)
+	}
+	if entry.Expire(time.Now().Add(time.Minute)) != 0 {
+		t.Error("touched item expired at its former time")
+	}
+}
+
+func TestMetaItem_ValueReader(t *testing.T) {
+	p := &pinnedValue{data: [][]byte{[]byte("0123"), []byte("4567"), []byte("89")}}
+	r := p.Reader()
+	all, err := ioutil.ReadAll(r)
+	if err != nil || string(all) != "0123456789" {
+		t.Fatalf("read all: %q, %v", all, err)
+	}
+	part := make([]byte, 5)
+	if n, e := r.ReadAt(part, 3); n != 5 || e != nil || string(part) != "34567" {
+		t.Errorf("read at 3: %q, %d, %v", part, n, e)
+	}
+	if n, e := r.ReadAt(part, 7); n != 3 || e != io.EOF || string(part[:n]) != "789" {
+		t.Errorf("read at 7: %q, %d, %v", part[:n], n, e)
+	}
+	if pos, _ := r.Seek(-4, io.SeekEnd); pos != 6 {
+		t.Errorf("seek from end: %d", pos)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "6789" {
+		t.Errorf("read after seek: %q", rest)
+	}
 }
@@ -20,8 +20,10 @@ var (
 	ResultEnd       = []byte("END\r\n")
 	ResultOk        = []byte("OK\r\n")
 	ResultTouched   = []byte("TOUCHED\r\n")
+	ResultMetaMiss  = []byte("EN\r\n")
 
 	ResultClientErrorPrefix = []byte("CLIENT_ERROR ")
+	ResultServerErrorPrefix = []byte("SERVER_ERROR ")
 )
 
 
@@ -60,6 +62,9 @@ type MsgLine struct {
 
 	// Compare and swap ID.
 	CasId uint64
+
+	// Args are the arguments of commands which are not parsed into the fields above.
+	Args []string
 }
 
 func (ml *MsgLine) String() string {
@@ -76,23 +81,80 @@ func (ml *MsgLine) String() string {
 }
 
 //
-func (ml *MsgLine) parseLine(line []byte) {
+func (ml *MsgLine) parseLine(line []byte) error {
 	parts := strings.Split(strings.Trim(string(line), " \r\n"), " ")
 
 	if ml.Cmd = parts[0]; ml.Cmd == "" {
-		return
+		return nil
 	}
-	
+
+	switch ml.Cmd {
+	case "auth":
+		if len(parts) != 3 {
+			return &MsgLineError{"auth", "expect user and token"}
+		}
+		ml.Args = parts[1:]
+		return nil
+	case "peer":
+		if len(parts) != 2 && len(parts) != 3 {
+			return &MsgLineError{"peer", "expect node and optional role"}
+		}
+		ml.Args = parts[1:]
+		return nil
+	case "as":
+		if len(parts) != 2 && len(parts) != 3 {
+			return &MsgLineError{"as", "expect tenant and optional identity"}
+		}
+		ml.Args = parts[1:]
+		return nil
+	case "quit":
+		return nil
+	case "stats", "flush_all", "snapshot":
+		ml.Args = parts[1:]
+		return nil
+	case "touch":
+		if len(parts) < 3 {
+			return &MsgLineError{"touch", "expect key and exptime"}
+		}
+		if ml.Key = parts[1]; !ValidKey(ml.Key) {
+			return &MsgLineError{"key", ""}
+		}
+		d, e := strconv.ParseInt(parts[2], 10, 64)
+		if e != nil {
+			return &MsgLineError{"exptime", e.Error()}
+		}
+		ml.Expiration = d
+		ml.Args = parts[3:]
+		return nil
+	case "mg", "delete", "persist":
+		if len(parts) < 2 {
+			return &MsgLineError{"key", "missing"}
+		}
+		if ml.Key = parts[1]; !ValidKey(ml.Key) {
+			return &MsgLineError{"key", ""}
+		}
+		ml.Args = parts[2:]
+		return nil
+	}
+
+	if len(parts) < 2 {
+		return &MsgLineError{"key", "missing"}
+	}
+
 	var err error
 	if parts, err = ml.handleStoreCmdParts(parts[1:]); err != nil {
-		return
+		return err
 	}
-	if ml.Cmd == "cas" && len(parts) > 0 {
-		if parts, err = ml.handleCasCmdParts(parts[1:]); err != nil {
-			return
+	if ml.Cmd == "cas" {
+		if len(parts) == 0 {
+			return &MsgLineError{"cas unique", "missing"}
+		}
+		if parts, err = ml.handleCasCmdParts(parts); err != nil {
+			return err
 		}
 	}
-
+	ml.Args = parts
+	return nil
 }
 
 func (ml *MsgLine) handleStoreCmdParts(parts []string) ([]string, error) {
@@ -115,7 +177,7 @@ func (ml *MsgLine) handleStoreCmdParts(parts []string) ([]string, error) {
 	}
 	i++
 
-	if d, e := strconv.ParseInt(parts[i], 10, 32); e == nil {
+	if d, e := strconv.ParseInt(parts[i], 10, 64); e == nil {
 		ml.Expiration = d
 	} else {
 		return nil, e
@@ -136,12 +198,10 @@ func (ml *MsgLine) handleStoreCmdParts(parts []string) ([]string, error) {
 
 func (ml *MsgLine) handleCasCmdParts(parts []string) ([]string, error) {
 	i := 0
-	if d, e := strconv.ParseInt(parts[i], 10, 64); e == nil && d >= 0 {
-		ml.CasId = uint64(d)
-	} else if e != nil {
-		return nil, e
+	if d, e := strconv.ParseUint(parts[i], 10, 64); e == nil {
+		ml.CasId = d
 	} else {
-		return nil, &MsgLineError{"cas unique", "negative number"}
+		return nil, &MsgLineError{"cas unique", e.Error()}
 	}
 	i++
 	return parts[i:], nil
@@ -0,0 +1,383 @@
+package filerelay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+
+const (
+	PersistFS = "fs"
+
+	_PersistFileHead = "FRP1" //first token of head line in files of fs backend
+)
+
+var (
+	ErrPersistNotFound = errors.New("not found in persistence")
+	ErrPersistTarget = errors.New("unknown persist target")
+	ErrPersistDisabled = errors.New("persistence not enabled")
+	ErrPersistBroken = errors.New("persisted data broken")
+)
+
+
+// PersistMeta describes value of item kept by persistence backend
+type PersistMeta struct {
+	Size int64
+	Flags uint32
+	ModTime time.Time //set by backend
+}
+
+// PersistBackend keeps values of items out of memory, by key;
+// Values are streamed in and out without being buffered whole.
+type PersistBackend interface {
+	// Put stores value of meta.Size bytes read from r, replacing the one of the same key
+	Put(key string, r io.Reader, meta PersistMeta) error
+	// Get returns reader of value, which must be closed; ErrPersistNotFound is returned for key not stored.
+	Get(key string) (io.ReadCloser, PersistMeta, error)
+	Delete(key string) error
+	Stat(key string) (PersistMeta, error)
+}
+
+// PersistFactory makes backend of a type with options in config
+type PersistFactory func(name string, options map[string]string) (PersistBackend, error)
+
+var (
+	_PersistFactories = map[string]PersistFactory{
+		PersistFS: newFSBackend,
+		PersistS3: newS3Backend,
+	}
+	_PersistFactoriesLock sync.RWMutex
+)
+
+// RegisterPersistBackend makes backends of the type available to config
+func RegisterPersistBackend(typ string, factory PersistFactory) {
+	_PersistFactoriesLock.Lock()
+	defer _PersistFactoriesLock.Unlock()
+	_PersistFactories[typ] = factory
+}
+
+
+// PersistConfig lists backends by name, for persist command to choose as target
+type PersistConfig struct {
+	Default string `yaml:"default"` //target of persist without one, and of read-through; default as the first backend
+	ReadThrough bool `yaml:"read-through"` //retrievals missed are read from the default backend
+	Backends []PersistBackendConfig `yaml:"backends"`
+}
+
+// PersistBackendConfig takes all other fields as options for backend of the type
+type PersistBackendConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	Options map[string]string `yaml:",inline"`
+}
+
+
+
+
+// Persistence keeps backends configured by name
+type Persistence struct {
+	backends map[string]PersistBackend
+	def string
+	readThrough bool
+
+	persisted uint64
+	persistFails uint64
+	readThroughs uint64
+}
+
+// NewPersistence returns nil for config without backends, which means persistence is off
+func NewPersistence(c *PersistConfig) (*Persistence, error) {
+	if len(c.Backends) == 0 {
+		return nil, nil
+	}
+	p := &Persistence{
+		backends: make(map[string]PersistBackend),
+		def: c.Default,
+		readThrough: c.ReadThrough,
+	}
+	_PersistFactoriesLock.RLock()
+	defer _PersistFactoriesLock.RUnlock()
+	for _, bc := range c.Backends {
+		if bc.Name == "" || p.backends[bc.Name] != nil {
+			return nil, errors.New("persist backend without name or with duplicated name: " + bc.Name)
+		}
+		factory, ok := _PersistFactories[bc.Type]
+		if !ok {
+			return nil, errors.New("unknown persist backend type: " + bc.Type)
+		}
+		b, err := factory(bc.Name, bc.Options)
+		if err != nil {
+			return nil, fmt.Errorf("persist backend %s: %v", bc.Name, err)
+		}
+		p.backends[bc.Name] = b
+	}
+	if p.def == "" {
+		p.def = c.Backends[0].Name
+	} else if p.backends[p.def] == nil {
+		return nil, errors.New("default persist backend not found: " + p.def)
+	}
+	return p, nil
+}
+
+func (p *Persistence) Enabled() bool {
+	return p != nil
+}
+
+// Backend returns the backend by name, or the default one for empty name
+func (p *Persistence) Backend(name string) (PersistBackend, bool) {
+	if name == "" {
+		name = p.def
+	}
+	b, ok := p.backends[name]
+	return b, ok
+}
+
+func (p *Persistence) ReadThrough() bool {
+	return p != nil && p.readThrough
+}
+
+
+
+
+// fsBackend keeps every value in a file under root, with a head line of flags and size;
+// Files are named by base64 of key, in directories by hash of key.
+type fsBackend struct {
+	root string
+}
+
+func newFSBackend(name string, options map[string]string) (PersistBackend, error) {
+	root := options["path"]
+	if root == "" {
+		return nil, errors.New("path of fs backend not set")
+	}
+	if e := os.MkdirAll(root, 0755); e != nil {
+		return nil, e
+	}
+	return &fsBackend{root: root}, nil
+}
+
+func (b *fsBackend) path(key string) string {
+	return filepath.Join(b.root, fmt.Sprintf("%02x", keyHash(key) & 0xff), base64.RawURLEncoding.EncodeToString([]byte(key)))
+}
+
+// Put writes into a temporary file renamed to the one of key when it's complete
+func (b *fsBackend) Put(key string, r io.Reader, meta PersistMeta) error {
+	path := b.path(key)
+	if e := os.MkdirAll(filepath.Dir(path), 0755); e != nil {
+		return e
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //fails after renamed
+
+	w := bufio.NewWriter(f)
+	_, err = fmt.Fprintf(w, "%s %d %d\n", _PersistFileHead, meta.Flags, meta.Size)
+	if err == nil {
+		_, err = io.CopyN(w, r, meta.Size)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// fsValue reads value after head line of file
+type fsValue struct {
+	*bufio.Reader
+	f *os.File
+}
+
+func (v *fsValue) Close() error {
+	return v.f.Close()
+}
+
+func (b *fsBackend) open(key string) (*fsValue, PersistMeta, error) {
+	var meta PersistMeta
+	f, err := os.Open(b.path(key))
+	if os.IsNotExist(err) {
+		return nil, meta, ErrPersistNotFound
+	} else if err != nil {
+		return nil, meta, err
+	}
+	v := &fsValue{Reader: bufio.NewReader(f), f: f}
+	line, err := v.ReadSlice('\n')
+	var head string
+	if err == nil {
+		_, err = fmt.Sscanf(string(bytes.TrimSpace(line)), "%s %d %d", &head, &meta.Flags, &meta.Size)
+	}
+	if err == nil && head != _PersistFileHead {
+		err = ErrPersistBroken
+	}
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			meta.ModTime = fi.ModTime()
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, meta, err
+	}
+	return v, meta, nil
+}
+
+func (b *fsBackend) Get(key string) (io.ReadCloser, PersistMeta, error) {
+	v, meta, err := b.open(key)
+	if err != nil {
+		return nil, meta, err
+	}
+	return v, meta, nil
+}
+
+func (b *fsBackend) Stat(key string) (PersistMeta, error) {
+	v, meta, err := b.open(key)
+	if err != nil {
+		return meta, err
+	}
+	return meta, v.Close()
+}
+
+func (b *fsBackend) Delete(key string) error {
+	err := os.Remove(b.path(key))
+	if os.IsNotExist(err) {
+		return ErrPersistNotFound
+	}
+	return err
+}
+
+
+
+
+// handlePersist serves "persist <key> [target]", copying value of item from its slots to the backend
+// of target, or the default one, under key prefixed by tenant; It responds OK, NOT_FOUND for item not stored,
+// or SERVER_ERROR if backend fails.
+func (h *handler) handlePersist(msgline *MsgLine, sc *ServConn, tenant *Tenant) error {
+	if !h.persistence.Enabled() {
+		h.writeClientError(sc.rw, ErrPersistDisabled.Error())
+		return nil
+	}
+	target := ""
+	if len(msgline.Args) > 0 {
+		target = msgline.Args[0]
+	}
+	backend, ok := h.persistence.Backend(target)
+	if !ok {
+		h.writeClientError(sc.rw, ErrPersistTarget.Error())
+		return nil
+	}
+	log := logger.WithFields(logrus.Fields{
+		"itemKey": msgline.Key,
+		"target": target,
+		"handler": h.index,
+	})
+
+	item := tenant.entry.Get(msgline.Key)
+	if item == nil {
+		return h.writeResult(sc.rw, ResultNotFound)
+	}
+	// slots are pinned until value is written to backend
+	value, intact := item.Pin()
+	defer value.Unpin()
+	if !intact {
+		return h.writeResult(sc.rw, ResultNotFound)
+	}
+
+	key := tenant.persistKey(item.key)
+	err := backend.Put(key, value.Reader(), PersistMeta{Size: int64(item.byteLen), Flags: item.flags})
+	if err == nil && value.Changed() {
+		_ = backend.Delete(key)
+		err = ErrSlotReused
+	}
+	if err != nil {
+		atomic.AddUint64(&h.persistence.persistFails, 1)
+		log.Errorf("Persist failed: %v", err.Error())
+		h.writeServerError(sc.rw, err.Error())
+		return nil
+	}
+	atomic.AddUint64(&h.persistence.persisted, 1)
+	log.Info("Item persisted")
+	return h.writeResult(sc.rw, ResultOK)
+}
+
+// readThrough loads item missed in tenant from the default backend with default expiration of tenant,
+// and returns nil if it's not persisted or fails to be loaded
+func (h *handler) readThrough(tenant *Tenant, key string) *MetaItem {
+	if !h.persistence.ReadThrough() {
+		return nil
+	}
+	backend, _ := h.persistence.Backend("")
+	r, meta, err := backend.Get(tenant.persistKey(key))
+	if err != nil {
+		if err != ErrPersistNotFound {
+			logger.Warnf("Read through of key [%s] failed: %v", key, err.Error())
+		}
+		return nil
+	}
+	defer r.Close()
+
+	exp, _ := tenant.ResolveExpiration(0, time.Now())
+	item := NewMetaItem(key, meta.Flags, exp, uint64(meta.Size))
+	item.tenant = tenant
+	if e := h.loadItem(item, r); e != nil {
+		logger.Warnf("Load of key [%s] from persistence failed: %v", key, e.Error())
+		return nil
+	}
+	atomic.AddUint64(&h.persistence.readThroughs, 1)
+	return item
+}
+
+// loadItem adds item not stored yet with value read from r into slots allocated for it
+func (h *handler) loadItem(item *MetaItem, r io.Reader) error {
+	entry := item.tenant.entry
+	if e := entry.Add(item); e != nil {
+		return e
+	}
+	fail := func(e error) error {
+		entry.RemoveItem(item)
+		item.ClearSlots()
+		return e
+	}
+	if e := h.allocSlots(item); e != nil && !h.spill.Enabled() {
+		return fail(e)
+	} else if e != nil {
+		item.ClearSlots()
+		if e := h.spillItem(item, r); e != nil {
+			return fail(e)
+		}
+		return nil
+	}
+	bytesLeft := item.byteLen
+	slots, gens, _ := item.held()
+	for i, s := range slots {
+		s.SetInfoWithItem(item)
+		n, e := s.ReadAndSet(item.key, gens[i], r, bytesLeft)
+		if e != nil {
+			return fail(e)
+		}
+		bytesLeft -= n
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package filerelay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+
+func TestPersist_FSBackend(t *testing.T) {
+	b, err := newFSBackend("local", map[string]string{"path": t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keys are never taken as paths
+	for _, key := range []string{"plain", "a/b/../c", "..", "/etc/passwd"} {
+		v := stressValue(key, 3000)
+		if e := b.Put(key, bytes.NewReader(v), PersistMeta{Size: int64(len(v)), Flags: 7}); e != nil {
+			t.Fatalf("put %s: %v", key, e)
+		}
+		meta, e := b.Stat(key)
+		if e != nil || meta.Size != int64(len(v)) || meta.Flags != 7 || meta.ModTime.IsZero() {
+			t.Fatalf("stat %s: %+v, %v", key, meta, e)
+		}
+		r, _, e := b.Get(key)
+		if e != nil {
+			t.Fatalf("get %s: %v", key, e)
+		}
+		got, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(got, v) {
+			t.Fatalf("get %s: %d bytes of value broken", key, len(got))
+		}
+		if e := b.Delete(key); e != nil {
+			t.Fatalf("delete %s: %v", key, e)
+		}
+		if _, e := b.Stat(key); e != ErrPersistNotFound {
+			t.Fatalf("stat %s after deleted: %v", key, e)
+		}
+	}
+
+	// value shorter than size is not stored
+	if e := b.Put("short", strings.NewReader("abc"), PersistMeta{Size: 10}); e == nil {
+		t.Error("put of short value succeeded")
+	}
+	if _, _, e := b.Get("short"); e != ErrPersistNotFound {
+		t.Errorf("get of short value: %v", e)
+	}
+}
+
+func TestPersist_Config(t *testing.T) {
+	var c PersistConfig
+	data := `
+default: local
+backends:
+  - name: local
+    type: fs
+    path: ` + t.TempDir() + `
+    fanout: 256
+`
+	if e := yaml.Unmarshal([]byte(data), &c); e != nil {
+		t.Fatal(e)
+	}
+	if c.Backends[0].Options["fanout"] != "256" {
+		t.Errorf("options of backend: %v", c.Backends[0].Options)
+	}
+	p, err := NewPersistence(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Backend(""); !ok {
+		t.Error("default backend not found")
+	}
+
+	RegisterPersistBackend("memory-test", func(name string, options map[string]string) (PersistBackend, error) {
+		return newFSBackend(name, map[string]string{"path": options["dir"]})
+	})
+	c.Backends = append(c.Backends, PersistBackendConfig{Name: "mem", Type: "memory-test", Options: map[string]string{"dir": t.TempDir()}})
+	if p, err = NewPersistence(&c); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Backend("mem"); !ok {
+		t.Error("backend of registered type not found")
+	}
+
+	c.Backends = append(c.Backends, PersistBackendConfig{Name: "bad", Type: "unknown"})
+	if _, err = NewPersistence(&c); err == nil {
+		t.Error("backend of unknown type accepted")
+	}
+}
+
+func TestPersist_Command(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.Persist = PersistConfig{
+		ReadThrough: true,
+		Backends: []PersistBackendConfig{
+			{Name: "local", Type: PersistFS, Options: map[string]string{"path": t.TempDir()}},
+			{Name: "other", Type: PersistFS, Options: map[string]string{"path": t.TempDir()}},
+		},
+	}
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+
+	v := stressValue("persisted", 200000)
+	if resp := command(t, rw, fmt.Sprintf("set persisted 9 0 %d", len(v)), v); resp != string(ResultStored) {
+		t.Fatalf("set: %q", resp)
+	}
+	if resp := command(t, rw, "persist persisted", nil); resp != string(ResultOK) {
+		t.Fatalf("persist: %q", resp)
+	}
+	if resp := command(t, rw, "persist persisted other", nil); resp != string(ResultOK) {
+		t.Fatalf("persist to other: %q", resp)
+	}
+	if resp := command(t, rw, "persist persisted nowhere", nil); !strings.HasPrefix(resp, "CLIENT_ERROR") {
+		t.Fatalf("persist to unknown target: %q", resp)
+	}
+	if resp := command(t, rw, "persist missing", nil); resp != string(ResultNotFound) {
+		t.Fatalf("persist of missing key: %q", resp)
+	}
+
+	// evicted item is read through from the default backend
+	if resp := command(t, rw, "delete persisted", nil); resp != string(ResultDeleted) {
+		t.Fatalf("delete: %q", resp)
+	}
+	fmt.Fprintf(rw, "get persisted\r\n")
+	rw.Flush()
+	got, err := readStressValue(rw)
+	if err != nil || !bytes.Equal(got, v) {
+		t.Fatalf("get read through: %d bytes, %v", len(got), err)
+	}
+	if resp := command(t, rw, "mg persisted f s", nil); resp != "HD f9 s200000\r\n" {
+		t.Fatalf("mg after read through: %q", resp)
+	}
+	if resp := command(t, rw, "mg missing", nil); resp != string(ResultMetaMiss) {
+		t.Fatalf("mg of key never persisted: %q", resp)
+	}
+}
+
+// TestPersist_Tenant persists the same key in 2 tenants by identities, and reads them through separately
+func TestPersist_Tenant(t *testing.T) {
+	defer quietLogs()()
+	c := authConfig(t)
+	c.Tenants = []TenantConfig{{Name: "team", Identities: []string{"alice"}}}
+	c.Persist = PersistConfig{
+		ReadThrough: true,
+		Backends: []PersistBackendConfig{
+			{Name: "local", Type: PersistFS, Options: map[string]string{"path": t.TempDir()}},
+		},
+	}
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+
+	login := func(user, token string) (net.Conn, *bufio.ReadWriter) {
+		conn, rw := dialTest(t, addr)
+		if resp := command(t, rw, "auth " + user + " " + token, nil); resp != string(ResultOK) {
+			t.Fatalf("auth %s: %q", user, resp)
+		}
+		return conn, rw
+	}
+	alice, ra := login("alice", "secret")
+	defer alice.Close()
+	bob, rb := login("bob", "token-2")
+	defer bob.Close()
+
+	if resp := command(t, ra, "set shared 1 0 4", []byte("team")); resp != string(ResultStored) {
+		t.Fatalf("set in tenant: %q", resp)
+	}
+	if resp := command(t, ra, "persist shared", nil); resp != string(ResultOK) {
+		t.Fatalf("persist in tenant: %q", resp)
+	}
+	// item persisted in another tenant is never read through
+	if resp := command(t, rb, "mg shared v", nil); resp != string(ResultMetaMiss) {
+		t.Fatalf("read through of other tenant: %q", resp)
+	}
+	if resp := command(t, rb, "set shared 2 0 7", []byte("default")); resp != string(ResultStored) {
+		t.Fatalf("set in default tenant: %q", resp)
+	}
+	if resp := command(t, rb, "persist shared", nil); resp != string(ResultOK) {
+		t.Fatalf("persist in default tenant: %q", resp)
+	}
+
+	if resp := command(t, ra, "delete shared", nil); resp != string(ResultDeleted) {
+		t.Fatalf("delete: %q", resp)
+	}
+	if resp := command(t, ra, "mg shared f s", nil); resp != "HD f1 s4\r\n" {
+		t.Fatalf("read through in tenant: %q", resp)
+	}
+}
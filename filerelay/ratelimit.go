@@ -0,0 +1,285 @@
+package filerelay
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+
+const (
+	_LimitBucketIdle = time.Minute //buckets not used for the period are dropped
+)
+
+var (
+	ErrRateLimited = errors.New("rate limited")
+)
+
+
+type limitKind int
+const (
+	limitCmd limitKind = iota
+	limitUpload
+	limitDownload
+	limitKindCount
+)
+
+
+// RateLimitConfig defines token-bucket limits applying to every remote address, identity or tenant,
+// or only the one in Match if it's set; Zero rate means no limit.
+type RateLimitConfig struct {
+	By string `yaml:"by"` //address, identity or tenant
+	Match string `yaml:"match"`
+
+	Commands float64 `yaml:"commands-per-second"`
+	UploadBytes float64 `yaml:"upload-bytes-per-second"`
+	DownloadBytes float64 `yaml:"download-bytes-per-second"`
+	Burst float64 `yaml:"burst-seconds"` //seconds of rate allowed in a burst; 1 by default
+
+	Reject bool `yaml:"reject"` //reject with "SERVER_ERROR rate limited" instead of slowing client down
+}
+
+func (c *RateLimitConfig) rate(kind limitKind) float64 {
+	switch kind {
+	case limitCmd:
+		return c.Commands
+	case limitUpload:
+		return c.UploadBytes
+	case limitDownload:
+		return c.DownloadBytes
+	}
+	return 0
+}
+
+
+// limitSubject identifies the client of a command for selecting buckets
+type limitSubject struct {
+	addr string
+	identity string
+	tenant string
+	peer bool //command from peer, limited by the node taking it from client
+}
+
+func makeLimitSubject(sc *ServConn, identity string, tenant *Tenant) limitSubject {
+	addr := sc.nc.RemoteAddr().String()
+	if host, _, e := net.SplitHostPort(addr); e == nil {
+		addr = host
+	}
+	return limitSubject{
+		addr: addr,
+		identity: identity,
+		tenant: tenant.name,
+		peer: sc.peer != "",
+	}
+}
+
+
+
+
+//
+type tokenBucket struct {
+	rate float64
+	burst float64
+	tokens float64
+	last time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate: rate,
+		burst: burst,
+		tokens: burst,
+		last: time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// admit takes n tokens when there is any left, which may put the bucket into debt
+func (b *tokenBucket) admit(n float64) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve takes n tokens and returns the time to wait for paying back the debt
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	return now.Sub(b.last) > _LimitBucketIdle
+}
+
+
+
+
+//
+type limitRule struct {
+	cfg RateLimitConfig
+	buckets map[string]*[limitKindCount]*tokenBucket
+	sweepAt time.Time
+	sync.Mutex
+}
+
+func (r *limitRule) subjectOf(sub *limitSubject) (string, bool) {
+	var val string
+	switch r.cfg.By {
+	case "address":
+		val = sub.addr
+	case "identity":
+		val = sub.identity
+	case "tenant":
+		val = sub.tenant
+	}
+	if r.cfg.Match != "" && r.cfg.Match != val {
+		return "", false
+	}
+	return val, true
+}
+
+func (r *limitRule) bucket(val string, kind limitKind) *tokenBucket {
+	rate := r.cfg.rate(kind)
+	if rate <= 0 {
+		return nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.sweepAt) > _LimitBucketIdle {
+		r.sweep(now)
+	}
+
+	set, ok := r.buckets[val]
+	if !ok {
+		set = &[limitKindCount]*tokenBucket{}
+		r.buckets[val] = set
+	}
+	if set[kind] == nil {
+		set[kind] = newTokenBucket(rate, rate * r.cfg.Burst)
+	}
+	return set[kind]
+}
+
+func (r *limitRule) sweep(now time.Time) {
+	for val, set := range r.buckets {
+		idle := true
+		for _, b := range set {
+			if b != nil && !b.idle(now) {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(r.buckets, val)
+		}
+	}
+	r.sweepAt = now
+}
+
+
+
+
+//
+type Limiter struct {
+	rules []*limitRule
+}
+
+func NewLimiter(cfgs []RateLimitConfig) (*Limiter, error) {
+	l := &Limiter{
+		rules: make([]*limitRule, 0, len(cfgs)),
+	}
+	for _, c := range cfgs {
+		switch c.By {
+		case "address", "identity", "tenant":
+		default:
+			return nil, errors.New("unknown subject of rate limit: " + c.By)
+		}
+		if c.Burst <= 0 {
+			c.Burst = 1
+		}
+		l.rules = append(l.rules, &limitRule{
+			cfg: c,
+			buckets: make(map[string]*[limitKindCount]*tokenBucket),
+			sweepAt: time.Now(),
+		})
+	}
+	return l, nil
+}
+
+func (l *Limiter) Enabled() bool {
+	return l != nil && len(l.rules) > 0
+}
+
+// Admit checks rules in reject mode, and fails with ErrRateLimited when any bucket is exhausted;
+// n tokens are taken from buckets in admission, so that a large value is admitted at once.
+func (l *Limiter) Admit(sub *limitSubject, kind limitKind, n uint64) error {
+	if !l.Enabled() || sub.peer {
+		return nil
+	}
+	for _, r := range l.rules {
+		if !r.cfg.Reject {
+			continue
+		}
+		val, ok := r.subjectOf(sub)
+		if !ok {
+			continue
+		}
+		if b := r.bucket(val, kind); b != nil && !b.admit(float64(n)) {
+			return ErrRateLimited
+		}
+	}
+	return nil
+}
+
+// Throttle takes n tokens from buckets of rules not in reject mode, and slows down the caller until the tokens are paid
+func (l *Limiter) Throttle(sub *limitSubject, kind limitKind, n uint64) {
+	if !l.Enabled() || sub.peer {
+		return
+	}
+	var wait time.Duration
+	for _, r := range l.rules {
+		if r.cfg.Reject {
+			continue
+		}
+		val, ok := r.subjectOf(sub)
+		if !ok {
+			continue
+		}
+		if b := r.bucket(val, kind); b != nil {
+			if d := b.reserve(float64(n)); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		dtrace.Logf("Throttle %v for subject: %+v", wait, *sub)
+		time.Sleep(wait)
+	}
+}
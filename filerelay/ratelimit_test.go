@@ -0,0 +1,132 @@
+package filerelay
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1000, 2000)
+	if !b.admit(1500) || !b.admit(1000) {
+		t.Fatal("tokens in burst not admitted")
+	}
+	// bucket in debt admits nothing until it's paid back
+	if b.admit(1) {
+		t.Error("admitted with bucket in debt")
+	}
+	if d := b.reserve(500); d < time.Millisecond * 900 || d > time.Second {
+		t.Errorf("wait for paying debt of 1000 tokens: %v", d)
+	}
+
+	b = newTokenBucket(1000, 1000)
+	b.last = b.last.Add(-time.Hour)
+	if d := b.reserve(1000); d != 0 {
+		t.Errorf("wait in burst: %v", d)
+	}
+	if !b.idle(time.Now().Add(_LimitBucketIdle * 2)) || b.idle(time.Now()) {
+		t.Error("bucket idle wrong")
+	}
+}
+
+func TestLimiter_Admit(t *testing.T) {
+	l, err := NewLimiter([]RateLimitConfig{
+		{By: "identity", Match: "alice", Commands: 2, Reject: true},
+		{By: "tenant", UploadBytes: 1000, Reject: true},
+		{By: "address", Commands: 1}, //throttled only
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &limitSubject{addr: "10.0.0.1", identity: "alice", tenant: "images"}
+	bob := &limitSubject{addr: "10.0.0.1", identity: "bob", tenant: "images"}
+	// commands are admitted while there are any tokens left, which may put bucket into debt
+	if e := l.Admit(alice, limitCmd, 3); e != nil {
+		t.Fatalf("commands rejected: %v", e)
+	}
+	if e := l.Admit(alice, limitCmd, 1); e != ErrRateLimited {
+		t.Errorf("command beyond limit: %v", e)
+	}
+	if e := l.Admit(bob, limitCmd, 1); e != nil {
+		t.Errorf("command of identity not matched: %v", e)
+	}
+
+	// large upload is admitted at once, and the next one waits for its debt
+	if e := l.Admit(bob, limitUpload, 5000); e != nil {
+		t.Errorf("upload rejected: %v", e)
+	}
+	if e := l.Admit(alice, limitUpload, 1); e != ErrRateLimited {
+		t.Errorf("upload in the same tenant: %v", e)
+	}
+	if e := l.Admit(&limitSubject{tenant: "docs"}, limitUpload, 1); e != nil {
+		t.Errorf("upload in another tenant: %v", e)
+	}
+
+	if _, e := NewLimiter([]RateLimitConfig{{By: "host"}}); e == nil {
+		t.Error("unknown subject of rate limit accepted")
+	}
+}
+
+func TestLimiter_Throttle(t *testing.T) {
+	l, err := NewLimiter([]RateLimitConfig{
+		{By: "address", UploadBytes: 1000, Burst: 2},
+		{By: "address", UploadBytes: 1000, Reject: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &limitSubject{addr: "10.0.0.1"}
+	start := time.Now()
+	l.Throttle(sub, limitUpload, 1500)
+	if d := time.Since(start); d > time.Millisecond * 100 {
+		t.Errorf("throttled in burst for %v", d)
+	}
+	l.Throttle(sub, limitUpload, 1000)
+	if d := time.Since(start); d < time.Millisecond * 400 || d > time.Millisecond * 800 {
+		t.Errorf("throttled for %v, expected 500ms", d)
+	}
+	// rules in reject mode never slow down
+	l.Throttle(&limitSubject{addr: "10.0.0.2"}, limitDownload, 1 << 20)
+}
+
+func TestLimiter_Download(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.RateLimits = []RateLimitConfig{{By: "address", DownloadBytes: 200 * 1024}}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, stop := serveTestListener(t, lis, c, 0)
+	defer stop()
+	conn, rw := dialTest(t, lis.Addr().String())
+	defer conn.Close()
+
+	v := stressValue("throttled", 300 * 1024)
+	if resp := command(t, rw, fmt.Sprintf("set throttled 0 0 %d", len(v)), v); resp != string(ResultStored) {
+		t.Fatalf("set: %q", resp)
+	}
+	item := server.tenants.Get(DefaultTenant).entry.Get("throttled")
+
+	// client is slowed down before slots are pinned
+	start := time.Now()
+	fmt.Fprintf(rw, "get throttled\r\n")
+	rw.Flush()
+	time.Sleep(time.Millisecond * 200)
+	for _, s := range item.slots {
+		if s.Pinned() {
+			t.Fatal("slots pinned while client is throttled")
+		}
+	}
+	if got, err := readStressValue(rw); err != nil || len(got) != len(v) {
+		t.Fatalf("get throttled: %d bytes, %v", len(got), err)
+	}
+	if d := time.Since(start); d < time.Millisecond * 400 {
+		t.Errorf("download not throttled: %v", d)
+	}
+}
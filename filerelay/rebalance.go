@@ -0,0 +1,117 @@
+package filerelay
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+
+const (
+	SlabAutomoveInterval = 10
+)
+
+
+// Rebalancer moves memory between slab-groups, similar to slab_automove of memcached:
+// When a group is under pressure of evictions or allocation failures while the storage is full,
+// slabs with all slots vacant are released from groups without pressure,
+// and their capacity is given back to total, so that the hot group can grow.
+type Rebalancer struct {
+	cfg *MemConfig
+	groups slabGroupMap
+	last map[uint64]uint64 //pressure of groups at last check
+	quit chan bool
+	done sync.WaitGroup
+}
+
+func NewRebalancer(c *MemConfig, groups slabGroupMap) *Rebalancer {
+	return &Rebalancer{
+		cfg: c,
+		groups: groups,
+		last: make(map[uint64]uint64),
+		quit: make(chan bool, 1),
+	}
+}
+
+func (r *Rebalancer) Start(intv int) {
+	if intv <= 0 {
+		intv = SlabAutomoveInterval
+	}
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		t := time.NewTicker(time.Second * time.Duration(intv))
+		for {
+			select {
+			case <-t.C:
+				r.Rebalance()
+			case <- r.quit:
+				t.Stop()
+				logger.Info("Quit Rebalancer")
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the check running to finish, so that groups are never checked after it returns
+func (r *Rebalancer) Stop() {
+	r.quit <- true
+	r.done.Wait()
+}
+
+// Rebalance releases vacant slabs from cold groups for the hottest group, and returns the released capacity
+func (r *Rebalancer) Rebalance() (released uint64) {
+	var hot *SlabGroup
+	var hotDelta uint64
+	cold := make([]*SlabGroup, 0, len(r.groups))
+
+	for c, g := range r.groups {
+		p := g.Pressure()
+		delta := p - r.last[c]
+		r.last[c] = p
+
+		if delta == 0 {
+			cold = append(cold, g)
+		} else if delta > hotDelta {
+			hot, hotDelta = g, delta
+		}
+	}
+	if hot == nil || len(cold) == 0 {
+		return
+	}
+
+	// room for the hot group to extend as it does in finding slots
+	ext := int( math.Round(float64(hot.initSlabCount) / 2) )
+	if ext < 1 {
+		ext = 1
+	}
+	need := hot.SlabSize() * uint64(ext)
+	total := r.cfg.TotalCapacity()
+	if total + need < r.cfg.maxStorageSize {
+		return
+	}
+	need = total + need - r.cfg.maxStorageSize
+
+	// release from groups of larger slabs first, which give more room in each release
+	sort.Slice(cold, func(i, j int) bool {
+		return cold[i].SlabSize() > cold[j].SlabSize()
+	})
+	for _, g := range cold {
+		if released >= need {
+			break
+		}
+		n := int( (need - released + g.SlabSize() - 1) / g.SlabSize() )
+		if cap := g.ReleaseVacantSlabs(n, 1); cap > 0 {
+			r.cfg.RemoveCapFromTotal(cap)
+			released += cap
+			memTrace.Logf("Rebalance - released %d bytes from group[%d] for group[%d]", cap, g.slotCap, hot.slotCap)
+		}
+	}
+
+	if released > 0 {
+		logger.Infof("Rebalanced %d bytes of slabs for slot capacity %d under pressure %d", released, hot.slotCap, hotDelta)
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package filerelay
+
+import (
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+// Reclaimer shrinks memory after traffic peaks:
+// Slabs with all slots vacant for the idle period are released, down to the initial count in group,
+// and their memory is given back to OS.
+type Reclaimer struct {
+	cfg *MemConfig
+	groups slabGroupMap
+	idleFor time.Duration
+	reclaimed uint64 //bytes reclaimed in total
+	quit chan bool
+	done sync.WaitGroup
+}
+
+func NewReclaimer(c *MemConfig, groups slabGroupMap, idleSecs int) *Reclaimer {
+	return &Reclaimer{
+		cfg: c,
+		groups: groups,
+		idleFor: time.Second * time.Duration(idleSecs),
+		quit: make(chan bool, 1),
+	}
+}
+
+func (r *Reclaimer) Start() {
+	// check a few times in the idle period, to reclaim not long after slabs become idle
+	intv := r.idleFor / 4
+	if intv < time.Second {
+		intv = time.Second
+	} else if intv > time.Minute {
+		intv = time.Minute
+	}
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		t := time.NewTicker(intv)
+		for {
+			select {
+			case <-t.C:
+				r.Reclaim()
+			case <- r.quit:
+				t.Stop()
+				logger.Info("Quit Reclaimer")
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the check running to finish, so that groups are never checked after it returns
+func (r *Reclaimer) Stop() {
+	r.quit <- true
+	r.done.Wait()
+}
+
+// Reclaim releases idle slabs in all groups, and returns the released capacity
+func (r *Reclaimer) Reclaim() (cap uint64) {
+	for c, g := range r.groups {
+		if n := g.ReclaimIdleSlabs(r.idleFor); n > 0 {
+			memTrace.Logf("Reclaim - released %d bytes of idle slabs from group[%d]", n, c)
+			cap += n
+		}
+	}
+	if cap == 0 {
+		return
+	}
+
+	r.cfg.RemoveCapFromTotal(cap)
+	atomic.AddUint64(&r.reclaimed, cap)
+	debug.FreeOSMemory()
+	logger.Infof("Reclaimed %d bytes of idle slabs; total capacity: %d", cap, r.cfg.TotalCapacity())
+	return
+}
+
+// Reclaimed is the bytes reclaimed since start
+func (r *Reclaimer) Reclaimed() uint64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&r.reclaimed)
+}
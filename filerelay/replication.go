@@ -0,0 +1,359 @@
+package filerelay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+
+const (
+	ReplicationSync = "sync"
+	ReplicationAsync = "async"
+
+	ReplicationQueue = 10000
+	ReplicationWorkers = 4
+
+	PeerReplica = "replica" //role declared on connections for replication
+)
+
+var (
+	ErrReplicationFailed = errors.New("replication failed")
+)
+
+
+func validReplication(mode string) bool {
+	return mode == "" || mode == ReplicationSync || mode == ReplicationAsync
+}
+
+
+type replicaOp byte
+const (
+	replicaStore replicaOp = iota
+	replicaDelete
+	replicaTouch
+	replicaMove //item handed off to new owner, not replacing the one stored there
+)
+
+// replicaTask is a change on key to be sent to replica nodes;
+// Expiration is in absolute Unix time, so that it's the same on replicas whenever it's sent.
+type replicaTask struct {
+	op replicaOp
+	tenant string //name of tenant holding the key
+	key string
+	item *MetaItem //for store
+	exp int64 //for store and touch
+}
+
+// line is the command applying the change on replica, preceded by tenant of the key;
+// Stored items keep cas unique of the primary.
+func (t *replicaTask) line() string {
+	as := ""
+	if t.tenant != "" {
+		as = "as " + t.tenant + "\r\n"
+	}
+	switch t.op {
+	case replicaStore:
+		return as + fmt.Sprintf("set %s %d %d %d %d\r\n", t.key, t.item.flags, t.exp, t.item.byteLen, t.item.casId)
+	case replicaTouch:
+		return as + fmt.Sprintf("touch %s %d\r\n", t.key, t.exp)
+	case replicaMove:
+		return as + fmt.Sprintf("add %s %d %d %d %d\r\n", t.key, t.item.flags, t.exp, t.item.byteLen, t.item.casId)
+	}
+	return as + "delete " + t.key + "\r\n"
+}
+
+// replied tells whether reply of replica means the change is applied
+func (t *replicaTask) replied(resp string) bool {
+	switch t.op {
+	case replicaStore:
+		return resp == string(ResultStored)
+	case replicaTouch:
+		return resp == string(ResultTouched) || resp == string(ResultNotFound)
+	case replicaMove:
+		// item stored on new owner is newer than the one handed off
+		return resp == string(ResultStored) || resp == string(ResultNotStored)
+	}
+	return resp == string(ResultDeleted) || resp == string(ResultNotFound)
+}
+
+
+
+
+// replicate sends the change to all replica nodes of key at once, and returns the first failure
+func (c *Cluster) replicate(t *replicaTask) error {
+	var err error
+	for _, node := range c.Owners(t.key) {
+		if node == c.self {
+			continue
+		}
+		if e := c.sendTask(node, t); e != nil {
+			atomic.AddUint64(&c.replicateFails, 1)
+			logger.WithFields(logrus.Fields{
+				"itemKey": t.key,
+				"replica": node,
+			}).Warnf("Replication failed: %v", e.Error())
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		atomic.AddUint64(&c.replicated, 1)
+	}
+	return err
+}
+
+// enqueue queues the change for async replication, or drops it when the queue is full
+func (c *Cluster) enqueue(t *replicaTask) {
+	q := c.queues[keyHash(t.key) % uint32(len(c.queues))]
+	select {
+	case q <- t:
+	default:
+		atomic.AddUint64(&c.replicateDrops, 1)
+		logger.Warnf("Replication queue full, change of key [%s] dropped", t.key)
+	}
+}
+
+func (c *Cluster) replicateQueued(q chan *replicaTask) {
+	defer c.workers.Done()
+	for {
+		select {
+		case t := <-q:
+			_ = c.replicate(t)
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// sendTask applies the change on a replica node; Connection from pool is tried again with a new one,
+// for it may have been closed by peer.
+func (c *Cluster) sendTask(node string, t *replicaTask) error {
+	pool := c.replicaPool(node)
+	if pool == nil {
+		return ErrPeerUnavailable
+	}
+	var err error
+	for i := 0; i < 2; i++ {
+		var pc *peerConn
+		if pc, err = pool.Get(); err != nil {
+			return err
+		}
+		var sent bool
+		sent, err = pc.apply(t)
+		if err != nil {
+			pc.broken = true
+		}
+		pool.Put(pc)
+		if err == nil || sent || err == ErrSlotReused {
+			return err
+		}
+	}
+	return err
+}
+
+// apply sends command of the change, with value streamed from slots of item for store;
+// It tells whether the command has been taken by peer, after which it's not to be sent again.
+// Store of item no longer intact is skipped, as the item has been replaced or removed by later changes.
+func (pc *peerConn) apply(t *replicaTask) (bool, error) {
+	var value *pinnedValue
+	if t.op == replicaStore || t.op == replicaMove {
+		var intact bool
+		if value, intact = t.item.Pin(); !intact {
+			return false, nil
+		}
+		defer value.Unpin()
+	}
+
+	if _, e := pc.rw.WriteString(t.line()); e != nil {
+		return false, e
+	}
+	if value != nil {
+		for _, data := range value.data {
+			if _, e := pc.rw.Write(data); e != nil {
+				return false, e
+			}
+		}
+		if value.disk != nil {
+			if _, e := io.Copy(pc.rw, value.Reader()); e != nil {
+				return false, e
+			}
+		}
+		if value.Changed() {
+			// connection is closed without ending the value block, so that nothing is stored by replica
+			return false, ErrSlotReused
+		}
+		if _, e := pc.rw.Write(Crlf); e != nil {
+			return false, e
+		}
+	}
+	if e := pc.rw.Flush(); e != nil {
+		return false, e
+	}
+
+	resp, e := pc.rw.ReadString('\n')
+	if e != nil {
+		return false, e
+	}
+	if !t.replied(resp) {
+		return true, errors.New("replica responded: " + strings.TrimSpace(resp))
+	}
+	return true, nil
+}
+
+// broadcast sends the command to all other nodes in ring, for changes on all keys like flush_all;
+// It expects OK from every node.
+func (c *Cluster) broadcast(line string) error {
+	var err error
+	for _, node := range c.ring.Nodes() {
+		if node == c.self {
+			continue
+		}
+		pool := c.replicaPool(node)
+		if pool == nil {
+			continue
+		}
+		pc, e := pool.Get()
+		if e == nil {
+			if e = pc.handshake(line); e != nil {
+				pc.broken = true
+			}
+			pool.Put(pc)
+		}
+		if e != nil {
+			logger.Warnf("Broadcast of [%s] to %s failed: %v", strings.TrimSpace(line), node, e.Error())
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+
+
+
+// replicates tells whether changes from the connection are replicated;
+// Changes sent for replication by peers are never replicated again.
+func (h *handler) replicates(sc *ServConn) bool {
+	return h.cluster.Enabled() && h.cluster.replicas > 1 && !sc.replica
+}
+
+// replicationMode is sync or async by the last argument of command, or by the tenant
+func (h *handler) replicationMode(msgline *MsgLine, tenant *Tenant) string {
+	if n := len(msgline.Args); n > 0 {
+		if mode := msgline.Args[n - 1]; mode == ReplicationSync || mode == ReplicationAsync {
+			return mode
+		}
+	}
+	if tenant.replication == "" {
+		return ReplicationAsync
+	}
+	return tenant.replication
+}
+
+// replicateChange sends the change to replicas of key in mode of the command,
+// and returns error only if sync replication fails
+func (h *handler) replicateChange(sc *ServConn, msgline *MsgLine, tenant *Tenant, t *replicaTask) error {
+	if !h.replicates(sc) {
+		return nil
+	}
+	t.tenant = tenant.name
+	if h.replicationMode(msgline, tenant) == ReplicationSync {
+		if e := h.cluster.replicate(t); e != nil {
+			return ErrReplicationFailed
+		}
+		return nil
+	}
+	h.cluster.enqueue(t)
+	return nil
+}
+
+func absoluteExpiration(ttl int64) int64 {
+	return time.Now().Unix() + ttl
+}
+
+// replicaCasId takes cas unique of the primary from storage command sent for replication
+func replicaCasId(sc *ServConn, msgline *MsgLine) uint64 {
+	if !sc.replica || len(msgline.Args) == 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(msgline.Args[0], 10, 64)
+	return id
+}
+
+
+// readReplicas serves retrieval missed on this node from replicas of key;
+// It returns false if no replica has the item, with nothing written to client.
+func (h *handler) readReplicas(msgline *MsgLine, sc *ServConn, sub *limitSubject) (bool, error) {
+	if !h.replicates(sc) {
+		return false, nil
+	}
+	line := strings.Join(append([]string{msgline.Cmd, msgline.Key}, msgline.Args...), " ") + "\r\n"
+	for _, node := range h.cluster.Owners(msgline.Key) {
+		if node == h.cluster.self {
+			continue
+		}
+		pool := h.cluster.replicaPool(node)
+		if pool == nil {
+			continue
+		}
+		pc, err := pool.Get()
+		if err != nil {
+			continue
+		}
+		hit, err := h.readReplica(msgline.Cmd, line, sc, pc, sub)
+		if err != nil {
+			pc.broken = true
+		}
+		pool.Put(pc)
+		if hit {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// readReplica relays reply of replica to client if it's a hit, or drains it for a miss
+func (h *handler) readReplica(cmd, line string, sc *ServConn, pc *peerConn, sub *limitSubject) (bool, error) {
+	if _, e := pc.rw.WriteString(line); e != nil {
+		return false, e
+	}
+	if e := pc.rw.Flush(); e != nil {
+		return false, e
+	}
+	first, err := pc.rw.ReadSlice('\n')
+	if err != nil {
+		return false, err
+	}
+
+	fields := strings.Fields(string(first))
+	hit := false
+	if len(fields) > 0 {
+		switch cmd {
+		case "get", "gets":
+			// miss is responded as value of 0 bytes
+			hit = fields[0] == "VALUE" && len(fields) >= 4 && fields[3] != "0"
+		case "mg":
+			hit = fields[0] == "VA" || fields[0] == "HD"
+		}
+	}
+	if hit {
+		return true, h.relayReply(cmd, first, sc, pc, sub)
+	}
+
+	// miss of get is ended with END
+	for len(fields) > 0 && fields[0] == "VALUE" {
+		if first, err = pc.rw.ReadSlice('\n'); err != nil {
+			return false, err
+		}
+		fields = strings.Fields(string(first))
+	}
+	return false, nil
+}
@@ -0,0 +1,301 @@
+package filerelay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func startReplicaCluster(t *testing.T, replication string) ([]string, []*Server, func()) {
+	return startTestCluster(t, 3, func(c *MemConfig) {
+		c.Cluster.Replicas = 2
+		c.Cluster.Replication = replication
+	})
+}
+
+// holders returns indexes of nodes holding key
+func holders(servers []*Server, key string) []int {
+	nodes := make([]int, 0, len(servers))
+	for i, s := range servers {
+		if s.tenants.Select(key, "").entry.Get(key) != nil {
+			nodes = append(nodes, i)
+		}
+	}
+	return nodes
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 3)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func nodeIndex(addrs []string, addr string) int {
+	for i, a := range addrs {
+		if a == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+
+func TestReplication_Sync(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startReplicaCluster(t, ReplicationAsync)
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	for i := 0; i < 20; i++ {
+		key := "sync-" + strconv.Itoa(i)
+		v := stressValue(key, 1000 + i * 5000)
+		if resp := command(t, rw, fmt.Sprintf("set %s 3 0 %d sync", key, len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+
+		// stored on owners before responded
+		owners := servers[0].cluster.Owners(key)
+		nodes := holders(servers, key)
+		if len(nodes) != 2 || addrs[nodes[0]] != owners[0] && addrs[nodes[0]] != owners[1] ||
+			addrs[nodes[1]] != owners[0] && addrs[nodes[1]] != owners[1] {
+			t.Fatalf("%s on nodes %v, expect owners %v", key, nodes, owners)
+		}
+		a := servers[nodes[0]].tenants.Select(key, "").entry.Get(key)
+		b := servers[nodes[1]].tenants.Select(key, "").entry.Get(key)
+		if a.casId != b.casId || a.flags != b.flags || a.byteLen != b.byteLen {
+			t.Fatalf("%s differs on replicas: %+v, %+v", key, a, b)
+		}
+
+		if resp := command(t, rw, "delete " + key + " sync", nil); resp != string(ResultDeleted) {
+			t.Fatalf("delete %s: %q", key, resp)
+		}
+		if nodes = holders(servers, key); len(nodes) != 0 {
+			t.Fatalf("%s left on nodes %v after deleted", key, nodes)
+		}
+	}
+}
+
+func TestReplication_Async(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startReplicaCluster(t, ReplicationAsync)
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[1])
+	defer conn.Close()
+	for i := 0; i < 20; i++ {
+		key := "async-" + strconv.Itoa(i)
+		v := stressValue(key, 2000)
+		if resp := command(t, rw, fmt.Sprintf("set %s 0 0 %d", key, len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+		if resp := command(t, rw, "touch " + key + " 300", nil); resp != string(ResultTouched) {
+			t.Fatalf("touch %s: %q", key, resp)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		key := "async-" + strconv.Itoa(i)
+		waitFor(t, "replicas of " + key, func() bool {
+			return len(holders(servers, key)) == 2
+		})
+	}
+
+	for i := 0; i < 20; i++ {
+		key := "async-" + strconv.Itoa(i)
+		if resp := command(t, rw, "delete " + key, nil); resp != string(ResultDeleted) {
+			t.Fatalf("delete %s: %q", key, resp)
+		}
+		waitFor(t, "delete of " + key + " on replicas", func() bool {
+			return len(holders(servers, key)) == 0
+		})
+	}
+}
+
+func TestReplication_ReadFallback(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startReplicaCluster(t, ReplicationSync)
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "fallback-" + strconv.Itoa(i)
+		v := stressValue(keys[i], 50000)
+		if resp := command(t, rw, fmt.Sprintf("set %s 0 0 %d", keys[i], len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", keys[i], resp)
+		}
+		// item lost on primary
+		primary := nodeIndex(addrs, servers[0].cluster.Owners(keys[i])[0])
+		_ = servers[primary].tenants.Select(keys[i], "").entry.Remove(keys[i])
+	}
+
+	for _, addr := range addrs {
+		c, r := dialTest(t, addr)
+		for _, key := range keys {
+			fmt.Fprintf(r, "get %s\r\n", key)
+			r.Flush()
+			v, err := readStressValue(r)
+			if err != nil || !bytes.Equal(v, stressValue(key, 50000)) {
+				t.Fatalf("get %s from %s missed on primary: %d bytes, %v", key, addr, len(v), err)
+			}
+			if resp := command(t, r, "mg " + key + " s", nil); resp != "HD s50000\r\n" {
+				t.Fatalf("mg %s from %s missed on primary: %q", key, addr, resp)
+			}
+		}
+		c.Close()
+	}
+
+	// primary unreachable from the first node
+	for _, key := range keys {
+		if primary := servers[0].cluster.Owners(key)[0]; primary != addrs[0] {
+			servers[0].cluster.pools[primary].addr = "127.0.0.1:1"
+		}
+	}
+	for _, key := range keys {
+		fmt.Fprintf(rw, "get %s\r\n", key)
+		rw.Flush()
+		if v, err := readStressValue(rw); err != nil || !bytes.Equal(v, stressValue(key, 50000)) {
+			t.Fatalf("get %s with primary unreachable: %d bytes, %v", key, len(v), err)
+		}
+	}
+}
+
+func TestReplication_Flush(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startReplicaCluster(t, ReplicationSync)
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[2])
+	defer conn.Close()
+	for i := 0; i < 30; i++ {
+		v := []byte("flush")
+		if resp := command(t, rw, fmt.Sprintf("set flush-%d 0 0 %d", i, len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set: %q", resp)
+		}
+	}
+	if resp := command(t, rw, "flush_all", nil); resp != string(ResultOK) {
+		t.Fatalf("flush_all: %q", resp)
+	}
+	for i, s := range servers {
+		if n := s.tenants.Select("", "").entry.Len(); n != 0 {
+			t.Errorf("%d items left on node %d after flush", n, i)
+		}
+	}
+}
+
+// gets returns value and cas unique of key
+func gets(t *testing.T, conn io.Writer, rw interface {
+	io.Reader
+	ReadString(byte) (string, error)
+}, key string) ([]byte, uint64) {
+	fmt.Fprintf(conn, "gets %s\r\n", key)
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 5 {
+		t.Fatalf("gets %s: %q", key, line)
+	}
+	size, _ := strconv.Atoi(fields[3])
+	cas, _ := strconv.ParseUint(fields[4], 10, 64)
+	v := make([]byte, size + len(Crlf))
+	if _, err = io.ReadFull(rw, v); err != nil {
+		t.Fatal(err)
+	}
+	if end, _ := rw.ReadString('\n'); end != string(ResultEnd) {
+		t.Fatalf("gets %s ended with %q", key, end)
+	}
+	return v[:size], cas
+}
+
+func TestReplication_CAS(t *testing.T) {
+	defer quietLogs()()
+	addrs, servers, stop := startReplicaCluster(t, ReplicationSync)
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	v := []byte("first")
+	if resp := command(t, rw, fmt.Sprintf("set cas-key 0 0 %d", len(v)), v); resp != string(ResultStored) {
+		t.Fatalf("set: %q", resp)
+	}
+	_, cas := gets(t, conn, rw, "cas-key")
+
+	v = []byte("second")
+	if resp := command(t, rw, fmt.Sprintf("cas cas-key 0 0 %d %d", len(v), cas), v); resp != string(ResultStored) {
+		t.Fatalf("cas with unique of item: %q", resp)
+	}
+	if resp := command(t, rw, fmt.Sprintf("cas cas-key 0 0 %d %d", len(v), cas), v); resp != string(ResultExists) {
+		t.Fatalf("cas with old unique: %q", resp)
+	}
+	if resp := command(t, rw, fmt.Sprintf("cas cas-missing 0 0 %d %d", len(v), cas), v); resp != string(ResultNotFound) {
+		t.Fatalf("cas on missing key: %q", resp)
+	}
+
+	// cas unique is the same on replicas, and from any node
+	got, newCas := gets(t, conn, rw, "cas-key")
+	if string(got) != "second" || newCas == cas {
+		t.Fatalf("gets after cas: %q, %d", got, newCas)
+	}
+	for _, i := range holders(servers, "cas-key") {
+		if id := servers[i].tenants.Select("", "").entry.Get("cas-key").casId; id != newCas {
+			t.Errorf("cas unique on node %d: %d, expect %d", i, id, newCas)
+		}
+	}
+	if newCas & CASNodeMax != cas & CASNodeMax {
+		t.Errorf("cas unique %d and %d by the same primary with different node ids", cas, newCas)
+	}
+}
+
+func TestReplication_Tenant(t *testing.T) {
+	defer quietLogs()()
+	auth := clusterAuth(t)
+	addrs, servers, stop := startTestCluster(t, 3, func(c *MemConfig) {
+		auth(c)
+		c.Cluster.Replicas = 2
+		c.Cluster.Replication = ReplicationSync
+	})
+	defer stop()
+
+	conn, rw := dialTest(t, addrs[0])
+	defer conn.Close()
+	if resp := command(t, rw, "auth alice secret", nil); resp != string(ResultOK) {
+		t.Fatalf("auth: %q", resp)
+	}
+	// replicas are kept in tenant of the key
+	inTenant := func(key string) (n int) {
+		for _, s := range servers {
+			if s.tenants.Get("team").entry.Get(key) != nil {
+				n++
+			}
+		}
+		return
+	}
+	for i := 0; i < 10; i++ {
+		key := "team-" + strconv.Itoa(i)
+		v := stressValue(key, 1000)
+		if resp := command(t, rw, fmt.Sprintf("set %s 0 0 %d", key, len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+		if n := inTenant(key); n != 2 {
+			t.Fatalf("%s stored in tenant on %d nodes", key, n)
+		}
+		if resp := command(t, rw, "delete " + key, nil); resp != string(ResultDeleted) {
+			t.Fatalf("delete %s: %q", key, resp)
+		}
+		if n := inTenant(key); n != 0 {
+			t.Fatalf("%s left in tenant on %d nodes after deleted", key, n)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package filerelay
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+
+func TestSlot_Pin(t *testing.T) {
+	slab := NewSlab(64, 1, SlabCheckInterval, SlabBackendHeap)
+	slot := slab.FindAvailableSlot()
+	slot.key, slot.used, slot.filling = "pin-test", 10, false
+	slot.setAt, slot.duration = time.Now().Add(-time.Minute), time.Second //expired
+
+	if _, ok := slot.Pin(slot.Gen()); !ok {
+		t.Fatal("expect slot pinned")
+	}
+	if slab.FindAvailableSlot() != nil {
+		t.Error("pinned slot should not be found available")
+	}
+	slot.Unpin()
+	if slab.FindAvailableSlot() != slot {
+		t.Error("expired slot should be found available after unpinned")
+	}
+	if _, ok := slot.Pin(slot.Gen() - 1); ok {
+		t.Error("slot taken for another generation should not be pinned")
+	}
+}
+
+func TestMetaItem_Pin(t *testing.T) {
+	slab := NewSlab(64, 2, SlabCheckInterval, SlabBackendHeap)
+	item := NewMetaItem("pin-item", 0, 600, 100)
+	for i := 0; i < 2; i++ {
+		s := slab.FindAvailableSlot()
+		s.SetInfoWithItem(item)
+		s.key, s.used, s.filling = item.key, 50, false
+		item.takeSlots([]*Slot{s})
+	}
+
+	value, intact := item.Pin()
+	if !intact || len(value.data) != 2 || !item.slots[0].Pinned() || !item.slots[1].Pinned() {
+		t.Fatal("expect slots of item pinned")
+	}
+	value.Unpin()
+
+	item.slots[1].take() //taken for others
+	if _, intact = item.Pin(); intact || item.slots[0].Pinned() || item.slots[1].Pinned() {
+		t.Error("expect slots unpinned for item not intact")
+	}
+}
+
+
+// newBenchValue prepares slots holding a 10MB value, and a connection to write to with a reader discarding data
+func newBenchValue(b *testing.B) (*MetaItem, net.Conn) {
+	const slotCap, slotCount = szMB, 10
+	slab := NewSlab(slotCap, slotCount, SlabCheckInterval, SlabBackendHeap)
+	item := NewMetaItem("bench", 0, 600, slotCap * slotCount)
+	for i := 0; i < slotCount; i++ {
+		s := slab.FindAvailableSlot()
+		s.used, s.filling = slotCap, false
+		item.takeSlots([]*Slot{s})
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		c, e := ln.Accept()
+		ln.Close()
+		if e == nil {
+			_, _ = io.Copy(ioutil.Discard, c)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(slotCap * slotCount))
+	return item, conn
+}
+
+// BenchmarkRetrieval_Copy writes value through buffer of connection, as it was before writev
+func BenchmarkRetrieval_Copy(b *testing.B) {
+	item, conn := newBenchValue(b)
+	defer conn.Close()
+	w := bufio.NewWriter(conn)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = w.WriteString("VALUE bench 0 10485760\r\n")
+		for _, s := range item.slots {
+			_, _ = w.Write(s.Data())
+		}
+		_, _ = w.Write(Crlf)
+		_, _ = w.Write(ResultEnd)
+		if err := w.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRetrieval_Writev(b *testing.B) {
+	item, conn := newBenchValue(b)
+	defer conn.Close()
+	sc := MakeServConn(conn, 0)
+	h := &handler{}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		value, _ := item.Pin()
+		err := h.writeValue(sc, []byte("VALUE bench 0 10485760\r\n"), value, ResultEnd)
+		value.Unpin()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
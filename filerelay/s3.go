@@ -0,0 +1,505 @@
+package filerelay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+const (
+	PersistS3 = "s3"
+
+	S3Region = "us-east-1"
+	S3KeyTemplate = "{key}"
+	S3PartSize = 8 * 1024 * 1024 //values larger than it are uploaded in parts of it
+	S3Retries = 3
+	S3RetryBackoff = 200 //milliseconds before the first retry, doubled for every next one
+	S3Timeout = 30 //seconds
+
+	_S3MinPartSize = 5 * 1024 * 1024 //parts except the last one can't be smaller in S3
+	_S3MaxParts = 10000
+	_S3Algorithm = "AWS4-HMAC-SHA256"
+	_S3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	_S3DateFormat = "20060102T150405Z"
+	_S3FlagsHeader = "X-Amz-Meta-Flags"
+)
+
+
+// S3Error is an error response of S3
+type S3Error struct {
+	Status int
+	Code string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3 error %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *S3Error) retryable() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+func s3ErrorOf(resp *http.Response) *S3Error {
+	e := &S3Error{Status: resp.StatusCode}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	_ = xml.Unmarshal(data, e)
+	if e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+
+
+
+// s3Signer signs requests by AWS signature version 4, with payload unsigned
+type s3Signer struct {
+	accessKey string
+	secretKey string
+	sessionToken string
+	region string
+}
+
+// sign adds date, payload hash and authorization headers to req
+func (s *s3Signer) sign(req *http.Request, now time.Time) {
+	stamp := now.UTC().Format(_S3DateFormat)
+	req.Header.Set("X-Amz-Date", stamp)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", _S3UnsignedPayload)
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" || name == "content-md5" {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		_S3Algorithm, s.accessKey, s.scope(stamp), strings.Join(signed, ";"), s.signature(req, signed, stamp)))
+}
+
+func (s *s3Signer) scope(stamp string) string {
+	return stamp[:8] + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature of req with headers signed and date stamp, for both signing and verifying
+func (s *s3Signer) signature(req *http.Request, signed []string, stamp string) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(s3CanonicalQuery(req.URL.Query()) + "\n")
+	for _, name := range signed {
+		value := host
+		if name != "host" {
+			value = strings.Join(req.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+		canonical.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical.WriteString("\n" + strings.Join(signed, ";") + "\n")
+	canonical.WriteString(req.Header.Get("X-Amz-Content-Sha256"))
+
+	hash := sha256.Sum256([]byte(canonical.String()))
+	toSign := _S3Algorithm + "\n" + stamp + "\n" + s.scope(stamp) + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{stamp[:8], s.region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	return hex.EncodeToString(key)
+}
+
+// s3Escape encodes all bytes except unreserved ones as AWS requires, and also '/' if it's not path
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || path && c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery is sorted by name and value, also used as query of requests
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(name, false) + "=" + s3Escape(v, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+
+
+
+// s3Backend keeps values as objects in a bucket of S3 or any storage compatible with it,
+// named by key template; Flags of items are kept in metadata of objects.
+type s3Backend struct {
+	client *http.Client
+	endpoint *url.URL
+	bucket string
+	keyTemplate string
+	pathStyle bool //bucket in path instead of host name
+	signer s3Signer
+
+	partSize int64
+	retries int
+	backoff time.Duration
+}
+
+func newS3Backend(name string, options map[string]string) (PersistBackend, error) {
+	b := &s3Backend{
+		bucket: options["bucket"],
+		keyTemplate: options["key-template"],
+		signer: s3Signer{
+			accessKey: options["access-key"],
+			secretKey: options["secret-key"],
+			sessionToken: options["session-token"],
+			region: options["region"],
+		},
+		partSize: S3PartSize,
+		retries: S3Retries,
+		backoff: time.Millisecond * S3RetryBackoff,
+	}
+	if b.bucket == "" {
+		return nil, errors.New("bucket of s3 backend not set")
+	}
+	if b.keyTemplate == "" {
+		b.keyTemplate = S3KeyTemplate
+	} else if !strings.Contains(b.keyTemplate, "{key}") && !strings.Contains(b.keyTemplate, "{base64}") {
+		return nil, errors.New("key template of s3 backend without {key} or {base64}")
+	}
+	if b.signer.region == "" {
+		b.signer.region = S3Region
+	}
+	if b.signer.accessKey == "" {
+		b.signer.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		b.signer.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		b.signer.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if b.signer.accessKey == "" || b.signer.secretKey == "" {
+		return nil, errors.New("credentials of s3 backend not set")
+	}
+
+	endpoint := options["endpoint"]
+	if endpoint == "" {
+		endpoint = "https://s3." + b.signer.region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("invalid endpoint of s3 backend: " + endpoint)
+	}
+	b.endpoint = u
+
+	var e error
+	ints := []struct {
+		name string
+		set func(int64)
+	}{
+		{"part-size", func(n int64) { b.partSize = n }},
+		{"retries", func(n int64) { b.retries = int(n) }},
+		{"retry-backoff", func(n int64) { b.backoff = time.Millisecond * time.Duration(n) }},
+		{"timeout", func(n int64) { b.client = &http.Client{Timeout: time.Second * time.Duration(n)} }},
+	}
+	for _, opt := range ints {
+		if v := options[opt.name]; v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s of s3 backend: %s", opt.name, v)
+			}
+			opt.set(n)
+		}
+	}
+	if v := options["path-style"]; v != "" {
+		if b.pathStyle, e = strconv.ParseBool(v); e != nil {
+			return nil, errors.New("invalid path-style of s3 backend: " + v)
+		}
+	}
+	if b.partSize < _S3MinPartSize {
+		return nil, fmt.Errorf("part-size of s3 backend less than %d", _S3MinPartSize)
+	}
+	if b.client == nil {
+		b.client = &http.Client{Timeout: time.Second * S3Timeout}
+	}
+	return b, nil
+}
+
+// object is name of object for key by template
+func (b *s3Backend) object(key string) string {
+	return strings.NewReplacer(
+		"{key}", key,
+		"{hash}", fmt.Sprintf("%02x", keyHash(key) & 0xff),
+		"{base64}", base64.RawURLEncoding.EncodeToString([]byte(key)),
+	).Replace(b.keyTemplate)
+}
+
+func (b *s3Backend) url(object string, query url.Values) *url.URL {
+	u := *b.endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/"
+	if b.pathStyle {
+		path += b.bucket + "/"
+	} else {
+		u.Host = b.bucket + "." + u.Host
+	}
+	u.Path = path + object
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// s3Body makes a new body of request for every attempt
+type s3Body func() (io.Reader, int64)
+
+// do sends request signed, and retries with backoff on failures of network, or 5xx and 429 responses;
+// Responses of other errors are returned as S3Error.
+func (b *s3Backend) do(method, object string, query url.Values, header http.Header, body s3Body) (*http.Response, error) {
+	var err error
+	for attempt := 0; attempt <= b.retries; attempt++ {
+		if attempt > 0 {
+			backoff := b.backoff << uint(attempt - 1)
+			time.Sleep(backoff / 2 + time.Duration(rand.Int63n(int64(backoff / 2) + 1)))
+			logger.Debugf("Retry %d of s3 %s %s: %v", attempt, method, object, err.Error())
+		}
+
+		req := &http.Request{
+			Method: method,
+			URL: b.url(object, query),
+			Header: make(http.Header),
+			Body: http.NoBody,
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if body != nil {
+			r, size := body()
+			if size > 0 {
+				req.Body, req.ContentLength = ioutil.NopCloser(r), size
+			}
+		}
+		b.signer.sign(req, time.Now())
+
+		var resp *http.Response
+		if resp, err = b.client.Do(req); err != nil {
+			continue
+		}
+		if resp.StatusCode / 100 == 2 {
+			return resp, nil
+		}
+		e := s3ErrorOf(resp)
+		resp.Body.Close()
+		if !e.retryable() {
+			return nil, e
+		}
+		err = e
+	}
+	return nil, err
+}
+
+// Put uploads value in one request, or in parts when it's larger than part size;
+// Value is read at offsets without being copied when r is io.ReaderAt, like the one of slots,
+// otherwise every request is buffered for retries.
+func (b *s3Backend) Put(key string, r io.Reader, meta PersistMeta) error {
+	object := b.object(key)
+	header := http.Header{_S3FlagsHeader: {strconv.FormatUint(uint64(meta.Flags), 10)}}
+	if meta.Size <= b.partSize {
+		body, err := b.body(r, 0, meta.Size)
+		if err != nil {
+			return err
+		}
+		resp, err := b.do(http.MethodPut, object, nil, header, body)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return b.putParts(object, r, meta.Size, header)
+}
+
+// body reads size bytes of value at off
+func (b *s3Backend) body(r io.Reader, off, size int64) (s3Body, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return func() (io.Reader, int64) {
+			return io.NewSectionReader(ra, off, size), size
+		}, nil
+	}
+	buf := make([]byte, size)
+	if _, e := io.ReadFull(r, buf); e != nil {
+		return nil, e
+	}
+	return func() (io.Reader, int64) {
+		return bytes.NewReader(buf), size
+	}, nil
+}
+
+// s3Part is in request to complete multipart upload
+type s3Part struct {
+	Number int `xml:"PartNumber"`
+	ETag string `xml:"ETag"`
+}
+
+// putParts uploads value by multipart upload, aborted on failure
+func (b *s3Backend) putParts(object string, r io.Reader, size int64, header http.Header) error {
+	partSize := b.partSize
+	for (size + partSize - 1) / partSize > _S3MaxParts {
+		partSize *= 2
+	}
+
+	resp, err := b.do(http.MethodPost, object, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err == nil && initiated.UploadId == "" {
+		err = errors.New("s3 multipart upload without id")
+	}
+	if err != nil {
+		return err
+	}
+	upload := url.Values{"uploadId": {initiated.UploadId}}
+
+	err = func() error {
+		var parts []s3Part
+		for off, n := int64(0), 1; off < size; off, n = off + partSize, n + 1 {
+			length := partSize
+			if size - off < length {
+				length = size - off
+			}
+			body, e := b.body(r, off, length)
+			if e != nil {
+				return e
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": upload["uploadId"]}
+			resp, e := b.do(http.MethodPut, object, query, nil, body)
+			if e != nil {
+				return e
+			}
+			resp.Body.Close()
+			parts = append(parts, s3Part{Number: n, ETag: resp.Header.Get("ETag")})
+		}
+
+		complete, e := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts []s3Part `xml:"Part"`
+		}{Parts: parts})
+		if e != nil {
+			return e
+		}
+		resp, e := b.do(http.MethodPost, object, upload, http.Header{"Content-Type": {"application/xml"}}, func() (io.Reader, int64) {
+			return bytes.NewReader(complete), int64(len(complete))
+		})
+		if e != nil {
+			return e
+		}
+		defer resp.Body.Close()
+		// failure of completing may come after status 200
+		data, e := ioutil.ReadAll(resp.Body)
+		if e == nil && bytes.Contains(data, []byte("<Error>")) {
+			s3e := &S3Error{Status: resp.StatusCode}
+			_ = xml.Unmarshal(data, s3e)
+			e = s3e
+		}
+		return e
+	}()
+	if err != nil {
+		if resp, e := b.do(http.MethodDelete, object, upload, nil, nil); e == nil {
+			resp.Body.Close()
+		} else {
+			logger.Warnf("Abort of s3 multipart upload of %s failed: %v", object, e.Error())
+		}
+	}
+	return err
+}
+
+func (b *s3Backend) meta(resp *http.Response) (PersistMeta, error) {
+	meta := PersistMeta{Size: resp.ContentLength}
+	if meta.Size < 0 {
+		return meta, errors.New("s3 object without content length")
+	}
+	if v := resp.Header.Get(_S3FlagsHeader); v != "" {
+		flags, e := strconv.ParseUint(v, 10, 32)
+		if e != nil {
+			return meta, ErrPersistBroken
+		}
+		meta.Flags = uint32(flags)
+	}
+	meta.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return meta, nil
+}
+
+// notFound maps 404 to ErrPersistNotFound
+func notFound(err error) error {
+	if e, ok := err.(*S3Error); ok && e.Status == http.StatusNotFound {
+		return ErrPersistNotFound
+	}
+	return err
+}
+
+func (b *s3Backend) Get(key string) (io.ReadCloser, PersistMeta, error) {
+	resp, err := b.do(http.MethodGet, b.object(key), nil, nil, nil)
+	if err != nil {
+		return nil, PersistMeta{}, notFound(err)
+	}
+	meta, err := b.meta(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, meta, err
+	}
+	return resp.Body, meta, nil
+}
+
+func (b *s3Backend) Stat(key string) (PersistMeta, error) {
+	resp, err := b.do(http.MethodHead, b.object(key), nil, nil, nil)
+	if err != nil {
+		return PersistMeta{}, notFound(err)
+	}
+	resp.Body.Close()
+	return b.meta(resp)
+}
+
+// Delete succeeds for key not stored, as S3 does
+func (b *s3Backend) Delete(key string) error {
+	resp, err := b.do(http.MethodDelete, b.object(key), nil, nil, nil)
+	if err != nil {
+		return notFound(err)
+	}
+	return resp.Body.Close()
+}
@@ -2,13 +2,17 @@ package filerelay
 
 import (
 	"bufio"
+	"bytes"
 	linkedlist "container/list"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -38,7 +42,10 @@ const (
 	szGB
 )
 
-type HdrState byte
+// index of handlers serving commands setting up connections, and connections from peers, out of handlers for clients
+const _PeerHandler = -1
+
+type HdrState int32
 const (
 	HdrReady HdrState = iota + 0
 	HdrRunning
@@ -49,6 +56,7 @@ const (
 const (
 	CacheMinExpiration = 60
 	CacheMaxEXpiration = 60 * 10
+	ExpirationRelativeMax = 60 * 60 * 24 * 30 //expiration over 30 days is taken as absolute Unix time
 	SlabCheckInterval = 10
 )
 
@@ -56,27 +64,50 @@ var _StoreCmds = map[string]bool{
 	"set": true,
 	"add": true,
 	"replace": true,
+	"cas": true,
 }
 
+var (
+	ErrBadDataChunk = errors.New("bad data chunk")
+)
+
 
 type MemConfig struct {
 	Config `yaml:",inline"`
 
 	LRUSize int `yaml:"lru-size"` //mac count of items in LRU-list
-	SkipListCheckStep int `yaml:"skiplist-check-step"`
-	//SkipListCheckIntv `yaml:"skiplist-check-interval"` int //in seconds
+	EvictionPolicy string `yaml:"eviction-policy"` //lru, slru or tinylfu
+	ExpireBatch int `yaml:"expire-batch"` //max items to remove in every check of expiration per second
+	ItemShards int `yaml:"item-shards"` //count of independently locked partitions of items in tenant
 
 	MinExpiration int64 `yaml:"min-expiration"` //in seconds
+	MaxExpiration int64 `yaml:"max-expiration"` //in seconds
+	DefaultExpiration int64 `yaml:"default-expiration"` //in seconds; for items stored with expiration 0
 	SlabCheckIntv int `yaml:"slab-check-interval"` //in seconds
+	SlabAutomove bool `yaml:"slab-automove"`
+	SlabAutomoveIntv int `yaml:"slab-automove-interval"` //in seconds
+	SlabIdleReclaim int `yaml:"slab-idle-reclaim"` //in seconds; release slabs vacant for the period, 0 to disable
 
 	SlotCapMin uint64 `yaml:"slot-capacity-min"` //in bytes
 	SlotCapMax uint64  `yaml:"slot-capacity-max"` //in bytes
 
 	SlotsInSlab int `yaml:"slots-in-slab"`
 	SlabsInGroup int `yaml:"slabs-in-group"`
+	SlabBackend string `yaml:"slab-backend"` //heap, or mmap for slots out of Go heap
+	StorageFull string `yaml:"storage-full"` //fail, or evict items for slots when storage is full
 
 	MaxStorage string `yaml:"max-storage"` //example: 200MB, 2GB`
 
+	AuthConfig `yaml:",inline"`
+	ACL []ACLRule `yaml:"acl"`
+	Tenants []TenantConfig `yaml:"tenants"`
+	RateLimits []RateLimitConfig `yaml:"rate-limits"`
+	Cluster ClusterConfig `yaml:"cluster"`
+	Persist PersistConfig `yaml:"persist"`
+	Spill SpillConfig `yaml:"spill"`
+	WAL WALConfig `yaml:"wal"`
+	SnapshotFile string `yaml:"snapshot-file"` //items are saved into it on stop and loaded on start; disabled when not set
+
 	// the following will not read from configuration data/file
 	maxStorageSize uint64
 	totalCapacity uint64
@@ -85,28 +116,41 @@ type MemConfig struct {
 
 func NewMemConfig() *MemConfig {
 	return &MemConfig{
+		Config: Config{
+			IdleTimeout: ConnIdleTimeout,
+		},
+
 		LRUSize: 100000,
-		SkipListCheckStep: 20,
-		//SkipListCheckIntv: 60,
+		EvictionPolicy: EvictionLRU,
+		ExpireBatch: ExpireBatch,
+		ItemShards: ItemShards,
 
 		MinExpiration: CacheMinExpiration,
+		MaxExpiration: CacheMaxEXpiration,
+		DefaultExpiration: CacheMaxEXpiration,
 		SlabCheckIntv: SlabCheckInterval,
+		SlabAutomoveIntv: SlabAutomoveInterval,
 	
 		SlotCapMin: ValFrom(sz16B, sz64B).(uint64),
 		SlotCapMax: ValFrom(sz64KB, szMB).(uint64),
 	
 		SlotsInSlab: ValFrom(10, 100).(int),
 		SlabsInGroup: ValFrom(20, 100).(int),
+		SlabBackend: SlabBackendHeap,
+		StorageFull: StorageFullFail,
 
 		MaxStorage: "200MB",
 	}
 }
 
 func (c *MemConfig) MaxStorageSize() uint64 {
-	defSize := 100 * szMB
+	return parseStorageSize(c.MaxStorage, 100 * szMB)
+}
+
+func parseStorageSize(size string, defSize uint64) uint64 {
 	patn := `^([1-9]\d{0,3})([MG]B)$`
 	reg := regexp.MustCompile(patn)
-	matches := reg.FindAllSubmatch([]byte(c.MaxStorage), -1)
+	matches := reg.FindAllSubmatch([]byte(size), -1)
 	if len(matches) == 0 {
 		return defSize
 	}
@@ -133,6 +177,12 @@ func (c *MemConfig) AddCapToTotal(cap uint64) {
 	c.Unlock()
 }
 
+func (c *MemConfig) RemoveCapFromTotal(cap uint64) {
+	c.Lock()
+	c.totalCapacity -= cap
+	c.Unlock()
+}
+
 func (c *MemConfig) TotalCapacity() uint64 {
 	c.Lock()
 	total := c.totalCapacity
@@ -149,35 +199,91 @@ type ServConn struct {
 	rw *bufio.ReadWriter
 	index uint64
 
+	// identity of the authenticated user; empty before authentication
+	identity string
+	// node declared by peer in cluster; commands from peers are served locally, never forwarded
+	peer string
+	// connection from peer for replication, on which changes are not replicated again
+	replica bool
+	// client of the next command, declared by peer forwarding or replicating the command
+	onBehalf *peerClient
+
+	timeout time.Duration //for every read from and write to connection; 0 for no timeout
 	timer *time.Timer
+	timedOut bool
 	closed bool
 }
 
 func MakeServConn(nc net.Conn, index uint64) *ServConn {
-	return &ServConn{
+	sc := &ServConn{
 		nc: nc,
-		rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
 		index: index,
 		closed: false,
 	}
+	sc.rw = bufio.NewReadWriter(bufio.NewReader(connReader{sc}), bufio.NewWriter(connWriter{sc}))
+	return sc
+}
+
+// connReader sets read deadline of connection before every read, so that a value block can take longer
+// than the timeout as a whole, as long as it keeps coming in
+type connReader struct {
+	sc *ServConn
+}
+
+func (r connReader) Read(b []byte) (int, error) {
+	if r.sc.timeout > 0 {
+		if e := r.sc.nc.SetReadDeadline(time.Now().Add(r.sc.timeout)); e != nil {
+			return 0, e
+		}
+	}
+	return r.sc.nc.Read(b)
+}
+
+// connWriter sets write deadline of connection before every write, so that a client not taking responses
+// never holds the handler, and slots of values pinned for it, for longer than the timeout
+type connWriter struct {
+	sc *ServConn
+}
+
+func (w connWriter) Write(b []byte) (int, error) {
+	if e := w.sc.extendWriteDeadline(); e != nil {
+		return 0, e
+	}
+	return w.sc.nc.Write(b)
+}
+
+func (sc *ServConn) extendWriteDeadline() error {
+	if sc.timeout <= 0 {
+		return nil
+	}
+	return sc.nc.SetWriteDeadline(time.Now().Add(sc.timeout))
+}
+
+// writeBuffers writes bufs to connection with writev, extending write deadline as long as client takes data
+func (sc *ServConn) writeBuffers(bufs net.Buffers) error {
+	for {
+		if e := sc.extendWriteDeadline(); e != nil {
+			return e
+		}
+		n, e := bufs.WriteTo(sc.nc)
+		if ne, ok := e.(net.Error); ok && ne.Timeout() && n > 0 {
+			continue
+		}
+		return e
+	}
 }
 
 func (sc *ServConn) Close() {
 	if !sc.closed {
 		sc.closed = true
 
-		timeout := true
-		if sc.timer != nil {
-			sc.timer.Stop()
-			sc.timer = nil
-			timeout = false
-		}
+		sc.CancelTimeOut()
 
 		if e := sc.nc.Close(); e != nil {
 			logger.Errorf("error in closing connection at index [%d]", sc.index)
 		}
 
-		if timeout {
+		if sc.timedOut {
 			logger.Warnf("connection timed out at index [%d]", sc.index)
 		} else {
 			logger.Infof("connection closed at index [%d]", sc.index)
@@ -189,12 +295,30 @@ func (sc *ServConn) AutoTimeOut() {
 	if sc.timer != nil {
 		return
 	}
-	sc.timer = time.NewTimer(time.Second * 10)
-	go func() {
-		<- sc.timer.C
+	sc.timer = time.AfterFunc(time.Second * 10, func() {
 		sc.timer = nil
+		sc.timedOut = true
 		sc.Close()
-	}()
+	})
+}
+
+// CancelTimeOut stops the timer for waiting in queue when the connection is picked up by handler
+func (sc *ServConn) CancelTimeOut() {
+	if sc.timer != nil {
+		sc.timer.Stop()
+		sc.timer = nil
+	}
+}
+
+// SetTimeout sets timeout for every read from connection, of command lines and value blocks, and for every write;
+// No data in the period means that the connection is idle, or the client is stuck in middle of a command.
+func (sc *ServConn) SetTimeout(secs int) error {
+	sc.timeout = time.Second * time.Duration(secs)
+	if secs <= 0 {
+		sc.timeout = 0
+		return sc.nc.SetDeadline(time.Time{})
+	}
+	return nil
 }
 
 
@@ -214,7 +338,9 @@ func NewWaitQueue(size int) *WaitQueue {
 }
 
 func (w *WaitQueue) Purge() {
+	w.Lock()
 	w.queue.Init()
+	w.Unlock()
 }
 
 func (w *WaitQueue) Push(sc *ServConn) {
@@ -241,6 +367,8 @@ func (w *WaitQueue) Pop() (sc *ServConn) {
 }
 
 func (w *WaitQueue) Len() int {
+	w.Lock()
+	defer w.Unlock()
 	return w.queue.Len()
 }
 
@@ -258,7 +386,9 @@ func NewReadyHandlers() *ReadyHandlers {
 }
 
 func (r *ReadyHandlers) Purge() {
+	r.Lock()
 	r.queue.Init()
+	r.Unlock()
 }
 
 func (r *ReadyHandlers) Push(h *handler) {
@@ -279,6 +409,8 @@ func (r *ReadyHandlers) Pop() (h *handler) {
 }
 
 func (r *ReadyHandlers) Len() int {
+	r.Lock()
+	defer r.Unlock()
 	return r.queue.Len()
 }
 
@@ -294,88 +426,188 @@ type Server struct {
 	readyHdrs *ReadyHandlers
 	waitQueue *WaitQueue
 	hdrNotif chan interface{}
+	connNotif chan bool //connection queued for handler
 	quit chan bool
 
-	memCfg MemConfig
-	entry *ItemsEntry
+	memCfg *MemConfig
+	tenants *TenantSet
+	limiter *Limiter
 	groups slabGroupMap
+	rebalancer *Rebalancer
+	reclaimer *Reclaimer
+	auth *Authenticator
+	acl *ACL
+	cluster *Cluster
+	persistence *Persistence
+	snapshot *Snapshot
+	spill *SpillStore
+	wal *WAL
+	startAt time.Time
 
 	sync.Mutex
 }
 
 
-func NewServer(c *MemConfig) *Server {
+func NewServer(c *MemConfig) (*Server, error) {
 	c.maxStorageSize = c.MaxStorageSize()
 	c.totalCapacity = 0
 	dtrace.Logf("## Start server with config: %+v", c)
 
+	if c.SlabBackend != SlabBackendHeap && c.SlabBackend != SlabBackendMmap {
+		return nil, errors.New("unknown slab backend: " + c.SlabBackend)
+	}
+	if c.MaxExpiration <= 0 {
+		c.MaxExpiration = CacheMaxEXpiration
+	}
+	if c.StorageFull != StorageFullFail && c.StorageFull != StorageFullEvict {
+		return nil, errors.New("unknown storage-full mode: " + c.StorageFull)
+	}
+
+	auth, err := NewAuthenticator(&c.AuthConfig)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := NewACL(c.ACL)
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := NewTenantSet(c)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := NewLimiter(c.RateLimits)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := NewCluster(&c.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	persistence, err := NewPersistence(&c.Persist)
+	if err != nil {
+		return nil, err
+	}
+	spill, err := NewSpillStore(&c.Spill)
+	if err != nil {
+		return nil, err
+	}
+	tenants.Each(func(t *Tenant) {
+		t.spill = spill
+	})
+	wal, err := NewWAL(&c.WAL)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Server{
 		maxRoutines: c.MaxRoutines,
 		handlers: make([]*handler, 0, c.MaxRoutines),
 		readyHdrs: NewReadyHandlers(),
 		waitQueue: NewWaitQueue(c.MaxRoutines * 10),
 		hdrNotif: make(chan interface{}, c.MaxRoutines),
+		connNotif: make(chan bool, 1),
 		quit: make(chan bool, 1),
 
-		memCfg: *c,
-		entry: NewItemsEntry(c.LRUSize, c.SkipListCheckStep),
+		memCfg: c,
+		tenants: tenants,
+		limiter: limiter,
 		groups: make( slabGroupMap ),
-	}
+		auth: auth,
+		acl: acl,
+		cluster: cluster,
+		persistence: persistence,
+		snapshot: NewSnapshot(c.SnapshotFile, tenants),
+		spill: spill,
+		wal: wal,
+	}, nil
 }
 
 func (s *Server) Start() {
+	s.startAt = time.Now()
 	s.initSlabs()
-	s.entry.StartCheck()
+	if s.memCfg.SlabAutomove {
+		s.rebalancer = NewRebalancer(s.memCfg, s.groups)
+		s.rebalancer.Start(s.memCfg.SlabAutomoveIntv)
+	}
+	if s.memCfg.SlabIdleReclaim > 0 {
+		s.reclaimer = NewReclaimer(s.memCfg, s.groups, s.memCfg.SlabIdleReclaim)
+		s.reclaimer.Start()
+	}
+	s.tenants.Each(func(t *Tenant) {
+		t.entry.StartCheck()
+	})
+	s.auth.StartWatch(s.memCfg.AuthReloadIntv)
+	s.spill.Start()
+	s.loadSnapshot()
+	s.replayWAL()
+	s.wal.Start()
+	s.cluster.Start(s.tenants)
 
 	go func() {
 		checks := 0
 		timeout := 50 * time.Millisecond
 
 		for {
+			var err error
+			for s.waitQueue.Len() > 0 {
+				e := s.handleNext()
+				if e != nil {
+					if e != err {
+						logger.Warnf("handling next: %v", e.Error())
+						err = e
+					}
+					checks++
+					break
+				}
+
+				err = e
+				checks = 0
+			}
+
+			to := timeout
+			if checks > 100 {
+				to *= 10
+			}
+			// waiting connections are handled again once a handler is free or a connection comes in
 			select {
 			case i := <- s.hdrNotif:
 				if h := i.(*handler); h != nil {
-					h.state = HdrReady
+					h.setState(HdrReady)
 					s.readyHdrs.Push(h)
 				}
 
+			case <- s.connNotif:
+
 			case <- s.quit:
 				dtrace.Log("quit server")
 				return
 
-			default:
-				var err error
-				for {
-					if s.waitQueue.Len() == 0 {
-						break
-					}
-					e := s.handleNext()
-					if e != nil {
-						if e != err {
-							logger.Warnf("handling next: %v", e.Error())
-							err = e
-						}
-						checks++
-						break
-					}
-
-					err = e
-					checks = 0
-				}
-
-				to := timeout
-				if checks > 100 {
-					to *= 10
-				}
-				time.Sleep(to)
+			case <- time.After(to):
 			}
 		}//for
 	}()
 }
 
 func (s *Server) Stop() {
-	s.entry.StopCheck()
+	s.tenants.Each(func(t *Tenant) {
+		t.entry.StopCheck()
+	})
+	s.auth.StopWatch()
+	if s.rebalancer != nil {
+		s.rebalancer.Stop()
+	}
+	if s.reclaimer != nil {
+		s.reclaimer.Stop()
+	}
 	s.quit <- true
+	if s.snapshot.Enabled() {
+		if _, e := s.snapshot.Save(); e != nil {
+			logger.Errorf("Snapshot on stop failed: %v", e.Error())
+		}
+	}
+	s.cluster.Close()
+	s.wal.Close()
+	s.spill.Close()
 	s.clearSlabs()
 
 	s.waitQueue.Purge()
@@ -394,7 +626,7 @@ func (s *Server) initSlabs() {
 	c := s.memCfg.SlotCapMin
 	for {
 		g := NewSlabGroup(c,
-			s.memCfg.SlabsInGroup, s.memCfg.SlotsInSlab, s.memCfg.SlabCheckIntv, s.memCfg.maxStorageSize)
+			s.memCfg.SlabsInGroup, s.memCfg.SlotsInSlab, s.memCfg.SlabCheckIntv, s.memCfg.maxStorageSize, s.memCfg.SlabBackend)
 		s.memCfg.AddCapToTotal( g.Capacity() )
 		s.groups[c] = g
 		dtrace.Logf("Check group: %d; %d, %v", len(s.groups), c, g)
@@ -420,9 +652,18 @@ func (s *Server) clearSlabs() {
 }
 
 
-//
+// Handle takes a new connection, which waits for its first command without a handler
 func (s *Server) Handle(sc *ServConn) {
+	go s.await(sc)
+}
+
+// queue puts connection with a command coming in to wait for a handler
+func (s *Server) queue(sc *ServConn) {
 	s.waitQueue.Push(sc)
+	select {
+	case s.connNotif <- true:
+	default:
+	}
 }
 
 //
@@ -433,7 +674,7 @@ func (s *Server) handleNext() error {
 		if cnt := len(s.handlers); cnt < s.maxRoutines {
 			dtrace.Logf("* Running handlers: %d", cnt)
 			s.Lock()
-			hdr = newHandler(cnt, s.hdrNotif, &s.memCfg, s.groups)
+			hdr = newHandler(cnt, s)
 			s.handlers = append(s.handlers, hdr)
 			s.Unlock()
 		}
@@ -452,14 +693,67 @@ func (s *Server) handleNext() error {
 	dtrace.Logf("* Process conn[%d] with handler: %d", sc.index, hdr.index)
 
 	go func(s *Server, h *handler, sc *ServConn) {
-		if e := h.process(sc, s.entry); e != nil {
+		keep, e := h.process(sc)
+		if e != nil {
 			logger.Errorf("error in handling connection[%d] by handler[%d]: %v", sc.index, h.index, e.Error())
 		}
-		sc.Close()
+		if !keep || e != nil {
+			sc.Close()
+			return
+		}
+		s.await(sc)
 	}(s, hdr, sc)
 	return nil
 }
 
+// await waits for the next command on connection without holding a handler, and queues the connection
+// once the command comes in; Connections idle for idle-timeout, or closed by client, are closed.
+// Commands setting up connection (auth, peer), and all commands on connection declared by peer, are served
+// at once with a handler of the connection, out of handlers for clients, so that commands forwarded between
+// nodes never wait for handlers taken by clients forwarding to each other.
+func (s *Server) await(sc *ServConn) {
+	var own *handler
+	for {
+		if e := sc.SetTimeout(s.memCfg.IdleTimeout); e != nil {
+			logger.Errorf("error in setting timeout of connection[%d]: %v", sc.index, e.Error())
+			sc.Close()
+			return
+		}
+		if sc.rw.Reader.Buffered() == 0 {
+			if _, e := sc.rw.Peek(1); e != nil {
+				if ne, ok := e.(net.Error); ok && ne.Timeout() {
+					logger.Infof("connection idle for too long at index [%d]", sc.index)
+				}
+				sc.Close()
+				return
+			}
+		}
+		if sc.peer == "" && !setupCommand(sc.rw.Reader) {
+			s.queue(sc)
+			return
+		}
+
+		if own == nil {
+			own = newHandler(_PeerHandler, s)
+			own.notif = nil
+		}
+		keep, e := own.process(sc)
+		if e != nil {
+			logger.Errorf("error in handling connection[%d] from peer [%s]: %v", sc.index, sc.peer, e.Error())
+		}
+		if !keep || e != nil {
+			sc.Close()
+			return
+		}
+	}
+}
+
+// setupCommand tells whether the command buffered on connection sets it up, as auth and peer do
+func setupCommand(r *bufio.Reader) bool {
+	buf, _ := r.Peek(r.Buffered())
+	return bytes.HasPrefix(buf, []byte("auth ")) || bytes.HasPrefix(buf, []byte("peer "))
+}
+
 
 
 
@@ -470,32 +764,61 @@ type handler struct {
 	index int
 
 	notif chan interface{}
-	state HdrState
+	state HdrState //changed by routines of server and of connection, by setState
 
 	cfg *MemConfig //only reference
 	groups slabGroupMap //only reference
+	auth *Authenticator //only reference
+	acl *ACL //only reference
+	tenants *TenantSet //only reference
+	limiter *Limiter //only reference
+	reclaimer *Reclaimer //only reference
+	cluster *Cluster //only reference
+	persistence *Persistence //only reference
+	snapshot *Snapshot //only reference
+	spill *SpillStore //only reference
+	wal *WAL //only reference
+	startAt time.Time
 }
 
-func newHandler(idx int, notif chan interface{}, c *MemConfig, groups slabGroupMap) *handler {
+func newHandler(idx int, s *Server) *handler {
 	return &handler{
 		index: idx,
-		notif: notif,
+		notif: s.hdrNotif,
 		state: HdrReady,
-		cfg: c,
-		groups: groups,
+		cfg: s.memCfg,
+		groups: s.groups,
+		auth: s.auth,
+		acl: s.acl,
+		tenants: s.tenants,
+		limiter: s.limiter,
+		reclaimer: s.reclaimer,
+		cluster: s.cluster,
+		persistence: s.persistence,
+		snapshot: s.snapshot,
+		spill: s.spill,
+		wal: s.wal,
+		startAt: s.startAt,
 	}
 }
 
 func (h *handler) stop() {
 	dtrace.Log("Handler stop at", h.index)
-	h.state = HdrQuit
+	h.setState(HdrQuit)
+}
+
+func (h *handler) setState(state HdrState) {
+	atomic.StoreInt32((*int32)(&h.state), int32(state))
 }
 
 
-func (h *handler) process(sc *ServConn, entry *ItemsEntry) error {
+// process serves the next command on connection, and tells whether the connection is kept for more commands;
+// The handler is given back after every command, so that connections left open hold no handler while idle.
+func (h *handler) process(sc *ServConn) (bool, error) {
 	//dtrace.Log("Nothing here in handler...")
 
-	h.state = HdrRunning
+	h.setState(HdrRunning)
+	sc.CancelTimeOut()
 
 	defer func() {
 		if err := recover(); err != nil {
@@ -505,18 +828,43 @@ func (h *handler) process(sc *ServConn, entry *ItemsEntry) error {
 			}).Errorf("handler-process failed: %v", err)
 		}
 
-		h.state = HdrIdle
+		h.setState(HdrIdle)
 		dtrace.Log("handler process completed at index with conn: ", h.index, sc.index)
-		h.notif <- h
+		if h.notif != nil {
+			h.notif <- h
+		}
 	}()
 
+	if e := sc.SetTimeout(h.cfg.IdleTimeout); e != nil {
+		return false, e
+	}
 	line, e := sc.rw.ReadSlice('\n')
 	if e != nil {
-		return e
+		if ne, ok := e.(net.Error); ok && ne.Timeout() {
+			logger.Infof("connection idle for too long at index [%d]", sc.index)
+			return false, nil
+		}
+		if e == io.EOF {
+			return false, nil
+		}
+		return false, e
+	}
+
+	var raw []byte //kept for forwarding in cluster
+	if h.cluster.Enabled() {
+		raw = append(raw, line...)
 	}
 
 	msgline := &MsgLine{}
-	msgline.parseLine(line)
+	if e := msgline.parseLine(line); e != nil {
+		h.writeClientError(sc.rw, e.Error())
+		return false, e
+	}
+	if msgline.Cmd == "" {
+		return true, nil
+	} else if msgline.Cmd == "quit" {
+		return false, nil
+	}
 	dtrace.Logf(" - Recv: %T %v\n - - - at handler[%d] with conn[%d]", msgline, msgline, h.index, sc.index)
 
 	log := logger.WithFields(logrus.Fields{
@@ -527,31 +875,249 @@ func (h *handler) process(sc *ServConn, entry *ItemsEntry) error {
 	})
 	log.Info("Incoming command")
 
+	if done, e := h.authenticate(msgline, sc); e != nil {
+		log.Warnf("Authentication failure: %v", e.Error())
+		return false, e
+	} else if done {
+		return true, nil
+	}
+
+	if msgline.Cmd == "peer" {
+		if !h.peerAllowed(sc) {
+			log.Warnf("Peer declared by [%s] denied", sc.identity)
+			h.writeClientError(sc.rw, ErrAccessDenied.Error())
+			return true, nil
+		}
+		sc.peer = msgline.Args[0]
+		sc.replica = len(msgline.Args) > 1 && msgline.Args[1] == PeerReplica
+		log.Infof("Connection from peer [%s], replica: %v", sc.peer, sc.replica)
+		if e := h.writeResult(sc.rw, ResultOK); e != nil {
+			return false, e
+		}
+		return true, nil
+	}
+	if msgline.Cmd == "as" {
+		if sc.peer == "" {
+			h.writeClientError(sc.rw, ErrAccessDenied.Error())
+			return true, nil
+		}
+		sc.onBehalf = parsePeerClient(msgline.Args)
+		return true, nil
+	}
+
+	// commands from peers are served for their clients
+	identity, tenant := sc.identity, (*Tenant)(nil)
+	if c := sc.onBehalf; c != nil {
+		sc.onBehalf = nil
+		if c.withIdentity {
+			identity = c.identity
+		}
+		tenant = h.tenants.Get(c.tenant)
+	}
+
+	if ok, e := h.authorize(msgline, sc, identity); e != nil {
+		return false, e
+	} else if !ok {
+		return true, nil
+	}
+
+	if tenant == nil {
+		tenant = h.tenants.Select(msgline.Key, identity)
+	}
+	sub := makeLimitSubject(sc, identity, tenant)
+	if e := h.limiter.Admit(&sub, limitCmd, 1); e != nil {
+		log.Warn("Command rejected by rate limit")
+		if e := h.rejectCommand(msgline, sc.rw, e); e != nil {
+			return false, e
+		}
+		return true, nil
+	}
+	h.limiter.Throttle(&sub, limitCmd, 1)
+
+	if h.cluster.Enabled() && sc.peer == "" && _ForwardCmds[msgline.Cmd] {
+		if done, e := h.forward(msgline, raw, sc, &sub); e != nil {
+			return false, e
+		} else if done {
+			return true, nil
+		}
+	}
+
+	if e := h.dispatch(msgline, sc, tenant, &sub); e != nil {
+		return false, e
+	}
+	return true, nil
+}
+
+func (h *handler) dispatch(msgline *MsgLine, sc *ServConn, tenant *Tenant, sub *limitSubject) error {
 	err := errors.New("unsupported command: " + msgline.Cmd)
 
 	if _StoreCmds[msgline.Cmd] {
-		err = h.handleStorage(msgline, sc.rw, entry)
+		err = h.handleStorage(msgline, sc, tenant, sub)
 	} else if msgline.Cmd == "get" || msgline.Cmd == "gets" {
-		err = h.handleRetrieval(msgline, sc.rw, entry)
+		err = h.handleRetrieval(msgline, sc, tenant, sub)
+	} else if msgline.Cmd == "mg" {
+		err = h.handleMetaGet(msgline, sc, tenant, sub)
+	} else if msgline.Cmd == "touch" {
+		err = h.handleTouch(msgline, sc, tenant)
+	} else if msgline.Cmd == "delete" {
+		err = h.handleDelete(msgline, sc, tenant)
+	} else if msgline.Cmd == "persist" {
+		err = h.handlePersist(msgline, sc, tenant)
+	} else if msgline.Cmd == "flush_all" {
+		err = h.handleFlush(msgline, sc)
+	} else if msgline.Cmd == "snapshot" {
+		err = h.handleSnapshot(msgline, sc)
+	} else if msgline.Cmd == "stats" {
+		err = h.handleStats(msgline, sc.rw)
 	}
 	return err
 }
 
 
+// authenticate handles authentication commands and returns true when the command is consumed by it;
+// Commands from unauthenticated connections which are not allowed result in error.
+func (h *handler) authenticate(msgline *MsgLine, sc *ServConn) (bool, error) {
+	if msgline.Cmd == "auth" {
+		if !h.auth.Enabled() {
+			h.writeClientError(sc.rw, "authentication not enabled")
+			return true, nil
+		}
+		user, token := msgline.Args[0], msgline.Args[1]
+		if !h.auth.Verify(user, token) {
+			h.writeClientError(sc.rw, ErrAuthFailed.Error())
+			return true, ErrAuthFailed
+		}
+		sc.identity = user
+		logger.Infof("Authenticated as [%s] for connection[%d]", user, sc.index)
+		return true, h.writeResult(sc.rw, ResultOK)
+	}
+
+	if !h.auth.Enabled() || sc.identity != "" || h.auth.Allowed(msgline.Cmd) {
+		return false, nil
+	}
+
+	// Memcached-style authentication with a fake "set" carrying credentials as its value
+	if msgline.Cmd == "set" {
+		if msgline.ValueLen > _AuthPayloadMax {
+			h.writeClientError(sc.rw, "authentication payload too long")
+			return true, ErrAuthFailed
+		}
+		payload := make([]byte, msgline.ValueLen + uint64(len(Crlf)))
+		if _, e := io.ReadFull(sc.rw, payload); e != nil {
+			return true, e
+		}
+		user, ok := h.auth.VerifyPayload(payload[:msgline.ValueLen])
+		if !ok {
+			h.writeClientError(sc.rw, ErrAuthFailed.Error())
+			return true, ErrAuthFailed
+		}
+		sc.identity = user
+		logger.Infof("Authenticated as [%s] for connection[%d]", user, sc.index)
+		return true, h.writeResult(sc.rw, ResultStored)
+	}
+
+	h.writeClientError(sc.rw, ErrUnauthenticated.Error())
+	return true, ErrUnauthenticated
+}
+
+// peerAllowed tells whether the connection may declare itself as peer:
+// authenticated with credentials of cluster, or granted admin permission by ACL
+func (h *handler) peerAllowed(sc *ServConn) bool {
+	if h.cluster.Enabled() && h.cluster.cfg.AuthUser != "" && sc.identity == h.cluster.cfg.AuthUser {
+		return true
+	}
+	if h.acl.Enabled() {
+		return h.acl.Check(sc.identity, "peer", "")
+	}
+	return !h.auth.Enabled()
+}
+
+// authorize checks the command of the identity against ACL, and responds with denial if it's not allowed
+func (h *handler) authorize(msgline *MsgLine, sc *ServConn, identity string) (bool, error) {
+	if !h.acl.Enabled() {
+		return true, nil
+	}
+
+	log := logger.WithFields(logrus.Fields{
+		"cmd": msgline.Cmd,
+		"itemKey": msgline.Key,
+		"identity": identity,
+		"handler": h.index,
+		"conn": sc.index,
+	})
+
+	if h.acl.Check(identity, msgline.Cmd, msgline.Key) {
+		log.Debug("ACL allowed")
+		return true, nil
+	}
+	log.Warn("ACL denied")
+
+	if _StoreCmds[msgline.Cmd] {
+		if _, e := sc.rw.Discard(int(msgline.ValueLen) + len(Crlf)); e != nil {
+			return false, e
+		}
+	}
+	h.writeClientError(sc.rw, ErrAccessDenied.Error())
+	return false, nil
+}
+
+// rejectCommand skips value block of storage command and responds with server error
+func (h *handler) rejectCommand(msgline *MsgLine, rw *bufio.ReadWriter, reason error) error {
+	if _StoreCmds[msgline.Cmd] {
+		if _, e := rw.Discard(int(msgline.ValueLen) + len(Crlf)); e != nil {
+			return e
+		}
+	}
+	h.writeServerError(rw, reason.Error())
+	return nil
+}
+
+func (h *handler) writeResult(rw *bufio.ReadWriter, result []byte) error {
+	if _, e := rw.Write(result); e != nil {
+		return e
+	}
+	return rw.Flush()
+}
 
-func (h *handler) handleStorage(msgline *MsgLine, rw *bufio.ReadWriter, entry *ItemsEntry) error {
+func (h *handler) writeClientError(rw *bufio.ReadWriter, info string) {
+	h.writeError(rw, ResultClientErrorPrefix, info)
+}
+
+func (h *handler) writeServerError(rw *bufio.ReadWriter, info string) {
+	h.writeError(rw, ResultServerErrorPrefix, info)
+}
+
+func (h *handler) writeError(rw *bufio.ReadWriter, prefix []byte, info string) {
+	line := make([]byte, 0, len(prefix) + len(info) + len(Crlf))
+	line = append(line, prefix...)
+	line = append(line, info...)
+	line = append(line, Crlf...)
+	if e := h.writeResult(rw, line); e != nil {
+		logger.Errorf("Write error failed at handler[%d]: %v", h.index, e.Error())
+	}
+}
+
+
+
+func (h *handler) handleStorage(msgline *MsgLine, sc *ServConn, tenant *Tenant, sub *limitSubject) error {
+	rw := sc.rw
 	log := logger.WithFields(logrus.Fields{
 		"cmd": msgline.Cmd,
 		"itemKey": msgline.Key,
 		"valueLen": msgline.ValueLen,
+		"tenant": tenant.name,
 		"handler": h.index,
 	})
 
-	exp := msgline.Expiration
-	if exp < h.cfg.MinExpiration {
-		exp = h.cfg.MinExpiration
-	} else if exp > CacheMaxEXpiration {
-		exp = CacheMaxEXpiration
+	if e := h.limiter.Admit(sub, limitUpload, msgline.ValueLen); e != nil {
+		log.Warn("Upload rejected by rate limit")
+		return h.rejectCommand(msgline, rw, e)
+	}
+
+	entry := tenant.entry
+	exp, expired := tenant.ResolveExpiration(msgline.Expiration, time.Now())
+	if expired {
+		return h.storeExpired(msgline, sc, tenant)
 	}
 
 	makeResp := func(cmd []byte) {
@@ -562,19 +1128,28 @@ func (h *handler) handleStorage(msgline *MsgLine, rw *bufio.ReadWriter, entry *I
 			log.Errorf("Flush buffer error: %v", e.Error())
 		}
 	}
+	// value left is skipped with its trailer for the command failed, and the connection goes on,
+	// unless the value can't be read any more
 	failResp := func(e error, bytsLeft uint64) error {
-		n, err := rw.Discard(int(bytsLeft))
+		if readFailed(e) {
+			return e
+		}
+		n, err := rw.Discard(int(bytsLeft) + len(Crlf))
 		if err != nil {
-			log.Errorf("Discard bytes error: %v", e.Error())
+			log.Errorf("Discard bytes error: %v", err.Error())
+			return err
 		} else {
 			log.Infof("Discard bytes: %d", n)
 		}
-		makeResp(ResultNotStored)
+		makeResp(storageResult(msgline.Cmd, e))
+		tenant.countSet(false)
 		dtrace.Logf("Storage request failure for key[%s] at handler[%d]: %v", msgline.Key, h.index, e.Error())
-		return e
+		return nil
 	}
 
 	item := NewMetaItem(msgline.Key, msgline.Flags, exp, msgline.ValueLen)
+	item.tenant = tenant
+	item.casId = replicaCasId(sc, msgline)
 	var err error
 	switch msgline.Cmd {
 	case "set":
@@ -583,38 +1158,150 @@ func (h *handler) handleStorage(msgline *MsgLine, rw *bufio.ReadWriter, entry *I
 		err = entry.Add(item)
 	case "replace":
 		err = entry.Replace(item)
+	case "cas":
+		err = entry.CompareAndSwap(item, msgline.CasId)
 	}
 	if err != nil {
 		return failResp(err, msgline.ValueLen)
 	}
+	// item with value not fully read is not to be found
+	removeResp := func(e error, bytesLeft uint64) error {
+		_ = entry.Remove(item.key)
+		item.ClearSlots()
+		return failResp(e, bytesLeft)
+	}
 
-	if e := h.allocSlots(item); e != nil {
+	if e := h.allocSlots(item); e != nil && !h.spill.Enabled() {
 		log.Errorf("Allocate slots error: %v", e.Error())
 		_ = entry.Remove(item.key)
+		item.ClearSlots() //in case item has been evicted from entry
 
 		return failResp(e, msgline.ValueLen)
+	} else if e != nil {
+		// value is written to disk instead, and item is kept there without slots
+		log.Infof("Item spilled to disk for allocation failure: %v", e.Error())
+		item.ClearSlots()
+		h.limiter.Throttle(sub, limitUpload, msgline.ValueLen)
+		value := &io.LimitedReader{R: rw, N: int64(msgline.ValueLen)}
+		if e := h.spillItem(item, value); e != nil {
+			log.Errorf("Spill error: %v", e.Error())
+			_ = entry.RemoveItem(item)
+			return failResp(e, uint64(value.N))
+		}
 	}
 
 	bytesLeft := msgline.ValueLen
-	for i, s := range item.slots {
+	slots, gens, _ := item.held()
+	for i, s := range slots {
 		dtrace.Logf(" - For key[%s] at handler[%d] # slot|%d|: %d, byte-left: %d",
 			msgline.Key, h.index, s.capacity, i, bytesLeft)
 
+		upload := bytesLeft
+		if upload > s.capacity {
+			upload = s.capacity
+		}
+		h.limiter.Throttle(sub, limitUpload, upload)
+
 		s.SetInfoWithItem(item)
-		if n, e := s.ReadAndSet(msgline.Key, rw, bytesLeft); e != nil {
+		if n, e := s.ReadAndSet(msgline.Key, gens[i], rw, bytesLeft); e != nil {
 			log.Errorf("Error when read buffer and set into slot: %v", e.Error())
 
-			return failResp(e, bytesLeft)
+			return removeResp(e, bytesLeft - n)
 		} else {
 			bytesLeft -= n
 		}
 	}
 
+	// value block is ended with \r\n
+	trailer := make([]byte, len(Crlf))
+	if _, e := io.ReadFull(rw, trailer); e != nil || !bytes.Equal(trailer, Crlf) {
+		_ = entry.Remove(item.key)
+		item.ClearSlots()
+		if e == nil {
+			h.writeClientError(rw, ErrBadDataChunk.Error())
+			e = ErrBadDataChunk
+		}
+		return e
+	}
+
+	if e := h.logChange(_WALStore, tenant, item); e != nil {
+		tenant.countSet(false)
+		h.writeServerError(rw, e.Error())
+		return nil
+	}
+	task := &replicaTask{op: replicaStore, key: item.key, item: item, exp: absoluteExpiration(exp)}
+	if e := h.replicateChange(sc, msgline, tenant, task); e != nil {
+		log.Errorf("Replication failed")
+		tenant.countSet(false)
+		h.writeServerError(rw, e.Error())
+		return nil
+	}
+
 	makeResp(ResultStored)
+	tenant.countSet(true)
 	log.Info("Successful command for storage")
 	return nil
 }
 
+// readFailed tells whether the error is of reading from connection, after which the rest of command can't be skipped
+func readFailed(e error) bool {
+	if _, ok := e.(net.Error); ok {
+		return true
+	}
+	return e == io.EOF || e == io.ErrUnexpectedEOF
+}
+
+// storageResult is the response for failure of storage command
+func storageResult(cmd string, e error) []byte {
+	if e == ErrCASConflict {
+		return ResultExists
+	}
+	if e == ErrItemNotFound && cmd == "cas" {
+		return ResultNotFound
+	}
+	return ResultNotStored
+}
+
+
+// storeExpired takes storage of item already expired as storing and expiring it at once:
+// the value is discarded, and the existing item of key is removed.
+func (h *handler) storeExpired(msgline *MsgLine, sc *ServConn, tenant *Tenant) error {
+	rw := sc.rw
+	if _, e := rw.Discard(int(msgline.ValueLen) + len(Crlf)); e != nil {
+		return e
+	}
+
+	old := tenant.entry.Get(msgline.Key)
+	found := old != nil
+	stored := msgline.Cmd == "set" || (msgline.Cmd == "add") != found
+	result := ResultStored
+	if msgline.Cmd == "cas" && found && old.casId != msgline.CasId {
+		stored = false
+		result = ResultExists
+	} else if !stored {
+		result = storageResult(msgline.Cmd, ErrItemNotFound)
+		if msgline.Cmd == "add" {
+			result = ResultNotStored
+		}
+	}
+	if stored && found {
+		removed := tenant.entry.Remove(msgline.Key)
+		e := h.logChange(_WALDelete, tenant, removed)
+		task := &replicaTask{op: replicaDelete, key: msgline.Key}
+		if e == nil {
+			e = h.replicateChange(sc, msgline, tenant, task)
+		}
+		if e != nil {
+			stored = false
+			tenant.countSet(stored)
+			h.writeServerError(rw, e.Error())
+			return nil
+		}
+	}
+	tenant.countSet(stored)
+	return h.writeResult(rw, result)
+}
+
 
 func (h *handler) allocSlots(t *MetaItem) error {
 	byteLen := t.byteLen
@@ -658,100 +1345,308 @@ func (h *handler) findSlots(slotCap uint64, cnt int, t *MetaItem) error {
 		return h.cfg.TotalCapacity()
 	}
 
-	group := h.groups[slotCap]
-	if slots, extraCap, e := group.FindAvailableSlots(t.key, cnt, getTotalCap); e == nil {
-		if Dev {
-			arr := make([]string, 0, len(slots))
-			for _, s := range slots {
-				p := fmt.Sprintf("%p", s)
-				arr = append(arr, p)
-			}
-			dtrace.Logf(" - Got slots for key[%s] with cap[%d]: %v", t.key, slotCap, arr)
+	// take storage share of tenant before finding slots in group
+	need := slotCap * uint64(cnt)
+	if t.tenant != nil {
+		if e := t.tenant.Charge(need, t); e != nil {
+			return e
 		}
+	}
 
+	group := h.groups[slotCap]
+	for {
+		slots, extraCap, e := group.FindAvailableSlots(t.key, cnt, getTotalCap)
 		if extraCap > 0 {
 			h.cfg.AddCapToTotal(extraCap)
 		}
+		if e == nil {
+			h.takeSlots(slots, slotCap, t)
+			return nil
+		}
 
-		if len(t.slots) > 0 {
-			t.slots = append(t.slots, slots...)
-		} else {
-			t.slots = slots
+		// with storage full, evict items holding slots of the capacity for room and try again
+		if h.cfg.StorageFull != StorageFullEvict || !h.tenants.EvictInClass(slotCap, t.tenant, t.key) {
+			if t.tenant != nil {
+				t.tenant.release(need)
+			}
+			return e
 		}
-	} else {
-		return e
+		dtrace.Logf(" - Evicted item for slots of key[%s] with cap[%d]", t.key, slotCap)
 	}
-	return nil
 }
 
+func (h *handler) takeSlots(slots []*Slot, slotCap uint64, t *MetaItem) {
+	if Dev {
+		arr := make([]string, 0, len(slots))
+		for _, s := range slots {
+			p := fmt.Sprintf("%p", s)
+			arr = append(arr, p)
+		}
+		dtrace.Logf(" - Got slots for key[%s] with cap[%d]: %v", t.key, slotCap, arr)
+	}
 
-func (h *handler) handleRetrieval(msgline *MsgLine, rw *bufio.ReadWriter, entry *ItemsEntry) error {
+	t.takeSlots(slots)
+}
+
+
+func (h *handler) handleRetrieval(msgline *MsgLine, sc *ServConn, tenant *Tenant, sub *limitSubject) error {
 	log := logger.WithFields(logrus.Fields{
 		"cmd": msgline.Cmd,
 		"itemKey": msgline.Key,
 		"handler": h.index,
 	})
 
-	endResp := func(er error) {
-		if _, e := rw.Write(ResultEnd); e != nil {
-			log.Errorf("write buffer error: %v", e.Error())
+	item := tenant.entry.Get(msgline.Key)
+	tenant.countGet(item != nil)
+	missed := item == nil
+	if missed {
+		item = voidMetaItem(msgline.Key)
+	}
+
+	// slots are pinned until value is written out from them
+	value, intact, err := h.pinValue(item, sub, true)
+	if err != nil {
+		log.Warn("Download rejected by rate limit")
+		h.writeServerError(sc.rw, err.Error())
+		return nil
+	}
+	defer value.Unpin()
+	byteLen := item.byteLen
+	if !intact {
+		byteLen = 0
+	}
+	if missed || !intact {
+		if hit, e := h.readReplicas(msgline, sc, sub); hit || e != nil {
+			return e
 		}
-		if e := rw.Flush(); e != nil {
-			log.Errorf("flush buffer error: %v", e.Error())
+		if loaded := h.readThrough(tenant, msgline.Key); loaded != nil {
+			item = loaded
+			if value, intact, err = h.pinValue(item, sub, true); err != nil {
+				log.Warn("Download rejected by rate limit")
+				h.writeServerError(sc.rw, err.Error())
+				return nil
+			}
+			defer value.Unpin()
+			if byteLen = item.byteLen; !intact {
+				byteLen = 0
+			}
 		}
+	}
 
-		if er == nil {
-			log.Info("Successful command for retrieval")
+	if byteLen == 0 {
+		value = nil
+	}
+	if e := h.writeValue(sc, h.respFirstLine(item, byteLen), value, ResultEnd); e != nil {
+		log.Errorf("write value error: %v", e.Error())
+		return e
+	}
+	log.Info("Successful command for retrieval")
+	return nil
+}
+
+// pinValue pins value of item to be written out; For download of the value, it's admitted and throttled
+// by size of the item before pinning, so that slots are never kept pinned while client is slowed down.
+func (h *handler) pinValue(item *MetaItem, sub *limitSubject, download bool) (*pinnedValue, bool, error) {
+	if download {
+		if e := h.limiter.Admit(sub, limitDownload, item.byteLen); e != nil {
+			return nil, false, e
 		}
+		h.limiter.Throttle(sub, limitDownload, item.byteLen)
 	}
+	value, intact := item.Pin()
+	return value, intact, nil
+}
 
-	item := entry.Get(msgline.Key)
-	if item == nil {
-		item = voidMetaItem(msgline.Key)
+// writeValue writes the head line, the pinned value as value block ended with \r\n, and the tail;
+// They're written with writev straight from slot memory, without copying into buffer of connection.
+// If any slot has been taken for another generation, the value block is not ended and ErrSlotReused is returned,
+// so that the connection is closed for client to tell the broken value.
+func (h *handler) writeValue(sc *ServConn, head []byte, value *pinnedValue, tail []byte) error {
+	if e := sc.rw.Flush(); e != nil {
+		return e
 	}
 
-	// Write value block and end with \r\n
-	byteLen := item.byteLen
-	for _, s := range item.slots {
-		if s.Vacant() {
-			byteLen = 0
-			break
+	bufs := net.Buffers{head}
+	if value != nil {
+		for _, data := range value.data {
+			bufs = append(bufs, data)
 		}
 	}
-
-	if e := h.writeRespFirstLine(item, rw, byteLen); e != nil {
-		endResp(e)
+	if e := sc.writeBuffers(bufs); e != nil {
 		return e
 	}
+	if value != nil && value.disk != nil {
+		// value on disk is streamed from segment
+		if _, e := io.Copy(connWriter{sc}, value.Reader()); e != nil {
+			return e
+		}
+	}
 
-	if byteLen > 0 {
-		for _, s := range item.slots {
-			bytes := s.Data()
-			if _, e := rw.Write(bytes); e != nil {
-				endResp(e)
-				return e
-			}
+	if value != nil && value.Changed() {
+		return ErrSlotReused
+	}
+	trailer := make(net.Buffers, 0, 2)
+	if value != nil {
+		trailer = append(trailer, Crlf)
+	}
+	if len(tail) > 0 {
+		trailer = append(trailer, tail)
+	}
+	return sc.writeBuffers(trailer)
+}
+
+// handleMetaGet serves the meta command "mg <key> <flag>*" with flags:
+// v for value, t for remaining TTL in seconds, f for flags, s for size, c for cas unique, k for key;
+// It responds "VA <size> <flag>*" followed by value block, or "HD <flag>*" without value, or "EN" for miss.
+func (h *handler) handleMetaGet(msgline *MsgLine, sc *ServConn, tenant *Tenant, sub *limitSubject) error {
+	rw := sc.rw
+	withValue := false
+	for _, f := range msgline.Args {
+		withValue = withValue || f == "v"
+	}
+
+	item := tenant.entry.Get(msgline.Key)
+	var value *pinnedValue
+	pin := func() error {
+		var intact bool
+		var err error
+		if value, intact, err = h.pinValue(item, sub, withValue); err != nil {
+			h.writeServerError(rw, err.Error())
+			return err
+		}
+		if !intact {
+			item = nil
 		}
-		if _, e := rw.Write([]byte("\r\n")); e != nil {
-			endResp(e)
+		return nil
+	}
+	defer func() {
+		value.Unpin()
+	}()
+	if item != nil && pin() != nil {
+		return nil
+	}
+	tenant.countGet(item != nil)
+	if item == nil {
+		if hit, e := h.readReplicas(msgline, sc, sub); hit || e != nil {
 			return e
 		}
+		if item = h.readThrough(tenant, msgline.Key); item != nil && pin() != nil {
+			return nil
+		}
+		if item == nil {
+			return h.writeResult(rw, ResultMetaMiss)
+		}
 	}
 
-	endResp(nil)
-	return nil
+	byteLen := item.byteLen
+	tokens := make([]string, 0, len(msgline.Args))
+	for _, f := range msgline.Args {
+		switch f {
+		case "v":
+		case "t":
+			tokens = append(tokens, "t" + strconv.FormatInt(item.TTL(time.Now()), 10))
+		case "f":
+			tokens = append(tokens, "f" + strconv.FormatUint(uint64(item.flags), 10))
+		case "s":
+			tokens = append(tokens, "s" + strconv.FormatUint(byteLen, 10))
+		case "c":
+			tokens = append(tokens, "c" + strconv.FormatUint(item.casId, 10))
+		case "k":
+			tokens = append(tokens, "k" + item.key)
+		default:
+			h.writeClientError(rw, "invalid flag: " + f)
+			return nil
+		}
+	}
+
+	if !withValue {
+		return h.writeResult(rw, []byte(strings.Join(append([]string{"HD"}, tokens...), " ") + "\r\n"))
+	}
+	head := append([]string{"VA", strconv.FormatUint(byteLen, 10)}, tokens...)
+	if byteLen == 0 {
+		// value block of empty value is still ended with \r\n
+		return h.writeResult(rw, []byte(strings.Join(head, " ") + "\r\n\r\n"))
+	}
+	return h.writeValue(sc, []byte(strings.Join(head, " ") + "\r\n"), value, nil)
 }
 
-func (h *handler) writeRespFirstLine(item *MetaItem, rw *bufio.ReadWriter, byteLen uint64) error {
-	var line string
-	if item.casId > 0 {
-		line = fmt.Sprintf("VALUE %s %d %d %d\r\n", item.key, item.flags, byteLen, item.casId)
+// handleTouch updates expiration of item, which is resolved in the same way as storage commands
+func (h *handler) handleTouch(msgline *MsgLine, sc *ServConn, tenant *Tenant) error {
+	exp, expired := tenant.ResolveExpiration(msgline.Expiration, time.Now())
+	var item *MetaItem
+	op := _WALTouch
+	task := &replicaTask{op: replicaTouch, key: msgline.Key, exp: absoluteExpiration(exp)}
+	if expired {
+		item = tenant.entry.Remove(msgline.Key)
+		op, task.op = _WALDelete, replicaDelete
 	} else {
-		line = fmt.Sprintf("VALUE %s %d %d\r\n", item.key, item.flags, byteLen)
+		item = tenant.entry.Touch(msgline.Key, exp)
 	}
-	if _, err := rw.Write([]byte(line)); err != nil {
-		return err
+	if item != nil {
+		e := h.logChange(op, tenant, item)
+		if e == nil {
+			e = h.replicateChange(sc, msgline, tenant, task)
+		}
+		if e != nil {
+			h.writeServerError(sc.rw, e.Error())
+			return nil
+		}
+		return h.writeResult(sc.rw, ResultTouched)
 	}
-	return nil
+	return h.writeResult(sc.rw, ResultNotFound)
+}
+
+// handleDelete removes item, and from replicas even if it's not found here, in case it's only left on replicas
+func (h *handler) handleDelete(msgline *MsgLine, sc *ServConn, tenant *Tenant) error {
+	removed := tenant.entry.Remove(msgline.Key)
+	if e := h.logChange(_WALDelete, tenant, removed); e != nil {
+		h.writeServerError(sc.rw, e.Error())
+		return nil
+	}
+	task := &replicaTask{op: replicaDelete, key: msgline.Key}
+	if e := h.replicateChange(sc, msgline, tenant, task); e != nil {
+		h.writeServerError(sc.rw, e.Error())
+		return nil
+	}
+	if removed != nil {
+		return h.writeResult(sc.rw, ResultDeleted)
+	}
+	return h.writeResult(sc.rw, ResultNotFound)
+}
+
+// handleFlush removes all items of every tenant, and on all other nodes in cluster unless it's from peer;
+// Delay of flush_all in memcached is not supported.
+func (h *handler) handleFlush(msgline *MsgLine, sc *ServConn) error {
+	if len(msgline.Args) > 0 && msgline.Args[0] != "0" {
+		h.writeClientError(sc.rw, "delay of flush_all not supported")
+		return nil
+	}
+	n := 0
+	h.tenants.Each(func(t *Tenant) {
+		n += t.entry.Flush()
+	})
+	logger.Infof("Flushed %d items at handler[%d]", n, h.index)
+	if h.wal.Enabled() {
+		if e := h.wal.Append(&walRecord{op: _WALFlush}, nil); e != nil {
+			logger.Errorf("Write-ahead log of flush_all failed: %v", e.Error())
+			h.writeServerError(sc.rw, ErrWALFailed.Error())
+			return nil
+		}
+	}
+
+	if h.cluster.Enabled() && sc.peer == "" {
+		if e := h.cluster.broadcast("flush_all"); e != nil {
+			h.writeServerError(sc.rw, e.Error())
+			return nil
+		}
+	}
+	return h.writeResult(sc.rw, ResultOK)
+}
+
+func (h *handler) respFirstLine(item *MetaItem, byteLen uint64) []byte {
+	if item.casId > 0 {
+		return []byte(fmt.Sprintf("VALUE %s %d %d %d\r\n", item.key, item.flags, byteLen, item.casId))
+	}
+	return []byte(fmt.Sprintf("VALUE %s %d %d\r\n", item.key, item.flags, byteLen))
 }
 
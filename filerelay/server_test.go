@@ -0,0 +1,113 @@
+package filerelay
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+
+func TestServConn_ReadTimeout(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.IdleTimeout = 1
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+
+	// value block coming in slowly takes longer than idle-timeout in whole
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+	value := stressValue("slow", 30)
+	rw.WriteString("set slow 0 0 30\r\n")
+	for i := 0; i < 3; i++ {
+		rw.Write(value[i * 10 : (i + 1) * 10])
+		if e := rw.Flush(); e != nil {
+			t.Fatal(e)
+		}
+		time.Sleep(time.Millisecond * 600)
+	}
+	if resp := command(t, rw, "", nil); resp != string(ResultStored) {
+		t.Fatalf("set of slow value: %q", resp)
+	}
+
+	// connection idle for the period is closed
+	time.Sleep(time.Millisecond * 1500)
+	expectClosed(t, rw, "idle-timeout")
+}
+
+func TestServConn_WriteTimeout(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.IdleTimeout = 1
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, stop := serveTestListener(t, lis, c, 4096)
+	defer stop()
+
+	conn, rw := dialTest(t, lis.Addr().String())
+	defer conn.Close()
+	_ = conn.(*net.TCPConn).SetReadBuffer(4096)
+	v := stressValue("stuck", 4 * 1024 * 1024)
+	if resp := command(t, rw, fmt.Sprintf("set stuck 0 0 %d", len(v)), v); resp != string(ResultStored) {
+		t.Fatalf("set: %q", resp)
+	}
+	item := server.tenants.Get(DefaultTenant).entry.Get("stuck")
+
+	// client never reading the value is dropped, and slots of the value are unpinned
+	fmt.Fprintf(rw, "get stuck\r\n")
+	rw.Flush()
+	time.Sleep(time.Millisecond * 500)
+	if !item.slots[0].Pinned() {
+		t.Fatal("slots not pinned while value is written")
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for item.slots[0].Pinned() {
+		if time.Now().After(deadline) {
+			t.Fatal("slots kept pinned for client not taking the value")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// TestServConn_IdleConnections keeps more connections open than handlers, each served in turn without waiting for others
+func TestServConn_IdleConnections(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 2
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+
+	conns := make([]net.Conn, 0, 6)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 6; i++ {
+		conn, rw := dialTest(t, addr)
+		conns = append(conns, conn)
+		_ = conn.SetDeadline(time.Now().Add(time.Second * 2))
+		key := fmt.Sprintf("idle-%d", i)
+		if resp := command(t, rw, "set " + key + " 0 0 4", []byte("idle")); resp != string(ResultStored) {
+			t.Fatalf("set on connection %d: %q", i, resp)
+		}
+		defer func(i int) {
+			// connections left idle are still served afterwards
+			_ = conn.SetDeadline(time.Now().Add(time.Second * 2))
+			if resp := command(t, rw, "mg " + key + " s", nil); resp != "HD s4\r\n" {
+				t.Errorf("mg on connection %d: %q", i, resp)
+			}
+		}(i)
+	}
+}
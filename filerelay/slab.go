@@ -5,6 +5,7 @@ import (
 	"errors"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,16 +13,39 @@ const (
 	_SlabsCheckConc = 3
 )
 
+var (
+	ErrNoEnoughSlots = errors.New("no enough slots")
+	ErrStorageFull = errors.New("storage full")
+)
+
 
 type Slab struct {
 	slotCap uint64
 	slots *list.List
 	checkTime int64
 	checkIntv int //in seconds
+	arena slabArena
+
+	group *SlabGroup
+	retired bool //slab released from group, no more slots to be found in it
+	idleSince time.Time //since when all slots found vacant
 	sync.Mutex
 }
 
-func NewSlab(slotCap uint64, slotCount, checkIntv int) *Slab {
+// recycle moves the cleared slot to front of slab, to be found first
+func (s *Slab) recycle(slot *Slot) {
+	s.Lock()
+	defer s.Unlock()
+
+	for elem := s.slots.Front(); elem != nil; elem = elem.Next() {
+		if elem.Value.(*Slot) == slot {
+			s.slots.MoveToFront(elem)
+			return
+		}
+	}
+}
+
+func NewSlab(slotCap uint64, slotCount, checkIntv int, backend string) *Slab {
 	if checkIntv < SlabCheckInterval {
 		checkIntv = SlabCheckInterval
 	}
@@ -30,9 +54,12 @@ func NewSlab(slotCap uint64, slotCount, checkIntv int) *Slab {
 		slots: list.New(),
 		checkTime: time.Now().Unix(),
 		checkIntv: checkIntv,
+		arena: newSlabArena(backend, slotCap * uint64(slotCount)),
 	}
 	for i := 0; i < slotCount; i++ {
-		slab.slots.PushBack( NewSlot(slotCap) )
+		slot := newSlotIn(slab.arena, i, slotCap)
+		slot.slab = &slab
+		slab.slots.PushBack(slot)
 	}
 	return &slab
 }
@@ -49,10 +76,14 @@ func (s *Slab) FindAvailableSlot() *Slot {
 	s.Lock()
 	defer s.Unlock()
 
+	if s.retired {
+		return nil
+	}
+
 	elem := s.slots.Front()
 	slot := elem.Value.(*Slot)
 	if slot.CheckClear() {
-		slot.Reserve() //reserve slot for avoiding found by others
+		slot.take()
 		s.slots.MoveToBack(elem)
 		return slot
 	}
@@ -69,7 +100,7 @@ func (s *Slab) FindAvailableSlot() *Slot {
 		if elem != nil {
 			s.slots.MoveToBack(elem)
 			slot = elem.Value.(*Slot)
-			slot.Reserve() //reserve slot for avoiding found by others
+			slot.take()
 			return slot
 		}
 		s.checkTime = time.Now().Unix()
@@ -78,6 +109,55 @@ func (s *Slab) FindAvailableSlot() *Slot {
 	return nil
 }
 
+// retireIfVacant marks the slab retired if all slots in it are vacant
+func (s *Slab) retireIfVacant() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for elem := s.slots.Front(); elem != nil; elem = elem.Next() {
+		if !elem.Value.(*Slot).Vacant() {
+			return false
+		}
+	}
+	s.retired = true
+	return true
+}
+
+// retireIfIdle marks the slab retired if all slots in it have been vacant for the period
+func (s *Slab) retireIfIdle(now time.Time, idleFor time.Duration) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for elem := s.slots.Front(); elem != nil; elem = elem.Next() {
+		if !elem.Value.(*Slot).Vacant() {
+			s.idleSince = time.Time{}
+			return false
+		}
+	}
+	if s.idleSince.IsZero() {
+		s.idleSince = now
+	}
+	if now.Sub(s.idleSince) < idleFor {
+		return false
+	}
+	s.retired = true
+	return true
+}
+
+// freeArena frees memory of the slab released from group, unless any of its slots is pinned
+func (s *Slab) freeArena() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for elem := s.slots.Front(); elem != nil; elem = elem.Next() {
+		if elem.Value.(*Slot).Pinned() {
+			return false
+		}
+	}
+	s.arena.Free()
+	return true
+}
+
 func (s *Slab) tryClearFromLast(n int) (el *list.Element) {
 	var elem *list.Element
 	var slot *Slot
@@ -101,22 +181,30 @@ type SlabGroup struct {
 	slotNumInSlab int
 	slotSum int
 	checkIntv int
+	backend string
 
 	maxStorageSize uint64
 	totalCap uint64
 
 	slabs *list.List
+
+	// counters of memory pressure
+	evictions uint64
+	allocFails uint64
+	released uint64 //count of slabs released
+	reclaimed uint64 //count of idle slabs reclaimed
 	sync.Mutex
 }
 
 type SlabCh chan *Slab
 
-func NewSlabGroup(slotCap uint64, slabCount, slotCount, checkIntv int, maxSize uint64) *SlabGroup {
+func NewSlabGroup(slotCap uint64, slabCount, slotCount, checkIntv int, maxSize uint64, backend string) *SlabGroup {
 	group := SlabGroup{
 		slotCap: slotCap,
 		initSlabCount: slabCount,
 		slotNumInSlab: slotCount,
 		checkIntv: checkIntv,
+		backend: backend,
 		maxStorageSize: maxSize,
 		slabs: list.New(),
 	}
@@ -129,7 +217,8 @@ func NewSlabGroup(slotCap uint64, slabCount, slotCount, checkIntv int, maxSize u
 func (g *SlabGroup) AddSlabs(slabCount int) (cap uint64) {
 	cap = 0
 	for i := 0; i < slabCount; i++ {
-		s := NewSlab(g.slotCap, g.slotNumInSlab, g.checkIntv)
+		s := NewSlab(g.slotCap, g.slotNumInSlab, g.checkIntv, g.backend)
+		s.group = g
 		g.slotSum += s.SlotCount()
 		cap += s.Capacity()
 		g.slabs.PushFront(s)
@@ -138,11 +227,84 @@ func (g *SlabGroup) AddSlabs(slabCount int) (cap uint64) {
 	return
 }
 
+// ReleaseVacantSlabs takes at most n slabs with all slots vacant out of group, keeping at least floor slabs;
+// Capacity of released slabs is returned.
+func (g *SlabGroup) ReleaseVacantSlabs(n, floor int) (cap uint64) {
+	if floor < 1 {
+		floor = 1
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	var prev *list.Element
+	for elem := g.slabs.Back(); elem != nil && n > 0 && g.slabs.Len() > floor; elem = prev {
+		prev = elem.Prev()
+		if s := elem.Value.(*Slab); s.retireIfVacant() {
+			cap += g.removeSlab(elem)
+			atomic.AddUint64(&g.released, 1)
+			n--
+		}
+	}
+	return
+}
+
+// ReclaimIdleSlabs takes slabs with all slots vacant for the period out of group,
+// keeping at least the initial count of slabs; Capacity of reclaimed slabs is returned.
+func (g *SlabGroup) ReclaimIdleSlabs(idleFor time.Duration) (cap uint64) {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	var prev *list.Element
+	for elem := g.slabs.Back(); elem != nil && g.slabs.Len() > g.initSlabCount; elem = prev {
+		prev = elem.Prev()
+		if s := elem.Value.(*Slab); s.retireIfIdle(now, idleFor) {
+			cap += g.removeSlab(elem)
+			atomic.AddUint64(&g.reclaimed, 1)
+		}
+	}
+	return
+}
+
+func (g *SlabGroup) removeSlab(elem *list.Element) uint64 {
+	s := g.slabs.Remove(elem).(*Slab)
+	g.slotSum -= s.SlotCount()
+	c := s.Capacity()
+	g.totalCap -= c
+	graveyard.bury(s)
+	return c
+}
+
+func (g *SlabGroup) SlabCount() int {
+	g.Lock()
+	defer g.Unlock()
+	return g.slabs.Len()
+}
+
+// SlabSize is capacity of each slab in group
+func (g *SlabGroup) SlabSize() uint64 {
+	return g.slotCap * uint64(g.slotNumInSlab)
+}
+
+func (g *SlabGroup) countEviction() {
+	atomic.AddUint64(&g.evictions, 1)
+}
+
+// Pressure is the sum of evictions and allocation failures in group
+func (g *SlabGroup) Pressure() uint64 {
+	return atomic.LoadUint64(&g.evictions) + atomic.LoadUint64(&g.allocFails)
+}
+
 func (g *SlabGroup) SlotSum() int {
+	g.Lock()
+	defer g.Unlock()
 	return g.slotSum
 }
 
 func (g *SlabGroup) Capacity() uint64 {
+	g.Lock()
+	defer g.Unlock()
 	return g.totalCap
 }
 
@@ -165,14 +327,17 @@ func (g *SlabGroup) FindAvailableSlots(key string, need int, getTotalCap func()
 	var slabsLeft, slotsLeft int
 
 	startCheck := func() {
-		slabSum := g.slabs.Len()
+		// slabs may be released from group at the same time
+		g.Lock()
+		slabSum, slotSum := g.slabs.Len(), g.slotSum
+		g.Unlock()
 		conc := g.slabCheckConcurrency(slabSum)
-		slabsLeft, slotsLeft = slabSum, g.SlotSum()
+		slabsLeft, slotsLeft = slabSum, slotSum
 		if conc > cnt {
 			conc = cnt
 		}
-		if sl := g.slabs.Len(); conc > sl {
-			conc = sl
+		if conc > slabSum {
+			conc = slabSum
 		}
 		memTrace.Logf("-- <%s> Find for Cap: %d - Need-slots: %d, Total-slabs: %d, Total-slots: %d; conc: %d", key, g.slotCap, cnt, slabsLeft, slotsLeft, conc)
 
@@ -245,11 +410,15 @@ func (g *SlabGroup) FindAvailableSlots(key string, need int, getTotalCap func()
 
 			startCheck()
 			if len(slots) < need {
-				return nil, 0, errors.New("no enough slots")
+				atomic.AddUint64(&g.allocFails, 1)
+				unreserveSlots(slots)
+				return nil, cap, ErrNoEnoughSlots
 			}
 		} else {
 			g.Unlock()
-			return nil, 0, errors.New("storage full")
+			atomic.AddUint64(&g.allocFails, 1)
+			unreserveSlots(slots)
+			return nil, 0, ErrStorageFull
 		}
 
 	}
@@ -258,6 +427,12 @@ func (g *SlabGroup) FindAvailableSlots(key string, need int, getTotalCap func()
 	return slots, cap, nil
 }
 
+func unreserveSlots(slots []*Slot) {
+	for _, s := range slots {
+		s.Unreserve()
+	}
+}
+
 func (g *SlabGroup) doCheck(key string, conc, total int, r SlabCh) int {
 	//memTrace.Logf("-- <%s> Check group[%d] with %d slabs; conc: %d, total: %d", key, g.slotCap, g.slabs.Len(), conc, total)
 	left := total
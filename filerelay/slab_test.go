@@ -0,0 +1,155 @@
+package filerelay
+
+import (
+	"io"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+func newTestGroups(c *MemConfig, caps ...uint64) slabGroupMap {
+	groups := make(slabGroupMap)
+	for _, cap := range caps {
+		g := NewSlabGroup(cap, 4, 10, SlabCheckInterval, c.maxStorageSize, SlabBackendHeap)
+		c.AddCapToTotal(g.Capacity())
+		groups[cap] = g
+	}
+	return groups
+}
+
+
+func TestSlabGroup_ReleaseVacantSlabs(t *testing.T) {
+	g := NewSlabGroup(64, 4, 10, SlabCheckInterval, szMB, SlabBackendHeap)
+	slots, _, err := g.FindAvailableSlots("release-test", 1, func() uint64 { return g.Capacity() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots[0].setAt = slots[0].reservedAt
+	slots[0].duration = CacheMaxEXpiration * time.Second
+	slots[0].used = 1
+
+	cap := g.ReleaseVacantSlabs(10, 0)
+	if cap != 3 * g.SlabSize() {
+		t.Errorf("expect 3 slabs released, got capacity: %d", cap)
+	}
+	if n := g.SlabCount(); n != 1 {
+		t.Errorf("expect the slab with occupied slot kept, got slabs: %d", n)
+	}
+	if g.Capacity() != g.SlabSize() || g.SlotSum() != 10 {
+		t.Errorf("unexpected group capacity %d or slots %d after release", g.Capacity(), g.SlotSum())
+	}
+}
+
+func TestSlabGroup_ReclaimIdleSlabs(t *testing.T) {
+	g := NewSlabGroup(64, 2, 10, SlabCheckInterval, szMB, SlabBackendHeap)
+	g.AddSlabs(3)
+
+	// slabs found idle at first, and reclaimed after idle for the period
+	if cap := g.ReclaimIdleSlabs(time.Millisecond * 10); cap != 0 {
+		t.Errorf("expect nothing reclaimed at first check, got: %d", cap)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if cap := g.ReclaimIdleSlabs(time.Millisecond * 10); cap != 3 * g.SlabSize() {
+		t.Errorf("expect slabs reclaimed down to initial count, got: %d", cap)
+	}
+	if n := g.SlabCount(); n != 2 {
+		t.Errorf("expect initial count of slabs kept, got: %d", n)
+	}
+}
+
+func TestSlab_Filling(t *testing.T) {
+	g := NewSlabGroup(64, 2, 10, SlabCheckInterval, szMB, SlabBackendHeap)
+	slots, _, err := g.FindAvailableSlots("filling-test", 1, func() uint64 { return g.Capacity() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := slots[0]
+
+	// slot taken and not filled yet is not vacant beyond limit of reservation
+	s.reservedAt = s.reservedAt.Add(-_ReserveLimit * 2)
+	if cap := g.ReleaseVacantSlabs(10, 0); cap != g.SlabSize() {
+		t.Errorf("expect the slab with slot in filling kept, got capacity released: %d", cap)
+	}
+
+	// slot is pinned while value is coming in, so that its slab is never freed
+	item := NewMetaItem("filling-test", 0, 60, 64)
+	s.SetInfoWithItem(item)
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, e := s.ReadAndSet(item.key, s.Gen(), r, 64)
+		done <- e
+	}()
+	w.Write(make([]byte, 32))
+	if !s.Pinned() || s.slab.freeArena() {
+		t.Error("slot in filling not pinned")
+	}
+	w.Write(make([]byte, 32))
+	if e := <-done; e != nil {
+		t.Fatal(e)
+	}
+	if s.Pinned() || !s.Occupied() || len(s.Data()) != 64 {
+		t.Errorf("slot not filled: %d bytes", len(s.Data()))
+	}
+	if _, e := s.ReadAndSet(item.key, s.Gen(), r, 64); e == nil {
+		t.Error("slot filled twice")
+	}
+}
+
+func TestRebalancer_Rebalance(t *testing.T) {
+	c := NewMemConfig()
+	c.maxStorageSize = 4 * (640 + 2560)
+	groups := newTestGroups(c, 64, 256)
+	hot, cold := groups[64], groups[256]
+
+	atomic.AddUint64(&hot.allocFails, 1)
+	r := NewRebalancer(c, groups)
+	released := r.Rebalance()
+
+	if released == 0 || released % cold.SlabSize() != 0 {
+		t.Fatalf("expect slabs released from cold group, got: %d", released)
+	}
+	if hot.SlabCount() != 4 {
+		t.Errorf("hot group should be untouched, got slabs: %d", hot.SlabCount())
+	}
+	if total := c.TotalCapacity(); total != c.maxStorageSize - released {
+		t.Errorf("total capacity not decreased: %d", total)
+	}
+
+	// no more pressure since last check
+	if released = r.Rebalance(); released != 0 {
+		t.Errorf("expect nothing released without new pressure, got: %d", released)
+	}
+}
+
+
+// GC pauses with 256MB in slots of 4KB, kept in Go heap or mmap arenas
+func benchmarkGCPause(b *testing.B, backend string) {
+	g := NewSlabGroup(sz4KB, 640, 100, SlabCheckInterval, szGB, backend)
+
+	var st runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&st)
+	pause, num := st.PauseTotalNs, st.NumGC
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	b.StopTimer()
+
+	runtime.ReadMemStats(&st)
+	b.ReportMetric(float64(st.PauseTotalNs - pause) / float64(st.NumGC - num), "pause-ns/gc")
+	b.ReportMetric(float64(st.HeapAlloc), "heap-bytes")
+	runtime.KeepAlive(g)
+}
+
+func BenchmarkGCPause_Heap(b *testing.B) {
+	benchmarkGCPause(b, SlabBackendHeap)
+}
+
+func BenchmarkGCPause_Mmap(b *testing.B) {
+	benchmarkGCPause(b, SlabBackendMmap)
+}
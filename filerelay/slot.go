@@ -4,15 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 	"time"
 )
 
 
 const _ReserveLimit = time.Second * 2
 
+var (
+	ErrSlotReused = errors.New("slot taken for others")
+)
+
 
 
-//
+// Slot is a piece of memory in slab holding a part of value; State of slot is guarded by lock of its slab.
 type Slot struct {
 	key string
 	capacity uint64
@@ -22,6 +27,11 @@ type Slot struct {
 	duration time.Duration
 
 	reservedAt time.Time
+	filling bool //taken for an item and not filled yet
+	pins int32 //count of readers writing data of slot out, or of the writer filling it
+	gen uint64 //generation, increased every time slot is taken for an item
+
+	slab *Slab //slab the slot belongs to
 }
 
 func NewSlot(capacity uint64) (s *Slot) {
@@ -33,57 +43,171 @@ func NewSlot(capacity uint64) (s *Slot) {
 	return 
 }
 
+// newSlotIn carves the slot at index out of the arena of slab
+func newSlotIn(arena slabArena, index int, capacity uint64) *Slot {
+	return &Slot{
+		capacity: capacity,
+		data: arena.Slice(uint64(index) * capacity, capacity),
+	}
+}
+
+// lock locks the slab of slot, which guards state of its slots
+func (s *Slot) lock() {
+	if s.slab != nil {
+		s.slab.Lock()
+	}
+}
+
+func (s *Slot) unlock() {
+	if s.slab != nil {
+		s.slab.Unlock()
+	}
+}
+
 func (s *Slot) Cap() uint64 {
 	return s.capacity
 }
 
-func (s *Slot) Clear() {
+// Release clears the slot taken at the generation, leaving it alone if it's been taken for others since then
+func (s *Slot) Release(gen uint64) {
+	s.lock()
+	defer s.unlock()
+	if s.Gen() == gen {
+		s.clear()
+	}
+}
+
+// clear empties the slot; it must be called with lock of slab
+func (s *Slot) clear() {
 	s.key = ""
 	s.used = 0
 	s.duration = 0
+	s.reservedAt = time.Time{}
+	s.filling = false
 }
 
+// Occupied tells whether the slot holds data of an item; it must be called with lock of slab
 func (s *Slot) Occupied() bool {
 	return s.used > 0 && s.duration > 0
 }
 
+// Vacant tells whether the slot can be taken for others;
+// Slots pinned by readers, or taken for an item and not filled yet, are never vacant.
+// It must be called with lock of slab.
 func (s *Slot) Vacant() bool {
+	if s.filling || s.Pinned() {
+		return false
+	}
 	if s.used == 0 || s.duration == 0 {
 		return timePassed(s.reservedAt, _ReserveLimit)
 	}
 	return timePassed(s.setAt, s.duration)
 }
 
+// CheckClear clears the slot if it's vacant; it must be called with lock of slab
 func (s *Slot) CheckClear() bool {
 	ok := s.Vacant()
 	if ok && s.duration > 0 {
-		s.Clear()
+		s.clear()
 	}
 	return ok
 }
 
+// Evicted records eviction of item holding the slot, as memory pressure of its group
+func (s *Slot) Evicted() {
+	if s.slab != nil && s.slab.group != nil {
+		s.slab.group.countEviction()
+	}
+}
+
+// take reserves the slot found available by slab for a new generation; it must be called with lock of slab
+func (s *Slot) take() {
+	atomic.AddUint64(&s.gen, 1)
+	s.Reserve() //reserve slot for avoiding found by others
+	s.filling = true
+}
+
+func (s *Slot) Gen() uint64 {
+	return atomic.LoadUint64(&s.gen)
+}
+
+// Pin keeps the slot of the generation from being taken for others while its data is written out,
+// and returns the data; It's done in lock of slab, so that the slot is either pinned or found available by slab.
+// False is returned if the slot has been taken for another generation, or holds no data, or its slab is released.
+func (s *Slot) Pin(gen uint64) ([]byte, bool) {
+	s.lock()
+	defer s.unlock()
+	if s.Gen() != gen || !s.Occupied() || s.released() {
+		return nil, false
+	}
+	atomic.AddInt32(&s.pins, 1)
+	return s.Data(), true
+}
+
+// released tells whether slab of the slot has been released from its group; it must be called with lock of slab
+func (s *Slot) released() bool {
+	return s.slab != nil && s.slab.retired
+}
+
+func (s *Slot) Unpin() {
+	atomic.AddInt32(&s.pins, -1)
+}
+
+func (s *Slot) Pinned() bool {
+	return atomic.LoadInt32(&s.pins) > 0
+}
+
+// Recycle makes the cleared slot found first in its slab
+func (s *Slot) Recycle() {
+	if s.slab != nil {
+		s.slab.recycle(s)
+	}
+}
+
+// Reserve keeps the slot from being found by others for a while; it must be called with lock of slab
 func (s *Slot) Reserve() {
 	s.reservedAt = time.Now()
 }
 
+// Unreserve gives back slot reserved but not taken
+func (s *Slot) Unreserve() {
+	s.lock()
+	defer s.unlock()
+	s.reservedAt = time.Time{}
+	s.filling = false
+}
+
 func (s *Slot) Key() string {
+	s.lock()
+	defer s.unlock()
 	return s.key
 }
 
+// Data is the data filled in slot; it must be called with lock of slab
 func (s *Slot) Data() []byte {
 	return s.data[:s.used]
 }
 
 func (s *Slot) SetInfoWithItem(t *MetaItem) {
-	s.setAt = t.setAt
-	s.duration = t.duration
+	setAt, duration := t.lifetime()
+	s.lock()
+	defer s.unlock()
+	s.setAt, s.duration = setAt, duration
 }
 
-func (s *Slot) ReadAndSet(key string, r io.Reader, byteLen uint64) (used uint64, err error) {
-	if s.Occupied() {
-		errInfo := fmt.Sprintf("slot is occupied by key: %s; tried by: %s", s.key, key)
-		return 0, errors.New(errInfo)
+// extend sets expiration of the touched item into slot taken at the generation
+func (s *Slot) extend(gen uint64, t *MetaItem) {
+	setAt, duration := t.lifetime()
+	s.lock()
+	defer s.unlock()
+	if s.Gen() == gen {
+		s.setAt, s.duration = setAt, duration
 	}
+}
+
+// ReadAndSet fills the slot taken at the generation with value read from r; The slot is pinned during the read,
+// so that it's never taken for others or freed with its slab, even if the item is cleared meanwhile.
+func (s *Slot) ReadAndSet(key string, gen uint64, r io.Reader, byteLen uint64) (used uint64, err error) {
 	if l := len(key); l == 0 || l > KeyMax {
 		return 0, errors.New("key too long")
 	}
@@ -92,12 +216,31 @@ func (s *Slot) ReadAndSet(key string, r io.Reader, byteLen uint64) (used uint64,
 		byteLen = s.capacity
 	}
 
-	s.key = key
+	s.lock()
+	if s.Occupied() {
+		s.unlock()
+		errInfo := fmt.Sprintf("slot is occupied by key: %s; tried by: %s", s.key, key)
+		return 0, errors.New(errInfo)
+	}
+	if s.Gen() != gen || !s.filling || s.released() {
+		s.unlock()
+		return 0, ErrSlotReused
+	}
+	atomic.AddInt32(&s.pins, 1)
+	s.unlock()
+	defer s.Unpin()
+
 	buf := s.data[:byteLen]
-	if n, e := io.ReadFull(r, buf); n > 0 {
-		used = uint64(n)
+	n, e := io.ReadFull(r, buf)
+	used, err = uint64(n), e
+
+	s.lock()
+	defer s.unlock()
+	// slot cleared with item meanwhile is left vacant
+	if s.filling && n > 0 {
+		s.key = key
 		s.used = used
-		err = e
+		s.filling = false
 	}
 	return
 }
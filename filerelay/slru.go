@@ -0,0 +1,179 @@
+package filerelay
+
+import (
+	linkedlist "container/list"
+)
+
+
+const (
+	_SLRUProtectedRatio = 0.8
+)
+
+
+type slruNode struct {
+	elem *linkedlist.Element
+	protected bool
+}
+
+
+// SLRU is segmented LRU: new items enter the probation segment, and are promoted into the protected segment
+// when they're hit again; Items over size of protected segment are demoted back to probation,
+// and the least recently used items in probation are evicted first.
+type SLRU struct {
+	size int
+	protectedSize int
+	probation *linkedlist.List
+	protected *linkedlist.List
+	lookup map[string]*slruNode
+}
+
+func NewSLRU(size int) *SLRU {
+	protectedSize := int(float64(size) * _SLRUProtectedRatio)
+	if protectedSize < 1 {
+		protectedSize = 1
+	}
+	return &SLRU{
+		size: size,
+		protectedSize: protectedSize,
+		probation: linkedlist.New(),
+		protected: linkedlist.New(),
+		lookup: make(map[string]*slruNode),
+	}
+}
+
+// hit moves item to front of protected segment, and demotes the oldest protected one if segment is full
+func (c *SLRU) hit(n *slruNode) {
+	if n.protected {
+		c.protected.MoveToFront(n.elem)
+		return
+	}
+
+	t := c.probation.Remove(n.elem).(*MetaItem)
+	n.elem = c.protected.PushFront(t)
+	n.protected = true
+
+	if c.protected.Len() > c.protectedSize {
+		old := c.protected.Remove(c.protected.Back()).(*MetaItem)
+		on := c.lookup[old.key]
+		on.elem = c.probation.PushFront(old)
+		on.protected = false
+	}
+}
+
+// insert puts new item into probation without eviction
+func (c *SLRU) insert(t *MetaItem) {
+	c.lookup[t.key] = &slruNode{
+		elem: c.probation.PushFront(t),
+	}
+}
+
+// detach takes item out of segment without clearing its slots
+func (c *SLRU) detach(key string) *MetaItem {
+	n, ok := c.lookup[key]
+	if !ok {
+		return nil
+	}
+	delete(c.lookup, key)
+	if n.protected {
+		return c.protected.Remove(n.elem).(*MetaItem)
+	}
+	return c.probation.Remove(n.elem).(*MetaItem)
+}
+
+// victim is the item to be evicted next
+func (c *SLRU) victim() *MetaItem {
+	if elem := c.probation.Back(); elem != nil {
+		return elem.Value.(*MetaItem)
+	}
+	if elem := c.protected.Back(); elem != nil {
+		return elem.Value.(*MetaItem)
+	}
+	return nil
+}
+
+func (c *SLRU) removeOldest(clear bool) *MetaItem {
+	t := c.victim()
+	if t == nil {
+		return nil
+	}
+	c.detach(t.key)
+	if clear {
+		t.evict()
+	}
+	return t
+}
+
+func (c *SLRU) Add(t *MetaItem, noReplace bool) (evicted *MetaItem, err error) {
+	if n, ok := c.lookup[t.key]; ok {
+		if noReplace {
+			err = errKeyExists(t.key)
+			return
+		}
+		replaceValue(n.elem, t)
+		c.hit(n)
+		return
+	}
+
+	c.insert(t)
+	if len(c.lookup) > c.size {
+		evicted = c.removeOldest(true)
+	}
+	return
+}
+
+func (c *SLRU) Replace(t *MetaItem) bool {
+	if n, ok := c.lookup[t.key]; ok {
+		replaceValue(n.elem, t)
+		c.hit(n)
+		return true
+	}
+	return false
+}
+
+func (c *SLRU) Get(key string) *MetaItem {
+	if n, ok := c.lookup[key]; ok {
+		c.hit(n)
+		return n.elem.Value.(*MetaItem)
+	}
+	return nil
+}
+
+func (c *SLRU) Peek(key string) *MetaItem {
+	if n, ok := c.lookup[key]; ok {
+		return n.elem.Value.(*MetaItem)
+	}
+	return nil
+}
+
+func (c *SLRU) Remove(key string) *MetaItem {
+	t := c.detach(key)
+	if t != nil {
+		t.ClearSlots()
+	}
+	return t
+}
+
+func (c *SLRU) Contains(key string) bool {
+	_, ok := c.lookup[key]
+	return ok
+}
+
+func (c *SLRU) Len() int {
+	return len(c.lookup)
+}
+
+func (c *SLRU) victims(fn func(t *MetaItem) bool) {
+	for _, l := range []*linkedlist.List{c.probation, c.protected} {
+		for elem := l.Back(); elem != nil; elem = elem.Prev() {
+			if !fn(elem.Value.(*MetaItem)) {
+				return
+			}
+		}
+	}
+}
+
+func (c *SLRU) Purge() {
+	c.probation.Init()
+	c.protected.Init()
+	c.lookup = make(map[string]*slruNode)
+}
@@ -0,0 +1,431 @@
+package filerelay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+const (
+	SnapshotVersion = 1
+
+	_SnapshotMagic = "FRSNAP"
+	_SnapshotItem byte = 1
+	_SnapshotEnd byte = 0
+	_SnapshotIntact byte = 1
+	_SnapshotDropped byte = 0 //value changed while written
+)
+
+var (
+	ErrSnapshotDisabled = errors.New("snapshot not enabled")
+	ErrSnapshotBroken = errors.New("snapshot broken")
+	ErrSnapshotVersion = errors.New("unsupported version of snapshot")
+)
+
+var _SnapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+
+// Snapshot saves items of all tenants with their values into a file, and loads them back on start;
+// The file starts with a head of magic, version and time of snapshot, followed by records of items
+// and an end record with count of items. Every record is checked by crc32 of its bytes. Items keep
+// flags, cas unique, and TTL remaining at time of snapshot, so that the ones expired before loaded are skipped.
+//
+// Record of item: kind, tenant and key each with uint16 length, flags, cas unique, TTL in milliseconds,
+// size and bytes of value, state of value, and crc32; in big endian.
+type Snapshot struct {
+	path string
+	tenants *TenantSet //only reference
+
+	saved uint64 //items in the last snapshot saved
+	loaded uint64
+	skipped uint64 //expired or failed in loading
+	savedAt int64 //unix time
+
+	sync.Mutex //one snapshot at a time
+}
+
+// NewSnapshot returns nil for empty path, which means snapshot is off
+func NewSnapshot(path string, tenants *TenantSet) *Snapshot {
+	if path == "" {
+		return nil
+	}
+	return &Snapshot{
+		path: path,
+		tenants: tenants,
+	}
+}
+
+func (s *Snapshot) Enabled() bool {
+	return s != nil
+}
+
+
+// snapshotWriter writes fields of records, summing them by crc32
+type snapshotWriter struct {
+	w *bufio.Writer
+	crc hash.Hash32
+	buf [8]byte
+	err error
+}
+
+func (w *snapshotWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	if _, w.err = w.w.Write(b); w.err == nil {
+		_, _ = w.crc.Write(b)
+	}
+}
+
+func (w *snapshotWriter) uint(v uint64, size int) {
+	switch size {
+	case 1:
+		w.buf[0] = byte(v)
+	case 2:
+		binary.BigEndian.PutUint16(w.buf[:], uint16(v))
+	case 4:
+		binary.BigEndian.PutUint32(w.buf[:], uint32(v))
+	default:
+		binary.BigEndian.PutUint64(w.buf[:], v)
+	}
+	w.write(w.buf[:size])
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uint(uint64(len(s)), 2)
+	w.write([]byte(s))
+}
+
+// end writes crc32 of the record, and starts a new one
+func (w *snapshotWriter) end() {
+	sum := w.crc.Sum32()
+	w.crc.Reset()
+	w.uint(uint64(sum), 4)
+	w.crc.Reset()
+}
+
+func (w *snapshotWriter) Write(b []byte) (int, error) {
+	w.write(b)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return len(b), nil
+}
+
+
+// Save writes all items into a temporary file renamed to the path when it's complete, and returns count of items;
+// Values are streamed from pinned slots, and the ones changed while written are marked as dropped.
+func (s *Snapshot) Save() (int, error) {
+	if !s.Enabled() {
+		return 0, ErrSnapshotDisabled
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	if e := os.MkdirAll(filepath.Dir(s.path), 0755); e != nil {
+		return 0, e
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), ".snapshot-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) //fails after renamed
+
+	now := time.Now()
+	w := &snapshotWriter{w: bufio.NewWriterSize(f, 256 * 1024), crc: crc32.New(_SnapshotTable)}
+	w.write([]byte(_SnapshotMagic))
+	w.uint(SnapshotVersion, 2)
+	w.uint(uint64(now.UnixNano() / int64(time.Millisecond)), 8)
+	w.end()
+
+	n := 0
+	s.tenants.Each(func(t *Tenant) {
+		for _, key := range t.entry.Keys() {
+			if w.err != nil {
+				return
+			}
+			if s.saveItem(w, t, key, now) {
+				n++
+			}
+		}
+	})
+	w.uint(uint64(_SnapshotEnd), 1)
+	w.uint(uint64(n), 8)
+	w.end()
+
+	err = w.err
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreUint64(&s.saved, uint64(n))
+	atomic.StoreInt64(&s.savedAt, now.Unix())
+	logger.Infof("Snapshot of %d items saved to %s in %v", n, s.path, time.Since(now))
+	return n, nil
+}
+
+// saveItem writes record of item if it's still stored and intact, and tells whether it's written intact
+func (s *Snapshot) saveItem(w *snapshotWriter, t *Tenant, key string, now time.Time) bool {
+	item := t.entry.Get(key)
+	if item == nil {
+		return false
+	}
+	value, intact := item.Pin()
+	defer value.Unpin()
+	ttl := item.Deadline().Sub(now) / time.Millisecond
+	if !intact || ttl <= 0 {
+		return false
+	}
+
+	w.uint(uint64(_SnapshotItem), 1)
+	w.string(t.name)
+	w.string(item.key)
+	w.uint(uint64(item.flags), 4)
+	w.uint(item.casId, 8)
+	w.uint(uint64(ttl), 8)
+	w.uint(item.byteLen, 8)
+	if w.err == nil {
+		_, w.err = io.Copy(w, value.Reader())
+	}
+	state := _SnapshotIntact
+	if value.Changed() {
+		state = _SnapshotDropped
+	}
+	w.uint(uint64(state), 1)
+	w.end()
+	return state == _SnapshotIntact
+}
+
+
+// snapshotReader reads fields of records, summing them by crc32
+type snapshotReader struct {
+	r *bufio.Reader
+	crc hash.Hash32
+	buf [8]byte
+	err error
+}
+
+func (r *snapshotReader) Read(b []byte) (int, error) {
+	n, e := r.r.Read(b)
+	_, _ = r.crc.Write(b[:n])
+	return n, e
+}
+
+func (r *snapshotReader) read(b []byte) {
+	if r.err != nil {
+		return
+	}
+	if _, r.err = io.ReadFull(r, b); r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+}
+
+func (r *snapshotReader) uint(size int) uint64 {
+	b := r.buf[:size]
+	r.read(b)
+	if r.err != nil {
+		return 0
+	}
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *snapshotReader) string() string {
+	n := r.uint(2)
+	if r.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	r.read(b)
+	return string(b)
+}
+
+// end checks crc32 of the record, and starts a new one
+func (r *snapshotReader) end() bool {
+	sum := r.crc.Sum32()
+	stored := uint32(r.uint(4))
+	r.crc.Reset()
+	if r.err == nil && stored != sum {
+		r.err = ErrSnapshotBroken
+	}
+	return r.err == nil
+}
+
+
+// snapshotLoader stores item with value read from r, like handler.loadItem
+type snapshotLoader func(item *MetaItem, r io.Reader) error
+
+// Load reads items from the file into their tenants by name, or by key for tenants no longer configured;
+// Items expired since the snapshot are skipped. Items loaded before a broken record are kept.
+func (s *Snapshot) Load(load snapshotLoader) (int, error) {
+	if !s.Enabled() {
+		return 0, ErrSnapshotDisabled
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := &snapshotReader{r: bufio.NewReaderSize(f, 256 * 1024), crc: crc32.New(_SnapshotTable)}
+	magic := make([]byte, len(_SnapshotMagic))
+	r.read(magic)
+	version := r.uint(2)
+	created := time.Unix(0, int64(r.uint(8)) * int64(time.Millisecond))
+	if r.err == nil && string(magic) != _SnapshotMagic {
+		return 0, ErrSnapshotBroken
+	}
+	if r.err == nil && version > SnapshotVersion {
+		return 0, ErrSnapshotVersion
+	}
+	if !r.end() {
+		return 0, r.err
+	}
+
+	n, records := 0, uint64(0)
+	for {
+		kind := byte(r.uint(1))
+		if r.err != nil {
+			return n, r.err
+		}
+		if kind == _SnapshotEnd {
+			count := r.uint(8)
+			if r.end() && count != records {
+				r.err = ErrSnapshotBroken
+			}
+			return n, r.err
+		} else if kind != _SnapshotItem {
+			return n, ErrSnapshotBroken
+		}
+		intact, loaded := s.loadItem(r, load, created)
+		if r.err != nil {
+			return n, r.err
+		}
+		if intact {
+			records++
+		}
+		if loaded {
+			n++
+		}
+	}
+}
+
+// loadItem reads a record of item, and tells whether value in the record is intact, and whether the item is loaded
+func (s *Snapshot) loadItem(r *snapshotReader, load snapshotLoader, created time.Time) (intact, loaded bool) {
+	name := r.string()
+	key := r.string()
+	flags := uint32(r.uint(4))
+	casId := r.uint(8)
+	ttl := time.Duration(r.uint(8)) * time.Millisecond
+	size := r.uint(8)
+	if r.err != nil {
+		return
+	}
+	if !ValidKey(key) {
+		r.err = ErrSnapshotBroken
+		return
+	}
+
+	tenant := s.tenants.Get(name)
+	if tenant == nil {
+		tenant = s.tenants.Select(key, "")
+	}
+	left := created.Add(ttl).Sub(time.Now())
+	var item *MetaItem
+	value := io.LimitReader(r, int64(size))
+	if left > 0 {
+		item = NewMetaItem(key, flags, 0, size)
+		item.duration = left
+		item.casId = casId
+		item.tenant = tenant
+		if e := load(item, value); e != nil {
+			logger.Warnf("Load of key [%s] from snapshot failed: %v", key, e.Error())
+			item = nil
+		}
+	}
+	if _, e := io.Copy(ioutil.Discard, value); e != nil {
+		r.err = e
+	} else if value.(*io.LimitedReader).N > 0 {
+		r.err = io.ErrUnexpectedEOF
+	}
+	intact = byte(r.uint(1)) == _SnapshotIntact
+	if !r.end() || !intact {
+		if item != nil {
+			tenant.entry.RemoveItem(item)
+			item.ClearSlots()
+		}
+		return
+	}
+	if item == nil {
+		atomic.AddUint64(&s.skipped, 1)
+		return
+	}
+	atomic.AddUint64(&s.loaded, 1)
+	return true, true
+}
+
+
+
+
+// loadSnapshot loads items saved before restart, ahead of serving and handoff in cluster
+func (s *Server) loadSnapshot() {
+	if !s.snapshot.Enabled() {
+		return
+	}
+	start := time.Now()
+	h := newHandler(-1, s)
+	n, err := s.snapshot.Load(h.loadItem)
+	if err != nil {
+		logger.Errorf("Snapshot loaded with %d items before failure: %v", n, err.Error())
+		return
+	}
+	logger.Infof("Snapshot of %d items loaded from %s in %v, %d skipped",
+		n, s.snapshot.path, time.Since(start), atomic.LoadUint64(&s.snapshot.skipped))
+}
+
+// handleSnapshot serves "snapshot", saving all items to the file of snapshot
+func (h *handler) handleSnapshot(msgline *MsgLine, sc *ServConn) error {
+	if !h.snapshot.Enabled() {
+		h.writeClientError(sc.rw, ErrSnapshotDisabled.Error())
+		return nil
+	}
+	if _, e := h.snapshot.Save(); e != nil {
+		logger.Errorf("Snapshot failed at handler[%d]: %v", h.index, e.Error())
+		h.writeServerError(sc.rw, e.Error())
+		return nil
+	}
+	return h.writeResult(sc.rw, ResultOK)
+}
@@ -0,0 +1,177 @@
+package filerelay
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func snapshotConfig(file string) *MemConfig {
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.MinExpiration = 1
+	c.SnapshotFile = file
+	c.Tenants = []TenantConfig{{Name: "images", Prefix: "img:"}}
+	return c
+}
+
+func startSnapshotServer(t *testing.T, file string) (string, *Server, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, stop := serveTestListener(t, lis, snapshotConfig(file), 0)
+	return lis.Addr().String(), server, stop
+}
+
+func TestSnapshot_Restart(t *testing.T) {
+	defer quietLogs()()
+	file := filepath.Join(t.TempDir(), "items.snap")
+	addr, _, stop := startSnapshotServer(t, file)
+	conn, rw := dialTest(t, addr)
+
+	values := map[string][]byte{
+		"img:large": stressValue("img:large", 300000),
+		"small": stressValue("small", 100),
+		"empty": {},
+		"short-lived": stressValue("short-lived", 1000),
+	}
+	for key, v := range values {
+		exp := 300
+		if key == "short-lived" {
+			exp = 1
+		}
+		if resp := command(t, rw, fmt.Sprintf("set %s %d %d %d", key, len(key), exp, len(v)), v); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+	}
+	cas := command(t, rw, "mg img:large c", nil)
+	conn.Close()
+	stop() //snapshot saved on stop
+
+	time.Sleep(time.Millisecond * 1100)
+	addr, server, stop := startSnapshotServer(t, file)
+	defer stop()
+	conn, rw = dialTest(t, addr)
+	defer conn.Close()
+
+	for key, v := range values {
+		if key == "short-lived" {
+			if resp := command(t, rw, "mg " + key, nil); resp != string(ResultMetaMiss) {
+				t.Errorf("expired item loaded: %q", resp)
+			}
+			continue
+		}
+		fmt.Fprintf(rw, "get %s\r\n", key)
+		rw.Flush()
+		got, err := readStressValue(rw)
+		if err != nil || !bytes.Equal(got, v) {
+			t.Fatalf("get %s after restart: %d bytes, %v", key, len(got), err)
+		}
+		var ttl int64
+		if resp := command(t, rw, "mg " + key + " f t", nil); !strings.HasPrefix(resp, fmt.Sprintf("HD f%d t", len(key))) {
+			t.Errorf("mg %s after restart: %q", key, resp)
+		} else if fmt.Sscanf(resp, fmt.Sprintf("HD f%d t%%d", len(key)), &ttl); ttl < 290 || ttl > 300 {
+			t.Errorf("ttl of %s after restart: %d", key, ttl)
+		}
+	}
+	if resp := command(t, rw, "mg img:large c", nil); resp != cas {
+		t.Errorf("cas unique after restart: %q, expected %q", resp, cas)
+	}
+	if server.tenants.Get("images").entry.Get("img:large") == nil {
+		t.Error("item not loaded into its tenant")
+	}
+	if loaded, skipped := server.snapshot.loaded, server.snapshot.skipped; loaded != 3 || skipped != 1 {
+		t.Errorf("%d items loaded, %d skipped", loaded, skipped)
+	}
+}
+
+func TestSnapshot_Command(t *testing.T) {
+	defer quietLogs()()
+	file := filepath.Join(t.TempDir(), "items.snap")
+	addr, server, stop := startSnapshotServer(t, file)
+	defer stop()
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+
+	v := stressValue("on-demand", 5000)
+	if resp := command(t, rw, fmt.Sprintf("set on-demand 0 0 %d", len(v)), v); resp != string(ResultStored) {
+		t.Fatalf("set: %q", resp)
+	}
+	if resp := command(t, rw, "snapshot", nil); resp != string(ResultOK) {
+		t.Fatalf("snapshot: %q", resp)
+	}
+	if server.snapshot.saved != 1 || server.snapshot.savedAt == 0 {
+		t.Errorf("stats of snapshot: %d items at %d", server.snapshot.saved, server.snapshot.savedAt)
+	}
+	if data, e := ioutil.ReadFile(file); e != nil || !bytes.HasPrefix(data, []byte(_SnapshotMagic)) || !bytes.Contains(data, v) {
+		t.Fatalf("snapshot file: %d bytes, %v", len(data), e)
+	}
+
+	c := snapshotConfig("")
+	c.MaxRoutines = 2
+	addr2, stop2 := startTestServer(t, c, 0)
+	defer stop2()
+	conn2, rw2 := dialTest(t, addr2)
+	defer conn2.Close()
+	if resp := command(t, rw2, "snapshot", nil); !strings.HasPrefix(resp, "CLIENT_ERROR") {
+		t.Errorf("snapshot without file: %q", resp)
+	}
+}
+
+func TestSnapshot_Broken(t *testing.T) {
+	defer quietLogs()()
+	file := filepath.Join(t.TempDir(), "items.snap")
+	_, server, stop := startSnapshotServer(t, file)
+	defer stop()
+
+	h := newHandler(-1, server)
+	tenant := server.tenants.Select("k", "")
+	for _, key := range []string{"k1", "k2", "k3"} {
+		v := stressValue(key, 1000)
+		item := NewMetaItem(key, 0, 300, uint64(len(v)))
+		item.tenant = tenant
+		if e := h.loadItem(item, bytes.NewReader(v)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if n, e := server.snapshot.Save(); n != 3 || e != nil {
+		t.Fatalf("save: %d, %v", n, e)
+	}
+	data, _ := ioutil.ReadFile(file)
+
+	load := func(data []byte) (int, error) {
+		tenant.entry.Flush()
+		if e := ioutil.WriteFile(file, data, 0644); e != nil {
+			t.Fatal(e)
+		}
+		return server.snapshot.Load(h.loadItem)
+	}
+	if n, e := load(data); n != 3 || e != nil {
+		t.Fatalf("load: %d, %v", n, e)
+	}
+
+	// value of the last item broken
+	broken := append([]byte{}, data...)
+	broken[len(broken) - 100] ^= 0xff
+	if n, e := load(broken); n != 2 || e != ErrSnapshotBroken || tenant.entry.Len() != 2 {
+		t.Errorf("load with broken value: %d, %v, %d items", n, e, tenant.entry.Len())
+	}
+	if n, e := load(data[:len(data) - 5]); n != 3 || e == nil {
+		t.Errorf("load of truncated: %d, %v", n, e)
+	}
+
+	future := append([]byte{}, data...)
+	future[len(_SnapshotMagic) + 1] = SnapshotVersion + 1
+	if _, e := load(future); e != ErrSnapshotVersion {
+		t.Errorf("load of newer version: %v", e)
+	}
+}
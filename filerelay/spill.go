@@ -0,0 +1,409 @@
+package filerelay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+const (
+	SpillMaxSize = "1GB"
+	SpillSegmentSize = "64MB"
+	SpillReclaimInterval = 10 //seconds
+
+	_SpillSegmentPattern = "seg-*.dat"
+)
+
+var (
+	ErrSpillFull = errors.New("spill storage full")
+)
+
+
+// SpillConfig enables the disk tier for items not fitting in memory, with its own budget of disk space
+type SpillConfig struct {
+	Dir string `yaml:"dir"` //directory of segment files; disk tier is disabled when not set
+	MaxSize string `yaml:"max-size"` //example: 500MB, 20GB, 1TB; default as 1GB
+	SegmentSize string `yaml:"segment-size"` //default as 64MB
+	ReclaimInterval int `yaml:"reclaim-interval"` //in seconds; default as 10
+}
+
+// parseDiskSize reads size in MB, GB or TB, without the bounds of memory storage
+func parseDiskSize(size string) (uint64, error) {
+	matches := regexp.MustCompile(`^([1-9]\d*)([MGT]B)$`).FindStringSubmatch(size)
+	if matches == nil {
+		return 0, errors.New("invalid disk size: " + size)
+	}
+	n, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	switch matches[2] {
+	case "GB":
+		n *= szGB
+	case "TB":
+		n *= szGB * 1024
+	default:
+		n *= szMB
+	}
+	return n, nil
+}
+
+
+// spillSegment is a file of values appended one after another; Values are never rewritten,
+// and the file is removed when no items point into it, or when all its items have expired.
+type spillSegment struct {
+	id uint64
+	f *os.File
+	size int64 //bytes taken in file
+	live int64 //bytes of items still pointing into segment
+	expireAt time.Time //of the item expiring last
+	pins int //readers of values in segment
+	removed bool
+}
+
+func (seg *spillSegment) path(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("seg-%08d.dat", seg.id))
+}
+
+// spillRef is location of value of item on disk
+type spillRef struct {
+	store *SpillStore //only reference
+	seg *spillSegment
+	off int64
+	size int64
+}
+
+// pin keeps segment from being closed until value is read; It fails if segment has been reclaimed.
+func (r *spillRef) pin() (*pinnedValue, bool) {
+	s := r.store
+	s.Lock()
+	defer s.Unlock()
+	if r.seg.removed {
+		return nil, false
+	}
+	r.seg.pins++
+	return &pinnedValue{disk: r}, true
+}
+
+func (r *spillRef) unpin() {
+	s := r.store
+	s.Lock()
+	defer s.Unlock()
+	if r.seg.pins--; r.seg.pins == 0 && r.seg.removed {
+		_ = r.seg.f.Close()
+	}
+}
+
+// release gives space of value back, when item is removed or replaced
+func (r *spillRef) release() {
+	s := r.store
+	s.Lock()
+	defer s.Unlock()
+	if r.seg.live -= r.size; r.seg.live > 0 {
+		return
+	}
+	if r.seg == s.active {
+		s.active = nil
+	}
+	s.remove(r.seg)
+}
+
+// extend keeps segment for item touched to expire later
+func (r *spillRef) extend(expireAt time.Time) {
+	s := r.store
+	s.Lock()
+	defer s.Unlock()
+	if expireAt.After(r.seg.expireAt) {
+		r.seg.expireAt = expireAt
+	}
+}
+
+// reader reads value at its location in segment
+func (r *spillRef) reader() io.ReaderAt {
+	return io.NewSectionReader(r.seg.f, r.off, r.size)
+}
+
+// segmentWriter writes at offset of segment, for writers sharing file without seeking
+type segmentWriter struct {
+	f *os.File
+	off int64
+}
+
+func (w *segmentWriter) Write(b []byte) (int, error) {
+	n, e := w.f.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, e
+}
+
+
+
+
+// SpillStore keeps values of items on disk in segments appended in turn, within budget of disk space;
+// Items on disk are only indexed in memory, so segments left from before are removed on start.
+type SpillStore struct {
+	dir string
+	maxSize int64
+	segSize int64
+	reclaimIntv int
+
+	segments map[uint64]*spillSegment
+	active *spillSegment //segment appended
+	nextId uint64
+	size int64 //bytes taken in all segments
+
+	spilled uint64
+	spillFails uint64
+	reclaimed uint64 //segments removed
+
+	quit chan bool
+	done sync.WaitGroup
+	sync.Mutex
+}
+
+// NewSpillStore returns nil for config without dir, which means disk tier is off
+func NewSpillStore(c *SpillConfig) (*SpillStore, error) {
+	if c.Dir == "" {
+		return nil, nil
+	}
+	s := &SpillStore{
+		dir: c.Dir,
+		reclaimIntv: c.ReclaimInterval,
+		segments: make(map[uint64]*spillSegment),
+		nextId: 1,
+		quit: make(chan bool),
+	}
+	if s.reclaimIntv <= 0 {
+		s.reclaimIntv = SpillReclaimInterval
+	}
+	for _, size := range []struct {
+		value, def string
+		to *int64
+	}{
+		{c.MaxSize, SpillMaxSize, &s.maxSize},
+		{c.SegmentSize, SpillSegmentSize, &s.segSize},
+	} {
+		if size.value == "" {
+			size.value = size.def
+		}
+		n, err := parseDiskSize(size.value)
+		if err != nil {
+			return nil, err
+		}
+		*size.to = int64(n)
+	}
+	if s.segSize > s.maxSize {
+		return nil, errors.New("segment size of spill larger than max size")
+	}
+
+	if e := os.MkdirAll(s.dir, 0755); e != nil {
+		return nil, e
+	}
+	left, _ := filepath.Glob(filepath.Join(s.dir, _SpillSegmentPattern))
+	for _, path := range left {
+		if e := os.Remove(path); e != nil {
+			return nil, e
+		}
+	}
+	return s, nil
+}
+
+func (s *SpillStore) Enabled() bool {
+	return s != nil
+}
+
+// Start reclaims segments with all items expired at every interval
+func (s *SpillStore) Start() {
+	if !s.Enabled() {
+		return
+	}
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		t := time.NewTicker(time.Second * time.Duration(s.reclaimIntv))
+		defer t.Stop()
+		for {
+			select {
+			case now := <-t.C:
+				s.Lock()
+				s.reclaim(now)
+				s.Unlock()
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops reclaiming, and removes all segments
+func (s *SpillStore) Close() {
+	if !s.Enabled() {
+		return
+	}
+	close(s.quit)
+	s.done.Wait()
+	s.Lock()
+	defer s.Unlock()
+	s.active = nil
+	for _, seg := range s.segments {
+		s.remove(seg)
+	}
+}
+
+// Write appends size bytes read from r to the active segment, for item expiring at the time;
+// A new segment is started when the active one is full, after reclaiming segments for budget.
+func (s *SpillStore) Write(r io.Reader, size int64, expireAt time.Time) (*spillRef, error) {
+	s.Lock()
+	ref, err := s.reserve(size, expireAt)
+	s.Unlock()
+	if err != nil {
+		atomic.AddUint64(&s.spillFails, 1)
+		return nil, err
+	}
+
+	n, err := io.Copy(&segmentWriter{f: ref.seg.f, off: ref.off}, io.LimitReader(r, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		ref.release()
+		atomic.AddUint64(&s.spillFails, 1)
+		return nil, err
+	}
+	atomic.AddUint64(&s.spilled, 1)
+	return ref, nil
+}
+
+// reserve takes room of value in the active segment; it must be called with lock
+func (s *SpillStore) reserve(size int64, expireAt time.Time) (*spillRef, error) {
+	seg := s.active
+	if seg == nil || seg.size > 0 && seg.size + size > s.segSize {
+		if s.size + size > s.maxSize {
+			s.reclaim(time.Now())
+		}
+		if s.size + size > s.maxSize {
+			return nil, ErrSpillFull
+		}
+		if seg != nil && seg.live <= 0 {
+			s.remove(seg)
+		}
+		seg = &spillSegment{id: s.nextId}
+		f, err := os.OpenFile(seg.path(s.dir), os.O_RDWR | os.O_CREATE | os.O_EXCL, 0644)
+		if err != nil {
+			s.active = nil
+			return nil, err
+		}
+		seg.f = f
+		s.nextId++
+		s.segments[seg.id] = seg
+		s.active = seg
+	} else if s.size + size > s.maxSize {
+		return nil, ErrSpillFull
+	}
+
+	ref := &spillRef{store: s, seg: seg, off: seg.size, size: size}
+	seg.size += size
+	seg.live += size
+	s.size += size
+	if expireAt.After(seg.expireAt) {
+		seg.expireAt = expireAt
+	}
+	return ref, nil
+}
+
+// reclaim removes segments of which all items have expired or been removed; it must be called with lock
+func (s *SpillStore) reclaim(now time.Time) {
+	for _, seg := range s.segments {
+		if seg.live > 0 && seg.expireAt.After(now) {
+			continue
+		}
+		if seg == s.active {
+			s.active = nil
+		}
+		s.remove(seg)
+	}
+}
+
+// remove deletes file of segment, which is closed after its values are read; it must be called with lock
+func (s *SpillStore) remove(seg *spillSegment) {
+	if seg.removed {
+		return
+	}
+	seg.removed = true
+	delete(s.segments, seg.id)
+	s.size -= seg.size
+	if e := os.Remove(seg.path(s.dir)); e != nil {
+		logger.Warnf("Remove of spill segment %d failed: %v", seg.id, e.Error())
+	}
+	if seg.pins == 0 {
+		_ = seg.f.Close()
+	}
+	atomic.AddUint64(&s.reclaimed, 1)
+}
+
+// Size is bytes taken on disk
+func (s *SpillStore) Size() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+func (s *SpillStore) Segments() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.segments)
+}
+
+
+
+
+// pinForSpill pins value of item evicted before expiration, to be written to disk tier of its tenant by spill;
+// It's called with lock of shard, before slots are cleared.
+func (t *MetaItem) pinForSpill() {
+	if t.disk != nil || t.tenant == nil || !t.tenant.spill.Enabled() {
+		return
+	}
+	if !t.Deadline().After(time.Now()) {
+		return
+	}
+	if value, intact := t.Pin(); intact {
+		t.spilling = value
+	}
+}
+
+// spill writes value pinned at eviction to disk tier, and returns the location;
+// It's called without lock of shard, so that others are not blocked by writing to disk.
+func (t *MetaItem) spill() *spillRef {
+	value := t.spilling
+	t.spilling = nil
+	defer value.Unpin()
+	ref, err := t.tenant.spill.Write(value.Reader(), int64(t.byteLen), t.Deadline())
+	if err != nil {
+		logger.Warnf("Spill of key [%s] failed: %v", t.key, err.Error())
+		return nil
+	}
+	if value.Changed() {
+		ref.release()
+		return nil
+	}
+	return ref
+}
+
+// spillItem writes value read from r to disk for item failing to take slots, and moves the item to disk
+func (h *handler) spillItem(item *MetaItem, r io.Reader) error {
+	ref, err := h.spill.Write(r, int64(item.byteLen), item.Deadline())
+	if err != nil {
+		return err
+	}
+	if !item.tenant.entry.spillItem(item, ref) {
+		ref.release() //replaced or removed already
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package filerelay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func readSpilled(t *testing.T, ref *spillRef) []byte {
+	value, ok := ref.pin()
+	if !ok {
+		t.Fatal("spilled value not pinned")
+	}
+	defer value.Unpin()
+	data, err := ioutil.ReadAll(value.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSpill_Store(t *testing.T) {
+	dir := t.TempDir()
+	if e := ioutil.WriteFile(filepath.Join(dir, "seg-00000009.dat"), []byte("left"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	s, err := NewSpillStore(&SpillConfig{Dir: dir, MaxSize: "3MB", SegmentSize: "1MB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, e := os.Stat(filepath.Join(dir, "seg-00000009.dat")); !os.IsNotExist(e) {
+		t.Error("segment left from before not removed")
+	}
+
+	// segments are rotated when full, until budget runs out
+	later := time.Now().Add(time.Minute)
+	var refs []*spillRef
+	var values [][]byte
+	for i := 0; ; i++ {
+		v := stressValue(fmt.Sprintf("spill-%d", i), 400 * 1024)
+		ref, e := s.Write(bytes.NewReader(v), int64(len(v)), later)
+		if e == ErrSpillFull {
+			break
+		} else if e != nil {
+			t.Fatal(e)
+		}
+		refs, values = append(refs, ref), append(values, v)
+	}
+	if len(refs) != 7 || s.Segments() != 4 || s.Size() != 7 * 400 * 1024 {
+		t.Fatalf("%d values spilled in %d segments of %d bytes", len(refs), s.Segments(), s.Size())
+	}
+	for i, ref := range refs {
+		if !bytes.Equal(readSpilled(t, ref), values[i]) {
+			t.Fatalf("value %d spilled broken", i)
+		}
+	}
+
+	// segment is removed when all its values are released, even if it's pinned for reading
+	pinned, _ := refs[0].pin()
+	refs[0].release()
+	refs[1].release()
+	if s.Segments() != 3 {
+		t.Errorf("%d segments after released", s.Segments())
+	}
+	if data, _ := ioutil.ReadAll(pinned.Reader()); !bytes.Equal(data, values[0]) {
+		t.Error("value pinned not read after segment removed")
+	}
+	pinned.Unpin()
+	if _, ok := refs[0].pin(); ok {
+		t.Error("value of removed segment pinned")
+	}
+	if _, e := s.Write(strings.NewReader("abc"), 10, later); e == nil {
+		t.Error("short value spilled")
+	}
+}
+
+func TestSpill_Reclaim(t *testing.T) {
+	s, err := NewSpillStore(&SpillConfig{Dir: t.TempDir(), MaxSize: "1MB", SegmentSize: "1MB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// segment with all values expired is reclaimed for budget
+	v := stressValue("short", 600 * 1024)
+	short, err := s.Write(bytes.NewReader(v), int64(len(v)), time.Now().Add(time.Millisecond * 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	v = stressValue("long", 600 * 1024)
+	long, err := s.Write(bytes.NewReader(v), int64(len(v)), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := short.pin(); ok {
+		t.Error("value expired not reclaimed")
+	}
+	if !bytes.Equal(readSpilled(t, long), v) || s.Size() != int64(len(v)) {
+		t.Errorf("value spilled after reclaimed: %d bytes on disk", s.Size())
+	}
+	if _, e := s.Write(bytes.NewReader(v), int64(len(v)), time.Now().Add(time.Minute)); e != ErrSpillFull {
+		t.Errorf("spilled beyond budget: %v", e)
+	}
+}
+
+// statsOf reads response of "stats" into map by names
+func statsOf(t *testing.T, rw *bufio.ReadWriter) map[string]string {
+	stats := make(map[string]string)
+	for line := command(t, rw, "stats", nil); line != string(ResultEnd); {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("stats: %q", line)
+		}
+		stats[fields[1]] = fields[2]
+		var err error
+		if line, err = rw.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stats
+}
+
+func TestSpill_Evicted(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.LRUSize = 4
+	c.ItemShards = 1
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.Spill = SpillConfig{Dir: t.TempDir(), MaxSize: "8MB", SegmentSize: "1MB"}
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+
+	values := make(map[string][]byte)
+	for i := 0; i < 12; i++ {
+		key := fmt.Sprintf("evicted-%d", i)
+		values[key] = stressValue(key, 30000 + i)
+		if resp := command(t, rw, fmt.Sprintf("set %s %d 300 %d", key, i, len(values[key])), values[key]); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+	}
+	stats := statsOf(t, rw)
+	if stats["spill_items"] != "8" || stats["curr_items"] != "12" {
+		t.Fatalf("items spilled: %s of %s", stats["spill_items"], stats["curr_items"])
+	}
+
+	// items on disk are retrieved as the ones in memory
+	for key, v := range values {
+		fmt.Fprintf(rw, "get %s\r\n", key)
+		rw.Flush()
+		got, err := readStressValue(rw)
+		if err != nil || !bytes.Equal(got, v) {
+			t.Fatalf("get %s: %d bytes, %v", key, len(got), err)
+		}
+	}
+	if resp := command(t, rw, "mg evicted-0 f s t", nil); resp != "HD f0 s30000 t300\r\n" {
+		t.Errorf("mg of item on disk: %q", resp)
+	}
+
+	if resp := command(t, rw, "add evicted-0 0 0 1", []byte("x")); resp != string(ResultNotStored) {
+		t.Errorf("add of key on disk: %q", resp)
+	}
+	if resp := command(t, rw, "touch evicted-1 100", nil); resp != string(ResultTouched) {
+		t.Errorf("touch of item on disk: %q", resp)
+	}
+	if resp := command(t, rw, "mg evicted-1 t", nil); resp != "HD t100\r\n" {
+		t.Errorf("mg of item touched on disk: %q", resp)
+	}
+	if resp := command(t, rw, "replace evicted-2 7 0 3", []byte("new")); resp != string(ResultStored) {
+		t.Errorf("replace of item on disk: %q", resp)
+	}
+	if resp := command(t, rw, "mg evicted-2 f s", nil); resp != "HD f7 s3\r\n" {
+		t.Errorf("mg of item replaced: %q", resp)
+	}
+	if resp := command(t, rw, "delete evicted-3", nil); resp != string(ResultDeleted) {
+		t.Errorf("delete of item on disk: %q", resp)
+	}
+	if resp := command(t, rw, "mg evicted-3", nil); resp != string(ResultMetaMiss) {
+		t.Errorf("mg of item deleted on disk: %q", resp)
+	}
+}
+
+func TestSpill_StorageFull(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.MaxStorage = "2MB"
+	c.Spill = SpillConfig{Dir: t.TempDir(), MaxSize: "4MB", SegmentSize: "2MB"}
+	addr, stop := startTestServer(t, c, 0)
+	defer stop()
+	conn, rw := dialTest(t, addr)
+	defer conn.Close()
+
+	// value larger than storage in memory goes to disk
+	v := stressValue("large", 3 * 1024 * 1024)
+	if resp := command(t, rw, fmt.Sprintf("set large 3 0 %d", len(v)), v); resp != string(ResultStored) {
+		t.Fatalf("set of large value: %q", resp)
+	}
+	fmt.Fprintf(rw, "get large\r\n")
+	rw.Flush()
+	if got, err := readStressValue(rw); err != nil || !bytes.Equal(got, v) {
+		t.Fatalf("get of large value: %d bytes, %v", len(got), err)
+	}
+
+	// value beyond budget of disk fails as storage full in memory, closing the connection
+	if resp := command(t, rw, fmt.Sprintf("set larger 3 0 %d", len(v)), v); resp != string(ResultNotStored) {
+		t.Fatalf("set beyond budget of disk: %q", resp)
+	}
+	conn.Close()
+	conn, rw = dialTest(t, addr)
+	defer conn.Close()
+	stats := statsOf(t, rw)
+	if stats["spill_items"] != "1" || stats["spill_fails"] != "1" || stats["spill_bytes"] != fmt.Sprint(len(v)) {
+		t.Errorf("stats of spill: %v", stats)
+	}
+
+	// space of item replaced is reclaimed
+	if resp := command(t, rw, "set large 0 0 5", []byte("small")); resp != string(ResultStored) {
+		t.Fatalf("set of small value: %q", resp)
+	}
+	if stats = statsOf(t, rw); stats["spill_items"] != "0" || stats["spill_bytes"] != "0" {
+		t.Errorf("stats of spill after replaced: %v", stats)
+	}
+}
+
+// TestSpill_AfterUnlock evicts items with values pinned under lock of shard, and spills them after it's released
+func TestSpill_AfterUnlock(t *testing.T) {
+	defer quietLogs()()
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.LRUSize = 4
+	c.ItemShards = 1
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.Spill = SpillConfig{Dir: t.TempDir(), MaxSize: "8MB", SegmentSize: "1MB"}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, stop := serveTestListener(t, lis, c, 0)
+	defer stop()
+	conn, rw := dialTest(t, lis.Addr().String())
+	defer conn.Close()
+
+	values := make(map[string][]byte)
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("unlocked-%d", i)
+		values[key] = stressValue(key, 20000)
+		if resp := command(t, rw, fmt.Sprintf("set %s 0 300 %d", key, len(values[key])), values[key]); resp != string(ResultStored) {
+			t.Fatalf("set %s: %q", key, resp)
+		}
+	}
+	shard := server.tenants.Select("", "").entry.shards[0]
+
+	// victim removed while its value is being spilled is never brought back
+	victim := shard.evictOldest("")
+	if victim == nil || victim.spilling == nil {
+		t.Fatal("value of victim not pinned for spill")
+	}
+	if shard.Remove(victim.key) != nil {
+		t.Error("victim found while being spilled")
+	}
+	shard.spillEvicted(victim)
+	if shard.Get(victim.key) != nil || server.spill.Size() != 0 {
+		t.Errorf("victim removed kept on disk: %d bytes", server.spill.Size())
+	}
+
+	// victim replaced while its value is being spilled is left to the new one
+	victim = shard.evictOldest("")
+	item := NewMetaItem(victim.key, 0, 300, 0)
+	if e := shard.Set(item); e != nil {
+		t.Fatal(e)
+	}
+	shard.spillEvicted(victim)
+	if shard.Get(victim.key) != item || server.spill.Size() != 0 {
+		t.Errorf("victim replaced kept on disk: %d bytes", server.spill.Size())
+	}
+
+	victim = shard.evictOldest("")
+	shard.spillEvicted(victim)
+	if got := shard.Get(victim.key); got != victim || got.disk == nil {
+		t.Fatal("victim not kept on disk")
+	}
+	if !bytes.Equal(readSpilled(t, victim.disk), values[victim.key]) {
+		t.Error("value spilled broken")
+	}
+}
@@ -0,0 +1,176 @@
+package filerelay
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+
+type statWriter func(name string, val interface{})
+
+// handleStats responds with lines of "STAT <name> <value>" and ends with "END";
+// The optional argument selects group of stats: "tenants" for stats per tenant, "slabs" for stats per slab-group,
+// "cluster" for members of cluster.
+func (h *handler) handleStats(msgline *MsgLine, rw *bufio.ReadWriter) error {
+	var err error
+	write := func(name string, val interface{}) {
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(rw, "STAT %s %v\r\n", name, val)
+	}
+
+	group := ""
+	if len(msgline.Args) > 0 {
+		group = msgline.Args[0]
+	}
+
+	switch group {
+	case "":
+		h.writeGeneralStats(write)
+	case "tenants":
+		h.writeTenantStats(write)
+	case "slabs":
+		h.writeSlabStats(write)
+	case "cluster":
+		h.writeClusterStats(write)
+	default:
+		h.writeClientError(rw, "unknown stats group: " + group)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	return h.writeResult(rw, ResultEnd)
+}
+
+func (h *handler) writeGeneralStats(write statWriter) {
+	now := time.Now()
+	write("pid", os.Getpid())
+	write("uptime", int64(now.Sub(h.startAt).Seconds()))
+	write("time", now.Unix())
+	write("max_routines", h.cfg.MaxRoutines)
+
+	var items int
+	var used uint64
+	h.tenants.Each(func(t *Tenant) {
+		items += t.entry.Len()
+		used += t.Used()
+	})
+	write("curr_items", items)
+	write("bytes", used)
+	write("total_capacity", h.cfg.TotalCapacity())
+	write("limit_maxbytes", h.cfg.maxStorageSize)
+	write("reclaimed_bytes", h.reclaimer.Reclaimed())
+	if h.persistence.Enabled() {
+		write("persisted", atomic.LoadUint64(&h.persistence.persisted))
+		write("persist_fails", atomic.LoadUint64(&h.persistence.persistFails))
+		write("read_throughs", atomic.LoadUint64(&h.persistence.readThroughs))
+	}
+	if h.spill.Enabled() {
+		var spilled int
+		h.tenants.Each(func(t *Tenant) {
+			spilled += t.entry.Spilled()
+		})
+		write("spill_items", spilled)
+		write("spill_bytes", h.spill.Size())
+		write("spill_limit_bytes", h.spill.maxSize)
+		write("spill_segments", h.spill.Segments())
+		write("spilled", atomic.LoadUint64(&h.spill.spilled))
+		write("spill_fails", atomic.LoadUint64(&h.spill.spillFails))
+		write("spill_reclaimed", atomic.LoadUint64(&h.spill.reclaimed))
+	}
+	if h.wal.Enabled() {
+		write("wal_segments", h.wal.Segments())
+		write("wal_bytes", h.wal.Size())
+		write("wal_appends", atomic.LoadUint64(&h.wal.appends))
+		write("wal_syncs", atomic.LoadUint64(&h.wal.syncs))
+		write("wal_fails", atomic.LoadUint64(&h.wal.fails))
+		write("wal_replayed", atomic.LoadUint64(&h.wal.replayed))
+		write("wal_compacted", atomic.LoadUint64(&h.wal.compacted))
+	}
+	if h.snapshot.Enabled() {
+		write("snapshot_items", atomic.LoadUint64(&h.snapshot.saved))
+		write("snapshot_time", atomic.LoadInt64(&h.snapshot.savedAt))
+		write("snapshot_loaded", atomic.LoadUint64(&h.snapshot.loaded))
+		write("snapshot_skipped", atomic.LoadUint64(&h.snapshot.skipped))
+	}
+	if h.cluster.Enabled() {
+		write("cluster_node", h.cluster.self)
+		write("cluster_membership", h.cluster.membership())
+		write("cluster_nodes", h.cluster.ring.Len())
+		write("cluster_forwarded", atomic.LoadUint64(&h.cluster.forwarded))
+		write("cluster_forward_fails", atomic.LoadUint64(&h.cluster.forwardFails))
+		write("cluster_replicas", h.cluster.replicas)
+		write("cluster_replicated", atomic.LoadUint64(&h.cluster.replicated))
+		write("cluster_replicate_fails", atomic.LoadUint64(&h.cluster.replicateFails))
+		write("cluster_replicate_drops", atomic.LoadUint64(&h.cluster.replicateDrops))
+		write("cluster_ring_version", h.cluster.RingVersion())
+		write("cluster_handoff_moved", atomic.LoadUint64(&h.cluster.handoff.moved))
+		write("cluster_handoff_fails", atomic.LoadUint64(&h.cluster.handoff.moveFails))
+		write("cluster_handoff_pending", h.cluster.handoff.Pending())
+	}
+}
+
+func (h *handler) writeTenantStats(write statWriter) {
+	h.tenants.Each(func(t *Tenant) {
+		st := t.Stats()
+		prefix := t.name + ":"
+		write(prefix + "curr_items", t.entry.Len())
+		write(prefix + "bytes", t.Used())
+		write(prefix + "limit_maxbytes", t.maxStorage)
+		write(prefix + "min_expiration", t.minExp)
+		write(prefix + "max_expiration", t.maxExp)
+		write(prefix + "default_expiration", t.defExp)
+		write(prefix + "cmd_get", st.CmdGet)
+		write(prefix + "get_hits", st.GetHits)
+		write(prefix + "get_misses", st.GetMisses)
+		write(prefix + "cmd_set", st.CmdSet)
+		write(prefix + "set_fails", st.SetFails)
+		write(prefix + "evictions", st.Evictions)
+		write(prefix + "expired", st.Expirations)
+	})
+}
+
+func (h *handler) writeSlabStats(write statWriter) {
+	for c := h.cfg.SlotCapMin; c <= h.cfg.SlotCapMax; c = c << szShift {
+		g := h.groups[c]
+		if g == nil {
+			continue
+		}
+		prefix := strconv.FormatUint(c, 10) + ":"
+		write(prefix + "slabs", g.SlabCount())
+		write(prefix + "slots", g.SlotSum())
+		write(prefix + "capacity", g.Capacity())
+		write(prefix + "evictions", atomic.LoadUint64(&g.evictions))
+		write(prefix + "alloc_fails", atomic.LoadUint64(&g.allocFails))
+		write(prefix + "released_slabs", atomic.LoadUint64(&g.released))
+		write(prefix + "reclaimed_slabs", atomic.LoadUint64(&g.reclaimed))
+	}
+}
+
+// writeClusterStats lists members with state, weight and incarnation in gossip membership,
+// or nodes in ring as alive in static membership
+func (h *handler) writeClusterStats(write statWriter) {
+	if !h.cluster.Enabled() {
+		return
+	}
+	if h.cluster.gossip == nil {
+		for _, node := range h.cluster.ring.Nodes() {
+			write(node + ":state", memberAlive)
+		}
+		return
+	}
+	for _, m := range h.cluster.gossip.Members() {
+		prefix := m.node + ":"
+		write(prefix + "state", m.state)
+		write(prefix + "weight", m.weight)
+		write(prefix + "incarnation", m.incarnation)
+		write(prefix + "changed", m.changedAt.Unix())
+	}
+}
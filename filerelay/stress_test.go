@@ -0,0 +1,173 @@
+package filerelay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+
+// startTestServer runs server on a random local port, and returns its address with a function to stop it;
+// Connections are made with the write buffer size if it's not 0.
+func startTestServer(t *testing.T, c *MemConfig, writeBuffer int) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stop := serveTestListener(t, lis, c, writeBuffer)
+	return lis.Addr().String(), stop
+}
+
+// serveTestListener runs server on the listener, for servers which should know their addresses before started
+func serveTestListener(t *testing.T, lis net.Listener, c *MemConfig, writeBuffer int) (*Server, func()) {
+	server, err := NewServer(c)
+	if err != nil {
+		lis.Close()
+		t.Fatal(err)
+	}
+	server.Start()
+
+	go func() {
+		var idx uint64
+		for {
+			conn, e := lis.Accept()
+			if e != nil {
+				return
+			}
+			idx++
+			if writeBuffer > 0 {
+				_ = conn.(*net.TCPConn).SetWriteBuffer(writeBuffer)
+			}
+			server.Handle(MakeServConn(conn, idx))
+		}
+	}()
+	return server, func() {
+		lis.Close()
+		server.Stop()
+	}
+}
+
+// stressValue fills value with the key repeatedly, so that bytes of another key can be told
+func stressValue(key string, size int) []byte {
+	pattern := []byte(key + "|")
+	return bytes.Repeat(pattern, size / len(pattern) + 1)[:size]
+}
+
+// TestStress_SlotReuse sets and gets values on storage so small that slots are taken for other items
+// all the time by evictions, and checks that no value is returned with bytes of other items.
+func TestStress_SlotReuse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+	defer quietLogs()()
+
+	c := NewMemConfig()
+	c.MaxRoutines = 8
+	c.SlotCapMin, c.SlotCapMax = 256, 4096
+	c.SlotsInSlab, c.SlabsInGroup = 4, 2
+	c.MaxStorage = "96KB"
+	c.StorageFull = StorageFullEvict
+	// small socket buffers keep readers writing values out of slots for a while
+	addr, stop := startTestServer(t, c, 16384)
+	defer stop()
+
+	var gets, hits, aborts, corrupted int64
+	deadline := time.Now().Add(time.Second * 2)
+	var wg sync.WaitGroup
+	for g := 0; g < 6; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = conn.(*net.TCPConn).SetReadBuffer(16384)
+				rw := bufio.NewReadWriter(bufio.NewReaderSize(conn, 1024), bufio.NewWriter(conn))
+				for time.Now().Before(deadline) {
+					key := "stress-" + strconv.Itoa(r.Intn(40))
+					if r.Intn(2) == 0 {
+						v := stressValue(key, 1000 + r.Intn(30 * 1024))
+						fmt.Fprintf(rw, "set %s 0 0 %d\r\n", key, len(v))
+						rw.Write(v)
+						rw.Write(Crlf)
+						if rw.Flush() != nil {
+							break
+						}
+						if _, e := rw.ReadString('\n'); e != nil {
+							break
+						}
+						continue
+					}
+
+					atomic.AddInt64(&gets, 1)
+					fmt.Fprintf(rw, "get %s\r\n", key)
+					if rw.Flush() != nil {
+						break
+					}
+					v, e := readStressValue(rw)
+					if e != nil {
+						// connection closed by server for value broken by slot reuse
+						atomic.AddInt64(&aborts, 1)
+						break
+					}
+					if len(v) == 0 {
+						continue
+					}
+					atomic.AddInt64(&hits, 1)
+					if !bytes.Equal(v, stressValue(key, len(v))) {
+						atomic.AddInt64(&corrupted, 1)
+					}
+				}
+				conn.Close()
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	t.Logf("gets: %d, hits: %d, aborted: %d, corrupted: %d", gets, hits, aborts, corrupted)
+	if corrupted > 0 {
+		t.Errorf("%d values returned with bytes of other items", corrupted)
+	}
+	if hits == 0 {
+		t.Error("no value returned in stress")
+	}
+}
+
+// readStressValue reads response of get, and returns nil value for miss
+func readStressValue(rw *bufio.ReadWriter) ([]byte, error) {
+	line, err := rw.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) < 4 || parts[0] != "VALUE" {
+		return nil, fmt.Errorf("unexpected response: %q", line)
+	}
+	size, _ := strconv.Atoi(parts[3])
+	if size == 0 {
+		_, err = rw.ReadString('\n') //END
+		return nil, err
+	}
+
+	v := make([]byte, size + len(Crlf))
+	if _, err = io.ReadFull(rw, v); err != nil {
+		return nil, err
+	}
+	if end, e := rw.ReadString('\n'); e != nil || end != string(ResultEnd) {
+		return nil, fmt.Errorf("unexpected end: %q", end)
+	}
+	return v[:size], nil
+}
@@ -0,0 +1,361 @@
+package filerelay
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+
+const (
+	DefaultTenant = "default"
+)
+
+var (
+	ErrTenantFull = errors.New("tenant storage full")
+)
+
+
+// TenantConfig defines a namespace of keys, selected by key prefix or authenticated identity;
+// Values not set fall back to the global ones.
+type TenantConfig struct {
+	Name string `yaml:"name"` //without "/", which separates it from keys in persistence backends
+	Prefix string `yaml:"prefix"`
+	Identities []string `yaml:"identities"`
+
+	LRUSize int `yaml:"lru-size"`
+	EvictionPolicy string `yaml:"eviction-policy"`
+	MaxStorage string `yaml:"max-storage"` //share of storage; example: 200MB, 2GB
+	MinExpiration int64 `yaml:"min-expiration"` //in seconds
+	MaxExpiration int64 `yaml:"max-expiration"` //in seconds
+	DefaultExpiration int64 `yaml:"default-expiration"` //in seconds; for items stored with expiration 0
+	Replication string `yaml:"replication"` //sync or async in cluster with replicas; default as the one of cluster
+}
+
+
+type TenantStats struct {
+	CmdGet uint64
+	GetHits uint64
+	GetMisses uint64
+	CmdSet uint64
+	SetFails uint64
+	Evictions uint64
+	Expirations uint64
+}
+
+
+//
+type Tenant struct {
+	name string
+	prefix string
+	entry *ItemsEntry
+
+	maxStorage uint64 //0 for no limit in tenant
+	share uint64 //storage held by tenant before its items are evicted for other tenants
+	minExp int64
+	maxExp int64
+	defExp int64
+	replication string
+	spill *SpillStore //only reference; disk tier for items evicted or failing to take slots
+
+	used uint64 //bytes of slots held by items
+	stats TenantStats
+}
+
+func NewTenant(tc *TenantConfig, c *MemConfig) (*Tenant, error) {
+	t := &Tenant{
+		name: tc.Name,
+		prefix: tc.Prefix,
+		minExp: tc.MinExpiration,
+		maxExp: tc.MaxExpiration,
+		defExp: tc.DefaultExpiration,
+		replication: tc.Replication,
+	}
+	if t.replication == "" {
+		t.replication = c.Cluster.Replication
+	}
+	if !validReplication(t.replication) {
+		return nil, errors.New("unknown replication of tenant " + t.name + ": " + t.replication)
+	}
+
+	lruSize := tc.LRUSize
+	if lruSize <= 0 {
+		lruSize = c.LRUSize
+	}
+	policyName := tc.EvictionPolicy
+	if policyName == "" {
+		policyName = c.EvictionPolicy
+	}
+	shards := c.ItemShards
+	if shards <= 0 {
+		shards = 1
+	}
+	if shards > lruSize {
+		shards = lruSize
+	}
+	policies := make([]EvictionPolicy, shards)
+	for i := range policies {
+		// size of entry is divided into shards
+		size := lruSize / shards
+		if i < lruSize % shards {
+			size++
+		}
+		p, err := NewEvictionPolicy(policyName, size)
+		if err != nil {
+			return nil, err
+		}
+		policies[i] = p
+	}
+	t.entry = NewItemsEntry(policies, c.ExpireBatch)
+
+	if tc.MaxStorage != "" {
+		t.maxStorage = parseStorageSize(tc.MaxStorage, c.maxStorageSize)
+	}
+	if t.minExp <= 0 {
+		t.minExp = c.MinExpiration
+	}
+	if t.maxExp <= 0 || t.maxExp > c.MaxExpiration {
+		t.maxExp = c.MaxExpiration
+	}
+	if t.minExp > t.maxExp {
+		t.minExp = t.maxExp
+	}
+	if t.defExp <= 0 {
+		t.defExp = c.DefaultExpiration
+	}
+	t.defExp = t.ClampExpiration(t.defExp)
+	return t, nil
+}
+
+func (t *Tenant) Name() string {
+	return t.name
+}
+
+// persistKey is key of item in persistence backends, prefixed by name of tenant,
+// so that items of tenants never meet in a backend
+func (t *Tenant) persistKey(key string) string {
+	return t.name + "/" + key
+}
+
+func (t *Tenant) Used() uint64 {
+	return atomic.LoadUint64(&t.used)
+}
+
+// ClampExpiration keeps expiration in the TTL bounds of tenant
+func (t *Tenant) ClampExpiration(exp int64) int64 {
+	if exp < t.minExp {
+		return t.minExp
+	} else if exp > t.maxExp {
+		return t.maxExp
+	}
+	return exp
+}
+
+// ResolveExpiration turns expiration in command into seconds from now in TTL bounds of tenant:
+// 0 for the default of tenant, and values over 30 days for absolute Unix time as memcached does;
+// Negative values, or absolute time passed, tell that item is expired already.
+func (t *Tenant) ResolveExpiration(exp int64, now time.Time) (ttl int64, expired bool) {
+	if exp == 0 {
+		return t.defExp, false
+	}
+	if exp > ExpirationRelativeMax {
+		exp -= now.Unix()
+	}
+	if exp <= 0 {
+		return 0, true
+	}
+	return t.ClampExpiration(exp), false
+}
+
+// Charge takes bytes from the storage share of tenant for more slots of the item,
+// and evicts the least recently used items of the tenant for room when exceeding its share;
+// The item itself is never evicted, and it fails at once if the item can't fit in the share at all.
+func (t *Tenant) Charge(bytes uint64, item *MetaItem) error {
+	if t.maxStorage == 0 {
+		atomic.AddUint64(&t.used, bytes)
+		return nil
+	}
+	if item.byteLen > t.maxStorage || bytes + item.SlotsCap() > t.maxStorage {
+		return ErrTenantFull
+	}
+
+	for {
+		used := atomic.LoadUint64(&t.used)
+		if used + bytes <= t.maxStorage {
+			if atomic.CompareAndSwapUint64(&t.used, used, used + bytes) {
+				return nil
+			}
+			continue
+		}
+		if t.entry.EvictOldest(item.key) == nil {
+			return ErrTenantFull
+		}
+		atomic.AddUint64(&t.stats.Evictions, 1)
+	}
+}
+
+func (t *Tenant) evictInClass(slotCap uint64, skip string) bool {
+	return t.entry.EvictInClass(slotCap, skip) != nil
+}
+
+// release gives bytes back to the storage share of tenant
+func (t *Tenant) release(bytes uint64) {
+	atomic.AddUint64(&t.used, ^(bytes - 1))
+}
+
+func (t *Tenant) Stats() TenantStats {
+	return TenantStats{
+		CmdGet: atomic.LoadUint64(&t.stats.CmdGet),
+		GetHits: atomic.LoadUint64(&t.stats.GetHits),
+		GetMisses: atomic.LoadUint64(&t.stats.GetMisses),
+		CmdSet: atomic.LoadUint64(&t.stats.CmdSet),
+		SetFails: atomic.LoadUint64(&t.stats.SetFails),
+		Evictions: atomic.LoadUint64(&t.stats.Evictions) + t.entry.Evictions(),
+		Expirations: t.entry.Expirations(),
+	}
+}
+
+func (t *Tenant) countGet(hit bool) {
+	atomic.AddUint64(&t.stats.CmdGet, 1)
+	if hit {
+		atomic.AddUint64(&t.stats.GetHits, 1)
+	} else {
+		atomic.AddUint64(&t.stats.GetMisses, 1)
+	}
+}
+
+func (t *Tenant) countSet(ok bool) {
+	atomic.AddUint64(&t.stats.CmdSet, 1)
+	if !ok {
+		atomic.AddUint64(&t.stats.SetFails, 1)
+	}
+}
+
+
+
+
+//
+type TenantSet struct {
+	list []*Tenant //in order of selecting by prefix, with longer prefix first
+	byIdentity map[string]*Tenant
+	fallback *Tenant
+}
+
+func NewTenantSet(c *MemConfig) (*TenantSet, error) {
+	ts := &TenantSet{
+		list: make([]*Tenant, 0, len(c.Tenants)),
+		byIdentity: make(map[string]*Tenant),
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Tenants {
+		tc := &c.Tenants[i]
+		if tc.Name == "" || names[tc.Name] {
+			return nil, errors.New("tenant without name or with duplicated name: " + tc.Name)
+		}
+		if strings.ContainsAny(tc.Name, "/ \t\r\n") {
+			return nil, errors.New("tenant name with slash or spaces: " + tc.Name)
+		}
+		names[tc.Name] = true
+
+		t, err := NewTenant(tc, c)
+		if err != nil {
+			return nil, err
+		}
+		if tc.Name == DefaultTenant {
+			ts.fallback = t
+		} else if tc.Prefix == "" && len(tc.Identities) == 0 {
+			return nil, errors.New("tenant can't be selected without prefix or identities: " + tc.Name)
+		}
+		for _, id := range tc.Identities {
+			ts.byIdentity[id] = t
+		}
+		ts.add(t)
+	}
+
+	if ts.fallback == nil {
+		t, err := NewTenant(&TenantConfig{Name: DefaultTenant}, c)
+		if err != nil {
+			return nil, err
+		}
+		ts.fallback = t
+		ts.add(t)
+	}
+	ts.assignShares(c.maxStorageSize)
+	return ts, nil
+}
+
+// assignShares gives tenants without max-storage even shares of the storage left by tenants with it
+func (ts *TenantSet) assignShares(total uint64) {
+	var assigned, rest uint64
+	open := 0
+	for _, t := range ts.list {
+		if t.maxStorage > 0 {
+			assigned += t.maxStorage
+		} else {
+			open++
+		}
+	}
+	if open > 0 && assigned < total {
+		rest = (total - assigned) / uint64(open)
+	}
+	for _, t := range ts.list {
+		t.share = t.maxStorage
+		if t.share == 0 {
+			t.share = rest
+		}
+	}
+}
+
+func (ts *TenantSet) add(t *Tenant) {
+	i := len(ts.list)
+	ts.list = append(ts.list, t)
+	for ; i > 0 && len(ts.list[i-1].prefix) < len(t.prefix); i-- {
+		ts.list[i] = ts.list[i-1]
+	}
+	ts.list[i] = t
+}
+
+// Select finds tenant of the key by prefix, or of the identity when no prefix matches
+func (ts *TenantSet) Select(key, identity string) *Tenant {
+	for _, t := range ts.list {
+		if t.prefix != "" && strings.HasPrefix(key, t.prefix) {
+			return t
+		}
+	}
+	if t, ok := ts.byIdentity[identity]; ok {
+		return t
+	}
+	return ts.fallback
+}
+
+// EvictInClass evicts an item holding slots of the capacity class, from the preferred tenant first,
+// and then from other tenants holding more than their shares; It returns false if no such item found.
+func (ts *TenantSet) EvictInClass(slotCap uint64, prefer *Tenant, skip string) bool {
+	if prefer != nil && prefer.evictInClass(slotCap, skip) {
+		return true
+	}
+	for _, t := range ts.list {
+		if t != prefer && t.Used() > t.share && t.evictInClass(slotCap, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// Get finds tenant by name, or returns nil
+func (ts *TenantSet) Get(name string) *Tenant {
+	for _, t := range ts.list {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (ts *TenantSet) Each(fn func(t *Tenant)) {
+	for _, t := range ts.list {
+		fn(t)
+	}
+}
@@ -0,0 +1,212 @@
+package filerelay
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+
+func TestTenant_ResolveExpiration(t *testing.T) {
+	c := NewMemConfig()
+	c.MaxExpiration = 3600
+	tenant, err := NewTenant(&TenantConfig{Name: "ttl", MinExpiration: 10, DefaultExpiration: 300}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		exp int64
+		ttl int64
+		expired bool
+	}{
+		{0, 300, false}, //default of tenant
+		{5, 10, false}, //clamped to min
+		{600, 600, false},
+		{86400, 3600, false}, //clamped to max
+		{-1, 0, true},
+		{now.Unix() + 120, 120, false}, //absolute time
+		{now.Unix() + 86400, 3600, false},
+		{now.Unix() - 1, 0, true}, //absolute time passed
+	}
+	for _, cs := range cases {
+		ttl, expired := tenant.ResolveExpiration(cs.exp, now)
+		if ttl != cs.ttl || expired != cs.expired {
+			t.Errorf("expiration %d: expect ttl %d expired %v, got %d %v", cs.exp, cs.ttl, cs.expired, ttl, expired)
+		}
+	}
+}
+
+func TestTenant_Bounds(t *testing.T) {
+	c := NewMemConfig()
+	c.MinExpiration, c.MaxExpiration, c.DefaultExpiration = 30, 600, 300
+	cases := []struct {
+		tc TenantConfig
+		minExp, maxExp, defExp int64
+	}{
+		{TenantConfig{Name: "global"}, 30, 600, 300},
+		{TenantConfig{Name: "short", MaxExpiration: 60}, 30, 60, 60}, //default clamped to max
+		{TenantConfig{Name: "over", MaxExpiration: 3600}, 30, 600, 300}, //max of tenant kept in the global one
+		{TenantConfig{Name: "long", MinExpiration: 120, DefaultExpiration: 60}, 120, 600, 120},
+		{TenantConfig{Name: "crossed", MinExpiration: 900}, 600, 600, 600},
+	}
+	for _, cs := range cases {
+		tenant, err := NewTenant(&cs.tc, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tenant.minExp != cs.minExp || tenant.maxExp != cs.maxExp || tenant.defExp != cs.defExp {
+			t.Errorf("bounds of tenant %s: %d .. %d, default %d", cs.tc.Name, tenant.minExp, tenant.maxExp, tenant.defExp)
+		}
+	}
+}
+
+func tenantConfig() *MemConfig {
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.MaxStorage = "16MB"
+	c.ItemShards = 1
+	c.Tenants = []TenantConfig{
+		{Name: "images", Prefix: "img:", MaxStorage: "2MB", MaxExpiration: 100},
+		{Name: "docs", Prefix: "doc:", MaxStorage: "2MB"},
+		{Name: "team", Identities: []string{"alice"}},
+	}
+	return c
+}
+
+func TestTenant_Share(t *testing.T) {
+	defer quietLogs()()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, stop := serveTestListener(t, lis, tenantConfig(), 0)
+	defer stop()
+	conn, rw := dialTest(t, lis.Addr().String())
+	defer conn.Close()
+	images, docs := server.tenants.Get("images"), server.tenants.Get("docs")
+
+	set := func(key string, size int) string {
+		return command(t, rw, fmt.Sprintf("set %s 0 1000 %d", key, size), stressValue(key, size))
+	}
+	if resp := set("doc:1", 512 * 1024); resp != string(ResultStored) {
+		t.Fatalf("set doc:1: %q", resp)
+	}
+	// items of tenant exceeding its share evict its own oldest items, not ones of other tenants
+	for i := 0; i < 6; i++ {
+		if resp := set("img:" + strconv.Itoa(i), 512 * 1024); resp != string(ResultStored) {
+			t.Fatalf("set img:%d: %q", i, resp)
+		}
+	}
+	if n := images.entry.Len(); n != 4 || images.entry.Get("img:0") != nil || images.entry.Get("img:5") == nil {
+		t.Errorf("%d items kept in share of tenant: %v", n, images.entry.Keys())
+	}
+	if images.Used() != 2 * szMB || docs.entry.Get("doc:1") == nil || docs.Used() != 512 * 1024 {
+		t.Errorf("storage used by tenants: %d, %d", images.Used(), docs.Used())
+	}
+
+	// TTL is clamped into bounds of tenant
+	if resp := command(t, rw, "mg img:5 t", nil); resp != "HD t100\r\n" {
+		t.Errorf("ttl in tenant: %q", resp)
+	}
+	if resp := command(t, rw, "mg doc:1 t", nil); resp != "HD t600\r\n" {
+		t.Errorf("ttl in tenant: %q", resp)
+	}
+
+	// item taking the whole share evicts all others but never itself
+	if resp := set("img:full", 2 * 1024 * 1024 - 1000); resp != string(ResultStored) {
+		t.Errorf("set of item taking the whole share: %q", resp)
+	}
+	if keys := images.entry.Keys(); len(keys) != 1 || keys[0] != "img:full" {
+		t.Errorf("items kept in share of tenant: %v", keys)
+	}
+	// item larger than share fails without evicting others
+	used := images.Used()
+	if resp := set("img:large", 2 * 1024 * 1024 + 100); resp != string(ResultNotStored) {
+		t.Errorf("set of item larger than share: %q", resp)
+	}
+	if images.entry.Get("img:large") != nil || images.entry.Get("img:full") == nil || images.Used() != used {
+		t.Errorf("item larger than share kept with %d bytes used", images.Used())
+	}
+}
+
+func TestTenantSet_EvictInClass(t *testing.T) {
+	c := NewMemConfig()
+	c.SlotCapMin, c.SlotCapMax = 64, 64
+	c.StorageFull = StorageFullEvict
+	c.ItemShards = 1
+	c.maxStorageSize = 6 * 64 //storage full with the initial slab, and shares of 128 bytes for 3 tenants
+	c.Tenants = []TenantConfig{{Name: "a", Prefix: "a:"}, {Name: "b", Prefix: "b:"}}
+	tenants, err := NewTenantSet(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := make(slabGroupMap)
+	groups[64] = NewSlabGroup(64, 1, 6, SlabCheckInterval, c.maxStorageSize, SlabBackendHeap)
+	c.AddCapToTotal(groups[64].Capacity())
+	h := &handler{cfg: c, groups: groups, tenants: tenants}
+
+	store := func(key string) {
+		tenant := tenants.Select(key, "")
+		item := NewMetaItem(key, 0, 600, 64)
+		item.tenant = tenant
+		_ = tenant.entry.Set(item)
+		if e := h.allocSlots(item); e != nil {
+			t.Fatalf("store %s: %v", key, e)
+		}
+		item.slots[0].SetInfoWithItem(item)
+		item.slots[0].ReadAndSet(key, item.gens[0], bytes.NewReader(make([]byte, 64)), 64)
+	}
+	for _, key := range []string{"a:0", "a:1", "a:2", "d:0", "d:1", "d:2"} {
+		store(key)
+	}
+	a, b, d := tenants.Get("a"), tenants.Get("b"), tenants.Get(DefaultTenant)
+
+	// items of other tenants are evicted only while they hold more than their shares
+	if !tenants.EvictInClass(64, b, "b:0") || a.entry.Get("a:0") != nil || a.Used() != 128 {
+		t.Errorf("item of tenant over share not evicted: %v", a.entry.Keys())
+	}
+	if !tenants.EvictInClass(64, b, "b:0") || d.entry.Get("d:0") != nil || d.Used() != 128 {
+		t.Errorf("item of tenant over share not evicted: %v", d.entry.Keys())
+	}
+	if tenants.EvictInClass(64, b, "b:0") || a.entry.Len() != 2 || d.entry.Len() != 2 {
+		t.Errorf("items of tenants within share evicted: %v, %v", a.entry.Keys(), d.entry.Keys())
+	}
+	store("b:0")
+	if b.entry.Get("b:0") == nil {
+		t.Error("item not stored in slot freed by eviction")
+	}
+}
+
+func TestTenantSet_Select(t *testing.T) {
+	ts, err := NewTenantSet(tenantConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key, identity, tenant string
+	}{
+		{"img:1", "", "images"},
+		{"img:1", "alice", "images"}, //prefix first
+		{"doc:1", "bob", "docs"},
+		{"other", "alice", "team"},
+		{"other", "bob", DefaultTenant},
+	}
+	for _, cs := range cases {
+		if name := ts.Select(cs.key, cs.identity).Name(); name != cs.tenant {
+			t.Errorf("tenant of %q by %q: %s", cs.key, cs.identity, name)
+		}
+	}
+
+	c := tenantConfig()
+	c.Tenants = append(c.Tenants, TenantConfig{Name: "unreachable"})
+	if _, e := NewTenantSet(c); e == nil {
+		t.Error("tenant without prefix or identities accepted")
+	}
+}
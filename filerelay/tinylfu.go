@@ -0,0 +1,239 @@
+package filerelay
+
+import (
+	linkedlist "container/list"
+	"hash/fnv"
+)
+
+
+const (
+	_TinyLFUWindowRatio = 0.01
+	_SketchDepth = 4
+	_SketchCounterMax = 15
+	_SketchSampleRatio = 10 //counters are halved after additions of the ratio to size
+)
+
+
+// cmSketch is a count-min sketch estimating frequency of keys, with counters aged periodically
+type cmSketch struct {
+	rows [_SketchDepth][]uint8
+	mask uint64
+	additions int
+	sampleSize int
+}
+
+func newCMSketch(size int) *cmSketch {
+	width := 16
+	for width < size {
+		width <<= 1
+	}
+	s := &cmSketch{
+		mask: uint64(width - 1),
+		sampleSize: size * _SketchSampleRatio,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *cmSketch) indexes(key string) (idx [_SketchDepth]uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := h1 >> 32 | h1 << 32
+	for i := range idx {
+		idx[i] = (h1 + uint64(i) * h2) & s.mask
+	}
+	return
+}
+
+func (s *cmSketch) Increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < _SketchCounterMax {
+			s.rows[i][j]++
+		}
+	}
+	if s.additions++; s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *cmSketch) Estimate(key string) uint8 {
+	var min uint8 = _SketchCounterMax
+	for i, j := range s.indexes(key) {
+		if v := s.rows[i][j]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// reset halves all counters for older frequency to fade out
+func (s *cmSketch) reset() {
+	for _, row := range s.rows {
+		for j := range row {
+			row[j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+
+
+
+// TinyLFU is W-TinyLFU: new items enter a small LRU window, and items out of window are admitted
+// into the main SLRU only if they're estimated more frequent than the victim of main.
+type TinyLFU struct {
+	windowSize int
+	window *linkedlist.List
+	lookup map[string]*linkedlist.Element //items in window
+	main *SLRU
+	sketch *cmSketch
+}
+
+func NewTinyLFU(size int) *TinyLFU {
+	windowSize := int(float64(size) * _TinyLFUWindowRatio)
+	if windowSize < 1 {
+		windowSize = 1
+	}
+	mainSize := size - windowSize
+	if mainSize < 1 {
+		mainSize = 1
+	}
+	return &TinyLFU{
+		windowSize: windowSize,
+		window: linkedlist.New(),
+		lookup: make(map[string]*linkedlist.Element),
+		main: NewSLRU(mainSize),
+		sketch: newCMSketch(size),
+	}
+}
+
+func (c *TinyLFU) Add(t *MetaItem, noReplace bool) (evicted *MetaItem, err error) {
+	c.sketch.Increment(t.key)
+
+	if elem, ok := c.lookup[t.key]; ok {
+		if noReplace {
+			return nil, errKeyExists(t.key)
+		}
+		c.window.MoveToFront(elem)
+		replaceValue(elem, t)
+		return
+	}
+	if c.main.Contains(t.key) {
+		return c.main.Add(t, noReplace)
+	}
+
+	c.lookup[t.key] = c.window.PushFront(t)
+	if c.window.Len() <= c.windowSize {
+		return
+	}
+
+	// candidate out of window competes with victim of main for admission
+	candidate := c.window.Remove(c.window.Back()).(*MetaItem)
+	delete(c.lookup, candidate.key)
+	if c.main.Len() < c.main.size {
+		c.main.insert(candidate)
+		return
+	}
+
+	victim := c.main.victim()
+	if c.sketch.Estimate(candidate.key) > c.sketch.Estimate(victim.key) {
+		c.main.detach(victim.key)
+		c.main.insert(candidate)
+		evicted = victim
+	} else {
+		evicted = candidate
+	}
+	evicted.evict()
+	return
+}
+
+func (c *TinyLFU) Replace(t *MetaItem) bool {
+	if elem, ok := c.lookup[t.key]; ok {
+		c.sketch.Increment(t.key)
+		c.window.MoveToFront(elem)
+		replaceValue(elem, t)
+		return true
+	}
+	if c.main.Replace(t) {
+		c.sketch.Increment(t.key)
+		return true
+	}
+	return false
+}
+
+func (c *TinyLFU) Get(key string) *MetaItem {
+	c.sketch.Increment(key)
+	if elem, ok := c.lookup[key]; ok {
+		c.window.MoveToFront(elem)
+		return elem.Value.(*MetaItem)
+	}
+	return c.main.Get(key)
+}
+
+func (c *TinyLFU) Peek(key string) *MetaItem {
+	if elem, ok := c.lookup[key]; ok {
+		return elem.Value.(*MetaItem)
+	}
+	return c.main.Peek(key)
+}
+
+func (c *TinyLFU) Remove(key string) *MetaItem {
+	if elem, ok := c.lookup[key]; ok {
+		delete(c.lookup, key)
+		t := c.window.Remove(elem).(*MetaItem)
+		t.ClearSlots()
+		return t
+	}
+	return c.main.Remove(key)
+}
+
+func (c *TinyLFU) removeOldest(clear bool) *MetaItem {
+	if t := c.main.removeOldest(clear); t != nil {
+		return t
+	}
+	if elem := c.window.Back(); elem != nil {
+		t := c.window.Remove(elem).(*MetaItem)
+		delete(c.lookup, t.key)
+		if clear {
+			t.evict()
+		}
+		return t
+	}
+	return nil
+}
+
+func (c *TinyLFU) victims(fn func(t *MetaItem) bool) {
+	stopped := false
+	c.main.victims(func(t *MetaItem) bool {
+		stopped = !fn(t)
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+	for elem := c.window.Back(); elem != nil; elem = elem.Prev() {
+		if !fn(elem.Value.(*MetaItem)) {
+			return
+		}
+	}
+}
+
+func (c *TinyLFU) Contains(key string) bool {
+	if _, ok := c.lookup[key]; ok {
+		return true
+	}
+	return c.main.Contains(key)
+}
+
+func (c *TinyLFU) Len() int {
+	return len(c.lookup) + c.main.Len()
+}
+
+func (c *TinyLFU) Purge() {
+	c.window.Init()
+	c.lookup = make(map[string]*linkedlist.Element)
+	c.main.Purge()
+}
@@ -0,0 +1,656 @@
+package filerelay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+const (
+	WALVersion = 1
+	WALFsyncAlways = "always"
+	WALFsyncInterval = "interval"
+	WALFsyncNever = "never"
+	WALFsyncIntervalMs = 100
+	WALSegmentSize = "64MB"
+	WALCompactInterval = 60 //seconds
+
+	_WALMagic = "FRWAL"
+	_WALSegmentPattern = "wal-*.log"
+	_WALStore byte = 1
+	_WALDelete byte = 2
+	_WALTouch byte = 3
+	_WALFlush byte = 4
+)
+
+var (
+	ErrWALFailed = errors.New("write-ahead log failed")
+	ErrWALBroken = errors.New("write-ahead log broken")
+)
+
+
+// WALConfig enables the write-ahead log of changes, so that items stored survive a crash
+type WALConfig struct {
+	Dir string `yaml:"dir"` //directory of segment files; disabled when not set
+	Fsync string `yaml:"fsync"` //always, interval or never; default as interval
+	FsyncInterval int `yaml:"fsync-interval"` //in milliseconds, for fsync of interval; default as 100
+	SegmentSize string `yaml:"segment-size"` //default as 64MB
+	CompactInterval int `yaml:"compact-interval"` //in seconds; default as 60
+}
+
+
+// walRecord is a change logged; Expiration is in absolute Unix time of milliseconds.
+// Records of all ops have the same fields, with those not used by the op as 0.
+type walRecord struct {
+	op byte
+	tenant string
+	key string
+	flags uint32
+	casId uint64
+	expireAt int64
+	size uint64
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// walSegment is a file of records appended one after another, removed when all its records have expired
+type walSegment struct {
+	id uint64
+	f *os.File //nil for segment sealed
+	w *snapshotWriter
+	size int64 //bytes written to file
+	expireAt int64 //until which records in segment are needed, in milliseconds
+}
+
+func (seg *walSegment) path(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("wal-%08d.log", seg.id))
+}
+
+func (seg *walSegment) Write(b []byte) (int, error) {
+	n, e := seg.f.Write(b)
+	seg.size += int64(n)
+	return n, e
+}
+
+// walKey is where the latest record of a key is, with the time until which records of the key are needed
+type walKey struct {
+	seg *walSegment
+	expireAt int64
+}
+
+
+
+
+// WAL appends set, add, replace, cas, delete, touch and flush_all to segment files before they're responded,
+// and replays them on start. Every segment starts with a head of magic, version and id, followed by records
+// in the format of snapshot, checked by crc32. A segment is rotated when it reaches the segment size, and removed
+// in compaction once all records in it have expired, including the ones of keys replaced, deleted or touched
+// by records in later segments, so that replay never brings back values of keys changed since.
+type WAL struct {
+	dir string
+	fsync string
+	fsyncIntv int
+	segSize int64
+	compactIntv int
+
+	segments []*walSegment //in order of id, with the active one as the last
+	active *walSegment
+	nextId uint64
+	keys map[string]walKey //by tenant and key
+	dirty bool //appended since the last fsync
+
+	appends uint64
+	syncs uint64
+	fails uint64
+	replayed uint64
+	compacted uint64 //segments removed
+
+	quit chan bool
+	done sync.WaitGroup
+	sync.Mutex
+}
+
+// NewWAL returns nil for config without dir, which means write-ahead log is off
+func NewWAL(c *WALConfig) (*WAL, error) {
+	if c.Dir == "" {
+		return nil, nil
+	}
+	w := &WAL{
+		dir: c.Dir,
+		fsync: c.Fsync,
+		fsyncIntv: c.FsyncInterval,
+		compactIntv: c.CompactInterval,
+		nextId: 1,
+		keys: make(map[string]walKey),
+		quit: make(chan bool),
+	}
+	if w.fsync == "" {
+		w.fsync = WALFsyncInterval
+	}
+	if w.fsync != WALFsyncAlways && w.fsync != WALFsyncInterval && w.fsync != WALFsyncNever {
+		return nil, errors.New("unknown fsync policy of wal: " + w.fsync)
+	}
+	if w.fsyncIntv <= 0 {
+		w.fsyncIntv = WALFsyncIntervalMs
+	}
+	if w.compactIntv <= 0 {
+		w.compactIntv = WALCompactInterval
+	}
+	size := c.SegmentSize
+	if size == "" {
+		size = WALSegmentSize
+	}
+	n, err := parseDiskSize(size)
+	if err != nil {
+		return nil, err
+	}
+	w.segSize = int64(n)
+	if e := os.MkdirAll(w.dir, 0755); e != nil {
+		return nil, e
+	}
+	return w, nil
+}
+
+func (w *WAL) Enabled() bool {
+	return w != nil
+}
+
+// Start fsyncs the active segment at every interval for policy of interval, and compacts segments
+func (w *WAL) Start() {
+	if !w.Enabled() {
+		return
+	}
+	w.done.Add(1)
+	go func() {
+		defer w.done.Done()
+		compact := time.NewTicker(time.Second * time.Duration(w.compactIntv))
+		defer compact.Stop()
+		var fsync <-chan time.Time
+		if w.fsync == WALFsyncInterval {
+			t := time.NewTicker(time.Millisecond * time.Duration(w.fsyncIntv))
+			defer t.Stop()
+			fsync = t.C
+		}
+		for {
+			select {
+			case <-fsync:
+				w.Lock()
+				w.sync()
+				w.Unlock()
+			case now := <-compact.C:
+				w.Compact(now)
+			case <-w.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops background work, and seals the active segment with fsync
+func (w *WAL) Close() {
+	if !w.Enabled() {
+		return
+	}
+	close(w.quit)
+	w.done.Wait()
+	w.Lock()
+	defer w.Unlock()
+	if w.active != nil {
+		if e := w.seal(w.active); e != nil {
+			logger.Errorf("Close of wal segment %d failed: %v", w.active.id, e.Error())
+		}
+		w.active = nil
+	}
+}
+
+
+// Append writes the record with value streamed from slots, and fsyncs it for policy of always;
+// A value changed while written is marked as dropped, and skipped in replay.
+// The active segment is sealed on failure, so that nothing is appended after a broken record.
+func (w *WAL) Append(rec *walRecord, value *pinnedValue) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if e := w.rotate(); e != nil {
+		atomic.AddUint64(&w.fails, 1)
+		return e
+	}
+	seg := w.active
+	sw := seg.w
+	writeWALRecord(sw, rec)
+	if value != nil && sw.err == nil {
+		_, sw.err = io.Copy(sw, value.Reader())
+	}
+	state := _SnapshotIntact
+	if value != nil && value.Changed() {
+		state = _SnapshotDropped
+	}
+	sw.uint(uint64(state), 1)
+	sw.end()
+
+	err := sw.err
+	if err == nil {
+		err = sw.w.Flush()
+	}
+	if err == nil && w.fsync == WALFsyncAlways {
+		if err = seg.f.Sync(); err == nil {
+			atomic.AddUint64(&w.syncs, 1)
+		}
+	}
+	if err != nil {
+		atomic.AddUint64(&w.fails, 1)
+		_ = w.seal(seg)
+		w.active = nil
+		return err
+	}
+	w.dirty = w.fsync == WALFsyncInterval
+	if state == _SnapshotIntact {
+		w.account(seg, rec)
+	}
+	atomic.AddUint64(&w.appends, 1)
+	return nil
+}
+
+func writeWALRecord(sw *snapshotWriter, rec *walRecord) {
+	sw.uint(uint64(rec.op), 1)
+	sw.string(rec.tenant)
+	sw.string(rec.key)
+	sw.uint(uint64(rec.flags), 4)
+	sw.uint(rec.casId, 8)
+	sw.uint(uint64(rec.expireAt), 8)
+	sw.uint(rec.size, 8)
+}
+
+// rotate seals the active segment when it's full, and starts a new one; it must be called with lock
+func (w *WAL) rotate() error {
+	if w.active != nil && w.active.size < w.segSize {
+		return nil
+	}
+	if w.active != nil {
+		if e := w.seal(w.active); e != nil {
+			logger.Warnf("Seal of wal segment %d failed: %v", w.active.id, e.Error())
+		}
+		w.active = nil
+	}
+
+	seg := &walSegment{id: w.nextId}
+	f, err := os.OpenFile(seg.path(w.dir), os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.nextId++
+	seg.f = f
+	seg.w = &snapshotWriter{w: bufio.NewWriterSize(seg, 64 * 1024), crc: crc32.New(_SnapshotTable)}
+	seg.w.write([]byte(_WALMagic))
+	seg.w.uint(WALVersion, 2)
+	seg.w.uint(seg.id, 8)
+	seg.w.end()
+	if seg.w.err == nil {
+		seg.w.err = seg.w.w.Flush()
+	}
+	if seg.w.err != nil {
+		_ = f.Close()
+		_ = os.Remove(seg.path(w.dir))
+		return seg.w.err
+	}
+	w.segments = append(w.segments, seg)
+	w.active = seg
+	return nil
+}
+
+// seal flushes and closes file of segment; it must be called with lock
+func (w *WAL) seal(seg *walSegment) error {
+	if seg.f == nil {
+		return nil
+	}
+	err := seg.w.err
+	if err == nil {
+		err = seg.w.w.Flush()
+	}
+	if e := seg.f.Sync(); err == nil {
+		err = e
+	}
+	if e := seg.f.Close(); err == nil {
+		err = e
+	}
+	seg.f, seg.w = nil, nil
+	return err
+}
+
+// sync fsyncs records appended to the active segment since the last fsync; it must be called with lock
+func (w *WAL) sync() {
+	if !w.dirty || w.active == nil {
+		return
+	}
+	if e := w.active.f.Sync(); e != nil {
+		atomic.AddUint64(&w.fails, 1)
+		logger.Errorf("Fsync of wal segment %d failed: %v", w.active.id, e.Error())
+		return
+	}
+	w.dirty = false
+	atomic.AddUint64(&w.syncs, 1)
+}
+
+// account extends the time for which segments are kept by the record; it must be called with lock.
+// A record is kept as long as the ones of the same key before it, and a touch keeps the record storing the value as well.
+func (w *WAL) account(seg *walSegment, rec *walRecord) {
+	expireAt := rec.expireAt
+	if rec.op == _WALFlush {
+		for _, k := range w.keys {
+			if k.expireAt > expireAt {
+				expireAt = k.expireAt
+			}
+		}
+		w.keys = make(map[string]walKey)
+	} else {
+		name := rec.tenant + " " + rec.key
+		old, found := w.keys[name]
+		if found && old.expireAt > expireAt {
+			expireAt = old.expireAt
+		}
+		switch {
+		case rec.op == _WALStore:
+			w.keys[name] = walKey{seg: seg, expireAt: expireAt}
+		case rec.op == _WALTouch && found:
+			if expireAt > old.seg.expireAt {
+				old.seg.expireAt = expireAt
+			}
+			w.keys[name] = walKey{seg: old.seg, expireAt: expireAt}
+		default:
+			delete(w.keys, name)
+		}
+	}
+	if expireAt > seg.expireAt {
+		seg.expireAt = expireAt
+	}
+}
+
+// Compact removes segments sealed with all their records expired
+func (w *WAL) Compact(now time.Time) int {
+	w.Lock()
+	defer w.Unlock()
+
+	ms := unixMillis(now)
+	for name, k := range w.keys {
+		if k.expireAt <= ms {
+			delete(w.keys, name)
+		}
+	}
+	n := 0
+	kept := w.segments[:0]
+	for _, seg := range w.segments {
+		if seg == w.active || seg.expireAt > ms {
+			kept = append(kept, seg)
+			continue
+		}
+		if e := os.Remove(seg.path(w.dir)); e != nil && !os.IsNotExist(e) {
+			logger.Warnf("Remove of wal segment %d failed: %v", seg.id, e.Error())
+			kept = append(kept, seg)
+			continue
+		}
+		n++
+	}
+	w.segments = kept
+	if n > 0 {
+		atomic.AddUint64(&w.compacted, uint64(n))
+		logger.Infof("Compaction of wal removed %d segments", n)
+	}
+	return n
+}
+
+// Size is bytes of all segments
+func (w *WAL) Size() (n int64) {
+	w.Lock()
+	defer w.Unlock()
+	for _, seg := range w.segments {
+		n += seg.size
+	}
+	return
+}
+
+func (w *WAL) Segments() int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.segments)
+}
+
+
+
+
+// walApplier applies the change of a record in replay, with value read from r for store,
+// and returns the item loaded
+type walApplier func(rec *walRecord, r io.Reader) (*MetaItem, error)
+
+// Replay applies records of all segments in order, before any is appended; Replay of a segment stops
+// at a broken record, which is the tail written at a crash, and goes on with the next segments.
+func (w *WAL) Replay(apply walApplier) (int, error) {
+	if !w.Enabled() {
+		return 0, nil
+	}
+	w.Lock()
+	defer w.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(w.dir, _WALSegmentPattern))
+	if err != nil {
+		return 0, err
+	}
+	var segments []*walSegment
+	for _, path := range paths {
+		var id uint64
+		if _, e := fmt.Sscanf(filepath.Base(path), "wal-%d.log", &id); e != nil {
+			continue
+		}
+		segments = append(segments, &walSegment{id: id})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+
+	n := 0
+	for _, seg := range segments {
+		k, e := w.replaySegment(seg, apply)
+		n += k
+		if e != nil {
+			logger.Errorf("Replay of wal segment %d stopped after %d records: %v", seg.id, k, e.Error())
+		}
+		w.segments = append(w.segments, seg)
+		w.nextId = seg.id + 1
+	}
+	atomic.AddUint64(&w.replayed, uint64(n))
+	return n, nil
+}
+
+func (w *WAL) replaySegment(seg *walSegment, apply walApplier) (int, error) {
+	f, err := os.Open(seg.path(w.dir))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if info, e := f.Stat(); e == nil {
+		seg.size = info.Size()
+	}
+
+	r := &snapshotReader{r: bufio.NewReaderSize(f, 256 * 1024), crc: crc32.New(_SnapshotTable)}
+	magic := make([]byte, len(_WALMagic))
+	r.read(magic)
+	version := r.uint(2)
+	id := r.uint(8)
+	if r.err == nil && (string(magic) != _WALMagic || id != seg.id) {
+		return 0, ErrWALBroken
+	}
+	if r.err == nil && version > WALVersion {
+		return 0, errors.New("unsupported version of wal")
+	}
+	if !r.end() {
+		return 0, r.err
+	}
+
+	n := 0
+	for {
+		if _, e := r.r.Peek(1); e == io.EOF {
+			return n, nil
+		}
+		rec := &walRecord{
+			op: byte(r.uint(1)),
+			tenant: r.string(),
+			key: r.string(),
+			flags: uint32(r.uint(4)),
+			casId: r.uint(8),
+			expireAt: int64(r.uint(8)),
+			size: r.uint(8),
+		}
+		if r.err != nil {
+			return n, r.err
+		}
+		if rec.op < _WALStore || rec.op > _WALFlush || rec.op != _WALFlush && !ValidKey(rec.key) {
+			return n, ErrWALBroken
+		}
+
+		// value is loaded while read, and the item is removed if the record turns out broken;
+		// Changes without value are applied after the record is checked.
+		var value io.Reader
+		var item *MetaItem
+		var failure error
+		if rec.op == _WALStore {
+			value = io.LimitReader(r, int64(rec.size))
+			item, failure = apply(rec, value)
+			if _, e := io.Copy(ioutil.Discard, value); e != nil {
+				r.err = e
+			} else if value.(*io.LimitedReader).N > 0 {
+				r.err = io.ErrUnexpectedEOF
+			}
+		}
+		intact := byte(r.uint(1)) == _SnapshotIntact
+		if !r.end() {
+			if item != nil {
+				item.tenant.entry.RemoveItem(item)
+				item.ClearSlots()
+			}
+			return n, r.err
+		}
+		if !intact {
+			if item != nil {
+				item.tenant.entry.RemoveItem(item)
+				item.ClearSlots()
+			}
+			continue
+		}
+		if value == nil {
+			_, failure = apply(rec, nil)
+		}
+		if failure != nil {
+			logger.Warnf("Replay of key [%s] from wal failed: %v", rec.key, failure.Error())
+		}
+		w.account(seg, rec)
+		n++
+	}
+}
+
+
+
+
+// logChange appends change on item to write-ahead log before the command is responded;
+// Store of item no longer intact is skipped, as the item has been replaced or removed by later changes.
+func (h *handler) logChange(op byte, tenant *Tenant, item *MetaItem) error {
+	if !h.wal.Enabled() || item == nil {
+		return nil
+	}
+	rec := &walRecord{op: op, tenant: tenant.name, key: item.key, casId: item.casId}
+	var value *pinnedValue
+	switch op {
+	case _WALStore:
+		var intact bool
+		if value, intact = item.Pin(); !intact {
+			return nil
+		}
+		defer value.Unpin()
+		rec.flags, rec.size = item.flags, item.byteLen
+		rec.expireAt = unixMillis(item.Deadline())
+	case _WALTouch:
+		rec.expireAt = unixMillis(item.Deadline())
+	}
+	if e := h.wal.Append(rec, value); e != nil {
+		logger.Errorf("Write-ahead log of key [%s] failed: %v", item.key, e.Error())
+		return ErrWALFailed
+	}
+	return nil
+}
+
+// replayRecord applies a record of write-ahead log to items; Cas uniques keep changes from being undone
+// by records of earlier changes appended later.
+func (h *handler) replayRecord(rec *walRecord, r io.Reader) (*MetaItem, error) {
+	if rec.op == _WALFlush {
+		h.tenants.Each(func(t *Tenant) {
+			t.entry.Flush()
+		})
+		return nil, nil
+	}
+	tenant := h.tenants.Get(rec.tenant)
+	if tenant == nil {
+		tenant = h.tenants.Select(rec.key, "")
+	}
+	entry := tenant.entry
+	left := time.Unix(0, rec.expireAt * int64(time.Millisecond)).Sub(time.Now())
+
+	cur := entry.Get(rec.key)
+	switch rec.op {
+	case _WALStore:
+		if cur != nil && cur.casId >= rec.casId {
+			return nil, nil
+		}
+		if cur != nil {
+			_ = entry.RemoveItem(cur)
+		}
+		if left <= 0 {
+			return nil, nil
+		}
+		item := NewMetaItem(rec.key, rec.flags, 0, rec.size)
+		item.duration = left
+		item.casId = rec.casId
+		item.tenant = tenant
+		if e := h.loadItem(item, r); e != nil {
+			return nil, e
+		}
+		return item, nil
+	case _WALTouch:
+		if cur == nil || cur.casId != rec.casId {
+			return nil, nil
+		}
+		if left <= 0 {
+			_ = entry.RemoveItem(cur)
+		} else {
+			entry.Touch(rec.key, int64((left + time.Second - 1) / time.Second))
+		}
+	case _WALDelete:
+		if cur != nil && cur.casId <= rec.casId {
+			_ = entry.RemoveItem(cur)
+		}
+	}
+	return nil, nil
+}
+
+// replayWAL rebuilds items from write-ahead log, after snapshot and ahead of serving
+func (s *Server) replayWAL() {
+	if !s.wal.Enabled() {
+		return
+	}
+	start := time.Now()
+	n, err := s.wal.Replay(newHandler(-1, s).replayRecord)
+	if err != nil {
+		logger.Errorf("Replay of wal failed after %d records: %v", n, err.Error())
+		return
+	}
+	logger.Infof("Replay of %d records from wal in %s in %v", n, s.wal.dir, time.Since(start))
+}
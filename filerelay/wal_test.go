@@ -0,0 +1,248 @@
+package filerelay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func walConfig(dir string) *MemConfig {
+	c := NewMemConfig()
+	c.MaxRoutines = 4
+	c.SlotCapMin, c.SlotCapMax = 64, 64 * 1024
+	c.SlotsInSlab, c.SlabsInGroup = 16, 2
+	c.MinExpiration = 1
+	c.WAL = WALConfig{Dir: dir, Fsync: WALFsyncAlways}
+	c.Tenants = []TenantConfig{{Name: "images", Prefix: "img:"}}
+	return c
+}
+
+func startWALServer(t *testing.T, dir string) (string, *Server, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, stop := serveTestListener(t, lis, walConfig(dir), 0)
+	return lis.Addr().String(), server, stop
+}
+
+func TestWAL_Replay(t *testing.T) {
+	defer quietLogs()()
+	dir := t.TempDir()
+	addr, _, stop := startWALServer(t, dir)
+	conn, rw := dialTest(t, addr)
+
+	values := map[string][]byte{
+		"img:large": stressValue("img:large", 300000),
+		"replaced": stressValue("replaced", 1000),
+		"swapped": stressValue("swapped", 2000),
+		"touched": stressValue("touched", 100),
+		"empty": {},
+	}
+	store := func(cmd, key string, v []byte, suffix string) {
+		line := fmt.Sprintf("%s %s %d 300 %d%s", cmd, key, len(key), len(v), suffix)
+		if resp := command(t, rw, line, v); resp != string(ResultStored) {
+			t.Fatalf("%s %s: %q", cmd, key, resp)
+		}
+	}
+	for key, v := range values {
+		store("set", key, v, "")
+	}
+	store("add", "added", []byte("added"), "")
+	values["added"] = []byte("added")
+	store("set", "deleted", []byte("gone"), "")
+	store("set", "short-lived", []byte("gone"), "")
+	values["replaced"] = stressValue("replaced-2", 1500)
+	store("replace", "replaced", values["replaced"], "")
+	var cas uint64
+	fmt.Sscanf(command(t, rw, "mg swapped c", nil), "HD c%d", &cas)
+	values["swapped"] = stressValue("swapped-2", 2500)
+	store("cas", "swapped", values["swapped"], fmt.Sprintf(" %d", cas))
+	casSwapped := command(t, rw, "mg swapped c", nil)
+
+	if resp := command(t, rw, "touch touched 100", nil); resp != string(ResultTouched) {
+		t.Fatalf("touch: %q", resp)
+	}
+	if resp := command(t, rw, "touch short-lived 1", nil); resp != string(ResultTouched) {
+		t.Fatalf("touch: %q", resp)
+	}
+	if resp := command(t, rw, "delete deleted", nil); resp != string(ResultDeleted) {
+		t.Fatalf("delete: %q", resp)
+	}
+	conn.Close()
+	stop()
+
+	time.Sleep(time.Millisecond * 1100)
+	addr, server, stop := startWALServer(t, dir)
+	conn, rw = dialTest(t, addr)
+
+	for key, v := range values {
+		fmt.Fprintf(rw, "get %s\r\n", key)
+		rw.Flush()
+		got, err := readStressValue(rw)
+		if err != nil || !bytes.Equal(got, v) {
+			t.Fatalf("get %s after replay: %d bytes, %v", key, len(got), err)
+		}
+		if resp := command(t, rw, "mg " + key + " f", nil); resp != fmt.Sprintf("HD f%d\r\n", len(key)) {
+			t.Errorf("flags of %s after replay: %q", key, resp)
+		}
+	}
+	for _, key := range []string{"deleted", "short-lived"} {
+		if resp := command(t, rw, "mg " + key, nil); resp != string(ResultMetaMiss) {
+			t.Errorf("%s replayed: %q", key, resp)
+		}
+	}
+	var ttl int64
+	if fmt.Sscanf(command(t, rw, "mg touched t", nil), "HD t%d", &ttl); ttl < 90 || ttl > 100 {
+		t.Errorf("ttl of touched after replay: %d", ttl)
+	}
+	if resp := command(t, rw, "mg swapped c", nil); resp != casSwapped {
+		t.Errorf("cas unique after replay: %q, expected %q", resp, casSwapped)
+	}
+	if server.tenants.Get("images").entry.Get("img:large") == nil {
+		t.Error("item not replayed into its tenant")
+	}
+
+	// flush_all is replayed as well
+	if resp := command(t, rw, "flush_all", nil); resp != string(ResultOK) {
+		t.Fatalf("flush_all: %q", resp)
+	}
+	conn.Close()
+	stop()
+	addr, _, stop = startWALServer(t, dir)
+	defer stop()
+	conn, rw = dialTest(t, addr)
+	defer conn.Close()
+	if resp := command(t, rw, "mg img:large", nil); resp != string(ResultMetaMiss) {
+		t.Errorf("item replayed after flush_all: %q", resp)
+	}
+}
+
+
+type walReplayed struct {
+	keys []string
+	values map[string][]byte
+}
+
+func (r *walReplayed) apply(rec *walRecord, value io.Reader) (*MetaItem, error) {
+	r.keys = append(r.keys, rec.key)
+	if value != nil {
+		data, err := ioutil.ReadAll(value)
+		if err != nil {
+			return nil, err
+		}
+		r.values[rec.key] = data
+	}
+	return nil, nil
+}
+
+func appendWAL(t *testing.T, w *WAL, op byte, key string, expireAt time.Time, value []byte) {
+	rec := &walRecord{op: op, tenant: "default", key: key, expireAt: unixMillis(expireAt)}
+	var pinned *pinnedValue
+	if value != nil {
+		rec.size = uint64(len(value))
+		pinned = &pinnedValue{data: [][]byte{value}}
+	}
+	if e := w.Append(rec, pinned); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestWAL_Compact(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(&WALConfig{Dir: dir, Fsync: WALFsyncNever, SegmentSize: "1MB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, long := time.Now().Add(time.Millisecond * 10), time.Now().Add(time.Minute)
+	store := func(key string, expireAt time.Time) {
+		appendWAL(t, w, _WALStore, key, expireAt, stressValue(key, 400 * 1024))
+	}
+	// segment 1 expires as a whole, segment 2 keeps a value replaced in segment 3,
+	// and segment 3 is kept as long as the value it replaces
+	store("s1", short)
+	store("s2", short)
+	store("s3", short)
+	store("k", long)
+	store("s4", short)
+	store("s5", short)
+	store("k", short)
+	store("s6", short)
+	store("s7", short)
+	appendWAL(t, w, _WALDelete, "s7", time.Time{}, nil)
+	if w.Segments() != 4 {
+		t.Fatalf("%d segments after rotation", w.Segments())
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	if n := w.Compact(time.Now()); n != 1 || w.Segments() != 3 {
+		t.Fatalf("%d segments removed by compaction, %d left", n, w.Segments())
+	}
+	if _, e := os.Stat(filepath.Join(dir, "wal-00000001.log")); !os.IsNotExist(e) {
+		t.Error("file of segment compacted not removed")
+	}
+	w.Close()
+
+	w, err = NewWAL(&WALConfig{Dir: dir, SegmentSize: "1MB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r := &walReplayed{values: make(map[string][]byte)}
+	if n, e := w.Replay(r.apply); n != 7 || e != nil {
+		t.Fatalf("%d records replayed: %v", n, e)
+	}
+	if keys := strings.Join(r.keys, ","); keys != "k,s4,s5,k,s6,s7,s7" {
+		t.Errorf("records replayed in order: %s", keys)
+	}
+	if !bytes.Equal(r.values["s5"], stressValue("s5", 400 * 1024)) {
+		t.Error("value replayed broken")
+	}
+	// the last segment is no longer active after replay
+	if n := w.Compact(time.Now()); n != 1 || w.Segments() != 2 {
+		t.Errorf("%d segments removed by compaction after replay, %d left", n, w.Segments())
+	}
+}
+
+func TestWAL_Broken(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(&WALConfig{Dir: dir, Fsync: WALFsyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		appendWAL(t, w, _WALStore, key, later, stressValue(key, 1000))
+	}
+	// crash while the last record is written, without close
+	path := filepath.Join(dir, "wal-00000001.log")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := os.Truncate(path, info.Size() - 5); e != nil {
+		t.Fatal(e)
+	}
+
+	w, err = NewWAL(&WALConfig{Dir: dir, Fsync: WALFsyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r := &walReplayed{values: make(map[string][]byte)}
+	if n, e := w.Replay(r.apply); n != 2 || e != nil {
+		t.Fatalf("%d records replayed from broken log: %v", n, e)
+	}
+	appendWAL(t, w, _WALTouch, "k1", later, nil)
+	if _, e := os.Stat(filepath.Join(dir, "wal-00000002.log")); e != nil {
+		t.Errorf("records not appended to a new segment after replay: %v", e)
+	}
+}
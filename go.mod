@@ -3,7 +3,6 @@ module github.com/nickeljew/file-relay
 go 1.12
 
 require (
-	github.com/huandu/skiplist v0.0.0-20180112095830-8e883b265e1b
 	github.com/sirupsen/logrus v1.4.2
 	gopkg.in/yaml.v3 v3.0.0-20190502103701-55513cacd4ae
 )
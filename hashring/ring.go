@@ -1,26 +1,249 @@
 package hashring
 
 import (
-	//"crypto/md5"
-	//"math"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
 )
 
 
 const (
 	PartitionCount = 4294967296 //int(math.Pow(2, 32))
+
+	DefaultVNodes = 160 //virtual nodes of node per weight
+
+	HashMD5 = "md5"
+	HashFNV = "fnv"
+)
+
+var (
+	ErrNodeExists = errors.New("node already in ring")
+	ErrNodeNotFound = errors.New("node not in ring")
+	ErrInvalidWeight = errors.New("weight of node must be positive")
 )
 
 
+// HashFunc maps key to a position in the ring, of PartitionCount positions
+type HashFunc func(key []byte) uint32
+
+// md5Hash takes the first 4 bytes of md5 sum of key
+func md5Hash(key []byte) uint32 {
+	sum := md5.Sum(key)
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// fnvHash is fnv-1a of key, with bits mixed by finalizer of murmur3;
+// Plain fnv-1a spreads keys differing only in the last bytes, like names of vnodes, poorly over the ring.
+func fnvHash(key []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// NewHashFunc returns the hash function by name: md5 or fnv
+func NewHashFunc(name string) (HashFunc, error) {
+	switch name {
+	case HashMD5, "":
+		return md5Hash, nil
+	case HashFNV:
+		return fnvHash, nil
+	}
+	return nil, errors.New("unknown hash function: " + name)
+}
+
+
+
+//
 type Node struct {
 	name string
+	weight int
+}
+
+func (n *Node) Name() string {
+	return n.name
 }
 
+func (n *Node) Weight() int {
+	return n.weight
+}
+
+
+// VNode is a position of node in the ring
 type VNode struct {
-	prev *VNode
-	next *VNode
-	//
+	hash uint32
+	node *Node
 }
 
+
+
+// Ring is a consistent hash ring of nodes; Every node is placed in the ring by virtual nodes
+// in count of its weight times vnodes of ring, and keys belong to the first virtual node clockwise.
+// Adding or removing a node only moves keys from or to virtual nodes of that node.
 type Ring struct {
+	hash HashFunc
+	vnodes int //virtual nodes per weight
+
+	nodes map[string]*Node
+	ring []VNode //sorted by hash
+
+	sync.RWMutex
+}
+
+// NewRing creates an empty ring with the hash function, and count of virtual nodes per weight;
+// DefaultVNodes is used if vnodes is not positive.
+func NewRing(hash HashFunc, vnodes int) *Ring {
+	if hash == nil {
+		hash = md5Hash
+	}
+	if vnodes <= 0 {
+		vnodes = DefaultVNodes
+	}
+	return &Ring{
+		hash: hash,
+		vnodes: vnodes,
+		nodes: make(map[string]*Node),
+	}
+}
+
+// AddNode places node of the weight in ring
+func (r *Ring) AddNode(name string, weight int) error {
+	if weight <= 0 {
+		return ErrInvalidWeight
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.nodes[name]; ok {
+		return ErrNodeExists
+	}
+	node := &Node{name: name, weight: weight}
+	r.nodes[name] = node
+
+	count := weight * r.vnodes
+	ring := make([]VNode, len(r.ring), len(r.ring) + count)
+	copy(ring, r.ring)
+	for i := 0; i < count; i++ {
+		ring = append(ring, VNode{
+			hash: r.hash([]byte(name + "#" + strconv.Itoa(i))),
+			node: node,
+		})
+	}
+	sortVNodes(ring)
+	r.ring = ring
+	return nil
+}
+
+// RemoveNode takes node and all its virtual nodes out of ring
+func (r *Ring) RemoveNode(name string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	node, ok := r.nodes[name]
+	if !ok {
+		return ErrNodeNotFound
+	}
+	delete(r.nodes, name)
+
+	ring := make([]VNode, 0, len(r.ring))
+	for _, v := range r.ring {
+		if v.node != node {
+			ring = append(ring, v)
+		}
+	}
+	r.ring = ring
+	return nil
+}
+
+// sortVNodes sorts virtual nodes by hash, and by name of node for ones colliding in hash,
+// so that the ring is the same whatever order nodes are added in
+func sortVNodes(ring []VNode) {
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].node.name < ring[j].node.name
+	})
+}
+
+// search returns index of the first virtual node clockwise from position of key
+func (r *Ring) search(key string) int {
+	h := r.hash([]byte(key))
+	i := sort.Search(len(r.ring), func(i int) bool {
+		return r.ring[i].hash >= h
+	})
+	if i == len(r.ring) {
+		i = 0
+	}
+	return i
+}
+
+// GetNode returns name of the node owning key; False is returned for an empty ring.
+func (r *Ring) GetNode(key string) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.ring) == 0 {
+		return "", false
+	}
+	return r.ring[r.search(key)].node.name, true
+}
+
+// GetNodes returns names of n distinct nodes for key, clockwise from the owner;
+// Fewer are returned if there're not n nodes in ring.
+func (r *Ring) GetNodes(key string, n int) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.ring) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	names := make([]string, 0, n)
+	seen := make(map[*Node]bool, n)
+	for i, start := 0, r.search(key); i < len(r.ring) && len(names) < n; i++ {
+		node := r.ring[(start + i) % len(r.ring)].node
+		if !seen[node] {
+			seen[node] = true
+			names = append(names, node.name)
+		}
+	}
+	return names
+}
+
+// Nodes returns names of all nodes in ring, sorted
+func (r *Ring) Nodes() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	names := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Ring) HasNode(name string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, ok := r.nodes[name]
+	return ok
+}
 
+func (r *Ring) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.nodes)
 }
@@ -0,0 +1,182 @@
+package hashring
+
+import (
+	"strconv"
+	"testing"
+)
+
+const testKeys = 100000
+
+var testHashes = []string{HashMD5, HashFNV}
+
+
+func newTestRing(t *testing.T, hash string, nodes int) *Ring {
+	fn, err := NewHashFunc(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRing(fn, 0)
+	for i := 0; i < nodes; i++ {
+		if err = r.AddNode("node-" + strconv.Itoa(i), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+// owners maps every test key to its node
+func owners(r *Ring) []string {
+	nodes := make([]string, testKeys)
+	for i := range nodes {
+		nodes[i], _ = r.GetNode("file-" + strconv.Itoa(i) + ".dat")
+	}
+	return nodes
+}
+
+func countKeys(nodes []string) map[string]int {
+	counts := make(map[string]int)
+	for _, n := range nodes {
+		counts[n]++
+	}
+	return counts
+}
+
+
+func TestRing_Distribution(t *testing.T) {
+	for _, hash := range testHashes {
+		r := newTestRing(t, hash, 10)
+		counts := countKeys(owners(r))
+		if len(counts) != 10 {
+			t.Fatalf("%s: keys on %d nodes, expect 10", hash, len(counts))
+		}
+		expect := testKeys / 10
+		for node, n := range counts {
+			if n < expect * 3 / 4 || n > expect * 5 / 4 {
+				t.Errorf("%s: %d keys on %s, expect about %d", hash, n, node, expect)
+			}
+		}
+	}
+}
+
+func TestRing_Weights(t *testing.T) {
+	for _, hash := range testHashes {
+		r := newTestRing(t, hash, 4)
+		if err := r.AddNode("heavy", 4); err != nil {
+			t.Fatal(err)
+		}
+		counts := countKeys(owners(r))
+		// heavy holds 4 of 8 weights
+		if n := counts["heavy"]; n < testKeys * 2 / 5 || n > testKeys * 3 / 5 {
+			t.Errorf("%s: %d keys on node of weight 4, expect about %d", hash, n, testKeys / 2)
+		}
+	}
+}
+
+func TestRing_Movement(t *testing.T) {
+	for _, hash := range testHashes {
+		r := newTestRing(t, hash, 10)
+		before := owners(r)
+
+		// keys only move to the added node, about 1/11 of them
+		if err := r.AddNode("node-new", 1); err != nil {
+			t.Fatal(err)
+		}
+		added := owners(r)
+		moved := 0
+		for i := range before {
+			if before[i] != added[i] {
+				moved++
+				if added[i] != "node-new" {
+					t.Fatalf("%s: key moved from %s to %s, not the added node", hash, before[i], added[i])
+				}
+			}
+		}
+		if expect := testKeys / 11; moved < expect / 2 || moved > expect * 3 / 2 {
+			t.Errorf("%s: %d keys moved for added node, expect about %d", hash, moved, expect)
+		}
+
+		// keys only move from the removed node
+		if err := r.RemoveNode("node-3"); err != nil {
+			t.Fatal(err)
+		}
+		removed := owners(r)
+		for i := range added {
+			if added[i] != removed[i] && added[i] != "node-3" {
+				t.Fatalf("%s: key moved from %s which is still in ring", hash, added[i])
+			}
+			if removed[i] == "node-3" {
+				t.Fatalf("%s: key still on removed node", hash)
+			}
+		}
+
+		// same ring whatever order nodes are added in
+		if err := r.RemoveNode("node-new"); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.AddNode("node-3", 1); err != nil {
+			t.Fatal(err)
+		}
+		restored := owners(r)
+		for i := range before {
+			if before[i] != restored[i] {
+				t.Fatalf("%s: key %d on %s after restoring nodes, was on %s", hash, i, restored[i], before[i])
+			}
+		}
+	}
+}
+
+func TestRing_GetNodes(t *testing.T) {
+	r := newTestRing(t, HashMD5, 5)
+	for i := 0; i < 1000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		nodes := r.GetNodes(key, 3)
+		if len(nodes) != 3 {
+			t.Fatalf("got %d nodes, expect 3", len(nodes))
+		}
+		if owner, _ := r.GetNode(key); nodes[0] != owner {
+			t.Fatalf("first node %s is not owner %s", nodes[0], owner)
+		}
+		if nodes[0] == nodes[1] || nodes[1] == nodes[2] || nodes[0] == nodes[2] {
+			t.Fatalf("nodes not distinct: %v", nodes)
+		}
+	}
+	if nodes := r.GetNodes("key", 10); len(nodes) != 5 {
+		t.Errorf("got %d nodes, expect all 5 nodes", len(nodes))
+	}
+}
+
+func TestRing_Membership(t *testing.T) {
+	r := NewRing(nil, 0)
+	if _, ok := r.GetNode("key"); ok {
+		t.Error("empty ring should own no key")
+	}
+	if r.AddNode("a", 0) != ErrInvalidWeight {
+		t.Error("expect invalid weight")
+	}
+	_ = r.AddNode("a", 1)
+	if r.AddNode("a", 2) != ErrNodeExists {
+		t.Error("expect node exists")
+	}
+	if r.RemoveNode("b") != ErrNodeNotFound {
+		t.Error("expect node not found")
+	}
+	if _, err := NewHashFunc("crc"); err == nil {
+		t.Error("unknown hash function should fail")
+	}
+}
+
+
+func BenchmarkRing_GetNode(b *testing.B) {
+	r := NewRing(nil, 0)
+	for i := 0; i < 10; i++ {
+		_ = r.AddNode("node-" + strconv.Itoa(i), 1)
+	}
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "file-" + strconv.Itoa(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = r.GetNode(keys[i % len(keys)])
+	}
+}
@@ -24,7 +24,7 @@ max-routines: 2
 
 # Memory purpose
 lru-size: 100000
-skiplist-check-step: 20
+expire-batch: 1000
 #min-expiration: 
 #slab-check-interval:
 #slot-capacity-min: 64